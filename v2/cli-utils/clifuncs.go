@@ -8,6 +8,9 @@ func printHelp() {
 	log.Println("\tmodel add <model name> <datasource> \tCreates a new model with the given <model name> and attaches it to <datasource>")
 	log.Println("\tserver start \tStarts the server")
 	log.Println("\tdiagnose [permissions|launcher] \tRuns a diagnostic check on the server for debugging purposes")
+	log.Println("\tindexes [diff|apply] [--prune] \tShows or applies the drift between the indexes declared in the models and the existing ones. --prune drops the undeclared indexes")
+	log.Println("\tmigrate create <name> \tCreates a new migration file under the migrations directory")
+	log.Println("\tmigrate [up|down|status] [steps] \tApplies, reverts or lists the migrations. The app main package must import the migrations and call westack.InitAndServe")
 	log.Println("\tgenerate \tGenerates all go files from .json files under common/models")
 	log.Println()
 }
@@ -0,0 +1,68 @@
+package cliutils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fredyk/westack-go/v2/datasource"
+	"github.com/fredyk/westack-go/v2/westack"
+)
+
+// runIndexes shows the drift between the indexes declared in the models and the existing ones, and applies it if apply
+// is true
+func runIndexes(apply bool, prune bool) error {
+	app := westack.New()
+	ctx := context.Background()
+	diffs, err := app.LoadIndexDiffs(ctx)
+	if err != nil {
+		return err
+	}
+	drift := false
+	for _, modelDiff := range diffs {
+		if modelDiff.Diff.InSync() && (len(modelDiff.Diff.Extra) == 0 || !prune) {
+			fmt.Printf("%v (%v): in sync\n", modelDiff.Model, modelDiff.Collection)
+		} else {
+			fmt.Printf("%v (%v):\n", modelDiff.Model, modelDiff.Collection)
+			drift = true
+		}
+		for _, index := range modelDiff.Diff.Missing {
+			fmt.Printf("\t+ %v\n", describeIndex(index))
+		}
+		for _, change := range modelDiff.Diff.Changed {
+			fmt.Printf("\t~ %v (was %v)\n", describeIndex(change.Declared), describeIndex(change.Existing))
+		}
+		for _, index := range modelDiff.Diff.Extra {
+			if prune {
+				fmt.Printf("\t- %v\n", describeIndex(index))
+			} else {
+				fmt.Printf("\t? %v (not declared, use --prune to drop it)\n", describeIndex(index))
+			}
+		}
+	}
+	if !apply || !drift {
+		return nil
+	}
+	err = app.ApplyIndexDiffs(ctx, diffs, prune)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Indexes applied")
+	return nil
+}
+
+func describeIndex(index datasource.Index) string {
+	description := fmt.Sprintf("%v %v", index.IndexName(), index.Keys)
+	if index.Unique {
+		description += " unique"
+	}
+	if index.Sparse {
+		description += " sparse"
+	}
+	if index.ExpireAfterSeconds != nil {
+		description += fmt.Sprintf(" expireAfterSeconds=%v", *index.ExpireAfterSeconds)
+	}
+	if len(index.PartialFilter) > 0 {
+		description += fmt.Sprintf(" partialFilter=%v", index.PartialFilter)
+	}
+	return description
+}
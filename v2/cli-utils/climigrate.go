@@ -0,0 +1,72 @@
+package cliutils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var migrationsPath = "migrations"
+
+var migrationTemplate = template.Must(template.New("migration").Parse(`package migrations
+
+import (
+	"github.com/fredyk/westack-go/v2/model"
+	"github.com/fredyk/westack-go/v2/westack"
+)
+
+func init() {
+	westack.RegisterMigration(westack.Migration{
+		Version: "{{.Version}}",
+		Name:    "{{.Name}}",
+		Up: func(app *westack.WeStack, ctx *model.EventContext) error {
+			return nil
+		},
+		Down: func(app *westack.WeStack, ctx *model.EventContext) error {
+			return nil
+		},
+	})
+}
+`))
+
+// createMigration writes an empty migration file under the migrations directory, versioned with the current time
+func createMigration(name string) error {
+	name = strings.Trim(regexp.MustCompile("[^a-zA-Z0-9]+").ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return fmt.Errorf("invalid migration name")
+	}
+	if _, err := os.Stat(migrationsPath); os.IsNotExist(err) {
+		err = os.Mkdir(migrationsPath, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	version := time.Now().UTC().Format("20060102150405")
+	path := filepath.Join(migrationsPath, fmt.Sprintf("%v_%v.go", version, name))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = migrationTemplate.Execute(file, map[string]string{"Version": version, "Name": name})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %v\n", path)
+	fmt.Println("Import the migrations package from your main package to register it")
+	return nil
+}
+
+// runMigrations runs the app of the current directory with the migrate arguments, as the migrations are compiled in it
+func runMigrations(args []string) error {
+	cmd := exec.Command("go", append([]string{"run", ".", "migrate"}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
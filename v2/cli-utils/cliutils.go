@@ -80,6 +80,49 @@ func RunCli() {
 				printHelp()
 			}
 		}
+	case "indexes":
+		if len(os.Args) < 3 {
+			printHelp()
+			return
+		}
+		prune := len(os.Args) > 3 && os.Args[3] == "--prune"
+		switch os.Args[2] {
+		case "diff":
+			err := runIndexes(false, prune)
+			if err != nil {
+				log.Fatalf("Error diffing indexes: %v", err)
+			}
+		case "apply":
+			err := runIndexes(true, prune)
+			if err != nil {
+				log.Fatalf("Error applying indexes: %v", err)
+			}
+		default:
+			printHelp()
+		}
+	case "migrate":
+		if len(os.Args) < 3 {
+			printHelp()
+			return
+		}
+		switch os.Args[2] {
+		case "create":
+			if len(os.Args) < 4 {
+				printHelp()
+				return
+			}
+			err := createMigration(os.Args[3])
+			if err != nil {
+				log.Fatalf("Error creating migration: %v", err)
+			}
+		case "up", "down", "status":
+			err := runMigrations(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Error running migrations: %v", err)
+			}
+		default:
+			printHelp()
+		}
 	case "generate":
 		err := generate()
 		if err != nil {
@@ -511,6 +511,7 @@ const (
 	OperationNameFindMany         OperationName = "findMany"
 	OperationNameCount            OperationName = "count"
 	OperationNameCreate           OperationName = "create"
+	OperationNameCreateMany       OperationName = "createMany"
 	OperationNameUpdateAttributes OperationName = "instance_updateAttributes"
 
 	// OperationNameUpdateById TODO: Check, this model method is not used
@@ -520,6 +521,22 @@ const (
 	OperationNameDeleteById OperationName = "instance_delete"
 	OperationNameDeleteMany OperationName = "deleteMany"
 
+	// soft delete
+	OperationNameRestoreById OperationName = "instance_restore"
+	OperationNamePurgeById   OperationName = "instance_purge"
+
+	// audit
+	OperationNameFindHistory OperationName = "instance_history"
+
+	// change streams
+	OperationNameStream OperationName = "stream"
+
+	// diagnostics
+	OperationNameExplain OperationName = "explain"
+
+	// analytics
+	OperationNameAggregate OperationName = "aggregate"
+
 	OperationNameFindSelf     OperationName = "findSelf"
 	OperationNameLogin        OperationName = "login"
 	OperationNameRefreshToken OperationName = "refreshToken"
@@ -612,6 +629,13 @@ type Filter struct {
 	Skip        int64              `json:"skip"`
 	Limit       int64              `json:"limit"`
 	Aggregation []AggregationStage `json:"aggregation"`
+	// Keyset opts into the keyset pagination for the first page, which requires a Limit and sorts by _id after Order
+	Keyset bool `json:"keyset,omitempty"`
+	// After and Before are the opaque cursors of the keyset pagination. See model.StatefulModel.PageCursors
+	After  string `json:"after,omitempty"`
+	Before string `json:"before,omitempty"`
+	// Search is the full-text query matched against the searchable fields of the model. See model.SearchConfig
+	Search string `json:"q,omitempty"`
 }
 
 // DeleteResult is the result of a DeleteMany operation.
@@ -620,6 +644,31 @@ type DeleteResult struct {
 	DeletedCount int64 `json:"deletedCount"`
 }
 
+// UpdateManyResult is the result of an UpdateMany operation.
+type UpdateManyResult struct {
+	// MatchedCount is the number of documents matched by the where.
+	MatchedCount int64 `json:"matchedCount"`
+	// ModifiedCount is the number of documents modified.
+	ModifiedCount int64 `json:"modifiedCount"`
+}
+
+// BulkItemResult is the result of a single item inside a bulk operation.
+type BulkItemResult struct {
+	// Index is the position of the item in the request body or in the matched documents.
+	Index   int         `json:"index"`
+	Id      interface{} `json:"id,omitempty"`
+	Success bool        `json:"success"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   fiber.Map   `json:"error,omitempty"`
+}
+
+// BulkResult is the result of a bulk operation, with one entry per processed item.
+type BulkResult struct {
+	SuccessCount int64            `json:"successCount"`
+	ErrorCount   int64            `json:"errorCount"`
+	Items        []BulkItemResult `json:"items"`
+}
+
 // CountResult is the result of a Count operation.
 type CountResult struct {
 	// Count is the number of documents.
@@ -0,0 +1,41 @@
+package datasource
+
+import (
+	"context"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// AggregateOptions bounds the resources used by Aggregate
+type AggregateOptions struct {
+	// AllowDiskUse lets the stages exceed the memory limit of the datasource by writing temporary files
+	AllowDiskUse bool
+	// MaxTime bounds the time spent running the pipeline, if greater than 0
+	MaxTime time.Duration
+}
+
+// AggregateConnector is implemented by the connectors able to run arbitrary pipelines with resource limits
+type AggregateConnector interface {
+	// Aggregate runs the pipeline under ctx. The cursor must be iterated with ctx too.
+	Aggregate(ctx context.Context, collectionName string, pipeline *wst.A, options AggregateOptions) (MongoCursorI, error)
+}
+
+// Aggregate runs the pipeline with the given limits. Connectors that do not implement AggregateConnector run it with
+// FindManyContext, so they only accept the stages they support, and ignore the limits.
+func (ds *Datasource) Aggregate(ctx context.Context, collectionName string, pipeline *wst.A, options AggregateOptions) (MongoCursorI, error) {
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if aggregateConnector, ok := ds.connectorInstance.(AggregateConnector); ok {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		return aggregateConnector.Aggregate(ctx, collectionName, pipeline, options)
+	}
+	if contextConnector != nil {
+		return contextConnector.FindManyContext(ctx, collectionName, pipeline)
+	}
+	return ds.connectorInstance.FindMany(collectionName, pipeline)
+}
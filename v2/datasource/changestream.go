@@ -0,0 +1,39 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// ChangeStreamConnector is implemented by the connectors able to notify the changes applied to a collection by any
+// process, like MongoDB change streams do.
+type ChangeStreamConnector interface {
+	// WatchCollection sends the changes of the collection until ctx is done or the stream fails, then closes the channel
+	WatchCollection(ctx context.Context, collectionName string) (<-chan CollectionChange, error)
+}
+
+// CollectionChange is a change notified by ChangeStreamConnector.WatchCollection
+type CollectionChange struct {
+	// OperationType is "insert", "update", "replace" or "delete"
+	OperationType string
+	DocumentId    interface{}
+	// FullDocument is the document after the change, or nil for deletes
+	FullDocument wst.M
+}
+
+// WatchCollection returns the changes applied to the collection. It fails if the connector does not implement
+// ChangeStreamConnector.
+func (ds *Datasource) WatchCollection(ctx context.Context, collectionName string) (<-chan CollectionChange, error) {
+	changeStreamConnector, ok := ds.connectorInstance.(ChangeStreamConnector)
+	if !ok {
+		return nil, fmt.Errorf("datasource %v does not support change streams", ds.Name)
+	}
+	return changeStreamConnector.WatchCollection(ctx, collectionName)
+}
+
+// MatchesWhere evaluates a where filter against a document, with the same operators as the memorykv connector
+func MatchesWhere(document wst.M, where wst.M) (bool, error) {
+	return memoryKvMatches(document, where)
+}
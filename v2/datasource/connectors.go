@@ -2,10 +2,15 @@ package datasource
 
 import (
 	"context"
+	"errors"
+	"sync"
+
 	wst "github.com/fredyk/westack-go/v2/common"
 	"github.com/spf13/viper"
 )
 
+// PersistedConnector is implemented by the connectors of the datasources. Connectors from other packages are made
+// available with RegisterConnector.
 type PersistedConnector interface {
 	// GetName Returns the name of the connector
 	GetName() string
@@ -15,14 +20,16 @@ type PersistedConnector interface {
 	Connect(parentContext context.Context) error
 	// FindMany Finds many documents in the datasource
 	FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error)
-	// findObjectById Finds a document in the datasource
-	findByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error)
+	// FindByObjectId Finds a document by its id in the datasource, applying the lookups after matching it
+	FindByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error)
 	// Count Counts documents in the datasource
 	Count(collectionName string, lookups *wst.A) (wst.CountResult, error)
 	// Create Creates a document in the datasource
 	Create(collectionName string, data *wst.M) (*wst.M, error)
 	// UpdateById Updates a document in the datasource
 	UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error)
+	// UpdateMany Updates many documents in the datasource
+	UpdateMany(collectionName string, whereLookups *wst.A, data *wst.M) (wst.UpdateManyResult, error)
 	// DeleteById Deletes a document in the datasource
 	DeleteById(collectionName string, id interface{}) (wst.DeleteResult, error)
 	// DeleteMany Deletes many documents in the datasource
@@ -36,3 +43,66 @@ type PersistedConnector interface {
 	// SetTimeout Sets the timeout for the datasource
 	SetTimeout(seconds float32)
 }
+
+// ConnectorFactory creates the connector of a datasource. It receives the datasource key, its SubViper, which is passed
+// again to PersistedConnector.SetConfig before connecting, and its Options, which may be nil.
+type ConnectorFactory func(dsKey string, dsViper *viper.Viper, options *Options) (PersistedConnector, error)
+
+var (
+	connectorFactories     = make(map[string]ConnectorFactory)
+	connectorFactoriesLock sync.RWMutex
+)
+
+func init() {
+	RegisterConnector("mongodb", func(dsKey string, dsViper *viper.Viper, options *Options) (PersistedConnector, error) {
+		var mongoOptions *MongoDBDatasourceOptions
+		if options != nil {
+			mongoOptions = options.MongoDB
+		}
+		return NewMongoDBConnector(mongoOptions), nil
+	})
+	RegisterConnector("memorykv", func(dsKey string, dsViper *viper.Viper, options *Options) (PersistedConnector, error) {
+		return NewMemoryKVConnector(wst.CreateDefaultMongoRegistry(), dsKey), nil
+	})
+	RegisterConnector("redis", func(dsKey string, dsViper *viper.Viper, options *Options) (PersistedConnector, error) {
+		return NewRedisConnector(wst.CreateDefaultMongoRegistry(), dsKey), nil
+	})
+}
+
+// RegisterConnector makes a connector available to the datasources whose "connector" setting in datasources.json is
+// name. It must be called before booting the app, usually from an init function. Registering an existing name replaces
+// its factory, including the ones of the built-in connectors.
+func RegisterConnector(name string, factory ConnectorFactory) {
+	if factory == nil {
+		panic("datasource: RegisterConnector factory is nil for " + name)
+	}
+	connectorFactoriesLock.Lock()
+	defer connectorFactoriesLock.Unlock()
+	connectorFactories[name] = factory
+}
+
+// IsConnectorRegistered tells whether a connector was registered with the given name
+func IsConnectorRegistered(name string) bool {
+	connectorFactoriesLock.RLock()
+	defer connectorFactoriesLock.RUnlock()
+	_, registered := connectorFactories[name]
+	return registered
+}
+
+func getConnectorByName(name string, dsKey string, dsViper *viper.Viper, options *Options) (PersistedConnector, error) {
+	connectorFactoriesLock.RLock()
+	factory, registered := connectorFactories[name]
+	connectorFactoriesLock.RUnlock()
+	if !registered {
+		if name == "sqlite" {
+			// The sqlite connector requires cgo, so it is only registered when its package is imported
+			return nil, errors.New("invalid connector sqlite, import github.com/fredyk/westack-go/v2/datasource/sqlite to register it")
+		}
+		return nil, errors.New("invalid connector " + name)
+	}
+	connector, err := factory(dsKey, dsViper, options)
+	if err == nil && connector == nil {
+		err = errors.New("connector factory returned nil for " + name)
+	}
+	return connector, err
+}
@@ -0,0 +1,131 @@
+package datasource
+
+import (
+	"context"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// ContextConnector is implemented by the connectors able to run their operations under the context of the caller,
+// usually the context of an HTTP request, so they are stopped when it is cancelled or its deadline expires
+type ContextConnector interface {
+	// FindManyContext is FindMany run under ctx. The cursor must be iterated with ctx too.
+	FindManyContext(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error)
+	// FindByObjectIdContext is FindByObjectId run under ctx
+	FindByObjectIdContext(ctx context.Context, collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error)
+	// CountContext is Count run under ctx
+	CountContext(ctx context.Context, collectionName string, lookups *wst.A) (wst.CountResult, error)
+	// CreateContext is Create run under ctx
+	CreateContext(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error)
+	// UpdateByIdContext is UpdateById run under ctx
+	UpdateByIdContext(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error)
+	// UpdateManyContext is UpdateMany run under ctx
+	UpdateManyContext(ctx context.Context, collectionName string, whereLookups *wst.A, data *wst.M) (wst.UpdateManyResult, error)
+	// DeleteByIdContext is DeleteById run under ctx
+	DeleteByIdContext(ctx context.Context, collectionName string, id interface{}) (wst.DeleteResult, error)
+	// DeleteManyContext is DeleteMany run under ctx
+	DeleteManyContext(ctx context.Context, collectionName string, whereLookups *wst.A) (wst.DeleteResult, error)
+}
+
+// contextConnector returns the connector as a ContextConnector, or nil if the connector does not implement it. It fails
+// if ctx is already done, so the connectors without context support do not start operations for requests already
+// cancelled.
+func (ds *Datasource) contextConnector(ctx context.Context) (ContextConnector, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	contextConnector, _ := ds.connectorInstance.(ContextConnector)
+	return contextConnector, nil
+}
+
+// FindManyContext is FindMany run under ctx
+func (ds *Datasource) FindManyContext(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if contextConnector != nil {
+		return contextConnector.FindManyContext(ctx, collectionName, lookups)
+	}
+	return ds.connectorInstance.FindMany(collectionName, lookups)
+}
+
+// CountContext is Count run under ctx
+func (ds *Datasource) CountContext(ctx context.Context, collectionName string, lookups *wst.A) (wst.CountResult, error) {
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return wst.CountResult{}, err
+	}
+	if contextConnector != nil {
+		return contextConnector.CountContext(ctx, collectionName, lookups)
+	}
+	return ds.connectorInstance.Count(collectionName, lookups)
+}
+
+// CreateContext is Create run under ctx
+func (ds *Datasource) CreateContext(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if contextConnector != nil {
+		return contextConnector.CreateContext(ctx, collectionName, data)
+	}
+	return ds.connectorInstance.Create(collectionName, data)
+}
+
+// UpdateByIdContext is UpdateById run under ctx
+func (ds *Datasource) UpdateByIdContext(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if contextConnector != nil {
+		return contextConnector.UpdateByIdContext(ctx, collectionName, id, data)
+	}
+	return ds.connectorInstance.UpdateById(collectionName, id, data)
+}
+
+// DeleteByIdContext is DeleteById run under ctx
+func (ds *Datasource) DeleteByIdContext(ctx context.Context, collectionName string, id interface{}) (wst.DeleteResult, error) {
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	if contextConnector != nil {
+		return contextConnector.DeleteByIdContext(ctx, collectionName, id)
+	}
+	return ds.connectorInstance.DeleteById(collectionName, id)
+}
+
+// DeleteManyContext is DeleteMany run under ctx
+func (ds *Datasource) DeleteManyContext(ctx context.Context, collectionName string, whereLookups *wst.A) (wst.DeleteResult, error) {
+	err := validateWhereLookups(whereLookups)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	if contextConnector != nil {
+		return contextConnector.DeleteManyContext(ctx, collectionName, whereLookups)
+	}
+	return ds.connectorInstance.DeleteMany(collectionName, whereLookups)
+}
+
+// UpdateManyContext is UpdateMany run under ctx
+func (ds *Datasource) UpdateManyContext(ctx context.Context, collectionName string, whereLookups *wst.A, data *wst.M) (wst.UpdateManyResult, error) {
+	err := validateUpdateMany(whereLookups, data)
+	if err != nil {
+		return wst.UpdateManyResult{}, err
+	}
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return wst.UpdateManyResult{}, err
+	}
+	if contextConnector != nil {
+		return contextConnector.UpdateManyContext(ctx, collectionName, whereLookups, data)
+	}
+	return ds.connectorInstance.UpdateMany(collectionName, whereLookups, data)
+}
@@ -14,7 +14,10 @@ import (
 
 type Options struct {
 	RetryOnError bool
-	MongoDB      *MongoDBDatasourceOptions
+	// Degraded keeps the process running when the datasource cannot be connected at boot or reconnected later,
+	// reporting it as unhealthy instead
+	Degraded bool
+	MongoDB  *MongoDBDatasourceOptions
 }
 
 type Datasource struct {
@@ -29,21 +32,7 @@ type Datasource struct {
 	SubViper          *viper.Viper
 	connectorInstance PersistedConnector
 	app               *wst.IApp
-}
-
-func getConnectorByName(name string, dsKey string, options *Options) (PersistedConnector, error) {
-	switch name {
-	case "mongodb":
-		var mongoOptions *MongoDBDatasourceOptions
-		if options != nil {
-			mongoOptions = options.MongoDB
-		}
-		return NewMongoDBConnector(mongoOptions), nil
-	case "memorykv":
-		return NewMemoryKVConnector(wst.CreateDefaultMongoRegistry(), dsKey), nil
-	default:
-		return nil, errors.New("invalid connector " + name)
-	}
+	health            *datasourceHealth
 }
 
 func (ds *Datasource) Initialize() error {
@@ -51,29 +40,20 @@ func (ds *Datasource) Initialize() error {
 	var connectorName = dsViper.GetString("connector")
 	var connector PersistedConnector
 	var err error
-	connector, err = getConnectorByName(connectorName, ds.Key, ds.Options)
+	connector, err = getConnectorByName(connectorName, ds.Key, dsViper, ds.Options)
 	if err != nil {
 		return err
 	}
 	connector.SetConfig(dsViper)
-	fmt.Printf("Connecting to datasource %v...\n", ds.Key)
-	err = connector.Connect(ds.Context)
+	err = ds.connect(connector)
 	if err != nil {
-		fmt.Printf("Could not connect to datasource %v: %v\n", ds.Key, err)
-		return err
-	} else {
-		fmt.Printf("[DEBUG] Connected to datasource %v\n", ds.Key)
-	}
-
-	fmt.Printf("Pinging datasource %v...\n", ds.Key)
-	err = connector.Ping(ds.Context)
-	if err != nil {
-		fmt.Printf("Could not ping datasource %v: %v\n", ds.Key, err)
-		return err
-	} else {
-		fmt.Printf("[DEBUG] Ping result OK for datasource %v\n", ds.Key)
-		ds.Db = connector.GetClient()
+		if ds.Options == nil || !ds.Options.Degraded {
+			return err
+		}
+		// The app boots anyway, reporting the datasource as unhealthy until the goroutine below connects it
+		fmt.Printf("[WARNING] Datasource %v is unavailable, retrying in the background: %v\n", ds.Key, err)
 	}
+	connected := err == nil
 
 	// Start a goroutine to reconnect to the datasource if it gets disconnected
 	init := time.Now().UnixMilli()
@@ -89,30 +69,41 @@ func (ds *Datasource) Initialize() error {
 			default:
 			}
 
-			err := connector.Ping(initialCtx)
+			if connected {
+				pingStart := time.Now()
+				err := connector.Ping(initialCtx)
+				ds.recordPing(pingStart, err)
+				if err == nil {
+					continue
+				}
+			}
+			log.Printf("[%v] Reconnecting datasource...\n", ds.Key)
+			connectStart := time.Now()
+			err := connector.Connect(initialCtx)
+			if err != nil {
+				ds.recordPing(connectStart, err)
+				if !ds.keepsRunningOnError() {
+					ds.app.Logger().Fatalf("[%v] Could not reconnect: %v\n", ds.Key, err)
+				}
+				log.Printf("[%v] Could not reconnect: %v\n", ds.Key, err)
+				continue
+			}
+			connected = true
+			pingStart := time.Now()
+			err = connector.Ping(initialCtx)
+			ds.recordPing(pingStart, err)
 			if err != nil {
-				log.Printf("[%v] Reconnecting datasource...\n", ds.Key)
-				err := connector.Connect(initialCtx)
-				if err != nil {
-					if ds.Options == nil || !ds.Options.RetryOnError {
-						ds.app.Logger().Fatalf("[%v] Could not reconnect: %v\n", ds.Key, err)
-					}
-				} else {
-					err = connector.Ping(initialCtx)
-					if err != nil {
-						select {
-						case <-initialCtx.Done():
-							return
-						default:
-						}
-						if ds.Options == nil || !ds.Options.RetryOnError {
-							ds.app.Logger().Fatalf("[%v] Mongo client disconnected after %vms: %v", ds.Key, time.Now().UnixMilli()-init, err)
-						}
-					} else {
-						log.Printf("successfully reconnected to %v\n", ds.Key)
-						ds.Db = connector.GetClient()
-					}
+				select {
+				case <-initialCtx.Done():
+					return
+				default:
 				}
+				if !ds.keepsRunningOnError() {
+					ds.app.Logger().Fatalf("[%v] Mongo client disconnected after %vms: %v", ds.Key, time.Now().UnixMilli()-init, err)
+				}
+			} else {
+				log.Printf("successfully reconnected to %v\n", ds.Key)
+				ds.Db = connector.GetClient()
 			}
 		}
 	}()
@@ -121,6 +112,33 @@ func (ds *Datasource) Initialize() error {
 	return nil
 }
 
+// connect connects the connector and pings it, recording the result as the health of the datasource
+func (ds *Datasource) connect(connector PersistedConnector) error {
+	fmt.Printf("Connecting to datasource %v...\n", ds.Key)
+	connectStart := time.Now()
+	err := connector.Connect(ds.Context)
+	if err != nil {
+		fmt.Printf("Could not connect to datasource %v: %v\n", ds.Key, err)
+		ds.recordPing(connectStart, err)
+		return err
+	} else {
+		fmt.Printf("[DEBUG] Connected to datasource %v\n", ds.Key)
+	}
+
+	fmt.Printf("Pinging datasource %v...\n", ds.Key)
+	pingStart := time.Now()
+	err = connector.Ping(ds.Context)
+	ds.recordPing(pingStart, err)
+	if err != nil {
+		fmt.Printf("Could not ping datasource %v: %v\n", ds.Key, err)
+		return err
+	} else {
+		fmt.Printf("[DEBUG] Ping result OK for datasource %v\n", ds.Key)
+		ds.Db = connector.GetClient()
+	}
+	return nil
+}
+
 // FindMany retrieves data from the specified collection based on the provided lookup conditions using the appropriate
 // data source connector specified in the configuration file.
 // @param collectionName string: the name of the collection from which to retrieve data.
@@ -129,7 +147,8 @@ func (ds *Datasource) Initialize() error {
 // @return MongoCursorI: a cursor to the result set that matches the lookup criteria, or an error if an error occurs
 // while attempting to retrieve the data.
 // The cursor needs to be closed outside of the function.
-// Implementations for Redis and memorykv connectors are not yet implemented and will result in an error.
+// The memorykv and redis connectors only support the $match, $project, $sort, $skip and $limit stages, and the sqlite connector
+// adds the $lookup and $unwind stages of the relations to them.
 func (ds *Datasource) FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error) {
 	return ds.connectorInstance.FindMany(collectionName, lookups)
 }
@@ -163,36 +182,65 @@ func (ds *Datasource) DeleteById(collectionName string, id interface{}) (wst.Del
 // and is used to filter the documents to delete.
 // It cannot be nil or empty.
 func (ds *Datasource) DeleteMany(collectionName string, whereLookups *wst.A) (result wst.DeleteResult, err error) {
+	err = validateWhereLookups(whereLookups)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	return ds.connectorInstance.DeleteMany(collectionName, whereLookups)
+}
+
+// UpdateMany sets the given data in all the documents matching whereLookups, without running any hook.
+// whereLookups follows the same rules as in DeleteMany.
+func (ds *Datasource) UpdateMany(collectionName string, whereLookups *wst.A, data *wst.M) (result wst.UpdateManyResult, err error) {
+	err = validateUpdateMany(whereLookups, data)
+	if err != nil {
+		return wst.UpdateManyResult{}, err
+	}
+	return ds.connectorInstance.UpdateMany(collectionName, whereLookups, data)
+}
+
+func validateUpdateMany(whereLookups *wst.A, data *wst.M) error {
+	err := validateWhereLookups(whereLookups)
+	if err != nil {
+		return err
+	}
+	if data == nil || len(*data) == 0 {
+		return errors.New("data cannot be nil or empty")
+	}
+	return nil
+}
+
+func validateWhereLookups(whereLookups *wst.A) error {
 	if whereLookups == nil {
-		return result, errors.New("whereLookups cannot be nil")
+		return errors.New("whereLookups cannot be nil")
 	}
 	if len(*whereLookups) != 1 {
-		return result, errors.New("whereLookups must have exactly one element as a $match stage")
+		return errors.New("whereLookups must have exactly one element as a $match stage")
 	}
 	if (*whereLookups)[0] == nil {
-		return result, errors.New("whereLookups cannot have nil elements")
+		return errors.New("whereLookups cannot have nil elements")
 	}
 	if (*whereLookups)[0]["$match"] == nil {
-		return result, errors.New("first element of whereLookups must be a $match stage")
+		return errors.New("first element of whereLookups must be a $match stage")
 	}
 	if len((*whereLookups)[0]) != 1 {
-		return result, errors.New("first element of whereLookups must be a single $match stage")
+		return errors.New("first element of whereLookups must be a single $match stage")
 	}
 	if len((*whereLookups)[0]["$match"].(wst.M)) == 0 {
-		return result, errors.New("first element of whereLookups must be a single and non-empty $match stage")
+		return errors.New("first element of whereLookups must be a single and non-empty $match stage")
 	}
-
-	return ds.connectorInstance.DeleteMany(collectionName, whereLookups)
-
+	return nil
 }
 
+// Close disconnects the connector and stops the reconnection goroutine started by Initialize
 func (ds *Datasource) Close() error {
+	// The goroutine is stopped even if the connector fails to disconnect
+	defer ds.ctxCancelFn()
 	err := ds.connectorInstance.Disconnect()
 	if err != nil {
 		fmt.Printf("[ERROR] Could not close datasource %v: %v\n", ds.Key, err)
 		return err
 	}
-	ds.ctxCancelFn()
 	fmt.Printf("[INFO] Closed datasource %v\n", ds.Key)
 	return nil
 }
@@ -225,6 +273,7 @@ func New(app *wst.IApp, dsKey string, dsViper *viper.Viper, parentContext contex
 		Context:     ctx,
 		ctxCancelFn: ctxCancelFn,
 		app:         app,
+		health:      &datasourceHealth{},
 	}
 	return ds
 }
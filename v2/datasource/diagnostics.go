@@ -0,0 +1,37 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// ExplainConnector is implemented by the connectors able to describe how they would run a pipeline
+type ExplainConnector interface {
+	// Explain returns the plan of the pipeline. verbosity is one of "queryPlanner", "executionStats" or
+	// "allPlansExecution", as in the MongoDB explain command.
+	Explain(ctx context.Context, collectionName string, lookups *wst.A, verbosity string) (wst.M, error)
+}
+
+// ErrExplainNotSupported is returned by Explain when the connector does not implement ExplainConnector
+var ErrExplainNotSupported = errors.New("the connector does not support explain")
+
+// Explain returns the plan of the pipeline, as described by the connector
+func (ds *Datasource) Explain(ctx context.Context, collectionName string, lookups *wst.A, verbosity string) (wst.M, error) {
+	explainConnector, ok := ds.connectorInstance.(ExplainConnector)
+	if !ok {
+		return nil, ErrExplainNotSupported
+	}
+	return explainConnector.Explain(ctx, collectionName, lookups, verbosity)
+}
+
+// SlowQueryThreshold returns the "slowQueryThresholdMs" setting of the datasource, or 0 if the slow queries are not
+// logged
+func (ds *Datasource) SlowQueryThreshold() time.Duration {
+	if ds == nil || ds.SubViper == nil {
+		return 0
+	}
+	return time.Duration(ds.SubViper.GetInt64("slowQueryThresholdMs")) * time.Millisecond
+}
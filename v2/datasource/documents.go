@@ -0,0 +1,16 @@
+package datasource
+
+// DocumentCollectionConnector is implemented by the connectors storing both cache entries and the documents of
+// persisted models, which need to know which collections hold documents
+type DocumentCollectionConnector interface {
+	// SetDocumentCollection declares the collection as a document store
+	SetDocumentCollection(collectionName string)
+}
+
+// SetDocumentCollection declares the collection of a persisted model in the connectors implementing
+// DocumentCollectionConnector. The other connectors only store documents, so it does nothing in them.
+func (ds *Datasource) SetDocumentCollection(collectionName string) {
+	if documentCollectionConnector, ok := ds.connectorInstance.(DocumentCollectionConnector); ok {
+		documentCollectionConnector.SetDocumentCollection(collectionName)
+	}
+}
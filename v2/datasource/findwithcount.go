@@ -0,0 +1,79 @@
+package datasource
+
+import (
+	"context"
+	"reflect"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// FindWithCountConnector is implemented by the connectors able to return a page of documents together with the number
+// of documents matched by the query, in a single round trip
+type FindWithCountConnector interface {
+	// FindManyWithCount returns the documents of pageLookups and the number of documents of countLookups. Both
+	// pipelines usually start with the same stages, which are run only once.
+	FindManyWithCount(collectionName string, pageLookups *wst.A, countLookups *wst.A) (MongoCursorI, int64, error)
+}
+
+// FindWithCountContextConnector is FindWithCountConnector for the connectors that also implement ContextConnector
+type FindWithCountContextConnector interface {
+	// FindManyWithCountContext is FindManyWithCount run under ctx
+	FindManyWithCountContext(ctx context.Context, collectionName string, pageLookups *wst.A, countLookups *wst.A) (MongoCursorI, int64, error)
+}
+
+// FindManyWithCount returns the documents matched by pageLookups and the number of documents matched by countLookups,
+// which is pageLookups without skip, limit and the like. Connectors that do not implement FindWithCountConnector run
+// FindMany and Count separately.
+func (ds *Datasource) FindManyWithCount(collectionName string, pageLookups *wst.A, countLookups *wst.A) (MongoCursorI, int64, error) {
+	if findWithCountConnector, ok := ds.connectorInstance.(FindWithCountConnector); ok {
+		return findWithCountConnector.FindManyWithCount(collectionName, pageLookups, countLookups)
+	}
+	count, err := ds.Count(collectionName, countLookups)
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := ds.FindMany(collectionName, pageLookups)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cursor, count.Count, nil
+}
+
+// FindManyWithCountContext is FindManyWithCount run under ctx
+func (ds *Datasource) FindManyWithCountContext(ctx context.Context, collectionName string, pageLookups *wst.A, countLookups *wst.A) (MongoCursorI, int64, error) {
+	contextConnector, err := ds.contextConnector(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if findWithCountConnector, ok := contextConnector.(FindWithCountContextConnector); ok {
+		return findWithCountConnector.FindManyWithCountContext(ctx, collectionName, pageLookups, countLookups)
+	}
+	if findWithCountConnector, ok := ds.connectorInstance.(FindWithCountConnector); ok {
+		return findWithCountConnector.FindManyWithCount(collectionName, pageLookups, countLookups)
+	}
+	count, err := ds.CountContext(ctx, collectionName, countLookups)
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := ds.FindManyContext(ctx, collectionName, pageLookups)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cursor, count.Count, nil
+}
+
+// splitCommonStages returns the leading stages shared by both pipelines, and the remaining stages of each one
+func splitCommonStages(a *wst.A, b *wst.A) (common wst.A, restA wst.A, restB wst.A) {
+	if a != nil {
+		restA = *a
+	}
+	if b != nil {
+		restB = *b
+	}
+	for len(restA) > 0 && len(restB) > 0 && reflect.DeepEqual(restA[0], restB[0]) {
+		common = append(common, restA[0])
+		restA = restA[1:]
+		restB = restB[1:]
+	}
+	return common, restA, restB
+}
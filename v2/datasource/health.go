@@ -0,0 +1,50 @@
+package datasource
+
+import (
+	"sync"
+	"time"
+)
+
+// HealthStatus is the result of the last ping of a datasource
+type HealthStatus struct {
+	Name      string    `json:"name"`
+	Connector string    `json:"connector"`
+	Healthy   bool      `json:"healthy"`
+	LastPing  time.Time `json:"lastPing"`
+	LatencyMs float64   `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// datasourceHealth is shared by the copies of a datasource bound to a transaction
+type datasourceHealth struct {
+	status HealthStatus
+	lock   sync.RWMutex
+}
+
+// Health returns the result of the last ping, which runs every 5 seconds once the datasource is initialized
+func (ds *Datasource) Health() HealthStatus {
+	ds.health.lock.RLock()
+	defer ds.health.lock.RUnlock()
+	status := ds.health.status
+	status.Name = ds.Name
+	status.Connector = ds.SubViper.GetString("connector")
+	return status
+}
+
+func (ds *Datasource) recordPing(start time.Time, err error) {
+	ds.health.lock.Lock()
+	defer ds.health.lock.Unlock()
+	ds.health.status = HealthStatus{
+		Healthy:   err == nil,
+		LastPing:  start,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000.0,
+	}
+	if err != nil {
+		ds.health.status.Error = err.Error()
+	}
+}
+
+// keepsRunningOnError tells whether a failed reconnection must not stop the process
+func (ds *Datasource) keepsRunningOnError() bool {
+	return ds.Options != nil && (ds.Options.RetryOnError || ds.Options.Degraded)
+}
@@ -0,0 +1,261 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// IndexConnector is implemented by the connectors able to manage the indexes of their collections
+type IndexConnector interface {
+	// ListIndexes returns the indexes of the collection, including the default _id index
+	ListIndexes(ctx context.Context, collectionName string) ([]Index, error)
+	CreateIndex(ctx context.Context, collectionName string, index Index) error
+	DropIndex(ctx context.Context, collectionName string, indexName string) error
+}
+
+// Index describes an index of a collection. The values of Keys are 1 or -1 for ascending and descending keys, or the
+// index type, like "text" or "2dsphere".
+type Index struct {
+	Name               string `json:"name"`
+	Keys               bson.D `json:"keys"`
+	Unique             bool   `json:"unique,omitempty"`
+	Sparse             bool   `json:"sparse,omitempty"`
+	ExpireAfterSeconds *int32 `json:"expireAfterSeconds,omitempty"`
+	PartialFilter      wst.M  `json:"partialFilter,omitempty"`
+	// Weights are the weights of the text keys. The missing ones weigh 1.
+	Weights map[string]int32 `json:"weights,omitempty"`
+}
+
+// defaultIndexName is the name of the index MongoDB creates for every collection
+const defaultIndexName = "_id_"
+
+// DuplicateKeyError is returned by the connectors when a write violates a unique index
+type DuplicateKeyError struct {
+	// Index is the name of the violated index, if the connector reports it
+	Index string
+	Err   error
+}
+
+func (err *DuplicateKeyError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *DuplicateKeyError) Unwrap() error {
+	return err.Err
+}
+
+// IndexName returns the name of the index, or the one MongoDB would generate from its keys
+func (index Index) IndexName() string {
+	if index.Name != "" {
+		return index.Name
+	}
+	parts := make([]string, 0, len(index.Keys)*2)
+	for _, key := range index.Keys {
+		parts = append(parts, key.Key, fmt.Sprintf("%v", normalizeIndexKeyValue(key.Value)))
+	}
+	return strings.Join(parts, "_")
+}
+
+// Equals tells whether both indexes have the same definition, regardless of their names
+func (index Index) Equals(other Index) bool {
+	if index.Unique != other.Unique || index.Sparse != other.Sparse {
+		return false
+	}
+	if (index.ExpireAfterSeconds == nil) != (other.ExpireAfterSeconds == nil) ||
+		(index.ExpireAfterSeconds != nil && *index.ExpireAfterSeconds != *other.ExpireAfterSeconds) {
+		return false
+	}
+	if len(index.PartialFilter) > 0 || len(other.PartialFilter) > 0 {
+		if !reflect.DeepEqual(normalizeIndexFilter(index.PartialFilter), normalizeIndexFilter(other.PartialFilter)) {
+			return false
+		}
+	}
+	if !reflect.DeepEqual(index.textWeights(), other.textWeights()) {
+		return false
+	}
+	return reflect.DeepEqual(comparableIndexKeys(index.Keys), comparableIndexKeys(other.Keys))
+}
+
+// textWeights returns the weight of every text key, including the default ones
+func (index Index) textWeights() map[string]int32 {
+	weights := map[string]int32{}
+	for _, key := range index.Keys {
+		if normalizeIndexKeyValue(key.Value) != "text" {
+			continue
+		}
+		weights[key.Key] = 1
+		if weight, ok := index.Weights[key.Key]; ok {
+			weights[key.Key] = weight
+		}
+	}
+	return weights
+}
+
+// IndexChange is an index whose definition differs from the declared one. It is applied by dropping and creating it again.
+type IndexChange struct {
+	Declared Index `json:"declared"`
+	Existing Index `json:"existing"`
+}
+
+// IndexDiff is the drift between the declared indexes of a collection and the existing ones
+type IndexDiff struct {
+	Missing []Index       `json:"missing,omitempty"`
+	Changed []IndexChange `json:"changed,omitempty"`
+	// Extra are the existing indexes that are not declared, apart from the default _id index
+	Extra []Index `json:"extra,omitempty"`
+}
+
+// InSync tells whether the declared indexes exist as declared. Extra indexes are not considered drift.
+func (diff IndexDiff) InSync() bool {
+	return len(diff.Missing) == 0 && len(diff.Changed) == 0
+}
+
+// DiffIndexes compares the declared indexes with the existing ones, matching them by name
+func DiffIndexes(declared []Index, existing []Index) IndexDiff {
+	var diff IndexDiff
+	existingByName := make(map[string]Index, len(existing))
+	for _, index := range existing {
+		existingByName[index.IndexName()] = index
+	}
+	declaredNames := make(map[string]bool, len(declared))
+	for _, index := range declared {
+		name := index.IndexName()
+		declaredNames[name] = true
+		current, exists := existingByName[name]
+		if !exists {
+			diff.Missing = append(diff.Missing, index)
+		} else if !index.Equals(current) {
+			diff.Changed = append(diff.Changed, IndexChange{Declared: index, Existing: current})
+		}
+	}
+	for _, index := range existing {
+		if name := index.IndexName(); name != defaultIndexName && !declaredNames[name] {
+			diff.Extra = append(diff.Extra, index)
+		}
+	}
+	return diff
+}
+
+// ListIndexes returns the indexes of the collection. It fails if the connector does not implement IndexConnector.
+func (ds *Datasource) ListIndexes(ctx context.Context, collectionName string) ([]Index, error) {
+	indexConnector, err := ds.indexConnector()
+	if err != nil {
+		return nil, err
+	}
+	return indexConnector.ListIndexes(ctx, collectionName)
+}
+
+// SupportsIndexes tells whether the connector of the datasource implements IndexConnector
+func (ds *Datasource) SupportsIndexes() bool {
+	_, ok := ds.connectorInstance.(IndexConnector)
+	return ok
+}
+
+// DiffIndexes compares the declared indexes of the collection with the existing ones
+func (ds *Datasource) DiffIndexes(ctx context.Context, collectionName string, declared []Index) (IndexDiff, error) {
+	existing, err := ds.ListIndexes(ctx, collectionName)
+	if err != nil {
+		return IndexDiff{}, err
+	}
+	return DiffIndexes(declared, existing), nil
+}
+
+// ApplyIndexDiff creates the missing indexes and replaces the changed ones. The extra indexes are dropped only if prune
+// is true.
+func (ds *Datasource) ApplyIndexDiff(ctx context.Context, collectionName string, diff IndexDiff, prune bool) error {
+	indexConnector, err := ds.indexConnector()
+	if err != nil {
+		return err
+	}
+	for _, change := range diff.Changed {
+		err = indexConnector.DropIndex(ctx, collectionName, change.Existing.IndexName())
+		if err != nil {
+			return fmt.Errorf("could not drop index %v: %w", change.Existing.IndexName(), err)
+		}
+		err = indexConnector.CreateIndex(ctx, collectionName, change.Declared)
+		if err != nil {
+			return fmt.Errorf("could not create index %v: %w", change.Declared.IndexName(), err)
+		}
+	}
+	for _, index := range diff.Missing {
+		err = indexConnector.CreateIndex(ctx, collectionName, index)
+		if err != nil {
+			return fmt.Errorf("could not create index %v: %w", index.IndexName(), err)
+		}
+	}
+	if prune {
+		for _, index := range diff.Extra {
+			err = indexConnector.DropIndex(ctx, collectionName, index.IndexName())
+			if err != nil {
+				return fmt.Errorf("could not drop index %v: %w", index.IndexName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ds *Datasource) indexConnector() (IndexConnector, error) {
+	indexConnector, ok := ds.connectorInstance.(IndexConnector)
+	if !ok {
+		return nil, fmt.Errorf("datasource %v does not support indexes", ds.Name)
+	}
+	return indexConnector, nil
+}
+
+// comparableIndexKeys normalizes the key values and sorts the text keys, whose order does not matter
+func comparableIndexKeys(keys bson.D) []string {
+	var result []string
+	var textKeys []string
+	for _, key := range keys {
+		value := normalizeIndexKeyValue(key.Value)
+		if value == "text" {
+			textKeys = append(textKeys, key.Key)
+			continue
+		}
+		result = append(result, fmt.Sprintf("%v:%v", key.Key, value))
+	}
+	sort.Strings(textKeys)
+	for _, key := range textKeys {
+		result = append(result, key+":text")
+	}
+	return result
+}
+
+func normalizeIndexKeyValue(value interface{}) interface{} {
+	if asFloat, ok := asMemoryKvFloat(value); ok {
+		return int(asFloat)
+	}
+	return value
+}
+
+// normalizeIndexFilter converts the maps and numbers of a filter to the same types, as the filters read from the
+// database are decoded differently from the declared ones
+func normalizeIndexFilter(value interface{}) interface{} {
+	if asMap, ok := asMemoryKvMap(value); ok {
+		if len(asMap) == 0 {
+			return nil
+		}
+		normalized := make(map[string]interface{}, len(asMap))
+		for key, element := range asMap {
+			normalized[key] = normalizeIndexFilter(element)
+		}
+		return normalized
+	}
+	if asSlice, ok := asMemoryKvSlice(value); ok {
+		normalized := make([]interface{}, len(asSlice))
+		for idx, element := range asSlice {
+			normalized[idx] = normalizeIndexFilter(element)
+		}
+		return normalized
+	}
+	if asFloat, ok := asMemoryKvFloat(value); ok {
+		return asFloat
+	}
+	return value
+}
@@ -11,15 +11,34 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // MemoryKVConnector implements the PersistedConnector interface
+//
+// It works in two modes per collection: as a cache, where each key holds a list of entries inside the `_redId`/`_entries`
+// envelope, and as a document store for regular persisted models, where each key is a document id holding a single document.
+// The collections of the models using the datasource are declared as document stores at boot with SetDocumentCollection.
 type MemoryKVConnector struct {
 	db       memorykv.MemoryKvDb
 	dsKey    string
 	dsConfig *viper.Viper
 	registry *bsoncodec.Registry
+
+	// documentCollections holds the collections used as document stores
+	documentCollections     map[string]bool
+	documentCollectionsLock sync.RWMutex
+	// writeLock serializes read-modify-write operations over documents
+	writeLock sync.Mutex
+	// textIndexes holds the tokenized indexes of the searchable collections
+	textIndexes     map[string]*memoryKvTextIndex
+	textIndexesLock sync.RWMutex
+	// server exposes db over RESP if the "server.address" setting is set
+	server *memorykv.Server
 }
 
 func (connector *MemoryKVConnector) GetName() string {
@@ -27,9 +46,108 @@ func (connector *MemoryKVConnector) GetName() string {
 }
 
 func (connector *MemoryKVConnector) Connect(parentContext context.Context) error {
-	connector.db = memorykv.NewMemoryKvDb(memorykv.Options{
+	if connector.dsConfig != nil && connector.dsConfig.GetString("url") != "" {
+		return connector.connectRemote()
+	}
+	options := memorykv.Options{
 		Name: connector.dsKey,
-	})
+	}
+	if connector.dsConfig != nil && connector.dsConfig.GetString("persistence.directory") != "" {
+		options.Persistence = &memorykv.PersistenceOptions{
+			Directory:        connector.dsConfig.GetString("persistence.directory"),
+			SnapshotInterval: time.Duration(connector.dsConfig.GetFloat64("persistence.snapshotInterval") * float64(time.Second)),
+		}
+	}
+	if connector.dsConfig != nil {
+		options.Limits = memorykv.Limits{
+			MaxBytes:   connector.dsConfig.GetInt64("maxBytes"),
+			MaxEntries: connector.dsConfig.GetInt("maxEntries"),
+			Policy:     memorykv.EvictionPolicy(strings.ToLower(connector.dsConfig.GetString("evictionPolicy"))),
+		}
+		if connector.dsConfig.IsSet("buckets") {
+			err := connector.dsConfig.UnmarshalKey("buckets", &options.BucketLimits)
+			if err != nil {
+				return fmt.Errorf("invalid buckets of datasource %v: %w", connector.dsKey, err)
+			}
+			for name, limits := range options.BucketLimits {
+				limits.Policy = memorykv.EvictionPolicy(strings.ToLower(string(limits.Policy)))
+				options.BucketLimits[name] = limits
+			}
+		}
+		err := validateEvictionPolicies(options)
+		if err != nil {
+			return err
+		}
+	}
+	db, err := memorykv.OpenMemoryKvDb(options)
+	if err != nil {
+		return fmt.Errorf("could not load the persisted entries of datasource %v: %w", connector.dsKey, err)
+	}
+	connector.db = db
+	if connector.dsConfig != nil && connector.dsConfig.GetString("server.address") != "" {
+		connector.server = memorykv.NewServer(connector.db, memorykv.ServerOptions{
+			Password: connector.dsConfig.GetString("server.password"),
+		})
+		err := connector.server.Start(connector.dsConfig.GetString("server.address"))
+		if err != nil {
+			return fmt.Errorf("could not start the memorykv server of datasource %v: %w", connector.dsKey, err)
+		}
+	}
+	return nil
+}
+
+// connectRemote uses the memorykv server or Redis of the "url" setting, like "redis://:password@host:6379/0", so the
+// entries are shared with the other replicas
+func (connector *MemoryKVConnector) connectRemote() error {
+	options, err := remoteOptionsFromUrl(connector.dsKey, connector.dsConfig.GetString("url"))
+	if err != nil {
+		return err
+	}
+	return connector.connectRemoteWith(options)
+}
+
+func (connector *MemoryKVConnector) connectRemoteWith(options memorykv.RemoteOptions) error {
+	options.PoolSize = connector.dsConfig.GetInt("poolSize")
+	options.Timeout = time.Duration(connector.dsConfig.GetFloat64("timeout") * float64(time.Second))
+	remote, err := memorykv.NewRemoteMemoryKvDb(options)
+	if err != nil {
+		return fmt.Errorf("could not connect datasource %v to %v: %w", connector.dsKey, options.Address, err)
+	}
+	connector.db = remote
+	return nil
+}
+
+func remoteOptionsFromUrl(dsKey string, rawUrl string) (memorykv.RemoteOptions, error) {
+	var options memorykv.RemoteOptions
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Scheme != "redis" || parsed.Host == "" {
+		return options, fmt.Errorf("invalid url of datasource %v. Use redis://[:password@]host:port[/database]", dsKey)
+	}
+	options.Address = parsed.Host
+	if password, ok := parsed.User.Password(); ok {
+		options.Password = password
+	}
+	if database := strings.Trim(parsed.Path, "/"); database != "" {
+		options.Database, err = strconv.Atoi(database)
+		if err != nil {
+			return options, fmt.Errorf("invalid database %v of datasource %v", database, dsKey)
+		}
+	}
+	return options, nil
+}
+
+func validateEvictionPolicies(options memorykv.Options) error {
+	policies := []memorykv.EvictionPolicy{options.Limits.Policy}
+	for _, limits := range options.BucketLimits {
+		policies = append(policies, limits.Policy)
+	}
+	for _, policy := range policies {
+		switch policy {
+		case "", memorykv.EvictionLRU, memorykv.EvictionLFU, memorykv.EvictionTTL:
+		default:
+			return fmt.Errorf("invalid eviction policy %v of datasource %v. Use lru, lfu or ttl", policy, options.Name)
+		}
+	}
 	return nil
 }
 
@@ -38,6 +156,14 @@ func (connector *MemoryKVConnector) SetConfig(dsViper *viper.Viper) {
 }
 
 func (connector *MemoryKVConnector) FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	if connector.isDocumentCollection(collectionName) || !isMemoryKvCacheQuery(lookups) {
+		documents, err := connector.findDocuments(collectionName, lookups)
+		if err != nil {
+			return nil, err
+		}
+		return connector.newDocumentsCursor(documents)
+	}
+
 	db := connector.db
 	if lookups == nil || len(*lookups) == 0 {
 		return nil, errors.New("empty query")
@@ -91,16 +217,44 @@ func (connector *MemoryKVConnector) FindMany(collectionName string, lookups *wst
 	return NewFixedMongoCursor(connector.registry, documents), nil
 }
 
-func (connector *MemoryKVConnector) findByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
-	panic("Not implemented")
+func (connector *MemoryKVConnector) FindByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+	wrappedLookups := &wst.A{
+		{
+			"$match": wst.M{
+				"_id": _id,
+			},
+		},
+	}
+	if lookups != nil {
+		*wrappedLookups = append(*wrappedLookups, *lookups...)
+	}
+	documents, err := connector.findDocuments(collectionName, wrappedLookups)
+	if err != nil {
+		return nil, err
+	}
+	if len(documents) > 0 {
+		return &documents[0], nil
+	} else {
+		return nil, errors.New("document not found")
+	}
 }
 
 func (connector *MemoryKVConnector) Count(collectionName string, lookups *wst.A) (wst.CountResult, error) {
-	//TODO implement me
-	panic("implement me")
+	if !connector.isDocumentCollection(collectionName) {
+		return wst.CountResult{}, nil
+	}
+	documents, err := connector.findDocuments(collectionName, lookups)
+	if err != nil {
+		return wst.CountResult{}, err
+	}
+	return wst.CountResult{Count: int64(len(documents))}, nil
 }
 
 func (connector *MemoryKVConnector) Create(collectionName string, data *wst.M) (*wst.M, error) {
+	if _, isCacheEnvelope := (*data)["_entries"]; !isCacheEnvelope {
+		return connector.createDocument(collectionName, data)
+	}
+
 	db := connector.db
 
 	var id interface{}
@@ -151,28 +305,300 @@ func (connector *MemoryKVConnector) Create(collectionName string, data *wst.M) (
 	return data, err
 }
 
+func (connector *MemoryKVConnector) createDocument(collectionName string, data *wst.M) (*wst.M, error) {
+	if (*data)["_id"] == nil {
+		if (*data)["id"] != nil {
+			(*data)["_id"] = (*data)["id"]
+		} else {
+			(*data)["_id"] = primitive.NewObjectID()
+		}
+	}
+	id := (*data)["_id"]
+	idAsStr := memoryKvIdAsString(id)
+
+	connector.writeLock.Lock()
+	defer connector.writeLock.Unlock()
+
+	connector.markDocumentCollection(collectionName)
+	bytes, err := bson.MarshalWithRegistry(connector.registry, *data)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := connector.db.GetBucket(collectionName).SetNX(idAsStr, [][]byte{bytes}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		return nil, &DuplicateKeyError{Index: defaultIndexName, Err: fmt.Errorf("duplicate key error: %v already exists in %v", idAsStr, collectionName)}
+	}
+	connector.indexDocument(collectionName, idAsStr, bytes, *data)
+	return connector.FindByObjectId(collectionName, id, nil)
+}
+
 func (connector *MemoryKVConnector) UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
-	//TODO implement me
-	panic("implement me")
+	delete(*data, "id")
+	delete(*data, "_id")
+
+	connector.writeLock.Lock()
+	document, err := connector.FindByObjectId(collectionName, id, nil)
+	if err != nil {
+		connector.writeLock.Unlock()
+		return nil, err
+	}
+	if expectedVersion, versioned := extractExpectedVersion(data); versioned {
+		matches, err := memoryKvMatches(*document, wst.M{VersionProperty: expectedVersion})
+		if err != nil || !matches {
+			connector.writeLock.Unlock()
+			if err == nil {
+				err = ErrVersionMismatch
+			}
+			return nil, err
+		}
+		(*document)[VersionProperty] = VersionOf(*document) + 1
+	}
+	for key, value := range *data {
+		(*document)[key] = value
+	}
+	err = connector.writeDocument(collectionName, memoryKvIdAsString(id), *document)
+	connector.writeLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return connector.FindByObjectId(collectionName, id, nil)
+}
+
+func (connector *MemoryKVConnector) UpdateMany(collectionName string, whereLookups *wst.A, data *wst.M) (wst.UpdateManyResult, error) {
+	if !connector.isDocumentCollection(collectionName) {
+		return wst.UpdateManyResult{}, nil
+	}
+	delete(*data, "id")
+	delete(*data, "_id")
+
+	connector.writeLock.Lock()
+	defer connector.writeLock.Unlock()
+
+	documents, err := connector.findDocuments(collectionName, whereLookups)
+	if err != nil {
+		return wst.UpdateManyResult{}, err
+	}
+	result := wst.UpdateManyResult{MatchedCount: int64(len(documents))}
+	for _, document := range documents {
+		for key, value := range *data {
+			document[key] = value
+		}
+		err = connector.writeDocument(collectionName, memoryKvIdAsString(document["_id"]), document)
+		if err != nil {
+			return result, err
+		}
+		result.ModifiedCount++
+	}
+	return result, nil
 }
 
 func (connector *MemoryKVConnector) DeleteById(collectionName string, id interface{}) (wst.DeleteResult, error) {
-	//TODO implement me
-	panic("implement me")
+	connector.writeLock.Lock()
+	defer connector.writeLock.Unlock()
+
+	bucket := connector.db.GetBucket(collectionName)
+	idAsStr := memoryKvIdAsString(id)
+	existing, err := bucket.Get(idAsStr)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	if existing == nil {
+		return wst.DeleteResult{DeletedCount: 0}, nil
+	}
+	err = bucket.Delete(idAsStr)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	connector.unindexDocument(collectionName, idAsStr)
+	return wst.DeleteResult{DeletedCount: 1}, nil
 }
 
 func (connector *MemoryKVConnector) DeleteMany(collectionName string, whereLookups *wst.A) (wst.DeleteResult, error) {
-	//TODO implement me
-	panic("implement me")
+	if !connector.isDocumentCollection(collectionName) {
+		return wst.DeleteResult{}, nil
+	}
+
+	connector.writeLock.Lock()
+	defer connector.writeLock.Unlock()
+
+	documents, err := connector.findDocuments(collectionName, whereLookups)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	bucket := connector.db.GetBucket(collectionName)
+	var deletedCount int64
+	for _, document := range documents {
+		idAsStr := memoryKvIdAsString(document["_id"])
+		err = bucket.Delete(idAsStr)
+		if err != nil {
+			return wst.DeleteResult{DeletedCount: deletedCount}, err
+		}
+		connector.unindexDocument(collectionName, idAsStr)
+		deletedCount++
+	}
+	return wst.DeleteResult{DeletedCount: deletedCount}, nil
+}
+
+// findDocuments loads the documents of the collection and evaluates the lookups over them. When the first stage matches
+// a single _id, only that key is read from the bucket, and a $text query only reads the keys found in the text index.
+func (connector *MemoryKVConnector) findDocuments(collectionName string, lookups *wst.A) ([]wst.M, error) {
+	bucket := connector.db.GetBucket(collectionName)
+
+	var textIndex *memoryKvTextIndex
+	query, searching := extractMemoryKvTextQuery(lookups)
+	if searching {
+		textIndex = connector.textIndex(collectionName)
+		if textIndex == nil {
+			return nil, fmt.Errorf("text index required for $text query on %v", collectionName)
+		}
+	}
+
+	var keys []string
+	id, singleKey := extractMemoryKvMatchedId(lookups)
+	if singleKey {
+		keys = []string{memoryKvIdAsString(id)}
+	} else if textIndex != nil {
+		var err error
+		keys, err = textIndex.candidates(bucket, connector.registry, query)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		keys = bucket.Keys()
+	}
+
+	documents := make([]wst.M, 0, len(keys))
+	for _, key := range keys {
+		entries, err := bucket.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if entries == nil && textIndex != nil {
+			// The document was deleted by another client
+			textIndex.remove(key)
+		}
+		for _, entry := range entries {
+			var document wst.M
+			err := bson.UnmarshalWithRegistry(connector.registry, entry, &document)
+			if err != nil {
+				return nil, err
+			}
+			if textIndex != nil {
+				document[memoryKvTextScoreKey] = textIndex.score(key, entry, document, query)
+			}
+			documents = append(documents, document)
+		}
+	}
+	documents, err := evaluateMemoryKvPipeline(documents, lookups)
+	for _, document := range documents {
+		delete(document, memoryKvTextScoreKey)
+	}
+	return documents, err
+}
+
+func (connector *MemoryKVConnector) writeDocument(collectionName string, idAsStr string, document wst.M) error {
+	bytes, err := bson.MarshalWithRegistry(connector.registry, document)
+	if err != nil {
+		return err
+	}
+	// GetSet reports the errors of remote buckets, unlike Set, and the documents never expire
+	_, err = connector.db.GetBucket(collectionName).GetSet(idAsStr, [][]byte{bytes})
+	if err != nil {
+		return err
+	}
+	connector.indexDocument(collectionName, idAsStr, bytes, document)
+	return nil
+}
+
+func (connector *MemoryKVConnector) newDocumentsCursor(documents []wst.M) (MongoCursorI, error) {
+	rawDocuments := make([][]byte, len(documents))
+	for idx, document := range documents {
+		bytes, err := bson.MarshalWithRegistry(connector.registry, document)
+		if err != nil {
+			return nil, err
+		}
+		rawDocuments[idx] = bytes
+	}
+	return NewFixedMongoCursor(connector.registry, rawDocuments), nil
+}
+
+// SetDocumentCollection declares the collection as a document store, so it is read as such even before any document is
+// created through this connector
+func (connector *MemoryKVConnector) SetDocumentCollection(collectionName string) {
+	connector.markDocumentCollection(collectionName)
+}
+
+func (connector *MemoryKVConnector) markDocumentCollection(collectionName string) {
+	if connector.isDocumentCollection(collectionName) {
+		return
+	}
+	// The eviction of remote databases is up to their server
+	if local, ok := connector.db.(*memorykv.MemoryKvDbImpl); ok {
+		local.ExcludeFromEviction(collectionName)
+	}
+	connector.documentCollectionsLock.Lock()
+	connector.documentCollections[collectionName] = true
+	connector.documentCollectionsLock.Unlock()
+}
+
+func (connector *MemoryKVConnector) isDocumentCollection(collectionName string) bool {
+	connector.documentCollectionsLock.RLock()
+	defer connector.documentCollectionsLock.RUnlock()
+	return connector.documentCollections[collectionName]
+}
+
+// isMemoryKvCacheQuery tells whether the lookups have the shape used to read cache entries, a single $match by key
+func isMemoryKvCacheQuery(lookups *wst.A) bool {
+	if lookups == nil || len(*lookups) != 1 || len((*lookups)[0]) != 1 {
+		return false
+	}
+	match, ok := asMemoryKvMap((*lookups)[0]["$match"])
+	_, isSearch := match["$text"]
+	return ok && len(match) == 1 && !isSearch
+}
+
+func extractMemoryKvMatchedId(lookups *wst.A) (interface{}, bool) {
+	if lookups == nil || len(*lookups) == 0 {
+		return nil, false
+	}
+	match, ok := asMemoryKvMap((*lookups)[0]["$match"])
+	if !ok {
+		return nil, false
+	}
+	id, ok := match["_id"]
+	if !ok {
+		return nil, false
+	}
+	switch id.(type) {
+	case string, primitive.ObjectID, uuid.UUID:
+		return id, true
+	}
+	return nil, false
 }
 
 func (connector *MemoryKVConnector) Disconnect() error {
-	// Clear memory of buckets
+	if connector.server != nil {
+		err := connector.server.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// Persist the entries before clearing the memory of buckets
+	err := connector.db.Close()
+	if err != nil {
+		return err
+	}
 	return connector.db.Purge()
 }
 
 func (connector *MemoryKVConnector) Ping(parentCtx context.Context) error {
-	// We don't need to ping memorykv
+	if remote, ok := connector.db.(*memorykv.RemoteMemoryKvDb); ok {
+		return remote.Ping(parentCtx)
+	}
+	// We don't need to ping a local memorykv
 	return nil
 }
 
@@ -187,7 +613,9 @@ func (connector *MemoryKVConnector) GetClient() interface{} {
 // NewMemoryKVConnector Factory method for MemoryKVConnector
 func NewMemoryKVConnector(registry *bsoncodec.Registry, dsKey string) PersistedConnector {
 	return &MemoryKVConnector{
-		dsKey:    dsKey,
-		registry: registry,
+		dsKey:               dsKey,
+		registry:            registry,
+		documentCollections: make(map[string]bool),
+		textIndexes:         make(map[string]*memoryKvTextIndex),
 	}
 }
@@ -0,0 +1,592 @@
+package datasource
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// evaluateMemoryKvPipeline applies the subset of aggregation stages supported by the memorykv connector
+// ($match, $project, $addFields, $set, $sort, $skip and $limit) to the given documents.
+func evaluateMemoryKvPipeline(documents []wst.M, lookups *wst.A) ([]wst.M, error) {
+	if lookups == nil {
+		return documents, nil
+	}
+	for _, stage := range *lookups {
+		for stageName, stageValue := range stage {
+			var err error
+			switch stageName {
+			case "$match":
+				match, ok := asMemoryKvMap(stageValue)
+				if !ok {
+					return nil, fmt.Errorf("invalid $match value type %T", stageValue)
+				}
+				var filtered []wst.M
+				for _, document := range documents {
+					matches, err := memoryKvMatches(document, match)
+					if err != nil {
+						return nil, err
+					}
+					if matches {
+						filtered = append(filtered, document)
+					}
+				}
+				documents = filtered
+			case "$project":
+				projection, ok := asMemoryKvMap(stageValue)
+				if !ok {
+					return nil, fmt.Errorf("invalid $project value type %T", stageValue)
+				}
+				for idx, document := range documents {
+					documents[idx] = applyMemoryKvProjection(document, projection)
+				}
+			case "$addFields", "$set":
+				fields, ok := asMemoryKvMap(stageValue)
+				if !ok {
+					return nil, fmt.Errorf("invalid %v value type %T", stageName, stageValue)
+				}
+				for _, document := range documents {
+					err = addMemoryKvFields(document, fields)
+					if err != nil {
+						break
+					}
+				}
+			case "$sort":
+				err = sortMemoryKvDocuments(documents, stageValue)
+			case "$skip":
+				skip, ok := asMemoryKvInt(stageValue)
+				if !ok {
+					return nil, fmt.Errorf("invalid $skip value %v", stageValue)
+				}
+				if skip >= len(documents) {
+					documents = nil
+				} else if skip > 0 {
+					documents = documents[skip:]
+				}
+			case "$limit":
+				limit, ok := asMemoryKvInt(stageValue)
+				if !ok {
+					return nil, fmt.Errorf("invalid $limit value %v", stageValue)
+				}
+				if limit < len(documents) {
+					documents = documents[:limit]
+				}
+			default:
+				return nil, fmt.Errorf("stage %v is not supported by the memorykv connector", stageName)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return documents, nil
+}
+
+func memoryKvMatches(document wst.M, match map[string]interface{}) (bool, error) {
+	for key, expected := range match {
+		switch key {
+		case "$text":
+			matches, err := memoryKvTextMatches(document)
+			if err != nil || !matches {
+				return false, err
+			}
+		case "$and", "$or", "$nor":
+			subMatches, ok := asMemoryKvSlice(expected)
+			if !ok {
+				return false, fmt.Errorf("invalid %v value type %T", key, expected)
+			}
+			matchedCount := 0
+			for _, subMatch := range subMatches {
+				asMap, ok := asMemoryKvMap(subMatch)
+				if !ok {
+					return false, fmt.Errorf("invalid %v entry type %T", key, subMatch)
+				}
+				matches, err := memoryKvMatches(document, asMap)
+				if err != nil {
+					return false, err
+				}
+				if matches {
+					matchedCount++
+				}
+			}
+			if (key == "$and" && matchedCount != len(subMatches)) || (key == "$or" && matchedCount == 0) || (key == "$nor" && matchedCount > 0) {
+				return false, nil
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("operator %v is not supported by the memorykv connector", key)
+			}
+			value, exists := lookupMemoryKvPath(document, key)
+			matches, err := memoryKvValueMatches(value, exists, expected)
+			if err != nil {
+				return false, err
+			}
+			if !matches {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func memoryKvValueMatches(value interface{}, exists bool, expected interface{}) (bool, error) {
+	if operators, ok := asMemoryKvMap(expected); ok && isMemoryKvOperatorMap(operators) {
+		for operator, operand := range operators {
+			matches, err := memoryKvOperatorMatches(value, exists, operator, operand, operators)
+			if err != nil {
+				return false, err
+			}
+			if !matches {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	if regex, ok := expected.(primitive.Regex); ok {
+		return memoryKvRegexMatches(value, regex.Pattern, regex.Options)
+	}
+	return memoryKvEqualsOrContains(value, expected), nil
+}
+
+func memoryKvOperatorMatches(value interface{}, exists bool, operator string, operand interface{}, operators map[string]interface{}) (bool, error) {
+	switch operator {
+	case "$eq":
+		return memoryKvEqualsOrContains(value, operand), nil
+	case "$ne":
+		return !memoryKvEqualsOrContains(value, operand), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, candidate := range memoryKvCandidates(value) {
+			comparison, comparable := compareMemoryKvValues(candidate, operand)
+			if !comparable {
+				continue
+			}
+			if (operator == "$gt" && comparison > 0) || (operator == "$gte" && comparison >= 0) || (operator == "$lt" && comparison < 0) || (operator == "$lte" && comparison <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		options, ok := asMemoryKvSlice(operand)
+		if !ok {
+			return false, fmt.Errorf("invalid %v value type %T", operator, operand)
+		}
+		found := false
+		for _, option := range options {
+			if memoryKvEqualsOrContains(value, option) {
+				found = true
+				break
+			}
+		}
+		return found == (operator == "$in"), nil
+	case "$exists":
+		shouldExist, ok := operand.(bool)
+		if !ok {
+			shouldExist = operand != nil && operand != 0
+		}
+		return exists == shouldExist, nil
+	case "$regex":
+		options, _ := operators["$options"].(string)
+		switch pattern := operand.(type) {
+		case string:
+			return memoryKvRegexMatches(value, pattern, options)
+		case primitive.Regex:
+			return memoryKvRegexMatches(value, pattern.Pattern, pattern.Options+options)
+		}
+		return false, fmt.Errorf("invalid $regex value type %T", operand)
+	case "$options":
+		// Handled together with $regex
+		return true, nil
+	case "$not":
+		matches, err := memoryKvValueMatches(value, exists, operand)
+		return !matches, err
+	case "$size":
+		size, ok := asMemoryKvInt(operand)
+		if !ok {
+			return false, fmt.Errorf("invalid $size value %v", operand)
+		}
+		asSlice, isSlice := asMemoryKvSlice(value)
+		return isSlice && len(asSlice) == size, nil
+	}
+	return false, fmt.Errorf("operator %v is not supported by the memorykv connector", operator)
+}
+
+func memoryKvRegexMatches(value interface{}, pattern string, options string) (bool, error) {
+	if strings.Contains(options, "i") {
+		pattern = "(?i)" + pattern
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, candidate := range memoryKvCandidates(value) {
+		if asString, ok := candidate.(string); ok && regex.MatchString(asString) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// memoryKvEqualsOrContains mimics the MongoDB equality semantics, where an array matches if any of its elements matches
+func memoryKvEqualsOrContains(value interface{}, expected interface{}) bool {
+	if memoryKvValuesEqual(value, expected) {
+		return true
+	}
+	if asSlice, ok := asMemoryKvSlice(value); ok {
+		for _, element := range asSlice {
+			if memoryKvValuesEqual(element, expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func memoryKvCandidates(value interface{}) []interface{} {
+	if asSlice, ok := asMemoryKvSlice(value); ok {
+		return asSlice
+	}
+	return []interface{}{value}
+}
+
+func memoryKvValuesEqual(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if comparison, comparable := compareMemoryKvValues(a, b); comparable {
+		return comparison == 0
+	}
+	return reflect.DeepEqual(normalizeMemoryKvValue(a), normalizeMemoryKvValue(b))
+}
+
+func normalizeMemoryKvValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		asFloat, _ := asMemoryKvFloat(v)
+		return asFloat
+	case primitive.ObjectID:
+		return v.Hex()
+	case *primitive.ObjectID:
+		if v == nil {
+			return nil
+		}
+		return v.Hex()
+	case uuid.UUID:
+		return v.String()
+	case time.Time:
+		return v.UnixMilli()
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return v.UnixMilli()
+	case primitive.DateTime:
+		return int64(v)
+	}
+	return value
+}
+
+// compareMemoryKvValues returns -1, 0 or 1 and whether both values are comparable at all
+func compareMemoryKvValues(a interface{}, b interface{}) (int, bool) {
+	normalizedA := normalizeMemoryKvValue(a)
+	normalizedB := normalizeMemoryKvValue(b)
+	switch va := normalizedA.(type) {
+	case float64:
+		if vb, ok := normalizedB.(float64); ok {
+			return compareOrdered(va, vb), true
+		}
+	case int64:
+		if vb, ok := normalizedB.(int64); ok {
+			return compareOrdered(va, vb), true
+		}
+	case string:
+		if vb, ok := normalizedB.(string); ok {
+			return compareOrdered(va, vb), true
+		}
+	case bool:
+		if vb, ok := normalizedB.(bool); ok {
+			if va == vb {
+				return 0, true
+			} else if !va {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered[T float64 | int64 | string](a T, b T) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func applyMemoryKvProjection(document wst.M, projection map[string]interface{}) wst.M {
+	inclusive := false
+	for key, value := range projection {
+		if key == "_id" {
+			continue
+		}
+		if asFloat, ok := asMemoryKvFloat(value); ok {
+			inclusive = asFloat != 0
+		} else if asBool, ok := value.(bool); ok {
+			inclusive = asBool
+		}
+		break
+	}
+	if _, hasId := projection["_id"]; hasId && len(projection) == 1 {
+		// {"_id": 1} keeps only the id
+		inclusive = !isMemoryKvExclusion(projection["_id"])
+	}
+	projected := wst.M{}
+	if inclusive {
+		if v, ok := document["_id"]; ok && !isMemoryKvExclusion(projection["_id"]) {
+			projected["_id"] = v
+		}
+		for key, value := range projection {
+			if v, ok := document[key]; ok && !isMemoryKvExclusion(value) {
+				projected[key] = v
+			}
+		}
+	} else {
+		for key, value := range document {
+			if v, ok := projection[key]; ok && isMemoryKvExclusion(v) {
+				continue
+			}
+			projected[key] = value
+		}
+	}
+	return projected
+}
+
+// addMemoryKvFields sets the fields to constant values, or to the relevance of the $text query with {"$meta": "textScore"}
+func addMemoryKvFields(document wst.M, fields map[string]interface{}) error {
+	for field, value := range fields {
+		if expression, ok := asMemoryKvMap(value); ok && len(expression) > 0 {
+			if expression["$meta"] != "textScore" || len(expression) != 1 {
+				return fmt.Errorf("expression %v is not supported by the memorykv connector", expression)
+			}
+			score, exists := document[memoryKvTextScoreKey]
+			if !exists {
+				return fmt.Errorf("$meta textScore requires a $text query")
+			}
+			document[field] = score
+		} else if path, ok := value.(string); ok && strings.HasPrefix(path, "$") {
+			return fmt.Errorf("field path %v is not supported by the memorykv connector", path)
+		} else {
+			document[field] = value
+		}
+	}
+	return nil
+}
+
+func isMemoryKvExclusion(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	if asBool, ok := value.(bool); ok {
+		return !asBool
+	}
+	if asFloat, ok := asMemoryKvFloat(value); ok {
+		return asFloat == 0
+	}
+	return false
+}
+
+func sortMemoryKvDocuments(documents []wst.M, sortSpec interface{}) error {
+	var keys bson.D
+	switch v := sortSpec.(type) {
+	case bson.D:
+		keys = v
+	default:
+		asMap, ok := asMemoryKvMap(sortSpec)
+		if !ok {
+			return fmt.Errorf("invalid $sort value type %T", sortSpec)
+		}
+		if len(asMap) > 1 {
+			// The order of the keys of a map is undefined
+			return fmt.Errorf("invalid $sort with several keys in a map, use a bson.D to keep their order")
+		}
+		for key, direction := range asMap {
+			keys = append(keys, bson.E{Key: key, Value: direction})
+		}
+	}
+	sort.SliceStable(documents, func(i, j int) bool {
+		for _, key := range keys {
+			direction, _ := asMemoryKvInt(key.Value)
+			a, _ := lookupMemoryKvPath(documents[i], key.Key)
+			b, _ := lookupMemoryKvPath(documents[j], key.Key)
+			comparison := compareMemoryKvForSort(a, b)
+			if comparison != 0 {
+				if direction < 0 {
+					return comparison > 0
+				}
+				return comparison < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// compareMemoryKvForSort sorts missing values first, like MongoDB does for ascending orders
+func compareMemoryKvForSort(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		} else if a == nil {
+			return -1
+		}
+		return 1
+	}
+	if comparison, comparable := compareMemoryKvValues(a, b); comparable {
+		return comparison
+	}
+	return compareOrdered(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func lookupMemoryKvPath(document wst.M, path string) (interface{}, bool) {
+	var current interface{} = document
+	for _, segment := range strings.Split(path, ".") {
+		if asMap, ok := asMemoryKvMap(current); ok {
+			value, exists := asMap[segment]
+			if !exists {
+				return nil, false
+			}
+			current = value
+		} else if asSlice, ok := asMemoryKvSlice(current); ok {
+			// Collect the segment from every element, as MongoDB does with arrays of documents
+			var collected []interface{}
+			for _, element := range asSlice {
+				if elementMap, ok := asMemoryKvMap(element); ok {
+					if value, exists := elementMap[segment]; exists {
+						collected = append(collected, value)
+					}
+				}
+			}
+			if len(collected) == 0 {
+				return nil, false
+			}
+			current = collected
+		} else {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func isMemoryKvOperatorMap(value map[string]interface{}) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for key := range value {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func asMemoryKvMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case wst.M:
+		return v, true
+	case *wst.M:
+		if v == nil {
+			return nil, false
+		}
+		return *v, true
+	case wst.Where:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	case primitive.M:
+		return v, true
+	case primitive.D:
+		return v.Map(), true
+	}
+	return nil, false
+}
+
+func asMemoryKvSlice(value interface{}) ([]interface{}, bool) {
+	if value == nil {
+		return nil, false
+	}
+	if _, isBinary := value.([]byte); isBinary {
+		return nil, false
+	}
+	reflected := reflect.ValueOf(value)
+	if reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return nil, false
+	}
+	// primitive.D is a slice too, but it represents a document, and ids are arrays of bytes
+	switch value.(type) {
+	case primitive.D, primitive.ObjectID, uuid.UUID:
+		return nil, false
+	}
+	result := make([]interface{}, reflected.Len())
+	for i := 0; i < reflected.Len(); i++ {
+		result[i] = reflected.Index(i).Interface()
+	}
+	return result, true
+}
+
+func asMemoryKvFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func asMemoryKvInt(value interface{}) (int, bool) {
+	asFloat, ok := asMemoryKvFloat(value)
+	return int(asFloat), ok
+}
+
+func memoryKvIdAsString(id interface{}) string {
+	switch v := id.(type) {
+	case string:
+		return v
+	case primitive.ObjectID:
+		return v.Hex()
+	case *primitive.ObjectID:
+		return v.Hex()
+	case uuid.UUID:
+		return v.String()
+	}
+	return fmt.Sprintf("%v", id)
+}
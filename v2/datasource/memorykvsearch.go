@@ -0,0 +1,263 @@
+package datasource
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/memorykv"
+)
+
+// memoryKvTextScoreKey holds the relevance of each document while a $text query is evaluated. It cannot collide with
+// the stored properties, which cannot start with $.
+const memoryKvTextScoreKey = "$textScore"
+
+// memoryKvTextIndex is the inverted index of the searchable fields of a collection, so a $text query only reads the
+// documents containing the searched words. It is built from the whole collection on the first query, and kept up to
+// date by the writes of the connector. Each entry keeps the hash of the encoded document it was built from, so the
+// documents read by a query are indexed again if they changed, but the documents written by other clients of a remote
+// memorykv are only found by the words they contained when they were indexed.
+type memoryKvTextIndex struct {
+	weights  map[string]int32
+	entries  map[string]memoryKvTextEntry
+	postings map[string]map[string]bool
+	built    bool
+	lock     sync.Mutex
+}
+
+type memoryKvTextEntry struct {
+	hash uint64
+	// terms holds the frequency of each word in the searchable fields, weighted by field
+	terms map[string]float64
+}
+
+// memoryKvTextQuery is a parsed $search string. The words prefixed with "-" exclude the documents containing them.
+type memoryKvTextQuery struct {
+	terms    []string
+	excluded []string
+}
+
+func (connector *MemoryKVConnector) SetTextIndex(collectionName string, weights map[string]int32) {
+	index := &memoryKvTextIndex{
+		weights:  make(map[string]int32, len(weights)),
+		entries:  make(map[string]memoryKvTextEntry),
+		postings: make(map[string]map[string]bool),
+	}
+	for field, weight := range weights {
+		index.weights[field] = weight
+	}
+	connector.textIndexesLock.Lock()
+	connector.textIndexes[collectionName] = index
+	connector.textIndexesLock.Unlock()
+}
+
+func (connector *MemoryKVConnector) textIndex(collectionName string) *memoryKvTextIndex {
+	connector.textIndexesLock.RLock()
+	defer connector.textIndexesLock.RUnlock()
+	return connector.textIndexes[collectionName]
+}
+
+// indexDocument updates the text index of the collection, if any, after the document was written
+func (connector *MemoryKVConnector) indexDocument(collectionName string, key string, encoded []byte, document wst.M) {
+	if textIndex := connector.textIndex(collectionName); textIndex != nil {
+		textIndex.update(key, encoded, document, true)
+	}
+}
+
+// unindexDocument removes the document from the text index of the collection, if any, after it was deleted
+func (connector *MemoryKVConnector) unindexDocument(collectionName string, key string) {
+	if textIndex := connector.textIndex(collectionName); textIndex != nil {
+		textIndex.remove(key)
+	}
+}
+
+// candidates returns the keys of the documents containing any of the searched words, building the index first if needed
+func (index *memoryKvTextIndex) candidates(bucket memorykv.MemoryKvBucket, registry *bsoncodec.Registry, query memoryKvTextQuery) ([]string, error) {
+	err := index.build(bucket, registry)
+	if err != nil {
+		return nil, err
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	seen := map[string]bool{}
+	var keys []string
+	for _, term := range query.terms {
+		for key := range index.postings[term] {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// build indexes every document of the collection the first time it is searched. The writes running meanwhile index
+// their documents by themselves, so the documents indexed already are not replaced with the ones read here.
+func (index *memoryKvTextIndex) build(bucket memorykv.MemoryKvBucket, registry *bsoncodec.Registry) error {
+	index.lock.Lock()
+	built := index.built
+	index.lock.Unlock()
+	if built {
+		return nil
+	}
+	for _, key := range bucket.Keys() {
+		entries, err := bucket.Get(key)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var document wst.M
+			err := bson.UnmarshalWithRegistry(registry, entry, &document)
+			if err != nil {
+				return err
+			}
+			index.update(key, entry, document, false)
+		}
+	}
+	index.lock.Lock()
+	index.built = true
+	index.lock.Unlock()
+	return nil
+}
+
+// update indexes the document again if it changed since it was indexed. The existing entry is kept unless replace is set.
+func (index *memoryKvTextIndex) update(key string, encoded []byte, document wst.M, replace bool) memoryKvTextEntry {
+	hash := fnv.New64a()
+	_, _ = hash.Write(encoded)
+	sum := hash.Sum64()
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	entry, exists := index.entries[key]
+	if exists && (entry.hash == sum || !replace) {
+		return entry
+	}
+	index.removeLocked(key)
+	entry = memoryKvTextEntry{hash: sum, terms: index.tokenize(document)}
+	index.entries[key] = entry
+	for term := range entry.terms {
+		if index.postings[term] == nil {
+			index.postings[term] = map[string]bool{}
+		}
+		index.postings[term][key] = true
+	}
+	return entry
+}
+
+func (index *memoryKvTextIndex) remove(key string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	index.removeLocked(key)
+}
+
+func (index *memoryKvTextIndex) removeLocked(key string) {
+	entry, exists := index.entries[key]
+	if !exists {
+		return
+	}
+	for term := range entry.terms {
+		delete(index.postings[term], key)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+	delete(index.entries, key)
+}
+
+// score returns the relevance of the document for query, or 0 if it does not match
+func (index *memoryKvTextIndex) score(key string, encoded []byte, document wst.M, query memoryKvTextQuery) float64 {
+	entry := index.update(key, encoded, document, true)
+	for _, term := range query.excluded {
+		if entry.terms[term] > 0 {
+			return 0
+		}
+	}
+	score := 0.0
+	for _, term := range query.terms {
+		score += entry.terms[term]
+	}
+	return score
+}
+
+// tokenize weighs each word of the searchable fields by the weight of the field, divided by the number of words in it
+func (index *memoryKvTextIndex) tokenize(document wst.M) map[string]float64 {
+	terms := map[string]float64{}
+	for field, weight := range index.weights {
+		value, exists := lookupMemoryKvPath(document, field)
+		if !exists {
+			continue
+		}
+		var words []string
+		for _, candidate := range memoryKvCandidates(value) {
+			if text, ok := candidate.(string); ok {
+				words = append(words, tokenizeText(text)...)
+			}
+		}
+		for _, word := range words {
+			terms[word] += float64(weight) / float64(len(words))
+		}
+	}
+	return terms
+}
+
+// extractMemoryKvTextQuery returns the $search string of the $text operator in the first $match stage
+func extractMemoryKvTextQuery(lookups *wst.A) (memoryKvTextQuery, bool) {
+	if lookups == nil || len(*lookups) == 0 {
+		return memoryKvTextQuery{}, false
+	}
+	match, ok := asMemoryKvMap((*lookups)[0]["$match"])
+	if !ok {
+		return memoryKvTextQuery{}, false
+	}
+	text, ok := asMemoryKvMap(match["$text"])
+	if !ok {
+		return memoryKvTextQuery{}, false
+	}
+	search, _ := text["$search"].(string)
+	return parseMemoryKvTextQuery(search), true
+}
+
+func parseMemoryKvTextQuery(search string) memoryKvTextQuery {
+	var query memoryKvTextQuery
+	seen := map[string]bool{}
+	for _, word := range strings.Fields(search) {
+		excluded := strings.HasPrefix(word, "-")
+		for _, term := range tokenizeText(word) {
+			if seen[term] {
+				continue
+			}
+			seen[term] = true
+			if excluded {
+				query.excluded = append(query.excluded, term)
+			} else {
+				query.terms = append(query.terms, term)
+			}
+		}
+	}
+	return query
+}
+
+// tokenizeText splits text into lowercase words
+func tokenizeText(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// memoryKvTextMatches tells whether the document was matched by the $text query evaluated in findDocuments
+func memoryKvTextMatches(document wst.M) (bool, error) {
+	score, ok := asMemoryKvFloat(document[memoryKvTextScoreKey])
+	if !ok {
+		return false, fmt.Errorf("$text is only supported in the first $match stage of a collection with a text index")
+	}
+	return score > 0, nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	wst "github.com/fredyk/westack-go/v2/common"
@@ -29,6 +30,17 @@ type MongoDBConnector struct {
 	options *MongoDBDatasourceOptions
 	dsViper *viper.Viper
 	context context.Context
+	// transactions is shared by the copies of the connector bound to a context or a transaction
+	transactions *mongoTransactionsProbe
+}
+
+// mongoTransactionsProbe caches whether the server accepts transactions. Failed probes are not cached, so they are
+// retried, but only the first failure is logged.
+type mongoTransactionsProbe struct {
+	lock      sync.Mutex
+	probed    bool
+	supported bool
+	warned    bool
 }
 
 // MongoDBConnector implements the PersistedConnector interface
@@ -118,7 +130,7 @@ func (connector *MongoDBConnector) FindMany(collectionName string, lookups *wst.
 	return cursor, nil
 }
 
-func (connector *MongoDBConnector) findByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+func (connector *MongoDBConnector) FindByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
 	wrappedLookups := &wst.A{
 		{
 			"$match": wst.M{
@@ -138,7 +150,7 @@ func (connector *MongoDBConnector) findByObjectId(collectionName string, _id int
 		if err != nil {
 			panic(err)
 		}
-	}(cursor, connector.context)
+	}(cursor, context.WithoutCancel(connector.context))
 	var results []wst.M
 	err = cursor.All(connector.context, &results)
 	if err != nil {
@@ -177,12 +189,13 @@ func (connector *MongoDBConnector) Count(collectionName string, lookups *wst.A)
 		fmt.Printf("error %v\n", err)
 		return wst.CountResult{}, err
 	}
+	// The cursor is closed even if ctx was cancelled while reading it
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
 		err := cursor.Close(ctx)
 		if err != nil {
 			panic(err)
 		}
-	}(cursor, ctx)
+	}(cursor, context.WithoutCancel(ctx))
 	var documents []struct {
 		Count int64 `bson:"_n"`
 	}
@@ -206,9 +219,9 @@ func (connector *MongoDBConnector) Create(collectionName string, data *wst.M) (*
 	}
 	insertOneResult, err := collection.InsertOne(connector.context, data)
 	if err != nil {
-		return nil, err
+		return nil, wrapMongoDuplicateKeyError(err)
 	}
-	return connector.findByObjectId(collectionName, insertOneResult.InsertedID, nil)
+	return connector.FindByObjectId(collectionName, insertOneResult.InsertedID, nil)
 }
 
 func (connector *MongoDBConnector) UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
@@ -218,23 +231,58 @@ func (connector *MongoDBConnector) UpdateById(collectionName string, id interfac
 	collection := database.Collection(collectionName)
 	delete(*data, "id")
 	delete(*data, "_id")
-	m, err := updateOneWithRetries(collection, connector, id, data, 2)
-	if err != nil {
-		return m, err
+	filter := wst.M{"_id": id}
+	update := wst.M{}
+	expectedVersion, versioned := extractExpectedVersion(data)
+	if versioned {
+		// The version check and the increment happen in the same operation, so concurrent updates cannot overwrite each other
+		filter[VersionProperty] = expectedVersion
+		update["$inc"] = wst.M{VersionProperty: 1}
 	}
-	return connector.findByObjectId(collectionName, id, nil)
+	if len(*data) > 0 {
+		update["$set"] = *data
+	}
+	if len(update) > 0 {
+		updateResult, err := updateOneWithRetries(collection, connector, filter, update, 2)
+		if err != nil {
+			return nil, wrapMongoDuplicateKeyError(err)
+		}
+		if versioned && updateResult.MatchedCount == 0 {
+			return nil, ErrVersionMismatch
+		}
+	}
+	return connector.FindByObjectId(collectionName, id, nil)
 }
 
-func updateOneWithRetries(collection *mongo.Collection, connector *MongoDBConnector, id interface{}, data *wst.M, remainingRetries int) (*wst.M, error) {
-	if _, err := collection.UpdateOne(connector.context, wst.M{"_id": id}, wst.M{"$set": *data}); err != nil {
+func updateOneWithRetries(collection *mongo.Collection, connector *MongoDBConnector, filter wst.M, update wst.M, remainingRetries int) (*mongo.UpdateResult, error) {
+	updateResult, err := collection.UpdateOne(connector.context, filter, update)
+	if err != nil {
 		// broken pipe
 		if remainingRetries > 0 && strings.Contains(err.Error(), "broken pipe") {
-			fmt.Printf("[WARNING] Retrying updateOne for %v\n", id)
-			return updateOneWithRetries(collection, connector, id, data, remainingRetries-1)
+			fmt.Printf("[WARNING] Retrying updateOne for %v\n", filter["_id"])
+			return updateOneWithRetries(collection, connector, filter, update, remainingRetries-1)
 		}
 		return nil, err
 	}
-	return nil, nil
+	return updateResult, nil
+}
+
+func (connector *MongoDBConnector) UpdateMany(collectionName string, whereLookups *wst.A, data *wst.M) (result wst.UpdateManyResult, err error) {
+	db := connector.db
+	database := db.Database(connector.dsViper.GetString("database"))
+	collection := database.Collection(collectionName)
+
+	delete(*data, "id")
+	delete(*data, "_id")
+	var mongoFilter bson.D
+	for key, value := range (*whereLookups)[0]["$match"].(wst.M) {
+		mongoFilter = append(mongoFilter, bson.E{Key: key, Value: value})
+	}
+	mongoResult, err := collection.UpdateMany(connector.context, mongoFilter, wst.M{"$set": *data})
+	if err != nil {
+		return result, wrapMongoDuplicateKeyError(err)
+	}
+	return wst.UpdateManyResult{MatchedCount: mongoResult.MatchedCount, ModifiedCount: mongoResult.ModifiedCount}, nil
 }
 
 func (connector *MongoDBConnector) DeleteById(collectionName string, id interface{}) (result wst.DeleteResult, err error) {
@@ -298,6 +346,76 @@ func (connector *MongoDBConnector) GetClient() interface{} {
 	return connector.db
 }
 
+// SupportsTransactions checks the server topology once, because transactions are only available in replica sets and
+// sharded clusters
+func (connector *MongoDBConnector) SupportsTransactions(parentCtx context.Context) bool {
+	probe := connector.transactions
+	probe.lock.Lock()
+	defer probe.lock.Unlock()
+	if probe.probed {
+		return probe.supported
+	}
+	var hello bson.M
+	err := connector.db.Database("admin").RunCommand(parentCtx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		if !probe.warned {
+			probe.warned = true
+			fmt.Printf("[WARNING] Could not check transactions support: %v\n", err)
+		}
+		return false
+	}
+	probe.probed = true
+	if setName, ok := hello["setName"].(string); ok && setName != "" {
+		probe.supported = true
+	} else {
+		msg, _ := hello["msg"].(string)
+		probe.supported = msg == "isdbgrid"
+	}
+	return probe.supported
+}
+
+func (connector *MongoDBConnector) StartTransaction(parentCtx context.Context) (ConnectorTransaction, error) {
+	session, err := connector.db.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	err = session.StartTransaction()
+	if err != nil {
+		session.EndSession(parentCtx)
+		return nil, err
+	}
+	return &mongoDBTransaction{
+		connector: &MongoDBConnector{
+			db:      connector.db,
+			options: connector.options,
+			dsViper: connector.dsViper,
+			// The operations receive the session through their context
+			context:      mongo.NewSessionContext(parentCtx, session),
+			transactions: connector.transactions,
+		},
+		session: session,
+	}, nil
+}
+
+type mongoDBTransaction struct {
+	connector *MongoDBConnector
+	session   mongo.Session
+}
+
+func (tx *mongoDBTransaction) Connector() PersistedConnector {
+	return tx.connector
+}
+
+func (tx *mongoDBTransaction) Commit(ctx context.Context) error {
+	defer tx.session.EndSession(ctx)
+	return tx.session.CommitTransaction(ctx)
+}
+
+func (tx *mongoDBTransaction) Abort(ctx context.Context) error {
+	defer tx.session.EndSession(ctx)
+	return tx.session.AbortTransaction(ctx)
+}
+
 func getDbUrl(dsViper *viper.Viper) string {
 	url := ""
 	if dsViper.GetString("url") != "" {
@@ -317,6 +435,184 @@ func getDbUrl(dsViper *viper.Viper) string {
 func NewMongoDBConnector(mongoOptions *MongoDBDatasourceOptions) PersistedConnector {
 
 	return &MongoDBConnector{
-		options: mongoOptions,
+		options:      mongoOptions,
+		transactions: &mongoTransactionsProbe{},
+	}
+}
+
+func (connector *MongoDBConnector) WatchCollection(ctx context.Context, collectionName string) (<-chan CollectionChange, error) {
+	collection := connector.db.Database(connector.dsViper.GetString("database")).Collection(collectionName)
+	stream, err := collection.Watch(ctx, mongo.Pipeline{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		return nil, err
 	}
+	changes := make(chan CollectionChange, 64)
+	go func() {
+		defer close(changes)
+		defer stream.Close(context.Background())
+		for stream.Next(ctx) {
+			var rawChange struct {
+				OperationType string `bson:"operationType"`
+				DocumentKey   struct {
+					Id interface{} `bson:"_id"`
+				} `bson:"documentKey"`
+				FullDocument wst.M `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&rawChange); err != nil {
+				log.Printf("[ERROR] Could not decode change of %v: %v\n", collectionName, err)
+				continue
+			}
+			changes <- CollectionChange{
+				OperationType: rawChange.OperationType,
+				DocumentId:    rawChange.DocumentKey.Id,
+				FullDocument:  rawChange.FullDocument,
+			}
+		}
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR] Change stream of %v stopped: %v\n", collectionName, err)
+		}
+	}()
+	return changes, nil
+}
+
+// FindManyWithCount runs the stages shared by both pipelines once, then a $facet with the page and the count. The page
+// is returned inside a single document, so it must fit in the 16MB document size limit.
+func (connector *MongoDBConnector) FindManyWithCount(collectionName string, pageLookups *wst.A, countLookups *wst.A) (MongoCursorI, int64, error) {
+	collection := connector.db.Database(connector.dsViper.GetString("database")).Collection(collectionName)
+
+	pipeline, pageStages, countStages := splitCommonStages(pageLookups, countLookups)
+	if len(pageStages) == 0 {
+		// $facet does not accept empty pipelines
+		pageStages = wst.A{{"$match": wst.M{}}}
+	}
+	pipeline = append(pipeline, wst.M{
+		"$facet": wst.M{
+			"data":  pageStages,
+			"total": append(countStages, wst.M{"$count": "count"}),
+		},
+	})
+	ctx := connector.context
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var facets []struct {
+		Data  []bson.Raw `bson:"data"`
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+	}
+	err = cursor.All(ctx, &facets)
+	if err != nil {
+		return nil, 0, err
+	}
+	var rawDocuments [][]byte
+	var total int64
+	if len(facets) > 0 {
+		for _, document := range facets[0].Data {
+			rawDocuments = append(rawDocuments, document)
+		}
+		if len(facets[0].Total) > 0 {
+			total = facets[0].Total[0].Count
+		}
+	}
+	registry := bson.DefaultRegistry
+	if connector.options != nil && connector.options.Registry != nil {
+		registry = connector.options.Registry
+	}
+	return NewFixedMongoCursor(registry, rawDocuments), total, nil
+}
+
+// withContext returns a copy of the connector whose operations run under ctx. The session of a transaction is kept.
+func (connector *MongoDBConnector) withContext(ctx context.Context) *MongoDBConnector {
+	if session := mongo.SessionFromContext(connector.context); session != nil {
+		ctx = mongo.NewSessionContext(ctx, session)
+	}
+	return &MongoDBConnector{
+		db:           connector.db,
+		options:      connector.options,
+		dsViper:      connector.dsViper,
+		context:      ctx,
+		transactions: connector.transactions,
+	}
+}
+
+func (connector *MongoDBConnector) FindManyContext(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	return connector.withContext(ctx).FindMany(collectionName, lookups)
+}
+
+func (connector *MongoDBConnector) FindByObjectIdContext(ctx context.Context, collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+	return connector.withContext(ctx).FindByObjectId(collectionName, _id, lookups)
+}
+
+func (connector *MongoDBConnector) CountContext(ctx context.Context, collectionName string, lookups *wst.A) (wst.CountResult, error) {
+	return connector.withContext(ctx).Count(collectionName, lookups)
+}
+
+func (connector *MongoDBConnector) CreateContext(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
+	return connector.withContext(ctx).Create(collectionName, data)
+}
+
+func (connector *MongoDBConnector) UpdateByIdContext(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+	return connector.withContext(ctx).UpdateById(collectionName, id, data)
+}
+
+func (connector *MongoDBConnector) UpdateManyContext(ctx context.Context, collectionName string, whereLookups *wst.A, data *wst.M) (wst.UpdateManyResult, error) {
+	return connector.withContext(ctx).UpdateMany(collectionName, whereLookups, data)
+}
+
+func (connector *MongoDBConnector) DeleteByIdContext(ctx context.Context, collectionName string, id interface{}) (wst.DeleteResult, error) {
+	return connector.withContext(ctx).DeleteById(collectionName, id)
+}
+
+func (connector *MongoDBConnector) DeleteManyContext(ctx context.Context, collectionName string, whereLookups *wst.A) (wst.DeleteResult, error) {
+	return connector.withContext(ctx).DeleteMany(collectionName, whereLookups)
+}
+
+func (connector *MongoDBConnector) FindManyWithCountContext(ctx context.Context, collectionName string, pageLookups *wst.A, countLookups *wst.A) (MongoCursorI, int64, error) {
+	return connector.withContext(ctx).FindManyWithCount(collectionName, pageLookups, countLookups)
+}
+
+func (connector *MongoDBConnector) Explain(ctx context.Context, collectionName string, lookups *wst.A, verbosity string) (wst.M, error) {
+	pipeline := wst.A{}
+	if lookups != nil {
+		pipeline = append(pipeline, *lookups...)
+	}
+	if verbosity == "" {
+		verbosity = "queryPlanner"
+	}
+	command := bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "aggregate", Value: collectionName},
+			{Key: "pipeline", Value: pipeline},
+			{Key: "allowDiskUse", Value: true},
+			{Key: "cursor", Value: bson.D{}},
+		}},
+		{Key: "verbosity", Value: verbosity},
+	}
+	var result wst.M
+	err := connector.db.Database(connector.dsViper.GetString("database")).RunCommand(ctx, command).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (connector *MongoDBConnector) Aggregate(ctx context.Context, collectionName string, pipeline *wst.A, aggregateOptions AggregateOptions) (MongoCursorI, error) {
+	collection := connector.db.Database(connector.dsViper.GetString("database")).Collection(collectionName)
+	stages := wst.A{}
+	if pipeline != nil {
+		stages = append(stages, *pipeline...)
+	}
+	mongoOptions := options.Aggregate().SetAllowDiskUse(aggregateOptions.AllowDiskUse).SetBatchSize(16)
+	if aggregateOptions.MaxTime > 0 {
+		mongoOptions = mongoOptions.SetMaxTime(aggregateOptions.MaxTime)
+	}
+	cursor, err := collection.Aggregate(connector.withContext(ctx).context, stages, mongoOptions)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
 }
@@ -0,0 +1,107 @@
+package datasource
+
+import (
+	"context"
+	"regexp"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var mongoDuplicateKeyIndexRegex = regexp.MustCompile(`index: (\S+) dup key`)
+
+// mongoIndexSpec is the document returned by listIndexes
+type mongoIndexSpec struct {
+	Name                    string `bson:"name"`
+	Key                     bson.D `bson:"key"`
+	Unique                  bool   `bson:"unique"`
+	Sparse                  bool   `bson:"sparse"`
+	ExpireAfterSeconds      *int32 `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.M `bson:"partialFilterExpression"`
+	Weights                 bson.D `bson:"weights"`
+}
+
+func (connector *MongoDBConnector) ListIndexes(ctx context.Context, collectionName string) ([]Index, error) {
+	collection := connector.db.Database(connector.dsViper.GetString("database")).Collection(collectionName)
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var specs []mongoIndexSpec
+	err = cursor.All(ctx, &specs)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]Index, 0, len(specs))
+	for _, spec := range specs {
+		index := Index{
+			Name:               spec.Name,
+			Unique:             spec.Unique,
+			Sparse:             spec.Sparse,
+			ExpireAfterSeconds: spec.ExpireAfterSeconds,
+		}
+		if len(spec.PartialFilterExpression) > 0 {
+			index.PartialFilter = wst.M(spec.PartialFilterExpression)
+		}
+		for _, key := range spec.Key {
+			// Text indexes are stored with the _fts and _ftsx keys, and the indexed fields as weights
+			if key.Key == "_fts" {
+				index.Weights = make(map[string]int32, len(spec.Weights))
+				for _, weight := range spec.Weights {
+					index.Keys = append(index.Keys, bson.E{Key: weight.Key, Value: "text"})
+					if value, ok := asMemoryKvFloat(weight.Value); ok {
+						index.Weights[weight.Key] = int32(value)
+					}
+				}
+				continue
+			} else if key.Key == "_ftsx" {
+				continue
+			}
+			index.Keys = append(index.Keys, key)
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+func (connector *MongoDBConnector) CreateIndex(ctx context.Context, collectionName string, index Index) error {
+	collection := connector.db.Database(connector.dsViper.GetString("database")).Collection(collectionName)
+	indexOptions := options.Index().SetName(index.IndexName())
+	if index.Unique {
+		indexOptions.SetUnique(true)
+	}
+	if index.Sparse {
+		indexOptions.SetSparse(true)
+	}
+	if index.ExpireAfterSeconds != nil {
+		indexOptions.SetExpireAfterSeconds(*index.ExpireAfterSeconds)
+	}
+	if len(index.PartialFilter) > 0 {
+		indexOptions.SetPartialFilterExpression(index.PartialFilter)
+	}
+	if len(index.Weights) > 0 {
+		indexOptions.SetWeights(index.Weights)
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: index.Keys, Options: indexOptions})
+	return err
+}
+
+func (connector *MongoDBConnector) DropIndex(ctx context.Context, collectionName string, indexName string) error {
+	collection := connector.db.Database(connector.dsViper.GetString("database")).Collection(collectionName)
+	_, err := collection.Indexes().DropOne(ctx, indexName)
+	return err
+}
+
+// wrapMongoDuplicateKeyError converts the duplicate key errors into a DuplicateKeyError naming the violated index
+func wrapMongoDuplicateKeyError(err error) error {
+	if err == nil || !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	indexName := ""
+	if match := mongoDuplicateKeyIndexRegex.FindStringSubmatch(err.Error()); match != nil {
+		indexName = match[1]
+	}
+	return &DuplicateKeyError{Index: indexName, Err: err}
+}
@@ -0,0 +1,59 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fredyk/westack-go/v2/memorykv"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+)
+
+const defaultRedisPort = 6379
+
+// RedisConnector implements the PersistedConnector interface over Redis, or over a memorykv Server
+//
+// It stores the collections like MemoryKVConnector, so a redis datasource can be the Cache.Datasource of the models:
+// each key of a cache holds the entries of the `_redId`/`_entries` envelope, and the keys are stored as
+// "<collection>:<key>". The server is reached with the "url" setting, like "redis://:password@host:6379/0", or with the
+// "host", "port", "password" and "database" settings.
+type RedisConnector struct {
+	*MemoryKVConnector
+}
+
+func (connector *RedisConnector) GetName() string {
+	return "redis"
+}
+
+func (connector *RedisConnector) Connect(parentContext context.Context) error {
+	if connector.dsConfig.GetString("url") != "" {
+		return connector.connectRemote()
+	}
+	host := connector.dsConfig.GetString("host")
+	if host == "" {
+		host = "localhost"
+	}
+	port := connector.dsConfig.GetInt("port")
+	if port <= 0 {
+		port = defaultRedisPort
+	}
+	return connector.connectRemoteWith(memorykv.RemoteOptions{
+		Address:  fmt.Sprintf("%v:%v", host, port),
+		Password: connector.dsConfig.GetString("password"),
+		Database: connector.dsConfig.GetInt("database"),
+	})
+}
+
+// Disconnect closes the connections. The entries are kept, as they are shared with the other replicas.
+func (connector *RedisConnector) Disconnect() error {
+	if connector.db == nil {
+		return nil
+	}
+	return connector.db.Close()
+}
+
+// NewRedisConnector Factory method for RedisConnector
+func NewRedisConnector(registry *bsoncodec.Registry, dsKey string) PersistedConnector {
+	return &RedisConnector{
+		MemoryKVConnector: NewMemoryKVConnector(registry, dsKey).(*MemoryKVConnector),
+	}
+}
@@ -0,0 +1,34 @@
+package datasource
+
+import (
+	"fmt"
+)
+
+// TextIndexConnector is implemented by the connectors that evaluate the $text queries by themselves, instead of
+// through a text index created with IndexConnector
+type TextIndexConnector interface {
+	// SetTextIndex declares the searchable fields of the collection and their weights
+	SetTextIndex(collectionName string, weights map[string]int32)
+}
+
+// SupportsSearch tells whether the connector can run $text queries, either through the text indexes of IndexConnector
+// or by itself as a TextIndexConnector
+func (ds *Datasource) SupportsSearch() bool {
+	switch ds.connectorInstance.(type) {
+	case TextIndexConnector, IndexConnector:
+		return true
+	}
+	return false
+}
+
+// SetTextIndex declares the searchable fields of the collection in the connectors implementing TextIndexConnector.
+// The other connectors need a text index, which is declared and created like the rest of the indexes.
+func (ds *Datasource) SetTextIndex(collectionName string, weights map[string]int32) error {
+	if !ds.SupportsSearch() {
+		return fmt.Errorf("datasource %v does not support search", ds.Name)
+	}
+	if textIndexConnector, ok := ds.connectorInstance.(TextIndexConnector); ok {
+		textIndexConnector.SetTextIndex(collectionName, weights)
+	}
+	return nil
+}
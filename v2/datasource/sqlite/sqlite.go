@@ -0,0 +1,41 @@
+// Package sqlite registers the "sqlite" connector, backed by the mattn/go-sqlite3 driver, which requires cgo. Import it
+// for its side effects to use sqlite datasources:
+//
+//	import _ "github.com/fredyk/westack-go/v2/datasource/sqlite"
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+// DriverName is the database/sql driver registered by this package, which adds the regexp() function used by $regex
+const DriverName = "sqlite3_westack"
+
+// Driver describes the registered driver to datasource.NewSQLiteConnector
+var Driver = datasource.SQLiteDriver{
+	Name:                  DriverName,
+	IsPrimaryKeyViolation: isPrimaryKeyViolation,
+}
+
+func init() {
+	sql.Register(DriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", datasource.SQLiteRegexp, true)
+		},
+	})
+	datasource.RegisterConnector("sqlite", func(dsKey string, dsViper *viper.Viper, options *datasource.Options) (datasource.PersistedConnector, error) {
+		return datasource.NewSQLiteConnector(wst.CreateDefaultMongoRegistry(), Driver), nil
+	})
+}
+
+func isPrimaryKeyViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
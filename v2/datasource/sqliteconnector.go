@@ -0,0 +1,551 @@
+package datasource
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SQLiteDriver is the database/sql driver used by SQLiteConnector. The datasource package does not depend on any
+// driver, so cgo is not required unless the connector is used: the datasource/sqlite package registers the "sqlite"
+// connector with the mattn/go-sqlite3 driver.
+type SQLiteDriver struct {
+	// Name is the name the driver was registered with in database/sql. Its connections must provide the
+	// regexp(pattern, value) function used by $regex, see SQLiteRegexp.
+	Name string
+	// IsPrimaryKeyViolation tells whether err was caused by inserting an existing _id
+	IsPrimaryKeyViolation func(err error) bool
+}
+
+// sqliteRegexCacheSize bounds the patterns compiled by SQLiteRegexp that are kept, as they come from the queries
+const sqliteRegexCacheSize = 256
+
+var sqliteRegexCache = &sqliteRegexLru{
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+}
+
+// sqliteRegexLru keeps the last sqliteRegexCacheSize patterns used
+type sqliteRegexLru struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type sqliteRegexEntry struct {
+	pattern  string
+	compiled *regexp.Regexp
+}
+
+func (cache *sqliteRegexLru) get(pattern string) (*regexp.Regexp, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[pattern]
+	if !ok {
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*sqliteRegexEntry).compiled, true
+}
+
+func (cache *sqliteRegexLru) add(pattern string, compiled *regexp.Regexp) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if _, ok := cache.entries[pattern]; ok {
+		return
+	}
+	cache.entries[pattern] = cache.order.PushFront(&sqliteRegexEntry{pattern: pattern, compiled: compiled})
+	if cache.order.Len() > sqliteRegexCacheSize {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*sqliteRegexEntry).pattern)
+	}
+}
+
+// SQLiteConnector implements the PersistedConnector interface
+//
+// Each collection is stored in its own table, created on first use, with the document id in the _id column and the
+// document in the data column as JSON. Values without a JSON counterpart, like ObjectIDs or dates, are stored as hex
+// strings and Unix milliseconds respectively, and their original types are kept in the types column, so the documents are
+// read back with the same types they were written with.
+//
+// The leading $match, $sort, $skip, $limit and $project stages of the lookups run in SQLite. The rest of the stages,
+// including the $lookup and $unwind stages of the relations, are evaluated afterwards in memory, querying the related
+// tables once per distinct key. Dotted paths are resolved through nested documents, but not through arrays of documents.
+//
+// The datasource "file" setting is the path of the database file, ":memory:" by default.
+type SQLiteConnector struct {
+	db       *sql.DB
+	dsConfig *viper.Viper
+	registry *bsoncodec.Registry
+	driver   SQLiteDriver
+	timeout  time.Duration
+
+	// tables holds the tables already created
+	tables sync.Map
+}
+
+// sqliteQuerier is implemented by both *sql.DB and *sql.Tx
+type sqliteQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (connector *SQLiteConnector) GetName() string {
+	return "sqlite"
+}
+
+func (connector *SQLiteConnector) SetConfig(dsViper *viper.Viper) {
+	connector.dsConfig = dsViper
+}
+
+func (connector *SQLiteConnector) Connect(parentContext context.Context) error {
+	if connector.db != nil {
+		// Reconnecting an in-memory database would lose its contents
+		return nil
+	}
+	file := ":memory:"
+	if connector.dsConfig != nil && connector.dsConfig.GetString("file") != "" {
+		file = connector.dsConfig.GetString("file")
+	}
+	inMemory := file == ":memory:" || strings.Contains(file, "mode=memory")
+	dsn := file
+	if !inMemory {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + "_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+	}
+	db, err := sql.Open(connector.driver.Name, dsn)
+	if err != nil {
+		return err
+	}
+	if inMemory {
+		// Every connection to ":memory:" opens a different database
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxIdleTime(0)
+		db.SetConnMaxLifetime(0)
+	}
+	connector.db = db
+	return nil
+}
+
+func (connector *SQLiteConnector) FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	return connector.FindManyContext(context.Background(), collectionName, lookups)
+}
+
+func (connector *SQLiteConnector) FindManyContext(parentCtx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	documents, err := connector.findDocuments(ctx, connector.db, collectionName, lookups)
+	if err != nil {
+		return nil, err
+	}
+	rawDocuments := make([][]byte, len(documents))
+	for idx, document := range documents {
+		bytes, err := bson.MarshalWithRegistry(connector.registry, document)
+		if err != nil {
+			return nil, err
+		}
+		rawDocuments[idx] = bytes
+	}
+	return NewFixedMongoCursor(connector.registry, rawDocuments), nil
+}
+
+func (connector *SQLiteConnector) FindByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+	return connector.FindByObjectIdContext(context.Background(), collectionName, _id, lookups)
+}
+
+func (connector *SQLiteConnector) FindByObjectIdContext(parentCtx context.Context, collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+	wrappedLookups := &wst.A{
+		{
+			"$match": wst.M{
+				"_id": _id,
+			},
+		},
+	}
+	if lookups != nil {
+		*wrappedLookups = append(*wrappedLookups, *lookups...)
+	}
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	documents, err := connector.findDocuments(ctx, connector.db, collectionName, wrappedLookups)
+	if err != nil {
+		return nil, err
+	}
+	if len(documents) == 0 {
+		return nil, errors.New("document not found")
+	}
+	// The document is decoded again from BSON, so it holds the same types as the documents read through FindMany
+	bytes, err := bson.MarshalWithRegistry(connector.registry, documents[0])
+	if err != nil {
+		return nil, err
+	}
+	var document wst.M
+	err = bson.UnmarshalWithRegistry(connector.registry, bytes, &document)
+	if err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+func (connector *SQLiteConnector) Count(collectionName string, lookups *wst.A) (wst.CountResult, error) {
+	return connector.CountContext(context.Background(), collectionName, lookups)
+}
+
+func (connector *SQLiteConnector) CountContext(parentCtx context.Context, collectionName string, lookups *wst.A) (wst.CountResult, error) {
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	err := connector.ensureTable(ctx, connector.db, collectionName)
+	if err != nil {
+		return wst.CountResult{}, err
+	}
+	query, err := buildSqliteQuery(lookups)
+	if err != nil {
+		return wst.CountResult{}, err
+	}
+	if len(query.remaining) > 0 {
+		documents, err := connector.findDocuments(ctx, connector.db, collectionName, lookups)
+		if err != nil {
+			return wst.CountResult{}, err
+		}
+		return wst.CountResult{Count: int64(len(documents))}, nil
+	}
+	statement, args := query.selectStatement(collectionName)
+	var count int64
+	err = connector.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+statement+")", args...).Scan(&count)
+	if err != nil {
+		return wst.CountResult{}, err
+	}
+	return wst.CountResult{Count: count}, nil
+}
+
+func (connector *SQLiteConnector) Create(collectionName string, data *wst.M) (*wst.M, error) {
+	return connector.CreateContext(context.Background(), collectionName, data)
+}
+
+func (connector *SQLiteConnector) CreateContext(parentCtx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
+	if (*data)["_id"] == nil {
+		if (*data)["id"] != nil {
+			(*data)["_id"] = (*data)["id"]
+		} else {
+			(*data)["_id"] = primitive.NewObjectID()
+		}
+	}
+	id := (*data)["_id"]
+
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	err := connector.ensureTable(ctx, connector.db, collectionName)
+	if err != nil {
+		return nil, err
+	}
+	encoded, types, err := encodeSqliteDocument(*data)
+	if err != nil {
+		return nil, err
+	}
+	_, err = connector.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %v (_id, data, types) VALUES (?, ?, ?)", quoteSqliteIdentifier(collectionName)), memoryKvIdAsString(id), encoded, types)
+	if err != nil {
+		if connector.driver.IsPrimaryKeyViolation != nil && connector.driver.IsPrimaryKeyViolation(err) {
+			return nil, &DuplicateKeyError{Index: defaultIndexName, Err: fmt.Errorf("duplicate key error: %v already exists in %v", memoryKvIdAsString(id), collectionName)}
+		}
+		return nil, err
+	}
+	return connector.FindByObjectIdContext(parentCtx, collectionName, id, nil)
+}
+
+func (connector *SQLiteConnector) UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+	return connector.UpdateByIdContext(context.Background(), collectionName, id, data)
+}
+
+func (connector *SQLiteConnector) UpdateByIdContext(parentCtx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+	delete(*data, "id")
+	delete(*data, "_id")
+
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	err := connector.ensureTable(ctx, connector.db, collectionName)
+	if err != nil {
+		return nil, err
+	}
+	err = connector.inTransaction(ctx, func(tx *sql.Tx) error {
+		documents, err := connector.findDocuments(ctx, tx, collectionName, &wst.A{{"$match": wst.M{"_id": id}}})
+		if err != nil {
+			return err
+		}
+		if len(documents) == 0 {
+			return errors.New("document not found")
+		}
+		document := documents[0]
+		if expectedVersion, versioned := extractExpectedVersion(data); versioned {
+			matches, err := memoryKvMatches(document, wst.M{VersionProperty: expectedVersion})
+			if err != nil {
+				return err
+			}
+			if !matches {
+				return ErrVersionMismatch
+			}
+			document[VersionProperty] = VersionOf(document) + 1
+		}
+		for key, value := range *data {
+			document[key] = value
+		}
+		return connector.writeDocument(ctx, tx, collectionName, document)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return connector.FindByObjectIdContext(parentCtx, collectionName, id, nil)
+}
+
+func (connector *SQLiteConnector) UpdateMany(collectionName string, whereLookups *wst.A, data *wst.M) (wst.UpdateManyResult, error) {
+	return connector.UpdateManyContext(context.Background(), collectionName, whereLookups, data)
+}
+
+func (connector *SQLiteConnector) UpdateManyContext(parentCtx context.Context, collectionName string, whereLookups *wst.A, data *wst.M) (wst.UpdateManyResult, error) {
+	delete(*data, "id")
+	delete(*data, "_id")
+
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	err := connector.ensureTable(ctx, connector.db, collectionName)
+	if err != nil {
+		return wst.UpdateManyResult{}, err
+	}
+	var result wst.UpdateManyResult
+	err = connector.inTransaction(ctx, func(tx *sql.Tx) error {
+		documents, err := connector.findDocuments(ctx, tx, collectionName, whereLookups)
+		if err != nil {
+			return err
+		}
+		result.MatchedCount = int64(len(documents))
+		for _, document := range documents {
+			for key, value := range *data {
+				document[key] = value
+			}
+			err = connector.writeDocument(ctx, tx, collectionName, document)
+			if err != nil {
+				return err
+			}
+			result.ModifiedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return wst.UpdateManyResult{}, err
+	}
+	return result, nil
+}
+
+func (connector *SQLiteConnector) DeleteById(collectionName string, id interface{}) (wst.DeleteResult, error) {
+	return connector.DeleteByIdContext(context.Background(), collectionName, id)
+}
+
+func (connector *SQLiteConnector) DeleteByIdContext(parentCtx context.Context, collectionName string, id interface{}) (wst.DeleteResult, error) {
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	err := connector.ensureTable(ctx, connector.db, collectionName)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	result, err := connector.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE _id = ?", quoteSqliteIdentifier(collectionName)), memoryKvIdAsString(id))
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	deletedCount, err := result.RowsAffected()
+	return wst.DeleteResult{DeletedCount: deletedCount}, err
+}
+
+func (connector *SQLiteConnector) DeleteMany(collectionName string, whereLookups *wst.A) (wst.DeleteResult, error) {
+	return connector.DeleteManyContext(context.Background(), collectionName, whereLookups)
+}
+
+func (connector *SQLiteConnector) DeleteManyContext(parentCtx context.Context, collectionName string, whereLookups *wst.A) (wst.DeleteResult, error) {
+	ctx, cancelFn := connector.operationContext(parentCtx)
+	defer cancelFn()
+	err := connector.ensureTable(ctx, connector.db, collectionName)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	query, err := buildSqliteQuery(whereLookups)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	table := quoteSqliteIdentifier(collectionName)
+	if len(query.remaining) == 0 {
+		statement, args := query.selectStatement(collectionName)
+		result, err := connector.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE _id IN (SELECT _id FROM (%v))", table, statement), args...)
+		if err != nil {
+			return wst.DeleteResult{}, err
+		}
+		deletedCount, err := result.RowsAffected()
+		return wst.DeleteResult{DeletedCount: deletedCount}, err
+	}
+	var deletedCount int64
+	err = connector.inTransaction(ctx, func(tx *sql.Tx) error {
+		documents, err := connector.findDocuments(ctx, tx, collectionName, whereLookups)
+		if err != nil {
+			return err
+		}
+		for _, document := range documents {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE _id = ?", table), memoryKvIdAsString(document["_id"]))
+			if err != nil {
+				return err
+			}
+			deletedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	return wst.DeleteResult{DeletedCount: deletedCount}, nil
+}
+
+// findDocuments runs the SQL part of the lookups and evaluates the rest of the stages over the documents read
+func (connector *SQLiteConnector) findDocuments(ctx context.Context, querier sqliteQuerier, collectionName string, lookups *wst.A) ([]wst.M, error) {
+	err := connector.ensureTable(ctx, querier, collectionName)
+	if err != nil {
+		return nil, err
+	}
+	query, err := buildSqliteQuery(lookups)
+	if err != nil {
+		return nil, err
+	}
+	statement, args := query.selectStatement(collectionName)
+	rows, err := querier.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	var documents []wst.M
+	for rows.Next() {
+		var id, data string
+		var types sql.NullString
+		err = rows.Scan(&id, &data, &types)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		document, err := decodeSqliteDocument(data, types.String)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	// The rows are released before evaluating the lookups, which query the database again
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return connector.evaluatePipeline(ctx, querier, documents, query.remaining)
+}
+
+func (connector *SQLiteConnector) writeDocument(ctx context.Context, querier sqliteQuerier, collectionName string, document wst.M) error {
+	encoded, types, err := encodeSqliteDocument(document)
+	if err != nil {
+		return err
+	}
+	_, err = querier.ExecContext(ctx, fmt.Sprintf("UPDATE %v SET data = ?, types = ? WHERE _id = ?", quoteSqliteIdentifier(collectionName)), encoded, types, memoryKvIdAsString(document["_id"]))
+	return err
+}
+
+func (connector *SQLiteConnector) ensureTable(ctx context.Context, querier sqliteQuerier, collectionName string) error {
+	if connector.db == nil {
+		return errors.New("client is disconnected")
+	}
+	if _, exists := connector.tables.Load(collectionName); exists {
+		return nil
+	}
+	_, err := querier.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (_id TEXT PRIMARY KEY, data TEXT NOT NULL, types TEXT)", quoteSqliteIdentifier(collectionName)))
+	if err != nil {
+		return err
+	}
+	connector.tables.Store(collectionName, true)
+	return nil
+}
+
+func (connector *SQLiteConnector) inTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := connector.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// operationContext bounds parentCtx with the timeout of the datasource
+func (connector *SQLiteConnector) operationContext(parentCtx context.Context) (context.Context, context.CancelFunc) {
+	if connector.timeout > 0 {
+		return context.WithTimeout(parentCtx, connector.timeout)
+	}
+	return context.WithCancel(parentCtx)
+}
+
+func (connector *SQLiteConnector) Disconnect() error {
+	if connector.db == nil {
+		return nil
+	}
+	err := connector.db.Close()
+	connector.db = nil
+	connector.tables = sync.Map{}
+	return err
+}
+
+func (connector *SQLiteConnector) Ping(parentCtx context.Context) error {
+	if connector.db == nil {
+		return errors.New("client is disconnected")
+	}
+	return connector.db.PingContext(parentCtx)
+}
+
+func (connector *SQLiteConnector) SetTimeout(seconds float32) {
+	connector.timeout = time.Duration(seconds * float32(time.Second))
+}
+
+func (connector *SQLiteConnector) GetClient() interface{} {
+	return connector.db
+}
+
+func quoteSqliteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// SQLiteRegexp is the regexp() function that SQLiteDriver connections must provide
+func SQLiteRegexp(pattern string, value string) (bool, error) {
+	if cached, ok := sqliteRegexCache.get(pattern); ok {
+		return cached.MatchString(value), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	sqliteRegexCache.add(pattern, compiled)
+	return compiled.MatchString(value), nil
+}
+
+// NewSQLiteConnector Factory method for SQLiteConnector
+func NewSQLiteConnector(registry *bsoncodec.Registry, driver SQLiteDriver) PersistedConnector {
+	return &SQLiteConnector{
+		registry: registry,
+		driver:   driver,
+	}
+}
@@ -0,0 +1,846 @@
+package datasource
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqliteQuery is the SQL part of the lookups sent to SQLiteConnector. The remaining stages are evaluated in memory.
+type sqliteQuery struct {
+	conditions []string
+	args       []interface{}
+	order      []string
+	skip       int
+	limit      int
+	projection string
+	// projectionArgs are bound before the rest of the args, as the projection comes first in the statement
+	projectionArgs []interface{}
+	remaining      wst.A
+}
+
+// buildSqliteQuery moves the leading stages of the lookups into SQL while they can be applied in the same order SQL
+// applies its clauses: WHERE, ORDER BY, OFFSET, LIMIT and then the projection.
+func buildSqliteQuery(lookups *wst.A) (*sqliteQuery, error) {
+	query := &sqliteQuery{limit: -1}
+	if lookups == nil {
+		return query, nil
+	}
+	for idx, stage := range *lookups {
+		if len(stage) != 1 || !query.push(stage) {
+			query.remaining = append(query.remaining, (*lookups)[idx:]...)
+			break
+		}
+	}
+	return query, nil
+}
+
+func (query *sqliteQuery) push(stage wst.M) bool {
+	for stageName, stageValue := range stage {
+		switch stageName {
+		case "$match":
+			if len(query.order) > 0 || query.skip > 0 || query.limit >= 0 || query.projection != "" {
+				return false
+			}
+			match, ok := asMemoryKvMap(stageValue)
+			if !ok {
+				return false
+			}
+			condition, args, ok := sqliteMatchCondition(match)
+			if !ok {
+				return false
+			}
+			query.conditions = append(query.conditions, condition)
+			query.args = append(query.args, args...)
+		case "$sort":
+			if len(query.order) > 0 || query.skip > 0 || query.limit >= 0 || query.projection != "" {
+				return false
+			}
+			order, ok := sqliteOrder(stageValue)
+			if !ok {
+				return false
+			}
+			query.order = order
+		case "$skip":
+			skip, ok := asMemoryKvInt(stageValue)
+			if !ok || query.limit >= 0 || query.projection != "" {
+				return false
+			}
+			query.skip += skip
+		case "$limit":
+			limit, ok := asMemoryKvInt(stageValue)
+			if !ok || query.projection != "" {
+				return false
+			}
+			if query.limit < 0 || limit < query.limit {
+				query.limit = limit
+			}
+		case "$project":
+			projection, ok := asMemoryKvMap(stageValue)
+			if !ok || query.projection != "" {
+				return false
+			}
+			query.projection, query.projectionArgs, ok = sqliteProjection(projection)
+			return ok
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (query *sqliteQuery) selectStatement(collectionName string) (string, []interface{}) {
+	var statement strings.Builder
+	args := append([]interface{}{}, query.projectionArgs...)
+	statement.WriteString("SELECT _id, ")
+	if query.projection != "" {
+		statement.WriteString(query.projection)
+	} else {
+		statement.WriteString("data")
+	}
+	statement.WriteString(", types FROM ")
+	statement.WriteString(quoteSqliteIdentifier(collectionName))
+	if len(query.conditions) > 0 {
+		statement.WriteString(" WHERE ")
+		statement.WriteString(strings.Join(query.conditions, " AND "))
+		args = append(args, query.args...)
+	}
+	if len(query.order) > 0 {
+		statement.WriteString(" ORDER BY ")
+		statement.WriteString(strings.Join(query.order, ", "))
+		statement.WriteString(", rowid")
+	}
+	if query.limit >= 0 || query.skip > 0 {
+		statement.WriteString(fmt.Sprintf(" LIMIT %d OFFSET %d", query.limit, query.skip))
+	}
+	return statement.String(), args
+}
+
+// sqliteMatchCondition translates a $match into an SQL condition over the data column. It returns false when the match
+// uses operators or operands without SQL translation.
+func sqliteMatchCondition(match map[string]interface{}) (string, []interface{}, bool) {
+	if len(match) == 0 {
+		return "1", nil, true
+	}
+	var conditions []string
+	var args []interface{}
+	for key, expected := range match {
+		var condition string
+		var conditionArgs []interface{}
+		var ok bool
+		switch key {
+		case "$and", "$or", "$nor":
+			condition, conditionArgs, ok = sqliteLogicalCondition(key, expected)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return "", nil, false
+			}
+			condition, conditionArgs, ok = sqliteFieldCondition(key, expected)
+		}
+		if !ok {
+			return "", nil, false
+		}
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")", args, true
+}
+
+func sqliteLogicalCondition(operator string, expected interface{}) (string, []interface{}, bool) {
+	subMatches, ok := asMemoryKvSlice(expected)
+	if !ok || len(subMatches) == 0 {
+		return "", nil, false
+	}
+	var conditions []string
+	var args []interface{}
+	for _, subMatch := range subMatches {
+		asMap, ok := asMemoryKvMap(subMatch)
+		if !ok {
+			return "", nil, false
+		}
+		condition, conditionArgs, ok := sqliteMatchCondition(asMap)
+		if !ok {
+			return "", nil, false
+		}
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+	switch operator {
+	case "$and":
+		return "(" + strings.Join(conditions, " AND ") + ")", args, true
+	case "$or":
+		return "(" + strings.Join(conditions, " OR ") + ")", args, true
+	default:
+		return "NOT (" + strings.Join(conditions, " OR ") + ")", args, true
+	}
+}
+
+func sqliteFieldCondition(field string, expected interface{}) (string, []interface{}, bool) {
+	path, ok := sqliteJsonPath(field)
+	if !ok {
+		return "", nil, false
+	}
+	if operators, ok := asMemoryKvMap(expected); ok && isMemoryKvOperatorMap(operators) {
+		var conditions []string
+		var args []interface{}
+		for operator, operand := range operators {
+			condition, conditionArgs, ok := sqliteOperatorCondition(field, path, operator, operand, operators)
+			if !ok {
+				return "", nil, false
+			}
+			if condition != "" {
+				conditions = append(conditions, condition)
+				args = append(args, conditionArgs...)
+			}
+		}
+		if len(conditions) == 0 {
+			return "1", nil, true
+		}
+		return "(" + strings.Join(conditions, " AND ") + ")", args, true
+	}
+	if regex, ok := expected.(primitive.Regex); ok {
+		return sqliteRegexCondition(path, regex.Pattern, regex.Options)
+	}
+	return sqliteEqualsCondition(field, path, expected)
+}
+
+func sqliteOperatorCondition(field string, path string, operator string, operand interface{}, operators map[string]interface{}) (string, []interface{}, bool) {
+	switch operator {
+	case "$eq":
+		return sqliteEqualsCondition(field, path, operand)
+	case "$ne":
+		condition, args, ok := sqliteEqualsCondition(field, path, operand)
+		return "NOT " + condition, args, ok
+	case "$gt", "$gte", "$lt", "$lte":
+		value, typeCondition, ok := sqliteScalar(operand)
+		if !ok || value == nil {
+			return "", nil, false
+		}
+		comparison := map[string]string{"$gt": ">", "$gte": ">=", "$lt": "<", "$lte": "<="}[operator]
+		return sqliteAnyElement(path, typeCondition+" AND value "+comparison+" ?", value)
+	case "$in", "$nin":
+		options, ok := asMemoryKvSlice(operand)
+		if !ok {
+			return "", nil, false
+		}
+		var conditions []string
+		args := []interface{}{}
+		for _, option := range options {
+			condition, conditionArgs, ok := sqliteEqualsCondition(field, path, option)
+			if !ok {
+				return "", nil, false
+			}
+			conditions = append(conditions, condition)
+			args = append(args, conditionArgs...)
+		}
+		condition := "0"
+		if len(conditions) > 0 {
+			condition = "(" + strings.Join(conditions, " OR ") + ")"
+		}
+		if operator == "$nin" {
+			condition = "NOT " + condition
+		}
+		return condition, args, true
+	case "$exists":
+		shouldExist, ok := operand.(bool)
+		if !ok {
+			shouldExist = operand != nil && operand != 0
+		}
+		if shouldExist {
+			return "json_type(data, ?) IS NOT NULL", []interface{}{path}, true
+		}
+		return "json_type(data, ?) IS NULL", []interface{}{path}, true
+	case "$regex":
+		options, _ := operators["$options"].(string)
+		switch pattern := operand.(type) {
+		case string:
+			return sqliteRegexCondition(path, pattern, options)
+		case primitive.Regex:
+			return sqliteRegexCondition(path, pattern.Pattern, pattern.Options+options)
+		}
+		return "", nil, false
+	case "$options":
+		// Handled together with $regex
+		return "", nil, true
+	case "$not":
+		condition, args, ok := sqliteFieldCondition(field, operand)
+		return "NOT " + condition, args, ok
+	case "$size":
+		size, ok := asMemoryKvInt(operand)
+		if !ok {
+			return "", nil, false
+		}
+		return "(json_type(data, ?) = 'array' AND json_array_length(data, ?) = ?)", []interface{}{path, path, size}, true
+	}
+	return "", nil, false
+}
+
+// sqliteEqualsCondition mimics the MongoDB equality semantics, where an array matches if any of its elements matches
+func sqliteEqualsCondition(field string, path string, expected interface{}) (string, []interface{}, bool) {
+	value, typeCondition, ok := sqliteScalar(expected)
+	if !ok {
+		return "", nil, false
+	}
+	if expected == nil {
+		return "(json_type(data, ?) IS NULL OR json_type(data, ?) = 'null')", []interface{}{path, path}, true
+	}
+	if field == "_id" && value != nil {
+		// The primary key is used for the lookups by id
+		return "(_id = ?)", []interface{}{memoryKvIdAsString(expected)}, true
+	}
+	if value == nil {
+		return sqliteAnyElement(path, typeCondition)
+	}
+	return sqliteAnyElement(path, typeCondition+" AND value = ?", value)
+}
+
+func sqliteRegexCondition(path string, pattern string, options string) (string, []interface{}, bool) {
+	if strings.Contains(options, "i") {
+		pattern = "(?i)" + pattern
+	}
+	return sqliteAnyElement(path, "type = 'text' AND regexp(?, value)", pattern)
+}
+
+// sqliteAnyElement selects the documents where the value at the path, or any element of it if it is an array,
+// satisfies the condition over the json_each columns type and value
+func sqliteAnyElement(path string, condition string, args ...interface{}) (string, []interface{}, bool) {
+	return "EXISTS (SELECT 1 FROM json_each(data, ?) WHERE typeof(key) <> 'text' AND " + condition + ")", append([]interface{}{path}, args...), true
+}
+
+// sqliteScalar normalizes an operand the same way encodeSqliteDocument stores it and returns the condition over the
+// json_each type column it requires. The value is nil for null and booleans, whose type is enough to match them.
+func sqliteScalar(operand interface{}) (value interface{}, typeCondition string, ok bool) {
+	switch v := operand.(type) {
+	case nil:
+		return nil, "type = 'null'", true
+	case bool:
+		if v {
+			return nil, "type = 'true'", true
+		}
+		return nil, "type = 'false'", true
+	case string:
+		return v, "type = 'text'", true
+	case primitive.ObjectID:
+		return v.Hex(), "type = 'text'", true
+	case *primitive.ObjectID:
+		if v != nil {
+			return v.Hex(), "type = 'text'", true
+		}
+	case uuid.UUID:
+		return v.String(), "type = 'text'", true
+	case time.Time:
+		return v.UnixMilli(), "type IN ('integer', 'real')", true
+	case *time.Time:
+		if v != nil {
+			return v.UnixMilli(), "type IN ('integer', 'real')", true
+		}
+	case primitive.DateTime:
+		return int64(v), "type IN ('integer', 'real')", true
+	default:
+		if asFloat, isNumber := asMemoryKvFloat(operand); isNumber {
+			return asFloat, "type IN ('integer', 'real')", true
+		}
+	}
+	return nil, "", false
+}
+
+func sqliteOrder(sortSpec interface{}) ([]string, bool) {
+	var keys bson.D
+	switch v := sortSpec.(type) {
+	case bson.D:
+		keys = v
+	default:
+		asMap, ok := asMemoryKvMap(sortSpec)
+		if !ok || len(asMap) > 1 {
+			// The order of the keys of a map is undefined
+			return nil, false
+		}
+		for key, direction := range asMap {
+			keys = append(keys, bson.E{Key: key, Value: direction})
+		}
+	}
+	var order []string
+	for _, key := range keys {
+		path, ok := sqliteJsonPath(key.Key)
+		direction, isNumber := asMemoryKvInt(key.Value)
+		if !ok || !isNumber {
+			return nil, false
+		}
+		expression := "json_extract(data, " + quoteSqliteString(path) + ")"
+		if direction < 0 {
+			expression += " DESC"
+		}
+		order = append(order, expression)
+	}
+	return order, true
+}
+
+// sqliteProjection translates a projection of top-level fields into an expression that replaces the data column
+func sqliteProjection(projection map[string]interface{}) (string, []interface{}, bool) {
+	inclusive := false
+	for key, value := range projection {
+		if strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			return "", nil, false
+		}
+		if _, isBool := value.(bool); !isBool {
+			if _, isNumber := asMemoryKvFloat(value); !isNumber {
+				return "", nil, false
+			}
+		}
+		if key != "_id" {
+			inclusive = !isMemoryKvExclusion(value)
+		}
+	}
+	if _, hasId := projection["_id"]; hasId && len(projection) == 1 {
+		// {"_id": 1} keeps only the id
+		inclusive = !isMemoryKvExclusion(projection["_id"])
+	}
+	var args []interface{}
+	if inclusive {
+		if !isMemoryKvExclusion(projection["_id"]) {
+			args = append(args, "_id")
+		}
+		for key, value := range projection {
+			if key != "_id" && !isMemoryKvExclusion(value) {
+				args = append(args, key)
+			}
+		}
+		// The booleans are rebuilt, as json_each returns them as integers
+		return "(SELECT json_group_object(key, CASE type WHEN 'true' THEN json('true') WHEN 'false' THEN json('false') ELSE value END) FROM json_each(data) WHERE key IN (?" + strings.Repeat(", ?", len(args)-1) + "))", args, len(args) > 0
+	}
+	for key, value := range projection {
+		if isMemoryKvExclusion(value) {
+			path, _ := sqliteJsonPath(key)
+			args = append(args, path)
+		}
+	}
+	if len(args) == 0 {
+		return "data", nil, true
+	}
+	return "json_remove(data" + strings.Repeat(", ?", len(args)) + ")", args, true
+}
+
+// sqliteJsonPath returns the SQLite JSON path of a dotted field name
+func sqliteJsonPath(field string) (string, bool) {
+	if field == "" || strings.Contains(field, `"`) {
+		return "", false
+	}
+	return `$."` + strings.Join(strings.Split(field, "."), `"."`) + `"`, true
+}
+
+func quoteSqliteString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// evaluatePipeline applies the stages that could not be translated into SQL. It adds the $lookup and $unwind stages
+// generated for the relations to the ones supported by the memorykv connector.
+func (connector *SQLiteConnector) evaluatePipeline(ctx context.Context, querier sqliteQuerier, documents []wst.M, stages wst.A) ([]wst.M, error) {
+	for _, stage := range stages {
+		var err error
+		if lookup, ok := stage["$lookup"]; ok && len(stage) == 1 {
+			documents, err = connector.evaluateLookup(ctx, querier, documents, lookup)
+		} else if unwind, ok := stage["$unwind"]; ok && len(stage) == 1 {
+			documents, err = evaluateSqliteUnwind(documents, unwind)
+		} else {
+			documents, err = evaluateMemoryKvPipeline(documents, &wst.A{stage})
+			if err != nil {
+				err = errors.New(strings.ReplaceAll(err.Error(), "memorykv", "sqlite"))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return documents, nil
+}
+
+// evaluateLookup joins the related documents. The $expr conditions of the pipeline are bound to the values of the let
+// variables of each document and turned into a regular $match, so the related table is queried with SQL.
+func (connector *SQLiteConnector) evaluateLookup(ctx context.Context, querier sqliteQuerier, documents []wst.M, lookupSpec interface{}) ([]wst.M, error) {
+	lookup, ok := asMemoryKvMap(lookupSpec)
+	if !ok {
+		return nil, fmt.Errorf("invalid $lookup value type %T", lookupSpec)
+	}
+	from, _ := lookup["from"].(string)
+	as, _ := lookup["as"].(string)
+	if from == "" || as == "" {
+		return nil, fmt.Errorf("$lookup requires from and as")
+	}
+	letSpec, _ := asMemoryKvMap(lookup["let"])
+	var pipeline []interface{}
+	if lookup["pipeline"] != nil {
+		pipeline, ok = asMemoryKvSlice(lookup["pipeline"])
+		if !ok {
+			return nil, fmt.Errorf("invalid $lookup pipeline type %T", lookup["pipeline"])
+		}
+	}
+	localField, _ := lookup["localField"].(string)
+	foreignField, _ := lookup["foreignField"].(string)
+
+	cache := make(map[string][]wst.M)
+	for _, document := range documents {
+		variables := make(map[string]interface{}, len(letSpec))
+		for name, expression := range letSpec {
+			variables[name] = resolveSqliteExpression(document, expression, nil)
+		}
+		var stages wst.A
+		if localField != "" && foreignField != "" {
+			localValue, _ := lookupMemoryKvPath(document, localField)
+			// Not a valid variable name, so it cannot collide with the let variables while being part of the cache key
+			variables["<localField>"] = localValue
+			stages = append(stages, wst.M{"$match": wst.M{foreignField: localValue}})
+		}
+		for _, pipelineStage := range pipeline {
+			stageMap, ok := asMemoryKvMap(pipelineStage)
+			if !ok {
+				return nil, fmt.Errorf("invalid $lookup stage type %T", pipelineStage)
+			}
+			bound, err := bindSqliteLookupStage(stageMap, variables)
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, bound)
+		}
+
+		cacheKey := fmt.Sprintf("%v", normalizeSqliteVariables(variables))
+		related, cached := cache[cacheKey]
+		if !cached {
+			var err error
+			related, err = connector.findDocuments(ctx, querier, from, &stages)
+			if err != nil {
+				return nil, err
+			}
+			cache[cacheKey] = related
+		}
+		joined := make([]interface{}, len(related))
+		for idx, relatedDocument := range related {
+			joined[idx] = relatedDocument
+		}
+		document[as] = joined
+	}
+	return documents, nil
+}
+
+// bindSqliteLookupStage replaces the $expr of a $match stage with the equivalent match for the values of the variables
+func bindSqliteLookupStage(stage map[string]interface{}, variables map[string]interface{}) (wst.M, error) {
+	bound := wst.M{}
+	for stageName, stageValue := range stage {
+		if stageName != "$match" {
+			bound[stageName] = stageValue
+			continue
+		}
+		match, ok := asMemoryKvMap(stageValue)
+		if !ok {
+			return nil, fmt.Errorf("invalid $match value type %T", stageValue)
+		}
+		boundMatch := wst.M{}
+		for key, value := range match {
+			if key != "$expr" {
+				boundMatch[key] = value
+				continue
+			}
+			exprMatch, err := sqliteExprAsMatch(value, variables)
+			if err != nil {
+				return nil, err
+			}
+			conditions := wst.A{exprMatch}
+			if existing, ok := asMemoryKvSlice(boundMatch["$and"]); ok {
+				for _, condition := range existing {
+					asMap, _ := asMemoryKvMap(condition)
+					conditions = append(conditions, asMap)
+				}
+			}
+			boundMatch["$and"] = conditions
+		}
+		bound[stageName] = boundMatch
+	}
+	return bound, nil
+}
+
+// sqliteExprAsMatch supports the $and and $eq expressions comparing a field with a variable, as used by the relations
+func sqliteExprAsMatch(expression interface{}, variables map[string]interface{}) (wst.M, error) {
+	asMap, ok := asMemoryKvMap(expression)
+	if !ok || len(asMap) != 1 {
+		return nil, fmt.Errorf("$expr %v is not supported by the sqlite connector", expression)
+	}
+	for operator, operands := range asMap {
+		asSlice, ok := asMemoryKvSlice(operands)
+		if !ok {
+			return nil, fmt.Errorf("invalid %v value type %T", operator, operands)
+		}
+		switch operator {
+		case "$and":
+			conditions := wst.A{}
+			for _, operand := range asSlice {
+				condition, err := sqliteExprAsMatch(operand, variables)
+				if err != nil {
+					return nil, err
+				}
+				conditions = append(conditions, condition)
+			}
+			return wst.M{"$and": conditions}, nil
+		case "$eq":
+			if len(asSlice) == 2 {
+				for idx := range asSlice {
+					field, isString := asSlice[idx].(string)
+					if isString && strings.HasPrefix(field, "$") && !strings.HasPrefix(field, "$$") {
+						other := resolveSqliteExpression(nil, asSlice[1-idx], variables)
+						if _, isSlice := asMemoryKvSlice(other); isSlice {
+							// An array would match any of its elements instead of the whole array
+							break
+						}
+						return wst.M{field[1:]: wst.M{"$eq": other}}, nil
+					}
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("$expr %v is not supported by the sqlite connector", expression)
+}
+
+// resolveSqliteExpression returns the value of "$field" in the document, of "$$variable" in the variables, or the
+// expression itself if it is a literal
+func resolveSqliteExpression(document wst.M, expression interface{}, variables map[string]interface{}) interface{} {
+	asString, ok := expression.(string)
+	if !ok || !strings.HasPrefix(asString, "$") {
+		return expression
+	}
+	if strings.HasPrefix(asString, "$$") {
+		return variables[asString[2:]]
+	}
+	if document == nil {
+		return nil
+	}
+	value, _ := lookupMemoryKvPath(document, asString[1:])
+	return value
+}
+
+func normalizeSqliteVariables(variables map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(variables))
+	for name, value := range variables {
+		normalized[name] = normalizeMemoryKvValue(value)
+	}
+	return normalized
+}
+
+func evaluateSqliteUnwind(documents []wst.M, unwindSpec interface{}) ([]wst.M, error) {
+	var path string
+	preserve := false
+	switch v := unwindSpec.(type) {
+	case string:
+		path = v
+	default:
+		asMap, ok := asMemoryKvMap(unwindSpec)
+		if !ok {
+			return nil, fmt.Errorf("invalid $unwind value type %T", unwindSpec)
+		}
+		path, _ = asMap["path"].(string)
+		preserve, _ = asMap["preserveNullAndEmptyArrays"].(bool)
+	}
+	field := strings.TrimPrefix(path, "$")
+	if field == path || field == "" || strings.Contains(field, ".") {
+		return nil, fmt.Errorf("$unwind path %v is not supported by the sqlite connector", path)
+	}
+	unwound := make([]wst.M, 0, len(documents))
+	for _, document := range documents {
+		value, exists := document[field]
+		elements, isSlice := asMemoryKvSlice(value)
+		switch {
+		case isSlice && len(elements) > 0:
+			for _, element := range elements {
+				copied := wst.CopyMap(document)
+				copied[field] = element
+				unwound = append(unwound, copied)
+			}
+		case isSlice:
+			if preserve {
+				copied := wst.CopyMap(document)
+				delete(copied, field)
+				unwound = append(unwound, copied)
+			}
+		case !exists || value == nil:
+			if preserve {
+				unwound = append(unwound, document)
+			}
+		default:
+			unwound = append(unwound, document)
+		}
+	}
+	return unwound, nil
+}
+
+// encodeSqliteDocument returns the JSON stored in the data column and the types of the values that JSON cannot hold
+func encodeSqliteDocument(document wst.M) (data string, types string, err error) {
+	typesMap := make(map[string]string)
+	encoded := encodeSqliteValue(document, "", typesMap)
+	dataBytes, err := json.Marshal(encoded)
+	if err != nil {
+		return "", "", err
+	}
+	typesBytes, err := json.Marshal(typesMap)
+	if err != nil {
+		return "", "", err
+	}
+	return string(dataBytes), string(typesBytes), nil
+}
+
+func encodeSqliteValue(value interface{}, path string, types map[string]string) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool, float32, float64:
+		return v
+	case primitive.Null, primitive.Undefined:
+		return nil
+	case int, int8, int16, uint8, uint16, uint32:
+		types[path] = "int"
+		return v
+	case int32:
+		types[path] = "int32"
+		return v
+	case int64, uint, uint64:
+		types[path] = "int64"
+		return v
+	case primitive.ObjectID:
+		types[path] = "objectId"
+		return v.Hex()
+	case *primitive.ObjectID:
+		if v == nil {
+			return nil
+		}
+		types[path] = "objectId"
+		return v.Hex()
+	case uuid.UUID:
+		types[path] = "uuid"
+		return v.String()
+	case time.Time:
+		types[path] = "date"
+		return v.UnixMilli()
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		types[path] = "date"
+		return v.UnixMilli()
+	case primitive.DateTime:
+		types[path] = "date"
+		return int64(v)
+	case []byte:
+		types[path] = "binary"
+		return base64.StdEncoding.EncodeToString(v)
+	case primitive.Binary:
+		types[path] = "binary"
+		return base64.StdEncoding.EncodeToString(v.Data)
+	case primitive.Decimal128:
+		types[path] = "decimal"
+		return v.String()
+	}
+	if asMap, ok := asMemoryKvMap(value); ok {
+		encoded := make(map[string]interface{}, len(asMap))
+		for key, element := range asMap {
+			encoded[key] = encodeSqliteValue(element, joinSqlitePath(path, key), types)
+		}
+		return encoded
+	}
+	if asSlice, ok := asMemoryKvSlice(value); ok {
+		encoded := make([]interface{}, len(asSlice))
+		for idx, element := range asSlice {
+			encoded[idx] = encodeSqliteValue(element, joinSqlitePath(path, strconv.Itoa(idx)), types)
+		}
+		return encoded
+	}
+	return value
+}
+
+func decodeSqliteDocument(data string, types string) (wst.M, error) {
+	typesMap := make(map[string]string)
+	if types != "" {
+		err := json.Unmarshal([]byte(types), &typesMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var raw interface{}
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeSqliteValue(raw, "", typesMap)
+	if err != nil {
+		return nil, err
+	}
+	document, ok := decoded.(wst.M)
+	if !ok {
+		return nil, fmt.Errorf("invalid sqlite document %v", data)
+	}
+	return document, nil
+}
+
+func decodeSqliteValue(value interface{}, path string, types map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		decoded := make(wst.M, len(v))
+		for key, element := range v {
+			decodedElement, err := decodeSqliteValue(element, joinSqlitePath(path, key), types)
+			if err != nil {
+				return nil, err
+			}
+			decoded[key] = decodedElement
+		}
+		return decoded, nil
+	case []interface{}:
+		decoded := make([]interface{}, len(v))
+		for idx, element := range v {
+			decodedElement, err := decodeSqliteValue(element, joinSqlitePath(path, strconv.Itoa(idx)), types)
+			if err != nil {
+				return nil, err
+			}
+			decoded[idx] = decodedElement
+		}
+		return decoded, nil
+	case json.Number:
+		switch types[path] {
+		case "int":
+			asInt, err := v.Int64()
+			return int(asInt), err
+		case "int32":
+			asInt, err := v.Int64()
+			return int32(asInt), err
+		case "int64":
+			return v.Int64()
+		case "date":
+			millis, err := v.Int64()
+			return time.UnixMilli(millis), err
+		}
+		return v.Float64()
+	case string:
+		switch types[path] {
+		case "objectId":
+			return primitive.ObjectIDFromHex(v)
+		case "uuid":
+			return uuid.Parse(v)
+		case "binary":
+			return base64.StdEncoding.DecodeString(v)
+		case "decimal":
+			return primitive.ParseDecimal128(v)
+		}
+	}
+	return value, nil
+}
+
+func joinSqlitePath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
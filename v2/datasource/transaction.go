@@ -0,0 +1,82 @@
+package datasource
+
+import (
+	"context"
+)
+
+// TransactionalConnector is implemented by the connectors able to run multi-document transactions.
+type TransactionalConnector interface {
+	// SupportsTransactions tells whether the server behind the connector accepts transactions. For example, a
+	// standalone MongoDB server does not, while replica sets and sharded clusters do.
+	SupportsTransactions(parentCtx context.Context) bool
+	// StartTransaction opens a transaction. All the operations sent through the returned connector belong to it
+	StartTransaction(parentCtx context.Context) (ConnectorTransaction, error)
+}
+
+// ConnectorTransaction is an open transaction returned by TransactionalConnector.StartTransaction
+type ConnectorTransaction interface {
+	// Connector returns a connector bound to the transaction
+	Connector() PersistedConnector
+	// Commit makes the changes visible to other operations and ends the transaction
+	Commit(ctx context.Context) error
+	// Abort discards the changes and ends the transaction
+	Abort(ctx context.Context) error
+}
+
+// Transaction is an open transaction in a single datasource.
+//
+// When the connector does not implement TransactionalConnector, or the server does not support transactions,
+// the returned Transaction falls back to the regular datasource: every operation is applied as soon as it runs, Commit
+// does nothing, and Abort cannot undo the operations already applied. Check Atomic to know which mode is in use.
+type Transaction struct {
+	// Datasource is the datasource bound to the transaction. Operations sent through it belong to the transaction
+	Datasource *Datasource
+	// Atomic is false when the transaction fell back to non-transactional operations
+	Atomic bool
+
+	source      *Datasource
+	transaction ConnectorTransaction
+}
+
+// StartTransaction opens a new transaction in the datasource. See Transaction for the fallback used when the connector
+// cannot run transactions.
+func (ds *Datasource) StartTransaction(parentCtx context.Context) (*Transaction, error) {
+	if parentCtx == nil {
+		parentCtx = ds.Context
+	}
+	transactionalConnector, ok := ds.connectorInstance.(TransactionalConnector)
+	if !ok || !transactionalConnector.SupportsTransactions(parentCtx) {
+		return &Transaction{Datasource: ds, source: ds}, nil
+	}
+	connectorTransaction, err := transactionalConnector.StartTransaction(parentCtx)
+	if err != nil {
+		return nil, err
+	}
+	boundDatasource := *ds
+	boundDatasource.connectorInstance = connectorTransaction.Connector()
+	return &Transaction{
+		Datasource:  &boundDatasource,
+		Atomic:      true,
+		source:      ds,
+		transaction: connectorTransaction,
+	}, nil
+}
+
+// Source returns the datasource where the transaction was started
+func (tx *Transaction) Source() *Datasource {
+	return tx.source
+}
+
+func (tx *Transaction) Commit(ctx context.Context) error {
+	if tx.transaction == nil {
+		return nil
+	}
+	return tx.transaction.Commit(ctx)
+}
+
+func (tx *Transaction) Abort(ctx context.Context) error {
+	if tx.transaction == nil {
+		return nil
+	}
+	return tx.transaction.Abort(ctx)
+}
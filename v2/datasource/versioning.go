@@ -0,0 +1,46 @@
+package datasource
+
+import (
+	"errors"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// VersionProperty holds the document version of the models configured with "versioned": true.
+//
+// When the data passed to UpdateById contains this property, its value is the version the document is expected to
+// have. The connectors only apply the update if the stored version matches, increment it in the same operation, and
+// return ErrVersionMismatch otherwise.
+const VersionProperty = "_version"
+
+var ErrVersionMismatch = errors.New("document version mismatch")
+
+// VersionOf returns the version stored in the document, or 0 for documents created before versioning was enabled
+func VersionOf(document wst.M) int64 {
+	switch v := document[VersionProperty].(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// extractExpectedVersion removes VersionProperty from data and returns the condition to match it
+func extractExpectedVersion(data *wst.M) (condition interface{}, found bool) {
+	expected, found := (*data)[VersionProperty]
+	if !found {
+		return nil, false
+	}
+	delete(*data, VersionProperty)
+	expectedVersion := VersionOf(wst.M{VersionProperty: expected})
+	if expectedVersion == 0 {
+		// Documents created before versioning was enabled do not have the property
+		return wst.M{"$in": []interface{}{0, nil}}, true
+	}
+	return expectedVersion, true
+}
@@ -0,0 +1,126 @@
+package memorykv
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrNotInteger is returned by IncrBy when the stored value is not an integer, or when the result would overflow
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+func (kvBucket *MemoryKvBucketImpl) Incr(key string, ttl time.Duration) (int64, error) {
+	return kvBucket.IncrBy(key, 1, ttl)
+}
+
+func (kvBucket *MemoryKvBucketImpl) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+	dataLock.Lock()
+	var current int64
+	pair, exists := kvBucket.liveLocked(key)
+	if exists {
+		if len(pair.value) != 1 {
+			dataLock.Unlock()
+			return 0, ErrNotInteger
+		}
+		var err error
+		current, err = strconv.ParseInt(string(pair.value[0]), 10, 64)
+		if err != nil {
+			dataLock.Unlock()
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		dataLock.Unlock()
+		return 0, ErrNotInteger
+	}
+	current += delta
+	value := [][]byte{[]byte(strconv.FormatInt(current, 10))}
+	kvBucket.setLocked(key, value)
+	var expiresAt int64
+	if !exists && ttl > 0 {
+		expiresAt = time.Now().Add(ttl).UnixMilli()
+		kvBucket.expireAtLocked(key, expiresAt)
+	}
+	kvBucket.logWrite(key, value, expiresAt)
+	dataLock.Unlock()
+	kvBucket.enforceLimits()
+	return current, nil
+}
+
+func (kvBucket *MemoryKvBucketImpl) SetNX(key string, value [][]byte, ttl time.Duration) (bool, error) {
+	dataLock.Lock()
+	if _, exists := kvBucket.liveLocked(key); exists {
+		dataLock.Unlock()
+		return false, nil
+	}
+	expiresAt := kvBucket.storeLocked(key, value, ttl)
+	kvBucket.logWrite(key, value, expiresAt)
+	dataLock.Unlock()
+	kvBucket.enforceLimits()
+	return true, nil
+}
+
+func (kvBucket *MemoryKvBucketImpl) CompareAndSwap(key string, oldValue [][]byte, newValue [][]byte, ttl time.Duration) (bool, error) {
+	dataLock.Lock()
+	pair, exists := kvBucket.liveLocked(key)
+	if exists != (oldValue != nil) || (exists && !equalValues(pair.value, oldValue)) {
+		dataLock.Unlock()
+		return false, nil
+	}
+	expiresAt := kvBucket.storeLocked(key, newValue, ttl)
+	kvBucket.logWrite(key, newValue, expiresAt)
+	dataLock.Unlock()
+	kvBucket.enforceLimits()
+	return true, nil
+}
+
+func (kvBucket *MemoryKvBucketImpl) GetSet(key string, value [][]byte) ([][]byte, error) {
+	return kvBucket.GetSetEx(key, value, 0)
+}
+
+func (kvBucket *MemoryKvBucketImpl) GetSetEx(key string, value [][]byte, ttl time.Duration) ([][]byte, error) {
+	dataLock.Lock()
+	var previous [][]byte
+	if pair, exists := kvBucket.liveLocked(key); exists {
+		previous = pair.value
+	}
+	expiresAt := kvBucket.storeLocked(key, value, ttl)
+	kvBucket.logWrite(key, value, expiresAt)
+	dataLock.Unlock()
+	kvBucket.enforceLimits()
+	return previous, nil
+}
+
+// storeLocked stores the value and sets its expiration if ttl is greater than 0. It returns the expiration set, or 0.
+// dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) storeLocked(key string, value [][]byte, ttl time.Duration) int64 {
+	kvBucket.setLocked(key, value)
+	if ttl <= 0 {
+		return 0
+	}
+	expiresAt := time.Now().Add(ttl).UnixMilli()
+	kvBucket.expireAtLocked(key, expiresAt)
+	return expiresAt
+}
+
+// logWrite logs a write, and its expiration if not 0. dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) logWrite(key string, value [][]byte, expiresAt int64) {
+	kvBucket.log(logRecord{op: logOpSet, key: key, value: value})
+	if expiresAt > 0 {
+		kvBucket.log(logRecord{op: logOpExpire, key: key, expiresAt: expiresAt})
+	}
+}
+
+func equalValues(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
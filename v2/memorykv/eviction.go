@@ -0,0 +1,162 @@
+package memorykv
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// EvictionPolicy chooses the entries removed when a database or bucket exceeds its Limits
+type EvictionPolicy string
+
+const (
+	// EvictionLRU removes the least recently used entries first
+	EvictionLRU EvictionPolicy = "lru"
+	// EvictionLFU removes the least frequently used entries first, and the least recently used among them
+	EvictionLFU EvictionPolicy = "lfu"
+	// EvictionTTL removes the entries closest to expire first, and the least recently used entries without TTL after
+	// them
+	EvictionTTL EvictionPolicy = "ttl"
+)
+
+// Limits bounds the memory used by a database or a bucket. MaxBytes counts the keys and values of the entries. Zero
+// values mean no limit.
+type Limits struct {
+	MaxBytes   int64          `mapstructure:"maxBytes"`
+	MaxEntries int            `mapstructure:"maxEntries"`
+	Policy     EvictionPolicy `mapstructure:"evictionPolicy"`
+}
+
+func (limits Limits) enabled() bool {
+	return limits.MaxBytes > 0 || limits.MaxEntries > 0
+}
+
+func (limits Limits) exceeded(size int64, entries int) bool {
+	return (limits.MaxBytes > 0 && size > limits.MaxBytes) || (limits.MaxEntries > 0 && entries > limits.MaxEntries)
+}
+
+// evictionSamples is how many entries of each bucket are compared to choose the next one to evict. As in Redis, the
+// policies are approximated by sampling, so a write never scans the whole bucket.
+const evictionSamples = 16
+
+// accessClock orders the accesses to the entries. A counter is used instead of the time, so the order is exact for
+// accesses within the same clock tick.
+var accessClock atomic.Int64
+
+func entrySize(key string, value [][]byte) int64 {
+	size := int64(len(key))
+	for _, b := range value {
+		size += int64(len(b))
+	}
+	return size
+}
+
+type evictionCandidate struct {
+	bucket *MemoryKvBucketImpl
+	pair   kvPair
+}
+
+// evictsBefore tells whether a must be evicted before b
+func evictsBefore(policy EvictionPolicy, a, b kvPair) bool {
+	switch policy {
+	case EvictionLFU:
+		if a.accessCount != b.accessCount {
+			return a.accessCount < b.accessCount
+		}
+	case EvictionTTL:
+		if (a.expiresAt > 0) != (b.expiresAt > 0) {
+			return a.expiresAt > 0
+		}
+		if a.expiresAt != b.expiresAt {
+			return a.expiresAt < b.expiresAt
+		}
+	}
+	return a.lastAccess < b.lastAccess
+}
+
+// sampleCandidates returns up to evictionSamples entries of each bucket, sorted by eviction order. dataLock must be held.
+func sampleCandidates(policy EvictionPolicy, buckets []*MemoryKvBucketImpl) []evictionCandidate {
+	var candidates []evictionCandidate
+	for _, bucket := range buckets {
+		count := 0
+		for _, pair := range bucket.data {
+			if count >= evictionSamples {
+				break
+			}
+			candidates = append(candidates, evictionCandidate{bucket: bucket, pair: pair})
+			count++
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return evictsBefore(policy, candidates[i].pair, candidates[j].pair)
+	})
+	return candidates
+}
+
+// evict removes entries of the buckets until the limits are not exceeded. The evictions are logged as deletes, so they
+// are not restored on restart. total returns the size and entries the limits apply to. dataLock must be held.
+func evict(limits Limits, buckets []*MemoryKvBucketImpl, total func() (int64, int)) {
+	policy := limits.Policy
+	if policy == "" {
+		policy = EvictionLRU
+	}
+	for limits.exceeded(total()) {
+		candidates := sampleCandidates(policy, buckets)
+		if len(candidates) == 0 {
+			break
+		}
+		// Evicting only the best candidate of each sample keeps the approximation close to the exact policy
+		candidate := candidates[0]
+		candidate.bucket.remove(candidate.pair.key)
+		candidate.bucket.evictions++
+		candidate.bucket.evictedBytes += entrySize(candidate.pair.key, candidate.pair.value)
+		candidate.bucket.log(logRecord{op: logOpDelete, key: candidate.pair.key})
+	}
+}
+
+// enforceLimits evicts the entries exceeding the limits of the bucket and then the ones of its database
+func (kvBucket *MemoryKvBucketImpl) enforceLimits() {
+	if kvBucket.limits.enabled() {
+		dataLock.Lock()
+		if !kvBucket.noEviction {
+			evict(kvBucket.limits, []*MemoryKvBucketImpl{kvBucket}, func() (int64, int) {
+				return kvBucket.size, len(kvBucket.data)
+			})
+		}
+		dataLock.Unlock()
+	}
+	if kvBucket.db != nil {
+		kvBucket.db.enforceLimits()
+	}
+}
+
+func (kvDb *MemoryKvDbImpl) enforceLimits() {
+	if !kvDb.limits.enabled() {
+		return
+	}
+	bucketsLock.RLock()
+	buckets := make([]*MemoryKvBucketImpl, 0, len(kvDb.buckets))
+	for _, bucket := range kvDb.buckets {
+		if impl, ok := bucket.(*MemoryKvBucketImpl); ok {
+			buckets = append(buckets, impl)
+		}
+	}
+	bucketsLock.RUnlock()
+	dataLock.Lock()
+	evictable := buckets[:0]
+	for _, bucket := range buckets {
+		if !bucket.noEviction {
+			evictable = append(evictable, bucket)
+		}
+	}
+	buckets = evictable
+	evict(kvDb.limits, buckets, func() (int64, int) {
+		var size int64
+		var entries int
+		for _, bucket := range buckets {
+			size += bucket.size
+			entries += len(bucket.data)
+		}
+		return size, entries
+	})
+	dataLock.Unlock()
+}
@@ -1,7 +1,9 @@
 package memorykv
 
 import (
+	"container/heap"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
@@ -9,6 +11,13 @@ import (
 
 type Options struct {
 	Name string
+	// Persistence makes the database survive restarts. It is kept only in memory if nil.
+	Persistence *PersistenceOptions
+	// Limits bounds the whole database. Entries are evicted from any bucket when it is exceeded.
+	Limits Limits
+	// BucketLimits bounds single buckets, matching their names case-insensitively. Their eviction policy defaults to the
+	// one of Limits.
+	BucketLimits map[string]Limits
 }
 
 //goland:noinspection GoNameStartsWithPackageName
@@ -22,13 +31,20 @@ type MemoryKvStats struct {
 	AvgObjSize             float64 `json:"avgObjSize"`
 	Misses                 int64   `json:"misses"`
 	Hits                   int64   `json:"hits"`
+	Evictions              int64   `json:"evictions"`
+	EvictedBytes           int64   `json:"evictedBytes"`
 }
 
 //goland:noinspection GoNameStartsWithPackageName
 type MemoryKvDb interface {
 	GetBucket(name string) MemoryKvBucket
+	Buckets() []string
 	Stats() map[string]MemoryKvStats
 	Purge() error
+	// Snapshot writes the persisted snapshot and truncates the log. It does nothing without persistence.
+	Snapshot() error
+	// Close writes a last snapshot and stops the persistence. The database is still usable in memory.
+	Close() error
 }
 
 //goland:noinspection GoNameStartsWithPackageName
@@ -38,6 +54,23 @@ type MemoryKvBucket interface {
 	SetEx(key string, value [][]byte, ttl time.Duration) error
 	Delete(key string) error
 	Expire(key string, ttl time.Duration) error
+	// TTL returns the time left until the key expires, or -1 if it does not expire. found is false for missing keys.
+	TTL(key string) (ttl time.Duration, found bool)
+	// Incr is IncrBy with a delta of 1
+	Incr(key string, ttl time.Duration) (int64, error)
+	// IncrBy adds delta to the integer stored at key and returns the result. Missing keys count as 0 and are created
+	// with ttl, if greater than 0. Existing keys keep their expiration, so a counter with TTL works as a fixed window.
+	IncrBy(key string, delta int64, ttl time.Duration) (int64, error)
+	// SetNX stores the value only if the key does not exist, with ttl if greater than 0. It tells whether it was stored.
+	SetNX(key string, value [][]byte, ttl time.Duration) (bool, error)
+	// CompareAndSwap stores newValue only if the current value equals oldValue, or if the key does not exist and
+	// oldValue is nil. The expiration is set to ttl if greater than 0, or kept otherwise. It tells whether it was stored.
+	CompareAndSwap(key string, oldValue [][]byte, newValue [][]byte, ttl time.Duration) (bool, error)
+	// GetSet stores the value, keeping the expiration of existing keys, and returns the previous value or nil
+	GetSet(key string, value [][]byte) ([][]byte, error)
+	// GetSetEx is GetSet with the expiration set to ttl in the same operation, if greater than 0
+	GetSetEx(key string, value [][]byte, ttl time.Duration) ([][]byte, error)
+	Keys() []string
 	Stats() MemoryKvStats
 	Flush()
 }
@@ -45,87 +78,109 @@ type MemoryKvBucket interface {
 type kvPair struct {
 	key       string
 	value     [][]byte
-	expiresAt int64 // unix timestamp in seconds
+	expiresAt int64 // unix timestamp in milliseconds
+	// lastAccess and accessCount are only tracked for the eviction policies
+	lastAccess  int64
+	accessCount int64
 }
 
+// expired tells whether the entry expired at now, a unix timestamp in seconds
+func (pair kvPair) expired(now int64) bool {
+	return pair.expiresAt > 0 && pair.expiresAt <= now
+}
+
+// expirationQueue is a min-heap of the keys with TTL by expiration, with one entry per key
 type expirationQueue struct {
 	expirationQueue []kvPair
+	// positions holds the index of each key in expirationQueue
+	positions map[string]int
+	lock      sync.RWMutex
 }
 
-var expirationLock sync.RWMutex
-
-func (queue *expirationQueue) Add(key string, expiresAt int64) {
-	expirationLock.Lock()
-	inserted := false
-	for i, pair := range queue.expirationQueue {
-		if pair.expiresAt > expiresAt {
-			queue.expirationQueue = append(queue.expirationQueue[:i], append([]kvPair{{key: key, value: nil, expiresAt: expiresAt}}, queue.expirationQueue[i:]...)...)
-			inserted = true
-			break
-		}
-	}
-	if !inserted {
-		queue.expirationQueue = append(queue.expirationQueue, kvPair{key: key, value: nil, expiresAt: expiresAt})
+// Update sets the expiration of key, adding it if missing
+func (queue *expirationQueue) Update(key string, expiresAt int64) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if i, ok := queue.positions[key]; ok {
+		queue.expirationQueue[i].expiresAt = expiresAt
+		heap.Fix(queue, i)
+	} else {
+		heap.Push(queue, kvPair{key: key, expiresAt: expiresAt})
 	}
-	expirationLock.Unlock()
 }
 
-func (queue *expirationQueue) Peek() (string, bool) {
-	expirationLock.RLock()
+// Peek returns the key expiring first and its expiration
+func (queue *expirationQueue) Peek() (string, int64, bool) {
+	queue.lock.RLock()
+	defer queue.lock.RUnlock()
 	if len(queue.expirationQueue) == 0 {
-		expirationLock.RUnlock()
-		return "", false
+		return "", 0, false
 	}
 	pair := queue.expirationQueue[0]
-	expirationLock.RUnlock()
-	return pair.key, true
+	return pair.key, pair.expiresAt, true
 }
 
 func (queue *expirationQueue) Remove(key string) {
-	expirationLock.Lock()
-	for i, pair := range queue.expirationQueue {
-		if pair.key == key {
-			queue.expirationQueue = append(queue.expirationQueue[:i], queue.expirationQueue[i+1:]...)
-			break
-		}
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if i, ok := queue.positions[key]; ok {
+		heap.Remove(queue, i)
 	}
-	expirationLock.Unlock()
 }
 
-func (queue *expirationQueue) Len() int64 {
-	expirationLock.RLock()
-	defer expirationLock.RUnlock()
+func (queue *expirationQueue) Clear() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.expirationQueue = make([]kvPair, 0)
+	queue.positions = make(map[string]int)
+}
+
+func (queue *expirationQueue) Size() int64 {
+	queue.lock.RLock()
+	defer queue.lock.RUnlock()
 	return int64(len(queue.expirationQueue))
 }
 
-func (queue *expirationQueue) Update(key string, expiresAt int64) {
-	expirationLock.Lock()
-	for i, pair := range queue.expirationQueue {
-		if pair.key == key {
-			queue.expirationQueue = append(queue.expirationQueue[:i], queue.expirationQueue[i+1:]...)
-			break
-		}
-	}
-	expirationLock.Unlock()
-	queue.Add(key, expiresAt)
+// Entries returns a copy of the queued keys and expirations, in no particular order
+func (queue *expirationQueue) Entries() []kvPair {
+	queue.lock.RLock()
+	defer queue.lock.RUnlock()
+	return append([]kvPair(nil), queue.expirationQueue...)
 }
 
-func (queue *expirationQueue) Cursor() chan kvPair {
-	expirationLock.RLock()
-	defer expirationLock.RUnlock()
-	ch := make(chan kvPair)
-	go func() {
-		for _, pair := range queue.expirationQueue {
-			ch <- pair
-		}
-		close(ch)
-	}()
-	return ch
+// Len, Less, Swap, Push and Pop implement heap.Interface. queue.lock must be held.
+func (queue *expirationQueue) Len() int {
+	return len(queue.expirationQueue)
+}
+
+func (queue *expirationQueue) Less(i, j int) bool {
+	return queue.expirationQueue[i].expiresAt < queue.expirationQueue[j].expiresAt
+}
+
+func (queue *expirationQueue) Swap(i, j int) {
+	queue.expirationQueue[i], queue.expirationQueue[j] = queue.expirationQueue[j], queue.expirationQueue[i]
+	queue.positions[queue.expirationQueue[i].key] = i
+	queue.positions[queue.expirationQueue[j].key] = j
+}
+
+func (queue *expirationQueue) Push(x any) {
+	pair := x.(kvPair)
+	queue.positions[pair.key] = len(queue.expirationQueue)
+	queue.expirationQueue = append(queue.expirationQueue, pair)
+}
+
+func (queue *expirationQueue) Pop() any {
+	last := len(queue.expirationQueue) - 1
+	pair := queue.expirationQueue[last]
+	queue.expirationQueue = queue.expirationQueue[:last]
+	delete(queue.positions, pair.key)
+	return pair
 }
 
 func newExpirationQueue() *expirationQueue {
 	return &expirationQueue{
 		expirationQueue: make([]kvPair, 0),
+		positions:       make(map[string]int),
 	}
 }
 
@@ -136,14 +191,36 @@ type MemoryKvBucketImpl struct {
 	expirationQueue *expirationQueue
 	misses          int64
 	hits            int64
+	persistence     *persistence
+	db              *MemoryKvDbImpl
+	limits          Limits
+	// size is the sum of the keys and values, as counted by Limits.MaxBytes
+	size         int64
+	evictions    int64
+	evictedBytes int64
+	// noEviction keeps the entries out of the eviction, as set by ExcludeFromEviction
+	noEviction bool
 }
 
 var dataLock sync.RWMutex
 
 func (kvBucket *MemoryKvBucketImpl) Get(key string) ([][]byte, error) {
-	dataLock.RLock()
-	pair, ok := kvBucket.data[key]
-	dataLock.RUnlock()
+	var pair kvPair
+	var ok bool
+	if kvBucket.tracksAccess() {
+		dataLock.Lock()
+		pair, ok = kvBucket.liveLocked(key)
+		if ok {
+			pair.lastAccess = accessClock.Add(1)
+			pair.accessCount++
+			kvBucket.data[key] = pair
+		}
+		dataLock.Unlock()
+	} else {
+		dataLock.RLock()
+		pair, ok = kvBucket.liveLocked(key)
+		dataLock.RUnlock()
+	}
 	if ok {
 		kvBucket.hits++
 		return pair.value, nil
@@ -154,59 +231,172 @@ func (kvBucket *MemoryKvBucketImpl) Get(key string) ([][]byte, error) {
 }
 
 func (kvBucket *MemoryKvBucketImpl) Set(key string, value [][]byte) {
-	dataLock.RLock()
+	dataLock.Lock()
+	kvBucket.setLocked(key, value)
+	kvBucket.log(logRecord{op: logOpSet, key: key, value: value})
+	dataLock.Unlock()
+	kvBucket.enforceLimits()
+}
+
+func (kvBucket *MemoryKvBucketImpl) set(key string, value [][]byte) {
+	dataLock.Lock()
+	kvBucket.setLocked(key, value)
+	dataLock.Unlock()
+}
+
+// setLocked stores the value, keeping the expiration of existing keys. dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) setLocked(key string, value [][]byte) {
 	pair, ok := kvBucket.data[key]
-	dataLock.RUnlock()
 	if ok {
-		dataLock.Lock()
+		kvBucket.size -= entrySize(key, pair.value)
+	}
+	if ok && !pair.expired(time.Now().UnixMilli()) {
 		pair.value = value
-		kvBucket.data[key] = pair
-		dataLock.Unlock()
 	} else {
-		dataLock.Lock()
-		kvBucket.data[key] = kvPair{
+		pair = kvPair{
 			key:   key,
 			value: value,
 		}
-		dataLock.Unlock()
+		kvBucket.expirationQueue.Remove(key)
 	}
-	kvBucket.expirationQueue.Add(key, time.Now().Unix()+86400*365)
+	pair.lastAccess = accessClock.Add(1)
+	pair.accessCount++
+	kvBucket.data[key] = pair
+	kvBucket.size += entrySize(key, value)
 }
 
+// liveLocked returns the entry of key unless it is missing or expired, as the expired entries may not have been removed
+// by performExpirations yet. dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) liveLocked(key string) (kvPair, bool) {
+	pair, ok := kvBucket.data[key]
+	if !ok || pair.expired(time.Now().UnixMilli()) {
+		return kvPair{}, false
+	}
+	return pair, true
+}
+
+// SetEx stores the value and its expiration under the same lock, so the key is never seen without it
 func (kvBucket *MemoryKvBucketImpl) SetEx(key string, value [][]byte, ttl time.Duration) error {
-	kvBucket.Set(key, value)
-	return kvBucket.Expire(key, ttl)
+	expiresAt := time.Now().Add(ttl).UnixMilli()
+	dataLock.Lock()
+	kvBucket.setLocked(key, value)
+	kvBucket.expireAtLocked(key, expiresAt)
+	kvBucket.logWrite(key, value, expiresAt)
+	dataLock.Unlock()
+	kvBucket.enforceLimits()
+	return nil
 }
 
 func (kvBucket *MemoryKvBucketImpl) Expire(key string, ttl time.Duration) error {
-	dataLock.RLock()
-	pair, ok := kvBucket.data[key]
-	dataLock.RUnlock()
-	if ok {
-		dataLock.Lock()
-		pair.expiresAt = time.Now().Add(ttl).Unix()
-		kvBucket.data[key] = pair
-		dataLock.Unlock()
-		kvBucket.expirationQueue.Update(key, pair.expiresAt)
+	expiresAt := time.Now().Add(ttl).UnixMilli()
+	dataLock.Lock()
+	defer dataLock.Unlock()
+	if kvBucket.expireAtLocked(key, expiresAt) {
+		kvBucket.log(logRecord{op: logOpExpire, key: key, expiresAt: expiresAt})
 		return nil
 	} else {
 		return fmt.Errorf("key not found")
 	}
 }
 
+func (kvBucket *MemoryKvBucketImpl) expireAt(key string, expiresAt int64) bool {
+	dataLock.Lock()
+	defer dataLock.Unlock()
+	return kvBucket.expireAtLocked(key, expiresAt)
+}
+
+// expireAtLocked sets the expiration of an existing key. dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) expireAtLocked(key string, expiresAt int64) bool {
+	pair, ok := kvBucket.liveLocked(key)
+	if ok {
+		pair.expiresAt = expiresAt
+		kvBucket.data[key] = pair
+		kvBucket.expirationQueue.Update(key, pair.expiresAt)
+	}
+	return ok
+}
+
+func (kvBucket *MemoryKvBucketImpl) TTL(key string) (time.Duration, bool) {
+	dataLock.RLock()
+	pair, ok := kvBucket.liveLocked(key)
+	dataLock.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	if pair.expiresAt == 0 {
+		return -1, true
+	}
+	return time.Until(time.UnixMilli(pair.expiresAt)), true
+}
+
 func (kvBucket *MemoryKvBucketImpl) Delete(key string) error {
 	dataLock.Lock()
-	delete(kvBucket.data, key)
+	kvBucket.remove(key)
+	kvBucket.log(logRecord{op: logOpDelete, key: key})
 	dataLock.Unlock()
 	return nil
 }
 
+func (kvBucket *MemoryKvBucketImpl) delete(key string) {
+	dataLock.Lock()
+	kvBucket.remove(key)
+	dataLock.Unlock()
+}
+
+// remove deletes the entry and its expiration, and updates the size of the bucket. dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) remove(key string) {
+	if pair, ok := kvBucket.data[key]; ok {
+		kvBucket.size -= entrySize(key, pair.value)
+		delete(kvBucket.data, key)
+		kvBucket.expirationQueue.Remove(key)
+	}
+}
+
+func (kvBucket *MemoryKvBucketImpl) tracksAccess() bool {
+	return kvBucket.limits.enabled() || (kvBucket.db != nil && kvBucket.db.limits.enabled())
+}
+
+// log appends the record to the persisted log. dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) log(record logRecord) {
+	if kvBucket.persistence != nil {
+		record.bucket = kvBucket.name
+		kvBucket.persistence.append(record)
+	}
+}
+
+func (kvBucket *MemoryKvBucketImpl) Keys() []string {
+	dataLock.RLock()
+	defer dataLock.RUnlock()
+	now := time.Now().UnixMilli()
+	keys := make([]string, 0, len(kvBucket.data))
+	for key, pair := range kvBucket.data {
+		if !pair.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 func (kvBucket *MemoryKvBucketImpl) Flush() {
 	dataLock.Lock()
-	kvBucket.data = make(map[string]kvPair)
+	kvBucket.flushLocked()
+	kvBucket.log(logRecord{op: logOpFlush})
+	dataLock.Unlock()
+}
+
+func (kvBucket *MemoryKvBucketImpl) flush() {
+	dataLock.Lock()
+	kvBucket.flushLocked()
 	dataLock.Unlock()
 }
 
+// flushLocked removes every entry. dataLock must be held.
+func (kvBucket *MemoryKvBucketImpl) flushLocked() {
+	kvBucket.data = make(map[string]kvPair)
+	kvBucket.size = 0
+	kvBucket.expirationQueue.Clear()
+}
+
 func (kvBucket *MemoryKvBucketImpl) Stats() MemoryKvStats {
 	dataLock.RLock()
 	defer dataLock.RUnlock()
@@ -220,7 +410,7 @@ func (kvBucket *MemoryKvBucketImpl) Stats() MemoryKvStats {
 	var _avgObjSizeCount float64
 	var _avgObjSizeSum float64
 	var sizeOfPair int64 = int64(unsafe.Sizeof(kvPair{}))
-	for pair := range kvBucket.expirationQueue.Cursor() {
+	for _, pair := range kvBucket.expirationQueue.Entries() {
 		if earliestExpirationTime == 0 || earliestExpirationTime > pair.expiresAt {
 			earliestExpirationTime = pair.expiresAt
 		}
@@ -243,95 +433,162 @@ func (kvBucket *MemoryKvBucketImpl) Stats() MemoryKvStats {
 		}
 	}
 	if _avgExpirationCount > 0 {
-		avgExpirationTime = _avgExpirationSum / _avgExpirationCount
+		// The expirations are kept in milliseconds, but the stats report them in seconds
+		avgExpirationTime = _avgExpirationSum / _avgExpirationCount / 1000
 	}
 	if _avgObjSizeCount > 0 {
 		avgObjSize = _avgObjSizeSum / _avgObjSizeCount
 	}
 	var earliestExpirationTimeIso8601 string
 	if earliestExpirationTime > 0 {
-		earliestExpirationTimeIso8601 = time.Unix(earliestExpirationTime, 0).Format(time.RFC3339)
+		earliestExpirationTimeIso8601 = time.UnixMilli(earliestExpirationTime).Format(time.RFC3339)
 	}
 	var latestExpirationTimeIso8601 string
 	if latestExpirationTime > 0 {
-		latestExpirationTimeIso8601 = time.Unix(latestExpirationTime, 0).Format(time.RFC3339)
+		latestExpirationTimeIso8601 = time.UnixMilli(latestExpirationTime).Format(time.RFC3339)
 	}
 	return MemoryKvStats{
 		Entries:                len(kvBucket.data),
 		Misses:                 kvBucket.misses,
 		Hits:                   kvBucket.hits,
+		Evictions:              kvBucket.evictions,
+		EvictedBytes:           kvBucket.evictedBytes,
 		AvgExpirationTime:      avgExpirationTime,
 		EarliestExpirationTime: earliestExpirationTimeIso8601,
 		LatestExpirationTime:   latestExpirationTimeIso8601,
-		ExpirationQueueSize:    kvBucket.expirationQueue.Len(),
+		ExpirationQueueSize:    kvBucket.expirationQueue.Size(),
 		TotalSize:              totalSize,
 		AvgObjSize:             avgObjSize,
 	}
 }
 
+// Purge empties the database in memory. The persisted files are kept, so Close must be called before to keep the
+// current entries.
 func (kvDb *MemoryKvDbImpl) Purge() error {
 	for _, bucket := range kvDb.buckets {
-		bucket.Flush()
+		if impl, ok := bucket.(*MemoryKvBucketImpl); ok {
+			impl.flush()
+		} else {
+			bucket.Flush()
+		}
 	}
 	kvDb.buckets = make(map[string]MemoryKvBucket)
 	return nil
 }
 
-func createBucket(name string) MemoryKvBucket {
+func createBucket(name string, kvDb *MemoryKvDbImpl) *MemoryKvBucketImpl {
+	limits, ok := kvDb.bucketLimits[name]
+	if !ok {
+		for bucketName, bucketLimits := range kvDb.bucketLimits {
+			if strings.EqualFold(bucketName, name) {
+				limits = bucketLimits
+				break
+			}
+		}
+	}
+	if limits.Policy == "" {
+		limits.Policy = kvDb.limits.Policy
+	}
 	kvBucket := &MemoryKvBucketImpl{
 		name:            name,
 		data:            make(map[string]kvPair),
 		expirationQueue: newExpirationQueue(),
+		persistence:     kvDb.persistence,
+		db:              kvDb,
+		limits:          limits,
 	}
 	go performExpirations(kvBucket)
 	return kvBucket
 }
 
+// performExpirations removes the expired entries. The expiration is checked again under dataLock, as it may have been
+// extended since it was peeked.
 func performExpirations(kvBucket *MemoryKvBucketImpl) {
 	for {
-		key, ok := kvBucket.expirationQueue.Peek()
-		if ok {
-			dataLock.RLock()
-			pair, ok := kvBucket.data[key]
-			dataLock.RUnlock()
-			if ok {
-				if pair.expiresAt > time.Now().Unix() {
-					toWait := time.Duration(pair.expiresAt-time.Now().Unix()) * time.Second
-					time.Sleep(toWait)
-				}
-				dataLock.Lock()
-				delete(kvBucket.data, key)
-				dataLock.Unlock()
-				kvBucket.expirationQueue.Remove(key)
-			} else {
-				kvBucket.expirationQueue.Remove(key)
-			}
-		} else {
+		key, expiresAt, ok := kvBucket.expirationQueue.Peek()
+		now := time.Now().UnixMilli()
+		if !ok || expiresAt > now {
+			// Keys expiring before the peeked one may be added while waiting
 			time.Sleep(1 * time.Second)
+			continue
 		}
+		dataLock.Lock()
+		pair, exists := kvBucket.data[key]
+		if !exists || pair.expiresAt == 0 {
+			kvBucket.expirationQueue.Remove(key)
+		} else if pair.expired(now) {
+			kvBucket.remove(key)
+		} else {
+			kvBucket.expirationQueue.Update(key, pair.expiresAt)
+		}
+		dataLock.Unlock()
 	}
 }
 
 //goland:noinspection GoNameStartsWithPackageName
 type MemoryKvDbImpl struct {
-	name    string
-	buckets map[string]MemoryKvBucket
+	name         string
+	buckets      map[string]MemoryKvBucket
+	persistence  *persistence
+	limits       Limits
+	bucketLimits map[string]Limits
 }
 
 var bucketsLock sync.RWMutex
 
 func (kvDb *MemoryKvDbImpl) GetBucket(name string) MemoryKvBucket {
+	return kvDb.getBucketImpl(name)
+}
+
+func (kvDb *MemoryKvDbImpl) getBucketImpl(name string) *MemoryKvBucketImpl {
 	bucketsLock.RLock()
 	bucket, ok := kvDb.buckets[name]
 	bucketsLock.RUnlock()
 	if ok {
-		return bucket
+		return bucket.(*MemoryKvBucketImpl)
 	}
 	bucketsLock.Lock()
 	defer bucketsLock.Unlock()
-	bucket = createBucket(name)
-	kvDb.buckets[name] = bucket
-	return bucket
+	// Another goroutine may have created it while waiting for the lock
+	if bucket, ok = kvDb.buckets[name]; ok {
+		return bucket.(*MemoryKvBucketImpl)
+	}
+	impl := createBucket(name, kvDb)
+	kvDb.buckets[name] = impl
+	return impl
+}
+
+// ExcludeFromEviction keeps the entries of the bucket from being evicted, like the documents of persisted models, which
+// would be lost otherwise. The bucket is not bounded by its own limits, and it is not counted in the ones of the database.
+func (kvDb *MemoryKvDbImpl) ExcludeFromEviction(bucketName string) {
+	bucket := kvDb.getBucketImpl(bucketName)
+	dataLock.Lock()
+	bucket.noEviction = true
+	dataLock.Unlock()
+}
+
+func (kvDb *MemoryKvDbImpl) Buckets() []string {
+	bucketsLock.RLock()
+	defer bucketsLock.RUnlock()
+	names := make([]string, 0, len(kvDb.buckets))
+	for name := range kvDb.buckets {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (kvDb *MemoryKvDbImpl) Snapshot() error {
+	if kvDb.persistence == nil {
+		return nil
+	}
+	return kvDb.persistence.snapshot(kvDb)
+}
+
+func (kvDb *MemoryKvDbImpl) Close() error {
+	if kvDb.persistence == nil {
+		return nil
+	}
+	return kvDb.persistence.close(kvDb)
 }
 
 func (kvDb *MemoryKvDbImpl) Stats() map[string]MemoryKvStats {
@@ -344,9 +601,44 @@ func (kvDb *MemoryKvDbImpl) Stats() map[string]MemoryKvStats {
 	return stats
 }
 
+// NewMemoryKvDb creates a database like OpenMemoryKvDb. If the persisted files cannot be read, the error is logged and
+// the database is kept only in memory.
 func NewMemoryKvDb(options Options) MemoryKvDb {
-	return &MemoryKvDbImpl{
-		name:    options.Name,
-		buckets: make(map[string]MemoryKvBucket),
+	kvDb, err := OpenMemoryKvDb(options)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not load the persisted memorykv %v: %v\n", options.Name, err)
+		options.Persistence = nil
+		kvDb, _ = OpenMemoryKvDb(options)
+	}
+	return kvDb
+}
+
+// OpenMemoryKvDb creates a database. With Options.Persistence, the persisted snapshot and logs are replayed first, and
+// the entries whose TTL expired meanwhile are discarded. It fails if they cannot be read.
+func OpenMemoryKvDb(options Options) (MemoryKvDb, error) {
+	kvDb := &MemoryKvDbImpl{
+		name:         options.Name,
+		buckets:      make(map[string]MemoryKvBucket),
+		limits:       options.Limits,
+		bucketLimits: options.BucketLimits,
+	}
+	if options.Persistence != nil {
+		persistence, err := newPersistence(options.Name, *options.Persistence)
+		if err == nil {
+			err = persistence.load(kvDb)
+		}
+		if err != nil {
+			return nil, err
+		}
+		kvDb.persistence = persistence
+		bucketsLock.Lock()
+		for _, bucket := range kvDb.buckets {
+			bucket.(*MemoryKvBucketImpl).persistence = persistence
+		}
+		bucketsLock.Unlock()
+		// The limits, which may have been lowered since the entries were persisted, are enforced on the next write, once
+		// the buckets excluded from eviction are declared
+		go persistence.runSnapshots(kvDb)
 	}
+	return kvDb, nil
 }
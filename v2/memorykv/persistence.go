@@ -0,0 +1,422 @@
+package memorykv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PersistenceOptions makes a database durable. Every write is appended to <Directory>/<name>.aof, and the whole
+// database is written to <Directory>/<name>.snapshot every SnapshotInterval. The log is moved to <name>.aof.previous
+// while the snapshot is written, and removed once it is complete. The files are replayed by OpenMemoryKvDb.
+type PersistenceOptions struct {
+	Directory string
+	// SnapshotInterval defaults to 60 seconds
+	SnapshotInterval time.Duration
+}
+
+const defaultSnapshotInterval = 60 * time.Second
+
+// maxLogRecordLength bounds the records of the append-only log. Values are limited to 512 MiB by the Server, like in
+// Redis, so longer records can only come from a corrupted length.
+const maxLogRecordLength = 1024 * 1024 * 1024
+
+const (
+	logOpSet byte = iota + 1
+	logOpExpire
+	logOpDelete
+	logOpFlush
+)
+
+// logRecord is an entry of the append-only log. Expirations are stored as absolute unix timestamps in milliseconds, so
+// replaying them later keeps the original deadline.
+type logRecord struct {
+	op        byte
+	bucket    string
+	key       string
+	value     [][]byte
+	expiresAt int64
+}
+
+type snapshotEntry struct {
+	Bucket    string
+	Key       string
+	Value     [][]byte
+	ExpiresAt int64
+}
+
+type persistence struct {
+	snapshotPath    string
+	logPath         string
+	previousLogPath string
+	interval        time.Duration
+
+	// lock guards logFile. The records are appended under dataLock too, so they follow the order of the writes.
+	lock    sync.Mutex
+	logFile *os.File
+	stop    chan struct{}
+	stopped bool
+	// snapshotLock serializes the snapshots, which are written without holding lock
+	snapshotLock sync.Mutex
+}
+
+func newPersistence(name string, options PersistenceOptions) (*persistence, error) {
+	err := os.MkdirAll(options.Directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	interval := options.SnapshotInterval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	return &persistence{
+		snapshotPath:    filepath.Join(options.Directory, name+".snapshot"),
+		logPath:         filepath.Join(options.Directory, name+".aof"),
+		previousLogPath: filepath.Join(options.Directory, name+".aof.previous"),
+		interval:        interval,
+		stop:            make(chan struct{}),
+	}, nil
+}
+
+// load replays the snapshot and then the log into kvDb, and opens the log for appending
+func (p *persistence) load(kvDb *MemoryKvDbImpl) error {
+	now := time.Now().UnixMilli()
+	snapshotFile, err := os.Open(p.snapshotPath)
+	if err == nil {
+		var entries []snapshotEntry
+		err = gob.NewDecoder(bufio.NewReader(snapshotFile)).Decode(&entries)
+		_ = snapshotFile.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("invalid snapshot %v: %w", p.snapshotPath, err)
+		}
+		for _, entry := range entries {
+			if entry.ExpiresAt > 0 && entry.ExpiresAt <= now {
+				continue
+			}
+			bucket := kvDb.getBucketImpl(entry.Bucket)
+			bucket.set(entry.Key, entry.Value)
+			if entry.ExpiresAt > 0 {
+				bucket.expireAt(entry.Key, entry.ExpiresAt)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// The log moved aside by a snapshot that did not complete holds the writes made before it
+	previousLogFile, err := os.Open(p.previousLogPath)
+	if err == nil {
+		replayLog(p.previousLogPath, previousLogFile, kvDb, now)
+		_ = previousLogFile.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	logFile, err := os.OpenFile(p.logPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	validSize := replayLog(p.logPath, logFile, kvDb, now)
+	err = logFile.Truncate(validSize)
+	if err == nil {
+		_, err = logFile.Seek(validSize, io.SeekStart)
+	}
+	if err != nil {
+		_ = logFile.Close()
+		return err
+	}
+	p.logFile = logFile
+	return nil
+}
+
+// replayLog applies the records of the log at path into kvDb, and returns the size of the valid records
+func replayLog(path string, logFile *os.File, kvDb *MemoryKvDbImpl, now int64) int64 {
+	var logSize int64
+	if info, err := logFile.Stat(); err == nil {
+		logSize = info.Size()
+	}
+	reader := bufio.NewReader(logFile)
+	var validSize int64
+	for {
+		record, size, err := readLogRecord(reader, logSize-validSize)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				// A record cut by a crash is discarded, together with anything after it
+				fmt.Printf("[WARNING] Discarding the end of %v: %v\n", path, err)
+			}
+			return validSize
+		}
+		validSize += size
+		bucket := kvDb.getBucketImpl(record.bucket)
+		switch record.op {
+		case logOpSet:
+			bucket.set(record.key, record.value)
+		case logOpExpire:
+			if record.expiresAt <= now {
+				bucket.delete(record.key)
+			} else {
+				bucket.expireAt(record.key, record.expiresAt)
+			}
+		case logOpDelete:
+			bucket.delete(record.key)
+		case logOpFlush:
+			bucket.flush()
+		}
+	}
+}
+
+// append writes a record to the log. Errors are logged, as the in-memory write already succeeded. dataLock must be
+// held, so the records are appended in the same order as the writes are applied.
+func (p *persistence) append(record logRecord) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.logFile == nil {
+		return
+	}
+	_, err := p.logFile.Write(encodeLogRecord(record))
+	if err != nil {
+		fmt.Printf("[ERROR] Could not append to %v: %v\n", p.logPath, err)
+	}
+}
+
+// snapshot writes every entry of kvDb to the snapshot file. The entries are copied and the log is moved aside at once,
+// under dataLock, and the writes made while the snapshot is encoded and synced go to a new log. The previous log is
+// removed once the snapshot is complete.
+func (p *persistence) snapshot(kvDb *MemoryKvDbImpl) error {
+	p.snapshotLock.Lock()
+	defer p.snapshotLock.Unlock()
+
+	entries, rotated, err := p.rotate(kvDb)
+	if err != nil || !rotated {
+		return err
+	}
+
+	tmpPath := p.snapshotPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = gob.NewEncoder(writer).Encode(entries)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, p.snapshotPath)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p.previousLogPath)
+}
+
+// rotate copies the entries of kvDb and moves the log to previousLogPath, opening a new one. If the log of a failed
+// snapshot is still there, the current log is appended to it instead. It tells whether the log was rotated, which is
+// not the case once the persistence is closed.
+func (p *persistence) rotate(kvDb *MemoryKvDbImpl) ([]snapshotEntry, bool, error) {
+	bucketsLock.RLock()
+	defer bucketsLock.RUnlock()
+	// No write is applied nor appended while dataLock is held
+	dataLock.RLock()
+	defer dataLock.RUnlock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.logFile == nil {
+		return nil, false, nil
+	}
+
+	var entries []snapshotEntry
+	for name, bucket := range kvDb.buckets {
+		if impl, ok := bucket.(*MemoryKvBucketImpl); ok {
+			for key, pair := range impl.data {
+				entries = append(entries, snapshotEntry{Bucket: name, Key: key, Value: pair.value, ExpiresAt: pair.expiresAt})
+			}
+		}
+	}
+
+	_, err := os.Stat(p.previousLogPath)
+	if err == nil {
+		err = appendFile(p.previousLogPath, p.logFile)
+		if err == nil {
+			err = p.logFile.Truncate(0)
+		}
+		if err == nil {
+			_, err = p.logFile.Seek(0, io.SeekStart)
+		}
+		return entries, err == nil, err
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	err = os.Rename(p.logPath, p.previousLogPath)
+	if err != nil {
+		return nil, false, err
+	}
+	logFile, err := os.OpenFile(p.logPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		// Keep appending to the moved log, as if it had not been rotated
+		_ = os.Rename(p.previousLogPath, p.logPath)
+		return nil, false, err
+	}
+	_ = p.logFile.Close()
+	p.logFile = logFile
+	return entries, true, nil
+}
+
+// appendFile appends the content of source to the file at path
+func appendFile(path string, source *os.File) error {
+	_, err := source.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	target, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (p *persistence) runSnapshots(kvDb *MemoryKvDbImpl) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			err := p.snapshot(kvDb)
+			if err != nil {
+				fmt.Printf("[ERROR] Could not write %v: %v\n", p.snapshotPath, err)
+			}
+		}
+	}
+}
+
+// close writes a last snapshot and closes the log
+func (p *persistence) close(kvDb *MemoryKvDbImpl) error {
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		return nil
+	}
+	p.stopped = true
+	close(p.stop)
+	p.lock.Unlock()
+
+	err := p.snapshot(kvDb)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	closeErr := p.logFile.Close()
+	p.logFile = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// encodeLogRecord serializes a record as its length followed by op, bucket, key, expiresAt and the values. Strings and
+// values are prefixed by their length.
+func encodeLogRecord(record logRecord) []byte {
+	body := []byte{record.op}
+	body = binary.AppendUvarint(body, uint64(len(record.bucket)))
+	body = append(body, record.bucket...)
+	body = binary.AppendUvarint(body, uint64(len(record.key)))
+	body = append(body, record.key...)
+	body = binary.AppendVarint(body, record.expiresAt)
+	body = binary.AppendUvarint(body, uint64(len(record.value)))
+	for _, value := range record.value {
+		body = binary.AppendUvarint(body, uint64(len(value)))
+		body = append(body, value...)
+	}
+	encoded := binary.AppendUvarint(nil, uint64(len(body)))
+	return append(encoded, body...)
+}
+
+// readLogRecord reads the next record and returns it with its encoded size. It returns io.EOF at the end of the log and
+// io.ErrUnexpectedEOF if the last record is incomplete. remaining is the number of bytes left in the log, so that a
+// corrupted length is detected before allocating its body.
+func readLogRecord(reader *bufio.Reader, remaining int64) (logRecord, int64, error) {
+	var record logRecord
+	bodyLength, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return record, 0, err
+	}
+	lengthSize := int64(len(binary.AppendUvarint(nil, bodyLength)))
+	if bodyLength > maxLogRecordLength {
+		return record, 0, fmt.Errorf("corrupted record of %v bytes", bodyLength)
+	}
+	if int64(bodyLength) > remaining-lengthSize {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, bodyLength)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	size := lengthSize + int64(bodyLength)
+
+	corrupted := fmt.Errorf("corrupted record")
+	readBytes := func() ([]byte, bool) {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return nil, false
+		}
+		value := body[n : n+int(length)]
+		body = body[n+int(length):]
+		return value, true
+	}
+	if len(body) == 0 {
+		return record, 0, corrupted
+	}
+	record.op = body[0]
+	body = body[1:]
+	bucket, ok := readBytes()
+	if !ok {
+		return record, 0, corrupted
+	}
+	record.bucket = string(bucket)
+	key, ok := readBytes()
+	if !ok {
+		return record, 0, corrupted
+	}
+	record.key = string(key)
+	expiresAt, n := binary.Varint(body)
+	if n <= 0 {
+		return record, 0, corrupted
+	}
+	record.expiresAt = expiresAt
+	body = body[n:]
+	count, n := binary.Uvarint(body)
+	if n <= 0 {
+		return record, 0, corrupted
+	}
+	body = body[n:]
+	for i := uint64(0); i < count; i++ {
+		value, ok := readBytes()
+		if !ok {
+			return record, 0, corrupted
+		}
+		record.value = append(record.value, append([]byte(nil), value...))
+	}
+	return record, size, nil
+}
@@ -0,0 +1,605 @@
+package memorykv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// multiValuePrefix starts the encoded values holding several entries. It is unlikely to start a plain value.
+var multiValuePrefix = []byte("\x00mkv\x00")
+
+// EncodeValue converts a value to the single string stored by Redis. A value with one entry is stored as is, and
+// other values as multiValuePrefix followed by the number of entries and each entry prefixed by its length.
+func EncodeValue(value [][]byte) []byte {
+	if len(value) == 1 && !bytes.HasPrefix(value[0], multiValuePrefix) {
+		return value[0]
+	}
+	encoded := append([]byte(nil), multiValuePrefix...)
+	encoded = binary.AppendUvarint(encoded, uint64(len(value)))
+	for _, entry := range value {
+		encoded = binary.AppendUvarint(encoded, uint64(len(entry)))
+		encoded = append(encoded, entry...)
+	}
+	return encoded
+}
+
+// DecodeValue reverts EncodeValue. Strings not encoded by EncodeValue are returned as a single entry.
+func DecodeValue(encoded []byte) [][]byte {
+	if !bytes.HasPrefix(encoded, multiValuePrefix) {
+		return [][]byte{encoded}
+	}
+	body := encoded[len(multiValuePrefix):]
+	count, n := binary.Uvarint(body)
+	if n <= 0 || count > uint64(len(body)) {
+		return [][]byte{encoded}
+	}
+	body = body[n:]
+	value := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return [][]byte{encoded}
+		}
+		value = append(value, body[n:n+int(length)])
+		body = body[n+int(length):]
+	}
+	return value
+}
+
+// RemoteOptions configures a database served by a memorykv Server or by Redis
+type RemoteOptions struct {
+	// Address is the host and port, like "127.0.0.1:6379"
+	Address  string
+	Password string
+	// Database is selected after connecting. The memorykv Server only has the database 0.
+	Database int
+	// PoolSize is the maximum number of idle connections kept open. It defaults to 10.
+	PoolSize int
+	// Timeout bounds the dial and each command. It defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+const (
+	defaultRemotePoolSize = 10
+	defaultRemoteTimeout  = 5 * time.Second
+	// remoteScanCount is the number of keys asked for in each SCAN
+	remoteScanCount = 1000
+)
+
+// RemoteMemoryKvDb is a MemoryKvDb stored by a memorykv Server or by Redis, so several processes share it. Bucket keys
+// are stored as "<bucket>:<key>".
+type RemoteMemoryKvDb struct {
+	options RemoteOptions
+	idle    chan *remoteConn
+
+	bucketsLock sync.Mutex
+	buckets     map[string]*RemoteMemoryKvBucket
+	closed      atomic.Bool
+}
+
+type remoteConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// NewRemoteMemoryKvDb connects to the server and checks that it answers to PING
+func NewRemoteMemoryKvDb(options RemoteOptions) (*RemoteMemoryKvDb, error) {
+	if options.PoolSize <= 0 {
+		options.PoolSize = defaultRemotePoolSize
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultRemoteTimeout
+	}
+	kvDb := &RemoteMemoryKvDb{
+		options: options,
+		idle:    make(chan *remoteConn, options.PoolSize),
+		buckets: make(map[string]*RemoteMemoryKvBucket),
+	}
+	err := kvDb.Ping(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return kvDb, nil
+}
+
+func (kvDb *RemoteMemoryKvDb) dial() (*remoteConn, error) {
+	conn, err := net.DialTimeout("tcp", kvDb.options.Address, kvDb.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	remote := &remoteConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	if kvDb.options.Password != "" {
+		_, err = remote.do(kvDb.options.Timeout, "AUTH", kvDb.options.Password)
+	}
+	if err == nil && kvDb.options.Database != 0 {
+		_, err = remote.do(kvDb.options.Timeout, "SELECT", strconv.Itoa(kvDb.options.Database))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return remote, nil
+}
+
+func (remote *remoteConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	replies, err := remote.pipeline(timeout, args)
+	if err != nil {
+		return nil, err
+	}
+	return replyOrError(replies[0])
+}
+
+// pipeline sends the commands and reads a reply for each of them. The error replies are returned as respError values.
+func (remote *remoteConn) pipeline(timeout time.Duration, commands ...[]string) ([]interface{}, error) {
+	_ = remote.conn.SetDeadline(time.Now().Add(timeout))
+	for _, args := range commands {
+		asBytes := make([][]byte, len(args))
+		for i, arg := range args {
+			asBytes[i] = []byte(arg)
+		}
+		err := writeCommand(remote.writer, asBytes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readResp(remote.reader, replyRespLimits)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func replyOrError(reply interface{}) (interface{}, error) {
+	if replyErr, ok := reply.(respError); ok {
+		return nil, replyErr
+	}
+	return reply, nil
+}
+
+// do runs a command on an idle connection
+func (kvDb *RemoteMemoryKvDb) do(args ...string) (interface{}, error) {
+	replies, err := kvDb.pipeline(args)
+	if err != nil {
+		return nil, err
+	}
+	return replyOrError(replies[0])
+}
+
+// multi runs the commands atomically between MULTI and EXEC, and returns their replies
+func (kvDb *RemoteMemoryKvDb) multi(commands ...[]string) ([]interface{}, error) {
+	transaction := append([][]string{{"MULTI"}}, commands...)
+	replies, err := kvDb.pipeline(append(transaction, []string{"EXEC"})...)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if _, err := replyOrError(reply); err != nil {
+			return nil, err
+		}
+	}
+	results, ok := replies[len(replies)-1].([]interface{})
+	if !ok || len(results) != len(commands) {
+		return nil, fmt.Errorf("unexpected reply to EXEC %v", replies[len(replies)-1])
+	}
+	return results, nil
+}
+
+// pipeline runs the commands on an idle connection
+func (kvDb *RemoteMemoryKvDb) pipeline(commands ...[]string) ([]interface{}, error) {
+	var replies []interface{}
+	err := kvDb.withConn(func(remote *remoteConn) error {
+		var err error
+		replies, err = remote.pipeline(kvDb.options.Timeout, commands...)
+		return err
+	})
+	return replies, err
+}
+
+// withConn runs fn on an idle connection, for the commands that depend on the state of the connection, like WATCH.
+// Connections failing with network errors are discarded.
+func (kvDb *RemoteMemoryKvDb) withConn(fn func(remote *remoteConn) error) error {
+	if kvDb.closed.Load() {
+		return errors.New("memorykv: remote database is closed")
+	}
+	var remote *remoteConn
+	select {
+	case remote = <-kvDb.idle:
+	default:
+		var err error
+		remote, err = kvDb.dial()
+		if err != nil {
+			return err
+		}
+	}
+	err := fn(remote)
+	// The connection is still usable after an error reply
+	if _, isReply := err.(respError); err != nil && !isReply {
+		_ = remote.conn.Close()
+		return err
+	}
+	select {
+	case kvDb.idle <- remote:
+	default:
+		_ = remote.conn.Close()
+	}
+	return err
+}
+
+// Ping checks that the server answers
+func (kvDb *RemoteMemoryKvDb) Ping(ctx context.Context) error {
+	reply, err := kvDb.do("PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply to PING %v", reply)
+	}
+	return ctx.Err()
+}
+
+func (kvDb *RemoteMemoryKvDb) GetBucket(name string) MemoryKvBucket {
+	kvDb.bucketsLock.Lock()
+	defer kvDb.bucketsLock.Unlock()
+	bucket, ok := kvDb.buckets[name]
+	if !ok {
+		bucket = &RemoteMemoryKvBucket{db: kvDb, name: name}
+		kvDb.buckets[name] = bucket
+	}
+	return bucket
+}
+
+// Buckets lists the buckets of all the keys of the server
+func (kvDb *RemoteMemoryKvDb) Buckets() []string {
+	keys, err := kvDb.keys("*")
+	if err != nil {
+		fmt.Printf("[ERROR] Could not list the memorykv buckets: %v\n", err)
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, key := range keys {
+		name, _ := splitKey(key)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Stats returns the hits and misses of the buckets used by this client. The server is not scanned.
+func (kvDb *RemoteMemoryKvDb) Stats() map[string]MemoryKvStats {
+	kvDb.bucketsLock.Lock()
+	defer kvDb.bucketsLock.Unlock()
+	stats := make(map[string]MemoryKvStats, len(kvDb.buckets))
+	for name, bucket := range kvDb.buckets {
+		stats[name] = bucket.Stats()
+	}
+	return stats
+}
+
+// Purge does nothing, as the entries are shared with other clients
+func (kvDb *RemoteMemoryKvDb) Purge() error {
+	return nil
+}
+
+// Snapshot does nothing, as the server persists its own entries
+func (kvDb *RemoteMemoryKvDb) Snapshot() error {
+	return nil
+}
+
+// Close closes the idle connections. Later commands fail.
+func (kvDb *RemoteMemoryKvDb) Close() error {
+	if kvDb.closed.Swap(true) {
+		return nil
+	}
+	for {
+		select {
+		case remote := <-kvDb.idle:
+			_ = remote.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// keys lists the keys matching the glob pattern with SCAN, which does not block Redis like KEYS
+func (kvDb *RemoteMemoryKvDb) keys(pattern string) ([]string, error) {
+	var keys []string
+	// SCAN may return a key more than once
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := kvDb.do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(remoteScanCount))
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected reply to SCAN %v", reply)
+		}
+		next, err := respBytes(page[0])
+		if err != nil {
+			return nil, err
+		}
+		values, ok := page[1].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected reply to SCAN %v", reply)
+		}
+		for _, value := range values {
+			key, err := respBytes(value)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				keys = append(keys, string(key))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+//goland:noinspection GoNameStartsWithPackageName
+type RemoteMemoryKvBucket struct {
+	db     *RemoteMemoryKvDb
+	name   string
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func (kvBucket *RemoteMemoryKvBucket) fullKey(key string) string {
+	return kvBucket.name + ":" + key
+}
+
+func (kvBucket *RemoteMemoryKvBucket) Get(key string) ([][]byte, error) {
+	reply, err := kvBucket.db.do("GET", kvBucket.fullKey(key))
+	if err != nil {
+		return nil, err
+	}
+	value, err := respBytes(reply)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		kvBucket.misses.Add(1)
+		return nil, nil
+	}
+	kvBucket.hits.Add(1)
+	return DecodeValue(value), nil
+}
+
+// Set logs the errors, as MemoryKvBucket.Set cannot return them
+func (kvBucket *RemoteMemoryKvBucket) Set(key string, value [][]byte) {
+	_, err := kvBucket.db.do("SET", kvBucket.fullKey(key), string(EncodeValue(value)))
+	if err != nil {
+		fmt.Printf("[ERROR] Could not set memorykv key %v: %v\n", kvBucket.fullKey(key), err)
+	}
+}
+
+func (kvBucket *RemoteMemoryKvBucket) SetEx(key string, value [][]byte, ttl time.Duration) error {
+	_, err := kvBucket.db.do("SET", kvBucket.fullKey(key), string(EncodeValue(value)), "PX", strconv.FormatInt(remoteMillis(ttl), 10))
+	return err
+}
+
+func (kvBucket *RemoteMemoryKvBucket) Delete(key string) error {
+	_, err := kvBucket.db.do("DEL", kvBucket.fullKey(key))
+	return err
+}
+
+func (kvBucket *RemoteMemoryKvBucket) Expire(key string, ttl time.Duration) error {
+	seconds := int64(ttl.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	reply, err := kvBucket.db.do("EXPIRE", kvBucket.fullKey(key), strconv.FormatInt(seconds, 10))
+	if err != nil {
+		return err
+	}
+	updated, err := respInteger(reply)
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("key not found")
+	}
+	return nil
+}
+
+func (kvBucket *RemoteMemoryKvBucket) TTL(key string) (time.Duration, bool) {
+	reply, err := kvBucket.db.do("TTL", kvBucket.fullKey(key))
+	if err != nil {
+		fmt.Printf("[ERROR] Could not get the TTL of memorykv key %v: %v\n", kvBucket.fullKey(key), err)
+		return 0, false
+	}
+	seconds, err := respInteger(reply)
+	if err != nil || seconds == -2 {
+		return 0, false
+	}
+	if seconds < 0 {
+		return -1, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func (kvBucket *RemoteMemoryKvBucket) Incr(key string, ttl time.Duration) (int64, error) {
+	return kvBucket.IncrBy(key, 1, ttl)
+}
+
+// IncrBy creates the missing counters with the TTL in the same transaction as the increment, as Redis does not create
+// counters with TTL
+func (kvBucket *RemoteMemoryKvBucket) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+	increment := []string{"INCRBY", kvBucket.fullKey(key), strconv.FormatInt(delta, 10)}
+	var reply interface{}
+	var err error
+	if ttl > 0 {
+		var replies []interface{}
+		replies, err = kvBucket.db.multi([]string{"SET", kvBucket.fullKey(key), "0", "NX", "PX", strconv.FormatInt(remoteMillis(ttl), 10)}, increment)
+		if err == nil {
+			reply, err = replyOrError(replies[1])
+		}
+	} else {
+		reply, err = kvBucket.db.do(increment...)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "not an integer") {
+			return 0, ErrNotInteger
+		}
+		return 0, err
+	}
+	return respInteger(reply)
+}
+
+func (kvBucket *RemoteMemoryKvBucket) SetNX(key string, value [][]byte, ttl time.Duration) (bool, error) {
+	args := []string{"SET", kvBucket.fullKey(key), string(EncodeValue(value)), "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(remoteMillis(ttl), 10))
+	}
+	reply, err := kvBucket.db.do(args...)
+	return reply != nil, err
+}
+
+// CompareAndSwap watches the key with WATCH, compares its value and sets the new one between MULTI and EXEC, which fails
+// if the key changed in the meantime
+func (kvBucket *RemoteMemoryKvBucket) CompareAndSwap(key string, oldValue [][]byte, newValue [][]byte, ttl time.Duration) (bool, error) {
+	if oldValue == nil {
+		return kvBucket.SetNX(key, newValue, ttl)
+	}
+	fullKey := kvBucket.fullKey(key)
+	set := []string{"SET", fullKey, string(EncodeValue(newValue))}
+	if ttl > 0 {
+		set = append(set, "PX", strconv.FormatInt(remoteMillis(ttl), 10))
+	} else {
+		set = append(set, "KEEPTTL")
+	}
+	var swapped bool
+	err := kvBucket.db.withConn(func(remote *remoteConn) error {
+		timeout := kvBucket.db.options.Timeout
+		replies, err := remote.pipeline(timeout, []string{"WATCH", fullKey}, []string{"GET", fullKey})
+		if err != nil {
+			return err
+		}
+		current, err := respBytes(replies[1])
+		if _, watchErr := replyOrError(replies[0]); watchErr != nil || err != nil || current == nil || !bytes.Equal(current, EncodeValue(oldValue)) {
+			_, unwatchErr := remote.do(timeout, "UNWATCH")
+			return errors.Join(watchErr, err, unwatchErr)
+		}
+		// EXEC discards the watched keys, and replies with a null array if one of them changed
+		replies, err = remote.pipeline(timeout, []string{"MULTI"}, set, []string{"EXEC"})
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if _, err := replyOrError(reply); err != nil {
+				return err
+			}
+		}
+		results, ok := replies[2].([]interface{})
+		if ok {
+			if _, err := replyOrError(results[0]); err != nil {
+				return err
+			}
+		}
+		swapped = ok
+		return nil
+	})
+	return swapped, err
+}
+
+func (kvBucket *RemoteMemoryKvBucket) GetSet(key string, value [][]byte) ([][]byte, error) {
+	return kvBucket.GetSetEx(key, value, 0)
+}
+
+func (kvBucket *RemoteMemoryKvBucket) GetSetEx(key string, value [][]byte, ttl time.Duration) ([][]byte, error) {
+	args := []string{"SET", kvBucket.fullKey(key), string(EncodeValue(value))}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(remoteMillis(ttl), 10))
+	} else {
+		args = append(args, "KEEPTTL")
+	}
+	reply, err := kvBucket.db.do(append(args, "GET")...)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := respBytes(reply)
+	if err != nil || previous == nil {
+		return nil, err
+	}
+	return DecodeValue(previous), nil
+}
+
+func (kvBucket *RemoteMemoryKvBucket) Keys() []string {
+	pattern := escapeGlob(kvBucket.name) + ":*"
+	if kvBucket.name == DefaultBucket {
+		// The memorykv Server lists the keys of DefaultBucket without prefix
+		pattern = "*"
+	}
+	keys, err := kvBucket.db.keys(pattern)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not list the keys of memorykv bucket %v: %v\n", kvBucket.name, err)
+		return nil
+	}
+	result := make([]string, 0, len(keys))
+	for _, fullKey := range keys {
+		if bucketName, key := splitKey(fullKey); bucketName == kvBucket.name {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// Flush deletes the keys of the bucket
+func (kvBucket *RemoteMemoryKvBucket) Flush() {
+	for _, key := range kvBucket.Keys() {
+		err := kvBucket.Delete(key)
+		if err != nil {
+			fmt.Printf("[ERROR] Could not flush memorykv bucket %v: %v\n", kvBucket.name, err)
+			return
+		}
+	}
+}
+
+func (kvBucket *RemoteMemoryKvBucket) Stats() MemoryKvStats {
+	return MemoryKvStats{
+		Hits:   kvBucket.hits.Load(),
+		Misses: kvBucket.misses.Load(),
+	}
+}
+
+// remoteMillis rounds up ttl to milliseconds, as Redis rejects expirations of 0
+func remoteMillis(ttl time.Duration) int64 {
+	millis := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	if millis < 1 {
+		millis = 1
+	}
+	return millis
+}
+
+func escapeGlob(value string) string {
+	var escaped strings.Builder
+	for _, char := range value {
+		if strings.ContainsRune(`*?[]\`, char) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
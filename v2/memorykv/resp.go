@@ -0,0 +1,173 @@
+package memorykv
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// respError is an error reply of the RESP protocol
+type respError string
+
+func (err respError) Error() string {
+	return string(err)
+}
+
+// respLimits bound the values accepted by readResp, so a peer cannot make it allocate unbounded memory
+type respLimits struct {
+	maxArrayLength int
+	maxBulkLength  int
+	// maxDepth is the number of nested arrays accepted
+	maxDepth int
+}
+
+var (
+	// unauthenticatedRespLimits apply to the requests received before AUTH, as in Redis
+	unauthenticatedRespLimits = respLimits{maxArrayLength: 10, maxBulkLength: 16 * 1024, maxDepth: 1}
+	// requestRespLimits apply to the requests of the authenticated clients, which are flat arrays of bulk strings
+	requestRespLimits = respLimits{maxArrayLength: 1024 * 1024, maxBulkLength: 512 * 1024 * 1024, maxDepth: 1}
+	// replyRespLimits apply to the replies read from a server
+	replyRespLimits = respLimits{maxArrayLength: math.MaxInt32, maxBulkLength: 512 * 1024 * 1024, maxDepth: 4}
+)
+
+// respChunkSize is the most memory allocated ahead of the data received for bulk strings and arrays
+const respChunkSize = 64 * 1024
+
+var errProtocol = errors.New("protocol error")
+
+// readResp reads a RESP value: a string for simple strings, a respError, an int64, a []byte for bulk strings, nil for
+// null replies or a []interface{} for arrays. Inline commands, as sent by telnet, are read as arrays of []byte.
+func readResp(reader *bufio.Reader, limits respLimits) (interface{}, error) {
+	return readRespValue(reader, limits, 0)
+}
+
+func readRespValue(reader *bufio.Reader, limits respLimits, depth int) (interface{}, error) {
+	line, err := readRespLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return readRespValue(reader, limits, depth)
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length > limits.maxBulkLength {
+			return nil, errProtocol
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		// The buffer grows as the data arrives, instead of trusting the announced length
+		value := bytes.NewBuffer(make([]byte, 0, min(length+2, respChunkSize)))
+		_, err = io.CopyN(value, reader, int64(length+2))
+		if err != nil {
+			return nil, err
+		}
+		return value.Bytes()[:length], nil
+	case '*':
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count > limits.maxArrayLength || depth >= limits.maxDepth {
+			return nil, errProtocol
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, 0, min(count, respChunkSize))
+		for i := 0; i < count; i++ {
+			value, err := readRespValue(reader, limits, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	fields := bytes.Fields(line)
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		values[i] = field
+	}
+	return values, nil
+}
+
+func readRespLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errProtocol
+		}
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+func writeSimpleString(writer *bufio.Writer, value string) {
+	writer.WriteString("+" + value + "\r\n")
+}
+
+func writeError(writer *bufio.Writer, message string) {
+	writer.WriteString("-" + message + "\r\n")
+}
+
+func writeInteger(writer *bufio.Writer, value int64) {
+	writer.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+}
+
+func writeBulk(writer *bufio.Writer, value []byte) {
+	if value == nil {
+		writer.WriteString("$-1\r\n")
+		return
+	}
+	writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n")
+	writer.Write(value)
+	writer.WriteString("\r\n")
+}
+
+func writeArrayHeader(writer *bufio.Writer, count int) {
+	writer.WriteString("*" + strconv.Itoa(count) + "\r\n")
+}
+
+// writeCommand writes a command as an array of bulk strings
+func writeCommand(writer *bufio.Writer, args ...[]byte) error {
+	writeArrayHeader(writer, len(args))
+	for _, arg := range args {
+		writeBulk(writer, arg)
+	}
+	return writer.Flush()
+}
+
+func respBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, nil
+	case respError:
+		return nil, v
+	}
+	return nil, fmt.Errorf("unexpected reply %v", value)
+}
+
+func respInteger(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case respError:
+		return 0, v
+	}
+	return 0, fmt.Errorf("unexpected reply %v", value)
+}
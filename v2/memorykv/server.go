@@ -0,0 +1,683 @@
+package memorykv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBucket holds the keys without a bucket prefix received by the Server
+const DefaultBucket = "default"
+
+// ServerOptions configures a Server
+type ServerOptions struct {
+	// Password must be sent with AUTH before any other command if not empty
+	Password string
+}
+
+// Server exposes a database over a subset of the Redis protocol (RESP): PING, ECHO, AUTH, SELECT 0, GET, SET with EX,
+// PX, NX, IFEQ, GET and KEEPTTL, SETEX, DEL, EXPIRE, PEXPIRE, TTL, INCR, INCRBY, KEYS, SCAN, FLUSHDB, MULTI, EXEC,
+// DISCARD, WATCH and UNWATCH. EXEC fails when the value of a watched key changed since WATCH. A key "<bucket>:<key>" is stored as <key> in <bucket>, and keys without a colon are stored in
+// DefaultBucket. Values holding several entries are returned by GET encoded as described in EncodeValue.
+type Server struct {
+	db      MemoryKvDb
+	options ServerOptions
+
+	// execLock is held exclusively by EXEC, so the transactions are atomic for the clients of the server
+	execLock sync.RWMutex
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewServer(db MemoryKvDb, options ServerOptions) *Server {
+	return &Server{
+		db:      db,
+		options: options,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listens on address, like "127.0.0.1:6380", and serves in the background until Close
+func (server *Server) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server.lock.Lock()
+	server.listener = listener
+	server.lock.Unlock()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil {
+			fmt.Printf("[ERROR] memorykv server on %v stopped: %v\n", listener.Addr(), err)
+		}
+	}()
+	return nil
+}
+
+// Serve accepts connections on listener until Close. It returns nil after Close.
+func (server *Server) Serve(listener net.Listener) error {
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		return listener.Close()
+	}
+	server.listener = listener
+	server.lock.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			server.lock.Lock()
+			closed := server.closed
+			server.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		server.lock.Lock()
+		if server.closed {
+			server.lock.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		server.conns[conn] = struct{}{}
+		server.wg.Add(1)
+		server.lock.Unlock()
+		go server.handle(conn)
+	}
+}
+
+// Addr returns the address the server listens on, or nil before serving
+func (server *Server) Addr() net.Addr {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Addr()
+}
+
+// Close stops listening and closes the open connections. The database is not closed.
+func (server *Server) Close() error {
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		return nil
+	}
+	server.closed = true
+	var err error
+	if server.listener != nil {
+		err = server.listener.Close()
+	}
+	for conn := range server.conns {
+		_ = conn.Close()
+	}
+	server.lock.Unlock()
+	server.wg.Wait()
+	return err
+}
+
+func (server *Server) handle(conn net.Conn) {
+	defer func() {
+		server.lock.Lock()
+		delete(server.conns, conn)
+		server.lock.Unlock()
+		_ = conn.Close()
+		server.wg.Done()
+	}()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	authenticated := server.options.Password == ""
+	// transaction holds the commands queued since MULTI, or is nil outside of MULTI
+	var transaction *serverTransaction
+	// watched holds the values of the keys watched since the last EXEC, DISCARD or UNWATCH. Missing keys are nil.
+	var watched map[string][]byte
+	for {
+		limits := requestRespLimits
+		if !authenticated {
+			limits = unauthenticatedRespLimits
+		}
+		request, err := readResp(reader, limits)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				writeError(writer, "ERR Protocol error")
+				_ = writer.Flush()
+			}
+			return
+		}
+		args, ok := commandArgs(request)
+		if !ok {
+			writeError(writer, "ERR Protocol error")
+			_ = writer.Flush()
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(args[0])
+		switch {
+		case name == "QUIT":
+			writeSimpleString(writer, "OK")
+			_ = writer.Flush()
+			return
+		case name == "AUTH":
+			authenticated = server.auth(writer, args)
+		case !authenticated:
+			writeError(writer, "NOAUTH Authentication required.")
+		case name == "MULTI":
+			if transaction != nil {
+				writeError(writer, "ERR MULTI calls can not be nested")
+			} else {
+				transaction = &serverTransaction{}
+				writeSimpleString(writer, "OK")
+			}
+		case name == "WATCH":
+			if transaction != nil {
+				writeError(writer, "ERR WATCH inside MULTI is not allowed")
+			} else if len(args) < 2 {
+				writeError(writer, "ERR wrong number of arguments for 'watch' command")
+			} else {
+				if watched == nil {
+					watched = make(map[string][]byte)
+				}
+				server.execLock.RLock()
+				for _, fullKey := range args[1:] {
+					if _, ok := watched[fullKey]; !ok {
+						watched[fullKey] = server.currentValue(fullKey)
+					}
+				}
+				server.execLock.RUnlock()
+				writeSimpleString(writer, "OK")
+			}
+		case name == "UNWATCH" && transaction == nil:
+			watched = nil
+			writeSimpleString(writer, "OK")
+		case name == "EXEC" || name == "DISCARD":
+			if transaction == nil {
+				writeError(writer, fmt.Sprintf("ERR %v without MULTI", name))
+			} else if name == "DISCARD" {
+				writeSimpleString(writer, "OK")
+			} else {
+				server.exec(writer, transaction, watched)
+			}
+			transaction = nil
+			watched = nil
+		case transaction != nil:
+			if message := commandError(name, args); message != "" {
+				transaction.aborted = true
+				writeError(writer, message)
+			} else {
+				transaction.commands = append(transaction.commands, args)
+				writeSimpleString(writer, "QUEUED")
+			}
+		default:
+			server.execLock.RLock()
+			server.execute(writer, name, args)
+			server.execLock.RUnlock()
+		}
+		// Pipelined commands are answered together
+		if reader.Buffered() == 0 {
+			if writer.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func commandArgs(request interface{}) ([]string, bool) {
+	values, ok := request.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	args := make([]string, len(values))
+	for i, value := range values {
+		asBytes, ok := value.([]byte)
+		if !ok {
+			return nil, false
+		}
+		args[i] = string(asBytes)
+	}
+	return args, true
+}
+
+func (server *Server) auth(writer *bufio.Writer, args []string) bool {
+	if len(args) < 2 || len(args) > 3 {
+		writeError(writer, "ERR wrong number of arguments for 'auth' command")
+		return false
+	}
+	if server.options.Password == "" {
+		writeError(writer, "ERR AUTH called without any password configured")
+		return true
+	}
+	password := args[len(args)-1]
+	if subtle.ConstantTimeCompare([]byte(password), []byte(server.options.Password)) != 1 {
+		writeError(writer, "WRONGPASS invalid username-password pair")
+		return false
+	}
+	writeSimpleString(writer, "OK")
+	return true
+}
+
+// arities are the numbers of arguments of the commands, including the command name. Negative numbers are minimums.
+var arities = map[string]int{
+	"PING":    -1,
+	"ECHO":    2,
+	"SELECT":  2,
+	"GET":     2,
+	"SET":     -3,
+	"SETEX":   4,
+	"DEL":     -2,
+	"EXPIRE":  3,
+	"PEXPIRE": 3,
+	"TTL":     2,
+	"INCR":    2,
+	"INCRBY":  3,
+	"KEYS":    2,
+	"SCAN":    -2,
+	"FLUSHDB": -1,
+	"COMMAND": -1,
+}
+
+// serverTransaction holds the commands queued between MULTI and EXEC
+type serverTransaction struct {
+	commands [][]string
+	// aborted is set when a command could not be queued, and makes EXEC fail
+	aborted bool
+}
+
+// commandError returns the error for unknown commands or wrong numbers of arguments, or an empty string
+func commandError(name string, args []string) string {
+	arity, known := arities[name]
+	if !known {
+		return fmt.Sprintf("ERR unknown command '%v'", args[0])
+	}
+	if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		return fmt.Sprintf("ERR wrong number of arguments for '%v' command", strings.ToLower(name))
+	}
+	return ""
+}
+
+// exec runs the queued commands without interleaving the commands of other clients, and replies with an array of
+// their replies. If the value of a watched key changed, nothing is run and the reply is a null array.
+func (server *Server) exec(writer *bufio.Writer, transaction *serverTransaction, watched map[string][]byte) {
+	if transaction.aborted {
+		writeError(writer, "EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+	server.execLock.Lock()
+	defer server.execLock.Unlock()
+	for fullKey, watchedValue := range watched {
+		current := server.currentValue(fullKey)
+		if (current == nil) != (watchedValue == nil) || !bytes.Equal(current, watchedValue) {
+			writeArrayHeader(writer, -1)
+			return
+		}
+	}
+	writeArrayHeader(writer, len(transaction.commands))
+	for _, args := range transaction.commands {
+		server.execute(writer, strings.ToUpper(args[0]), args)
+	}
+}
+
+// currentValue returns the encoded value of the key, or nil if it does not exist
+func (server *Server) currentValue(fullKey string) []byte {
+	bucket, key := server.bucketKey(fullKey)
+	value, err := bucket.Get(key)
+	if err != nil || value == nil {
+		return nil
+	}
+	return EncodeValue(value)
+}
+
+func (server *Server) execute(writer *bufio.Writer, name string, args []string) {
+	if message := commandError(name, args); message != "" {
+		writeError(writer, message)
+		return
+	}
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			writeBulk(writer, []byte(args[1]))
+		} else {
+			writeSimpleString(writer, "PONG")
+		}
+	case "ECHO":
+		writeBulk(writer, []byte(args[1]))
+	case "SELECT":
+		if args[1] != "0" {
+			writeError(writer, "ERR DB index is out of range")
+		} else {
+			writeSimpleString(writer, "OK")
+		}
+	case "COMMAND":
+		// redis-cli asks for the command docs on start
+		writeArrayHeader(writer, 0)
+	case "GET":
+		bucket, key := server.bucketKey(args[1])
+		value, err := bucket.Get(key)
+		if err != nil {
+			writeError(writer, "ERR "+err.Error())
+		} else if value == nil {
+			writeBulk(writer, nil)
+		} else {
+			writeBulk(writer, EncodeValue(value))
+		}
+	case "SET":
+		server.set(writer, args)
+	case "SETEX":
+		seconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || seconds <= 0 {
+			writeError(writer, "ERR invalid expire time in 'setex' command")
+			return
+		}
+		bucket, key := server.bucketKey(args[1])
+		server.writeOkOrError(writer, bucket.SetEx(key, DecodeValue([]byte(args[3])), time.Duration(seconds)*time.Second))
+	case "DEL":
+		var deleted int64
+		for _, fullKey := range args[1:] {
+			bucket, key := server.bucketKey(fullKey)
+			if _, found := bucket.TTL(key); found {
+				if bucket.Delete(key) == nil {
+					deleted++
+				}
+			}
+		}
+		writeInteger(writer, deleted)
+	case "EXPIRE", "PEXPIRE":
+		amount, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			writeError(writer, "ERR value is not an integer or out of range")
+			return
+		}
+		ttl := time.Duration(amount) * time.Second
+		if name == "PEXPIRE" {
+			ttl = time.Duration(amount) * time.Millisecond
+		}
+		bucket, key := server.bucketKey(args[1])
+		if _, found := bucket.TTL(key); !found {
+			writeInteger(writer, 0)
+			return
+		}
+		if ttl <= 0 {
+			err = bucket.Delete(key)
+		} else {
+			err = bucket.Expire(key, ttl)
+		}
+		if err != nil {
+			writeInteger(writer, 0)
+		} else {
+			writeInteger(writer, 1)
+		}
+	case "TTL":
+		bucket, key := server.bucketKey(args[1])
+		ttl, found := bucket.TTL(key)
+		switch {
+		case !found:
+			writeInteger(writer, -2)
+		case ttl < 0:
+			writeInteger(writer, -1)
+		default:
+			writeInteger(writer, int64(math.Round(ttl.Seconds())))
+		}
+	case "INCR":
+		server.incrBy(writer, args[1], 1)
+	case "INCRBY":
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			writeError(writer, "ERR "+ErrNotInteger.Error())
+			return
+		}
+		server.incrBy(writer, args[1], delta)
+	case "KEYS":
+		writeKeys(writer, server.keys(args[1]))
+	case "SCAN":
+		server.scan(writer, args)
+	case "FLUSHDB":
+		for _, bucketName := range server.db.Buckets() {
+			server.db.GetBucket(bucketName).Flush()
+		}
+		writeSimpleString(writer, "OK")
+	}
+}
+
+// set runs SET key value [EX seconds|PX milliseconds] [NX|IFEQ old] [GET] [KEEPTTL]. GET keeps the expiration, and
+// cannot be combined with NX or IFEQ.
+func (server *Server) set(writer *bufio.Writer, args []string) {
+	var ttl time.Duration
+	var nx, get, ifeq bool
+	var oldValue []byte
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch {
+		case (option == "EX" || option == "PX") && i+1 < len(args) && ttl == 0:
+			amount, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || amount <= 0 {
+				writeError(writer, "ERR invalid expire time in 'set' command")
+				return
+			}
+			if option == "EX" {
+				ttl = time.Duration(amount) * time.Second
+			} else {
+				ttl = time.Duration(amount) * time.Millisecond
+			}
+			i++
+		case option == "NX":
+			nx = true
+		case option == "IFEQ" && i+1 < len(args):
+			ifeq = true
+			oldValue = []byte(args[i+1])
+			i++
+		case option == "GET":
+			get = true
+		case option == "KEEPTTL":
+			// The expiration of existing keys is always kept, unless EX or PX are set
+		default:
+			writeError(writer, "ERR syntax error")
+			return
+		}
+	}
+	if (nx && ifeq) || (get && (nx || ifeq)) {
+		writeError(writer, "ERR syntax error")
+		return
+	}
+	bucket, key := server.bucketKey(args[1])
+	value := DecodeValue([]byte(args[2]))
+	switch {
+	case nx || ifeq:
+		var stored bool
+		var err error
+		if nx {
+			stored, err = bucket.SetNX(key, value, ttl)
+		} else {
+			stored, err = bucket.CompareAndSwap(key, DecodeValue(oldValue), value, ttl)
+		}
+		if err != nil {
+			writeError(writer, "ERR "+err.Error())
+		} else if stored {
+			writeSimpleString(writer, "OK")
+		} else {
+			writeBulk(writer, nil)
+		}
+	case get:
+		previous, err := bucket.GetSetEx(key, value, ttl)
+		if err != nil {
+			writeError(writer, "ERR "+err.Error())
+		} else if previous == nil {
+			writeBulk(writer, nil)
+		} else {
+			writeBulk(writer, EncodeValue(previous))
+		}
+	case ttl > 0:
+		server.writeOkOrError(writer, bucket.SetEx(key, value, ttl))
+	default:
+		bucket.Set(key, value)
+		writeSimpleString(writer, "OK")
+	}
+}
+
+// keys returns the full keys matching the glob pattern
+func (server *Server) keys(pattern string) []string {
+	var keys []string
+	for _, bucketName := range server.db.Buckets() {
+		for _, key := range server.db.GetBucket(bucketName).Keys() {
+			fullKey := joinKey(bucketName, key)
+			if matchGlob(pattern, fullKey) {
+				keys = append(keys, fullKey)
+			}
+		}
+	}
+	return keys
+}
+
+// scan runs SCAN cursor [MATCH pattern] [COUNT count]. Listing the keys does not block the other clients, so every
+// key is returned in the first page, which COUNT allows, as it is only a hint.
+func (server *Server) scan(writer *bufio.Writer, args []string) {
+	if args[1] != "0" {
+		writeError(writer, "ERR invalid cursor")
+		return
+	}
+	pattern := "*"
+	for i := 2; i < len(args); i += 2 {
+		option := strings.ToUpper(args[i])
+		if i+1 >= len(args) || (option != "MATCH" && option != "COUNT") {
+			writeError(writer, "ERR syntax error")
+			return
+		}
+		if option == "MATCH" {
+			pattern = args[i+1]
+		} else if count, err := strconv.Atoi(args[i+1]); err != nil || count < 1 {
+			writeError(writer, "ERR value is not an integer or out of range")
+			return
+		}
+	}
+	writeArrayHeader(writer, 2)
+	writeBulk(writer, []byte("0"))
+	writeKeys(writer, server.keys(pattern))
+}
+
+func writeKeys(writer *bufio.Writer, keys []string) {
+	writeArrayHeader(writer, len(keys))
+	for _, key := range keys {
+		writeBulk(writer, []byte(key))
+	}
+}
+
+func (server *Server) incrBy(writer *bufio.Writer, fullKey string, delta int64) {
+	bucket, key := server.bucketKey(fullKey)
+	result, err := bucket.IncrBy(key, delta, 0)
+	if err != nil {
+		writeError(writer, "ERR "+err.Error())
+		return
+	}
+	writeInteger(writer, result)
+}
+
+func (server *Server) writeOkOrError(writer *bufio.Writer, err error) {
+	if err != nil {
+		writeError(writer, "ERR "+err.Error())
+	} else {
+		writeSimpleString(writer, "OK")
+	}
+}
+
+func (server *Server) bucketKey(fullKey string) (MemoryKvBucket, string) {
+	bucketName, key := splitKey(fullKey)
+	return server.db.GetBucket(bucketName), key
+}
+
+// splitKey returns the bucket and key of "<bucket>:<key>", or DefaultBucket for keys without a colon
+func splitKey(fullKey string) (string, string) {
+	if idx := strings.IndexByte(fullKey, ':'); idx > 0 {
+		return fullKey[:idx], fullKey[idx+1:]
+	}
+	return DefaultBucket, fullKey
+}
+
+// joinKey reverts splitKey
+func joinKey(bucketName, key string) string {
+	if bucketName == DefaultBucket && !strings.Contains(key, ":") {
+		return key
+	}
+	return bucketName + ":" + key
+}
+
+// matchGlob matches the patterns of the KEYS command: * for any characters, ? for one character, [abc] and [a-z] for
+// one of a set, and \ to escape the next character. When a token does not match, only the last * is backtracked, as
+// the earlier ones cannot match more, so the time is bounded by len(pattern) * len(value).
+func matchGlob(pattern, value string) bool {
+	p, v := 0, 0
+	// lastStar is the position of the last * seen, or -1, and starValue the position of value it resumes from
+	lastStar, starValue := -1, 0
+	for v < len(value) {
+		if p < len(pattern) && pattern[p] == '*' {
+			lastStar, starValue = p, v
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if width, matched := matchGlobToken(pattern[p:], value[v]); matched {
+				p += width
+				v++
+				continue
+			}
+		}
+		if lastStar < 0 {
+			return false
+		}
+		// The last * takes one more character
+		starValue++
+		p, v = lastStar+1, starValue
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchGlobToken matches a character with the token at the start of pattern, and returns the length of the token
+func matchGlobToken(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			return 0, false
+		}
+		set := pattern[1 : end+1]
+		negate := len(set) > 0 && set[0] == '^'
+		if negate {
+			set = set[1:]
+		}
+		matched := false
+		for i := 0; i < len(set); i++ {
+			if i+2 < len(set) && set[i+1] == '-' {
+				if set[i] <= c && c <= set[i+2] {
+					matched = true
+				}
+				i += 2
+			} else if set[i] == c {
+				matched = true
+			}
+		}
+		return end + 2, matched != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
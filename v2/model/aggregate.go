@@ -0,0 +1,337 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+// AggregateStages are the stages accepted by Aggregate. $facet runs sub-pipelines made of the same stages.
+var AggregateStages = []string{
+	"$addFields",
+	"$bucket",
+	"$bucketAuto",
+	"$count",
+	"$facet",
+	"$group",
+	"$limit",
+	"$match",
+	"$project",
+	"$set",
+	"$skip",
+	"$sort",
+	"$sortByCount",
+	"$unset",
+	"$unwind",
+}
+
+// forbiddenAggregateOperators read other collections, write, run JavaScript or read fields by a computed name, which
+// would get around the check of the hidden properties, so they are rejected at any depth
+var forbiddenAggregateOperators = map[string]bool{
+	"$accumulator": true,
+	"$function":    true,
+	"$getField":    true,
+	"$graphLookup": true,
+	"$lookup":      true,
+	"$merge":       true,
+	"$out":         true,
+	"$setField":    true,
+	"$unionWith":   true,
+	"$unsetField":  true,
+	"$where":       true,
+}
+
+const (
+	defaultAggregateMaxStages  = 20
+	defaultAggregateMaxResults = 1000
+	defaultAggregateMaxTimeMs  = 30000
+)
+
+// ParseAggregatePipeline parses a JSON array of stages. MongoDB Extended JSON is accepted, so dates can be written as
+// {"$date": "2024-01-01T00:00:00Z"}, for instance in the boundaries of $bucket. The documents inside the stages are
+// decoded as bson.D, keeping the order of their keys, which matters in $sort.
+func ParseAggregatePipeline(raw string) (wst.A, error) {
+	var document struct {
+		Pipeline []bson.D `bson:"pipeline"`
+	}
+	err := bson.UnmarshalExtJSON([]byte(`{"pipeline":`+raw+`}`), false, &document)
+	if err != nil {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_PIPELINE", fiber.Map{"message": fmt.Sprintf("the pipeline must be a JSON array of stages: %v", err)}, "ValidationError")
+	}
+	stages := make(wst.A, len(document.Pipeline))
+	for idx, stage := range document.Pipeline {
+		stages[idx] = wst.M{}
+		for _, element := range stage {
+			stages[idx][element.Key] = element.Value
+		}
+	}
+	return stages, nil
+}
+
+// Aggregate runs the stages over the documents of the model that the bearer of currentContext can read, and returns
+// the documents they produce. The stages must be among AggregateStages and within the limits of the "aggregate"
+// config of the model. The read scope of the bearer, see ReadScope, and the soft delete condition are prepended as
+// the first $match stage.
+func (loadedModel *StatefulModel) Aggregate(stages wst.A, currentContext *EventContext) (wst.A, error) {
+	currentContext = existingOrEmpty(currentContext)
+	config := loadedModel.Config.Aggregate
+	maxStages := config.MaxStages
+	if maxStages <= 0 {
+		maxStages = defaultAggregateMaxStages
+	}
+	stageCount := 0
+	err := validateAggregateStages(stages, &stageCount, maxStages, false)
+	if err != nil {
+		return nil, err
+	}
+	if reference := loadedModel.findHiddenReference(stages); reference != "" {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "BAD_AGGREGATION_STAGE", fiber.Map{"message": fmt.Sprintf("%v cannot be used in the pipeline", reference)}, "ValidationError")
+	}
+
+	scope, err := loadedModel.ReadScope(string(wst.OperationNameAggregate), currentContext)
+	if err != nil {
+		return nil, err
+	}
+	if scope == nil {
+		scope = wst.M{}
+	}
+	pipeline := *loadedModel.excludeSoftDeleted(&wst.A{{"$match": scope}}, currentContext)
+	if len(pipeline[0]["$match"].(wst.M)) == 0 {
+		pipeline = wst.A{}
+	}
+	if len(loadedModel.Config.Hidden) > 0 {
+		// The hidden properties are removed before the stages run, in case a stage reaches them anyway
+		hidden := wst.M{}
+		for _, propertyName := range loadedModel.Config.Hidden {
+			hidden[propertyName] = 0
+		}
+		pipeline = append(pipeline, wst.M{"$project": hidden})
+	}
+	pipeline = append(pipeline, stages...)
+	maxResults := config.MaxResults
+	if maxResults <= 0 {
+		maxResults = defaultAggregateMaxResults
+	}
+	pipeline = append(pipeline, wst.M{"$limit": maxResults})
+
+	maxTimeMs := config.MaxTimeMs
+	if maxTimeMs <= 0 {
+		maxTimeMs = defaultAggregateMaxTimeMs
+	}
+	ds, err := loadedModel.datasourceFor(currentContext)
+	if err != nil {
+		return nil, err
+	}
+	ctx := currentContext.RequestContext()
+	startedAt := time.Now()
+	cursor, err := ds.Aggregate(ctx, loadedModel.CollectionName, &pipeline, datasource.AggregateOptions{
+		AllowDiskUse: config.AllowDiskUse,
+		MaxTime:      time.Duration(maxTimeMs) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var results []wst.M
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return nil, err
+	}
+	loadedModel.logSlowQuery(wst.OperationNameAggregate, time.Since(startedAt))
+	if results == nil {
+		return wst.A{}, nil
+	}
+	// The stages passing the documents through return them whole
+	for _, result := range results {
+		for _, propertyName := range loadedModel.Config.Hidden {
+			delete(result, propertyName)
+		}
+	}
+	return results, nil
+}
+
+// findHiddenReference returns the first hidden property, or the variable holding the whole document, referenced by
+// value, or ""
+func (loadedModel *StatefulModel) findHiddenReference(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		if strings.HasPrefix(v, "$$ROOT") || strings.HasPrefix(v, "$$CURRENT") {
+			return v
+		}
+		if strings.HasPrefix(v, "$") && !strings.HasPrefix(v, "$$") && loadedModel.isHiddenPath(v[1:]) {
+			return v
+		}
+	case wst.A:
+		for _, item := range v {
+			if reference := loadedModel.findHiddenReference(item); reference != "" {
+				return reference
+			}
+		}
+	case primitive.A:
+		for _, item := range v {
+			if reference := loadedModel.findHiddenReference(item); reference != "" {
+				return reference
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if reference := loadedModel.findHiddenReference(item); reference != "" {
+				return reference
+			}
+		}
+	case primitive.D:
+		for _, item := range v {
+			if loadedModel.isHiddenPath(item.Key) {
+				return item.Key
+			}
+			if reference := loadedModel.findHiddenReference(item.Value); reference != "" {
+				return reference
+			}
+		}
+	default:
+		if m, ok := asMap(value); ok {
+			for key, nested := range m {
+				if loadedModel.isHiddenPath(key) {
+					return key
+				}
+				if reference := loadedModel.findHiddenReference(nested); reference != "" {
+					return reference
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// isHiddenPath tells whether the dotted path starts with a hidden property
+func (loadedModel *StatefulModel) isHiddenPath(path string) bool {
+	root := strings.SplitN(path, ".", 2)[0]
+	for _, propertyName := range loadedModel.Config.Hidden {
+		if root == propertyName {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAggregateStages checks the stages, and the sub-pipelines of $facet, counting them in stageCount
+func validateAggregateStages(stages wst.A, stageCount *int, maxStages int, insideFacet bool) error {
+	for _, stage := range stages {
+		*stageCount++
+		if *stageCount > maxStages {
+			return wst.CreateError(fiber.ErrBadRequest, "PIPELINE_TOO_LARGE", fiber.Map{"message": fmt.Sprintf("the pipeline cannot have more than %v stages", maxStages)}, "ValidationError")
+		}
+		if len(stage) != 1 {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_PIPELINE", fiber.Map{"message": "each stage must have exactly one key"}, "ValidationError")
+		}
+		for name, value := range stage {
+			if !isAggregateStage(name) || insideFacet && name == "$facet" {
+				return wst.CreateError(fiber.ErrBadRequest, "BAD_AGGREGATION_STAGE", fiber.Map{"message": fmt.Sprintf("%s aggregation stage not allowed", name)}, "ValidationError")
+			}
+			if operator := findForbiddenOperator(value); operator != "" {
+				return wst.CreateError(fiber.ErrBadRequest, "BAD_AGGREGATION_STAGE", fiber.Map{"message": fmt.Sprintf("%s operator not allowed", operator)}, "ValidationError")
+			}
+			if name != "$facet" {
+				continue
+			}
+			facets, ok := asMap(value)
+			if !ok {
+				return wst.CreateError(fiber.ErrBadRequest, "INVALID_PIPELINE", fiber.Map{"message": "$facet must be an object of pipelines"}, "ValidationError")
+			}
+			for facetName, facet := range facets {
+				subStages, ok := asStages(facet)
+				if !ok {
+					return wst.CreateError(fiber.ErrBadRequest, "INVALID_PIPELINE", fiber.Map{"message": fmt.Sprintf("facet %v must be an array of stages", facetName)}, "ValidationError")
+				}
+				err := validateAggregateStages(subStages, stageCount, maxStages, true)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isAggregateStage(name string) bool {
+	for _, allowedStage := range AggregateStages {
+		if name == allowedStage {
+			return true
+		}
+	}
+	return false
+}
+
+// findForbiddenOperator returns the first key of forbiddenAggregateOperators found in value, or ""
+func findForbiddenOperator(value interface{}) string {
+	if m, ok := asMap(value); ok {
+		for key, nested := range m {
+			if forbiddenAggregateOperators[key] {
+				return key
+			}
+			if operator := findForbiddenOperator(nested); operator != "" {
+				return operator
+			}
+		}
+		return ""
+	}
+	switch v := value.(type) {
+	case primitive.A:
+		for _, item := range v {
+			if operator := findForbiddenOperator(item); operator != "" {
+				return operator
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if operator := findForbiddenOperator(item); operator != "" {
+				return operator
+			}
+		}
+	}
+	return ""
+}
+
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case wst.M:
+		return v, true
+	case primitive.M:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	case primitive.D:
+		return v.Map(), true
+	}
+	return nil, false
+}
+
+func asStages(value interface{}) (wst.A, bool) {
+	var items []interface{}
+	switch v := value.(type) {
+	case wst.A:
+		return v, true
+	case primitive.A:
+		items = v
+	case []interface{}:
+		items = v
+	default:
+		return nil, false
+	}
+	stages := make(wst.A, len(items))
+	for idx, item := range items {
+		stage, ok := asMap(item)
+		if !ok {
+			return nil, false
+		}
+		stages[idx] = stage
+	}
+	return stages, true
+}
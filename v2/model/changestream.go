@@ -0,0 +1,264 @@
+package model
+
+import (
+	"sync"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+type ChangeEventType string
+
+const (
+	ChangeEventCreated ChangeEventType = "created"
+	ChangeEventUpdated ChangeEventType = "updated"
+	ChangeEventDeleted ChangeEventType = "deleted"
+)
+
+// changeSubscriptionBuffer is the number of events a subscriber can fall behind before its subscription is closed
+const changeSubscriptionBuffer = 64
+
+// ChangeEvent is a change of a document, sent to the subscribers of the model change stream
+type ChangeEvent struct {
+	Sequence  int64           `json:"-"` // Sequence is assigned when the event is published
+	Type      ChangeEventType `json:"type"`
+	ModelName string          `json:"modelName"`
+	Id        interface{}     `json:"id"`
+	Data      wst.M           `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+type changeStream struct {
+	lock          sync.RWMutex
+	subscriptions map[*ChangeSubscription]struct{}
+
+	// pending holds the events waiting to be delivered by the dispatcher goroutine, which runs while dispatching is set
+	pendingLock sync.Mutex
+	pending     []changeDelivery
+	dispatching bool
+	sequence    int64
+}
+
+// changeDelivery is an event waiting to be delivered. The recipients are resolved by the dispatcher unless resolved is set.
+type changeDelivery struct {
+	event      ChangeEvent
+	recipients ChangeRecipients
+	resolved   bool
+}
+
+// ChangeSubscription receives the change events of a model matching a where filter and readable by its bearer
+type ChangeSubscription struct {
+	model   *StatefulModel
+	where   wst.M
+	context *EventContext
+
+	lock   sync.Mutex
+	closed bool
+	events chan ChangeEvent
+}
+
+// ChangeRecipients are the subscriptions selected for an event by ChangeRecipients
+type ChangeRecipients []*ChangeSubscription
+
+// SubscribeChanges starts receiving the change events of the model. The where filter uses the same syntax as
+// wst.Filter, although it is evaluated against the document alone, so conditions on relations never match.
+// The subscription must be closed once it is no longer needed.
+func (loadedModel *StatefulModel) SubscribeChanges(where *wst.Where, currentContext *EventContext) (*ChangeSubscription, error) {
+	currentContext = existingOrEmpty(currentContext)
+	whereM := wst.M{}
+	if where != nil {
+		whereM = wst.CopyMap(wst.M(*where))
+		if !currentContext.DisableTypeConversions {
+			_, err := datasource.ReplaceObjectIds(whereM)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	subscription := &ChangeSubscription{
+		model: loadedModel,
+		where: whereM,
+		// The request context is released once the handler returns, so only the authorization data is kept
+		context: &EventContext{Bearer: currentContext.Bearer, Remote: currentContext.Remote, Model: loadedModel},
+		events:  make(chan ChangeEvent, changeSubscriptionBuffer),
+	}
+	loadedModel.changes.lock.Lock()
+	loadedModel.changes.subscriptions[subscription] = struct{}{}
+	loadedModel.changes.lock.Unlock()
+	return subscription, nil
+}
+
+// HasChangeSubscriptions tells whether someone is listening to the changes of the model
+func (loadedModel *StatefulModel) HasChangeSubscriptions() bool {
+	loadedModel.changes.lock.RLock()
+	defer loadedModel.changes.lock.RUnlock()
+	return len(loadedModel.changes.subscriptions) > 0
+}
+
+// CloseChangeSubscriptions closes every subscription of the model, which ends the open change streams
+func (loadedModel *StatefulModel) CloseChangeSubscriptions() {
+	loadedModel.changes.lock.RLock()
+	subscriptions := make([]*ChangeSubscription, 0, len(loadedModel.changes.subscriptions))
+	for subscription := range loadedModel.changes.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	loadedModel.changes.lock.RUnlock()
+	for _, subscription := range subscriptions {
+		subscription.Close()
+	}
+}
+
+// NewChangeEvent builds an event of the model change stream. The hidden properties are removed from data.
+func (loadedModel *StatefulModel) NewChangeEvent(eventType ChangeEventType, id interface{}, data wst.M) ChangeEvent {
+	if data != nil {
+		data = wst.CopyMap(data)
+		for _, propertyName := range loadedModel.Config.Hidden {
+			delete(data, propertyName)
+		}
+	}
+	return ChangeEvent{
+		Type:      eventType,
+		ModelName: loadedModel.Name,
+		Id:        id,
+		Data:      data,
+		Timestamp: time.Now(),
+	}
+}
+
+// ChangeRecipients returns the subscriptions whose where filter matches the event and whose bearer is allowed to read
+// the document. The "$owner" policies need the document to exist, so deletions must be resolved before removing it.
+func (loadedModel *StatefulModel) ChangeRecipients(event ChangeEvent) ChangeRecipients {
+	loadedModel.changes.lock.RLock()
+	subscriptions := make([]*ChangeSubscription, 0, len(loadedModel.changes.subscriptions))
+	for subscription := range loadedModel.changes.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	loadedModel.changes.lock.RUnlock()
+
+	var recipients ChangeRecipients
+	for _, subscription := range subscriptions {
+		if subscription.matches(event) && subscription.canRead(event) {
+			recipients = append(recipients, subscription)
+		}
+	}
+	return recipients
+}
+
+// PublishChange sends the event to the subscriptions returned by ChangeRecipients. The recipients are resolved and
+// the event is delivered in the background, in the same order the events were published.
+func (loadedModel *StatefulModel) PublishChange(event ChangeEvent) {
+	loadedModel.enqueueChange(changeDelivery{event: event})
+}
+
+// PublishChangeTo sends the event in the background to recipients already resolved with ChangeRecipients, keeping the
+// order of the events published with PublishChange
+func (loadedModel *StatefulModel) PublishChangeTo(recipients ChangeRecipients, event ChangeEvent) {
+	loadedModel.enqueueChange(changeDelivery{event: event, recipients: recipients, resolved: true})
+}
+
+func (loadedModel *StatefulModel) enqueueChange(delivery changeDelivery) {
+	changes := loadedModel.changes
+	changes.pendingLock.Lock()
+	changes.sequence++
+	delivery.event.Sequence = changes.sequence
+	changes.pending = append(changes.pending, delivery)
+	if changes.dispatching {
+		changes.pendingLock.Unlock()
+		return
+	}
+	changes.dispatching = true
+	changes.pendingLock.Unlock()
+	go loadedModel.dispatchChanges()
+}
+
+// dispatchChanges delivers the pending events until there are no more, then exits
+func (loadedModel *StatefulModel) dispatchChanges() {
+	changes := loadedModel.changes
+	for {
+		changes.pendingLock.Lock()
+		if len(changes.pending) == 0 {
+			changes.pending = nil
+			changes.dispatching = false
+			changes.pendingLock.Unlock()
+			return
+		}
+		delivery := changes.pending[0]
+		changes.pending = changes.pending[1:]
+		changes.pendingLock.Unlock()
+
+		recipients := delivery.recipients
+		if !delivery.resolved {
+			recipients = loadedModel.ChangeRecipients(delivery.event)
+		}
+		recipients.Send(delivery.event)
+	}
+}
+
+// Send delivers the event without blocking. Subscriptions that fell too far behind are closed.
+func (recipients ChangeRecipients) Send(event ChangeEvent) {
+	for _, subscription := range recipients {
+		subscription.send(event)
+	}
+}
+
+// Events returns the channel of the subscription, which is closed together with the subscription
+func (subscription *ChangeSubscription) Events() <-chan ChangeEvent {
+	return subscription.events
+}
+
+// Close stops the subscription. It is safe to call it more than once.
+func (subscription *ChangeSubscription) Close() {
+	subscription.model.changes.lock.Lock()
+	delete(subscription.model.changes.subscriptions, subscription)
+	subscription.model.changes.lock.Unlock()
+
+	subscription.lock.Lock()
+	defer subscription.lock.Unlock()
+	if !subscription.closed {
+		subscription.closed = true
+		close(subscription.events)
+	}
+}
+
+func (subscription *ChangeSubscription) send(event ChangeEvent) {
+	subscription.lock.Lock()
+	if subscription.closed {
+		subscription.lock.Unlock()
+		return
+	}
+	select {
+	case subscription.events <- event:
+		subscription.lock.Unlock()
+	default:
+		subscription.lock.Unlock()
+		if subscription.model.App.Debug {
+			subscription.model.App.Logger().Printf("[DEBUG] Closing slow change subscription of %v\n", subscription.model.Name)
+		}
+		subscription.Close()
+	}
+}
+
+func (subscription *ChangeSubscription) matches(event ChangeEvent) bool {
+	if len(subscription.where) == 0 {
+		return true
+	}
+	if event.Data == nil {
+		return false
+	}
+	document := wst.CopyMap(event.Data)
+	document["_id"] = event.Id
+	matches, err := datasource.MatchesWhere(document, subscription.where)
+	if err != nil {
+		if subscription.model.App.Debug {
+			subscription.model.App.Logger().Printf("[DEBUG] Could not evaluate change subscription filter of %v: %v\n", subscription.model.Name, err)
+		}
+		return false
+	}
+	return matches
+}
+
+func (subscription *ChangeSubscription) canRead(event ChangeEvent) bool {
+	_, allowed := subscription.model.EnforceEx(subscription.context.Bearer, GetIDAsString(event.Id), string(wst.OperationNameFindById), subscription.context)
+	return allowed
+}
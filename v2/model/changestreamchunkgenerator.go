@@ -0,0 +1,96 @@
+package model
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// changeStreamHeartbeat is the interval of the comments sent to keep idle streams open and to detect closed connections
+const changeStreamHeartbeat = 15 * time.Second
+
+// ChangeStreamChunkGenerator writes the events of a change subscription as Server-Sent Events
+type ChangeStreamChunkGenerator struct {
+	Debug bool
+
+	subscription *ChangeSubscription
+	currentChunk Chunk
+	started      bool
+}
+
+func (chunkGenerator *ChangeStreamChunkGenerator) ContentType() string {
+	return "text/event-stream"
+}
+
+func (chunkGenerator *ChangeStreamChunkGenerator) NextChunk() (chunk Chunk, err error) {
+	err = chunkGenerator.GenerateNextChunk()
+	return chunkGenerator.currentChunk, err
+}
+
+func (chunkGenerator *ChangeStreamChunkGenerator) GenerateNextChunk() error {
+	chunkGenerator.currentChunk.raw = nil
+	chunkGenerator.currentChunk.length = 0
+	if !chunkGenerator.started {
+		chunkGenerator.started = true
+		chunkGenerator.setChunk([]byte(": connected\n\n"))
+		return nil
+	}
+	select {
+	case event, ok := <-chunkGenerator.subscription.Events():
+		if !ok {
+			return io.EOF
+		}
+		asBytes, err := json.Marshal(event)
+		if err != nil {
+			if chunkGenerator.Debug {
+				fmt.Printf("[ERROR] ChangeStreamChunkGenerator.GenerateNextChunk() failed to marshal event: %v\n", err)
+			}
+			return err
+		}
+		chunkGenerator.setChunk([]byte(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Type, asBytes)))
+	case <-time.After(changeStreamHeartbeat):
+		chunkGenerator.setChunk([]byte(": heartbeat\n\n"))
+	}
+	return nil
+}
+
+func (chunkGenerator *ChangeStreamChunkGenerator) setChunk(raw []byte) {
+	chunkGenerator.currentChunk.raw = raw
+	chunkGenerator.currentChunk.length = len(raw)
+}
+
+// Reader returns a reader that closes the subscription when the response stream is released, which happens as soon as
+// the client disconnects
+func (chunkGenerator *ChangeStreamChunkGenerator) Reader(eventContext *EventContext) io.Reader {
+	return &changeStreamReader{
+		ChunkGeneratorReader: ChunkGeneratorReader{
+			chunkGenerator: chunkGenerator,
+			eventContext:   eventContext,
+			debug:          chunkGenerator.Debug,
+		},
+		subscription: chunkGenerator.subscription,
+	}
+}
+
+func (chunkGenerator *ChangeStreamChunkGenerator) SetDebug(debug bool) {
+	chunkGenerator.Debug = debug
+}
+
+type changeStreamReader struct {
+	ChunkGeneratorReader
+	subscription *ChangeSubscription
+}
+
+func (reader *changeStreamReader) Close() error {
+	reader.subscription.Close()
+	return nil
+}
+
+func NewChangeStreamChunkGenerator(loadedModel *StatefulModel, subscription *ChangeSubscription) ChunkGenerator {
+	return &ChangeStreamChunkGenerator{
+		subscription: subscription,
+		Debug:        loadedModel.App.Debug,
+	}
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// FindManyPipeline returns the aggregation pipeline run by FindMany for filterMap
+func (loadedModel *StatefulModel) FindManyPipeline(filterMap *wst.Filter, currentContext *EventContext) (*wst.A, error) {
+	currentContext = existingOrEmpty(currentContext)
+	lookups, err := loadedModel.ExtractLookupsFromFilter(filterMap, currentContext.DisableTypeConversions)
+	if err != nil {
+		return nil, err
+	}
+	return loadedModel.excludeSoftDeleted(lookups, currentContext), nil
+}
+
+// Explain returns the pipeline run by FindMany for filterMap, and its plan as described by the datasource. See
+// datasource.Datasource.Explain.
+func (loadedModel *StatefulModel) Explain(filterMap *wst.Filter, verbosity string, currentContext *EventContext) (*wst.A, wst.M, error) {
+	currentContext = existingOrEmpty(currentContext)
+	lookups, err := loadedModel.FindManyPipeline(filterMap, currentContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	ds, err := loadedModel.datasourceFor(currentContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan, err := ds.Explain(currentContext.RequestContext(), loadedModel.CollectionName, lookups, verbosity)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lookups, plan, nil
+}
+
+// logSlowQuery logs the queries that took longer than the "slowQueryThresholdMs" setting of the datasource. The pipeline
+// is left out because it may contain personal data.
+func (loadedModel *StatefulModel) logSlowQuery(operationName wst.OperationName, elapsed time.Duration) {
+	threshold := loadedModel.Datasource.SlowQueryThreshold()
+	if threshold <= 0 {
+		return
+	}
+	if elapsed < threshold {
+		return
+	}
+	fmt.Printf("[WARNING] Slow query on %v.%v (collection %v) took %v\n", loadedModel.Name, operationName, loadedModel.CollectionName, elapsed.Round(time.Millisecond))
+}
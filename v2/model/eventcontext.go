@@ -1,8 +1,10 @@
 package model
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	fiber "github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt"
@@ -16,6 +18,7 @@ type EventContext struct {
 	Remote                 *RemoteMethodOptions
 	Filter                 *wst.Filter
 	Data                   *wst.M
+	DataItems              *wst.A // DataItems holds the request body when it is a JSON array
 	Query                  *wst.M
 	Instance               *StatefulInstance
 	Ctx                    *fiber.Ctx
@@ -27,9 +30,21 @@ type EventContext struct {
 	StatusCode             int
 	DisableTypeConversions bool
 	SkipFieldProtection    bool
+	IncludeDeleted         bool // IncludeDeleted disables the soft delete filter of FindMany, FindById and Count
 	OperationName          wst.OperationName
 	OperationId            int64
 	Handled                bool
+	Transaction            *Transaction // Transaction is only set in the base context created by WithTransaction
+	// Before is the state of the document before an update or delete, for the observers that compare it in the "after
+	// save" and "after delete" events. It is only set by the observers that need it. For UpdateMany and DeleteMany,
+	// it maps the id of each matched document to its state.
+	Before wst.M
+	// Context is the context of the request, under which the datasource operations run. See RequestContext.
+	Context context.Context
+
+	cancelContext context.CancelFunc
+	// finished is set once the remote method of this base context returned. It is nil outside of remote methods.
+	finished *atomic.Bool
 }
 
 func (eventContext *EventContext) UpdateEphemeral(newData *wst.M) {
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+// DeclaredIndexes returns the indexes declared in the "indexes" section of the model config, and the text index of the
+// "search" section. A collection can only have one text index, so it fails if more than one is declared.
+func (loadedModel *StatefulModel) DeclaredIndexes() ([]datasource.Index, error) {
+	indexes := make([]datasource.Index, 0, len(loadedModel.Config.Indexes))
+	textIndex := ""
+	for idx, indexConfig := range loadedModel.Config.Indexes {
+		if len(indexConfig.Keys) == 0 {
+			return nil, fmt.Errorf("index %v of model %v has no keys", idx, loadedModel.Name)
+		}
+		index := datasource.Index{
+			Name:               indexConfig.Name,
+			Unique:             indexConfig.Unique,
+			Sparse:             indexConfig.Sparse,
+			ExpireAfterSeconds: indexConfig.ExpireAfterSeconds,
+			PartialFilter:      indexConfig.PartialFilter,
+		}
+		for _, key := range indexConfig.Keys {
+			parts := strings.Fields(key)
+			if len(parts) == 0 || len(parts) > 2 {
+				return nil, fmt.Errorf("invalid key %q in index %v of model %v", key, idx, loadedModel.Name)
+			}
+			var value interface{} = 1
+			if len(parts) == 2 {
+				switch strings.ToUpper(parts[1]) {
+				case "ASC":
+				case "DESC":
+					value = -1
+				case "TEXT":
+					value = "text"
+				case "2DSPHERE":
+					value = "2dsphere"
+				default:
+					return nil, fmt.Errorf("invalid key %q in index %v of model %v", key, idx, loadedModel.Name)
+				}
+			}
+			index.Keys = append(index.Keys, bson.E{Key: parts[0], Value: value})
+		}
+		if hasTextKey(index) {
+			if textIndex != "" {
+				return nil, fmt.Errorf("model %v declares the text indexes %v and %v, but a collection can only have one", loadedModel.Name, textIndex, index.IndexName())
+			}
+			textIndex = index.IndexName()
+		}
+		indexes = append(indexes, index)
+	}
+	if loadedModel.Config.Search != nil {
+		if textIndex != "" {
+			return nil, fmt.Errorf("model %v declares the text index %v and a \"search\" section, but a collection can only have one text index. Declare the searchable fields in \"search\" only", loadedModel.Name, textIndex)
+		}
+		index, err := loadedModel.searchIndex()
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+func hasTextKey(index datasource.Index) bool {
+	for _, key := range index.Keys {
+		if key.Value == "text" {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexDiff compares the declared indexes with the ones existing in the datasource
+func (loadedModel *StatefulModel) IndexDiff(ctx context.Context) (datasource.IndexDiff, error) {
+	declared, err := loadedModel.DeclaredIndexes()
+	if err != nil {
+		return datasource.IndexDiff{}, err
+	}
+	return loadedModel.Datasource.DiffIndexes(ctx, loadedModel.CollectionName, declared)
+}
+
+// SyncIndexes creates or updates the declared indexes, and drops the undeclared ones if prune is true. It returns the
+// applied diff.
+func (loadedModel *StatefulModel) SyncIndexes(ctx context.Context, prune bool) (datasource.IndexDiff, error) {
+	diff, err := loadedModel.IndexDiff(ctx)
+	if err != nil {
+		return diff, err
+	}
+	return diff, loadedModel.Datasource.ApplyIndexDiff(ctx, loadedModel.CollectionName, diff, prune)
+}
+
+// duplicateKeyError converts a unique index violation into a 409 validation error naming the indexed properties
+func duplicateKeyError(loadedModel *StatefulModel, err error) error {
+	var duplicateKeyErr *datasource.DuplicateKeyError
+	if !errors.As(err, &duplicateKeyErr) {
+		return err
+	}
+	fields := []string{"id"}
+	if declared, declaredErr := loadedModel.DeclaredIndexes(); declaredErr == nil {
+		for _, index := range declared {
+			if index.IndexName() == duplicateKeyErr.Index {
+				fields = fields[:0]
+				for _, key := range index.Keys {
+					fields = append(fields, key.Key)
+				}
+				break
+			}
+		}
+	}
+	codes := wst.M{}
+	for _, field := range fields {
+		codes[field] = []string{"uniqueness"}
+	}
+	return wst.CreateError(fiber.ErrConflict, "UNIQUENESS", fiber.Map{"message": fmt.Sprintf("The `%v` instance is not valid. Details: %v already exists.", loadedModel.Name, strings.Join(fields, ", ")), "codes": codes}, "ValidationError")
+}
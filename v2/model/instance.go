@@ -245,10 +245,16 @@ func (modelInstance *StatefulInstance) UpdateAttributes(data interface{}, baseCo
 	for key := range *modelInstance.Model.Config.Relations {
 		delete(finalData, key)
 	}
-	_, err := modelInstance.Model.Datasource.UpdateById(modelInstance.Model.CollectionName, modelInstance.Id, &finalData)
-
+	ds, err := modelInstance.Model.datasourceFor(targetBaseContext)
 	if err != nil {
 		return nil, err
+	}
+	// The update is rejected if the document changed since this instance was loaded
+	modelInstance.Model.setExpectedVersion(finalData, modelInstance.GetInt(datasource.VersionProperty))
+	_, err = ds.UpdateByIdContext(targetBaseContext.RequestContext(), modelInstance.Model.CollectionName, modelInstance.Id, &finalData)
+
+	if err != nil {
+		return nil, duplicateKeyError(modelInstance.Model, versionConflictError(modelInstance.Model, modelInstance.Id, err))
 	} else {
 		err := modelInstance.Reload(eventContext)
 		modelInstance.HideProperties()
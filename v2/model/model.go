@@ -10,6 +10,7 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/casbin/casbin/v2"
@@ -78,31 +79,78 @@ type CacheConfig struct {
 	ExcludeFields []string   `json:"excludeFields"`
 }
 
+type ChangeStreamConfig struct {
+	Enabled bool `json:"enabled"`
+	// Source is "memory" (default) to publish the changes applied by this process, or "mongodb" to read them from a
+	// MongoDB change stream, so the changes applied by other processes are received too
+	Source string `json:"source"`
+}
+
+// AggregateConfig limits the pipelines run by GET /{plural}/aggregate
+type AggregateConfig struct {
+	// MaxStages bounds the number of stages, including the ones inside $facet. 20 by default.
+	MaxStages int `json:"maxStages"`
+	// MaxResults bounds the number of documents returned. 1000 by default.
+	MaxResults int `json:"maxResults"`
+	// MaxTimeMs bounds the time spent by the datasource running the pipeline. 30000 by default.
+	MaxTimeMs int `json:"maxTimeMs"`
+	// AllowDiskUse lets the stages exceed the memory limit of the datasource by writing temporary files. Otherwise,
+	// the pipelines exceeding it fail.
+	AllowDiskUse bool `json:"allowDiskUse"`
+}
+
+// IndexConfig declares an index of the model collection. Each key is a property name, optionally followed by ASC
+// (default), DESC, TEXT or 2DSPHERE, like "createdAt DESC".
+type IndexConfig struct {
+	Name               string   `json:"name"`
+	Keys               []string `json:"keys"`
+	Unique             bool     `json:"unique"`
+	Sparse             bool     `json:"sparse"`
+	ExpireAfterSeconds *int32   `json:"expireAfterSeconds"`
+	PartialFilter      wst.M    `json:"partialFilter"`
+}
+
+// SearchConfig declares the properties matched by the full-text search of the "q" filter parameter
+type SearchConfig struct {
+	// Fields are the searchable properties
+	Fields []string `json:"fields"`
+	// Weights are the relevance of the matches in each field, 1 by default
+	Weights map[string]int32 `json:"weights"`
+}
+
 type MongoConfig struct {
 	//Database string `json:"database"`
 	Collection string `json:"collection"`
 }
 
 type Config struct {
-	Name        string                `json:"name"`
-	Plural      string                `json:"plural"`
-	Base        string                `json:"base"`
-	Public      bool                  `json:"public"`
-	Properties  map[string]Property   `json:"properties"`
-	Relations   *map[string]*Relation `json:"relations"`
-	Hidden      []string              `json:"hidden"`
-	Protected   []string              `json:"protected"`
-	Validations []Validation          `json:"validations"`
-	Casbin      CasbinConfig          `json:"casbin"`
-	Cache       CacheConfig           `json:"cache"`
-	Mongo       MongoConfig           `json:"mongo"`
+	Name         string                `json:"name"`
+	Plural       string                `json:"plural"`
+	Base         string                `json:"base"`
+	Public       bool                  `json:"public"`
+	Properties   map[string]Property   `json:"properties"`
+	Relations    *map[string]*Relation `json:"relations"`
+	Hidden       []string              `json:"hidden"`
+	Protected    []string              `json:"protected"`
+	Validations  []Validation          `json:"validations"`
+	SoftDelete   bool                  `json:"softDelete"`
+	Versioned    bool                  `json:"versioned"`
+	Audit        bool                  `json:"audit"`
+	ChangeStream ChangeStreamConfig    `json:"changeStream"`
+	Casbin       CasbinConfig          `json:"casbin"`
+	Cache        CacheConfig           `json:"cache"`
+	Mongo        MongoConfig           `json:"mongo"`
+	Indexes      []IndexConfig         `json:"indexes"`
+	Aggregate    AggregateConfig       `json:"aggregate"`
+	Search       *SearchConfig         `json:"search"`
 }
 
 type Validation struct {
 	If         map[string]Condition  `json:"if"`
 	Then       *Validation           `json:"then"`
 	AllOf      []Validation          `json:"allOf"`
-	OneOf      []Validation          `json:"oneOf"`
+	AnyOf      []Validation          `json:"anyOf"` // AnyOf passes when at least one of the validations passes
+	OneOf      []Validation          `json:"oneOf"` // OneOf is the former name of AnyOf, kept for the existing configs
 	Properties map[string]Validation `json:"properties"`
 	NotEmpty   bool                  `json:"notEmpty"`
 }
@@ -154,10 +202,16 @@ type StatefulModel struct {
 	authCache           map[string]map[string]map[string]bool
 	hasHiddenProperties bool
 	pendingOperations   map[int64]map[string][]pendingOperationEntry
+	// pendingOperationsLock guards pendingOperations, which the concurrent requests queue to and dispatch from
+	pendingOperationsLock sync.Mutex
+	changes               *changeStream
 }
 
 type pendingOperationEntry struct {
 	handler func(eventContext *EventContext) error
+	// finished is set once the remote method that queued the operation returned, so it will never be dispatched. It is
+	// nil for the operations queued outside of remote methods.
+	finished *atomic.Bool
 }
 
 func (loadedModel *StatefulModel) GetConfig() *Config {
@@ -190,6 +244,7 @@ func New(config *Config, modelRegistry *map[string]*StatefulModel) Model {
 		earlyDisabledMethods: map[string]bool{},
 		authCache:            map[string]map[string]map[string]bool{},
 		pendingOperations:    map[int64]map[string][]pendingOperationEntry{},
+		changes:              &changeStream{subscriptions: map[*ChangeSubscription]struct{}{}},
 	}
 	loadedModel.NilInstance = &StatefulInstance{
 		Model: loadedModel,
@@ -319,13 +374,36 @@ func ParseFilter(filter string) *wst.Filter {
 }
 
 func (loadedModel *StatefulModel) FindMany(filterMap *wst.Filter, currentContext *EventContext) Cursor {
+	cursor, _, err := loadedModel.findMany(filterMap, currentContext, false)
+	if err != nil {
+		return NewErrorCursor(err)
+	}
+	return cursor
+}
+
+// FindManyWithTotal is FindMany that also returns the number of documents matching the filter regardless of its skip,
+// limit and pagination cursors. Connectors implementing datasource.FindWithCountConnector obtain both in a single query.
+func (loadedModel *StatefulModel) FindManyWithTotal(filterMap *wst.Filter, currentContext *EventContext) (Cursor, int64, error) {
+	return loadedModel.findMany(filterMap, currentContext, true)
+}
+
+func (loadedModel *StatefulModel) findMany(filterMap *wst.Filter, currentContext *EventContext, withTotal bool) (Cursor, int64, error) {
 
 	currentContext = existingOrEmpty(currentContext)
 	targetBaseContext := FindBaseContext(currentContext)
 
-	lookups, err := loadedModel.ExtractLookupsFromFilter(filterMap, currentContext.DisableTypeConversions)
+	lookups, err := loadedModel.FindManyPipeline(filterMap, currentContext)
 	if err != nil {
-		return NewErrorCursor(err)
+		return nil, 0, err
+	}
+
+	var countLookups *wst.A
+	if withTotal {
+		countLookups, err = loadedModel.ExtractLookupsFromFilter(totalCountFilter(filterMap), currentContext.DisableTypeConversions)
+		if err != nil {
+			return nil, 0, err
+		}
+		countLookups = loadedModel.excludeSoftDeleted(countLookups, currentContext)
 	}
 
 	currentOperationContext := &EventContext{
@@ -340,38 +418,50 @@ func (loadedModel *StatefulModel) FindMany(filterMap *wst.Filter, currentContext
 	if loadedModel.DisabledHandlers["__operation__before_load"] != true {
 		err := loadedModel.GetHandler("__operation__before_load")(currentOperationContext)
 		if err != nil {
-			return NewErrorCursor(err)
+			return nil, 0, err
 		}
 		if currentOperationContext.Result != nil {
+			// The database is not queried, so the total is the number of results provided by the hook
+			var result InstanceA
 			switch currentOperationContext.Result.(type) {
 			case *InstanceA:
-				return newFixedLengthCursor(*currentOperationContext.Result.(*InstanceA))
+				result = *currentOperationContext.Result.(*InstanceA)
 			case InstanceA:
-				return newFixedLengthCursor(currentOperationContext.Result.(InstanceA))
+				result = currentOperationContext.Result.(InstanceA)
 			case []*StatefulInstance:
-				return newFixedLengthCursor(copyInstanceSlice(currentOperationContext.Result.([]*StatefulInstance)))
+				result = copyInstanceSlice(currentOperationContext.Result.([]*StatefulInstance))
 			case wst.A:
-				var result InstanceA
 				result, err = loadedModel.buildInstanceAFromA(currentOperationContext.Result.(wst.A), currentOperationContext)
 				if err != nil {
-					return NewErrorCursor(err)
+					return nil, 0, err
 				}
-				return newFixedLengthCursor(result)
 			default:
-				return NewErrorCursor(fmt.Errorf("invalid eventContext.Result type, expected InstanceA or []wst.M; found %T", currentOperationContext.Result))
+				return nil, 0, fmt.Errorf("invalid eventContext.Result type, expected InstanceA or []wst.M; found %T", currentOperationContext.Result)
 			}
+			return newFixedLengthCursor(result), int64(len(result)), nil
 		}
 	}
 	//for key := range *loadedModel.Config.Relations {
 	//	delete(finalData, key)
 	//}
 
-	dsCursor, err := loadedModel.Datasource.FindMany(loadedModel.CollectionName, lookups)
+	ds, err := loadedModel.datasourceFor(targetBaseContext)
 	if err != nil {
-		return NewErrorCursor(err)
+		return nil, 0, err
+	}
+	var dsCursor datasource.MongoCursorI
+	var total int64
+	startedAt := time.Now()
+	if withTotal {
+		dsCursor, total, err = ds.FindManyWithCountContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, lookups, countLookups)
+	} else {
+		dsCursor, err = ds.FindManyContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, lookups)
+	}
+	if err != nil {
+		return nil, 0, err
 	}
 	if dsCursor == nil {
-		return NewErrorCursor(fmt.Errorf("invalid query result"))
+		return nil, 0, fmt.Errorf("invalid query result")
 	}
 
 	var targetInclude *wst.Include
@@ -387,9 +477,22 @@ func (loadedModel *StatefulModel) FindMany(filterMap *wst.Filter, currentContext
 	cursor.UsedPipeline = lookups
 	//var cursor = newMongoCursor(context.Background(), dsCursor).(*MongoCursor)
 
-	go loadedModel.dispatchFindManyResults(cursor, dsCursor, targetInclude, currentOperationContext, results, filterMap)
+	go loadedModel.dispatchFindManyResults(cursor, dsCursor, targetInclude, currentOperationContext, results, filterMap, startedAt)
 
-	return cursor
+	return cursor, total, nil
+}
+
+// totalCountFilter returns the filter that matches the same documents as filterMap, without paginating them
+func totalCountFilter(filterMap *wst.Filter) *wst.Filter {
+	if filterMap == nil {
+		return nil
+	}
+	return &wst.Filter{
+		Where:       filterMap.Where,
+		Include:     filterMap.Include,
+		Aggregation: filterMap.Aggregation,
+		Search:      filterMap.Search,
+	}
 }
 
 func FindBaseContext(currentContext *EventContext) *EventContext {
@@ -436,10 +539,9 @@ func insertCacheEntries(safeCacheDs *datasource.Datasource, loadedModel *Statefu
 }
 
 func doExpireCacheKey(safeCacheDs *datasource.Datasource, loadedModel *StatefulModel, canonicalId string) (err error) {
-	connectorName := safeCacheDs.SubViper.GetString("connector")
-	switch connectorName {
-	case "memorykv":
-		db := safeCacheDs.Db.(memorykv.MemoryKvDb)
+	// The memorykv and redis connectors expose their entries as a memorykv.MemoryKvDb
+	switch db := safeCacheDs.Db.(type) {
+	case memorykv.MemoryKvDb:
 		bucket := db.GetBucket(loadedModel.CollectionName)
 		if loadedModel.App.Debug {
 			log.Println("CACHING", loadedModel.Name)
@@ -456,7 +558,7 @@ func doExpireCacheKey(safeCacheDs *datasource.Datasource, loadedModel *StatefulM
 			fmt.Printf("[DEBUG] expiring %v in %v seconds, err=%v\n", canonicalId, ttl, err)
 		}
 	default:
-		return errors.New(fmt.Sprintf("Unsupported cache connector %v", connectorName))
+		return errors.New(fmt.Sprintf("Unsupported cache connector %v", safeCacheDs.SubViper.GetString("connector")))
 	}
 	return err
 }
@@ -476,6 +578,7 @@ func (loadedModel *StatefulModel) Count(filterMap *wst.Filter, currentContext *E
 	if err != nil {
 		return wst.CountResult{}, err
 	}
+	lookups = loadedModel.excludeSoftDeleted(lookups, currentContext)
 
 	eventContext := &EventContext{
 		BaseContext: targetBaseContext,
@@ -491,7 +594,14 @@ func (loadedModel *StatefulModel) Count(filterMap *wst.Filter, currentContext *E
 
 	eventContext.Filter = filterMap
 
-	return loadedModel.Datasource.Count(loadedModel.CollectionName, lookups)
+	ds, err := loadedModel.datasourceFor(targetBaseContext)
+	if err != nil {
+		return wst.CountResult{}, err
+	}
+	startedAt := time.Now()
+	result, err := ds.CountContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, lookups)
+	loadedModel.logSlowQuery(eventContext.OperationName, time.Since(startedAt))
+	return result, err
 }
 
 func (loadedModel *StatefulModel) FindOne(filterMap *wst.Filter, baseContext *EventContext) (Instance, error) {
@@ -625,10 +735,17 @@ func (loadedModel *StatefulModel) Create(data interface{}, currentContext *Event
 	for key := range *loadedModel.Config.Relations {
 		delete(finalData, key)
 	}
-	document, err := loadedModel.Datasource.Create(loadedModel.CollectionName, &finalData)
-
+	if loadedModel.Config.Versioned {
+		finalData[datasource.VersionProperty] = 1
+	}
+	ds, err := loadedModel.datasourceFor(targetBaseContext)
 	if err != nil {
 		return nil, err
+	}
+	document, err := ds.CreateContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, &finalData)
+
+	if err != nil {
+		return nil, duplicateKeyError(loadedModel, err)
 	} else {
 		result, err := loadedModel.Build(*document, eventContext)
 		if err != nil {
@@ -684,7 +801,16 @@ func (loadedModel *StatefulModel) DeleteById(id interface{}, currentContext *Eve
 		}
 	}
 
-	deleteResult, err := loadedModel.Datasource.DeleteById(loadedModel.CollectionName, finalId)
+	ds, err := loadedModel.datasourceFor(targetBaseContext)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	var deleteResult wst.DeleteResult
+	if loadedModel.Config.SoftDelete {
+		deleteResult, err = loadedModel.softDeleteById(targetBaseContext.RequestContext(), ds, finalId)
+	} else {
+		deleteResult, err = ds.DeleteByIdContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, finalId)
+	}
 	if err != nil {
 		return deleteResult, err
 	}
@@ -722,8 +848,98 @@ func (loadedModel *StatefulModel) DeleteMany(where *wst.Where, currentContext *E
 	eventContext.Model = loadedModel
 	eventContext.IsNewInstance = false
 	eventContext.OperationName = wst.OperationNameDeleteMany
+	eventContext.Filter = &wst.Filter{Where: where}
+
+	if loadedModel.DisabledHandlers["__operation__before_delete_many"] != true {
+		err := loadedModel.GetHandler("__operation__before_delete_many")(eventContext)
+		if err != nil {
+			return result, err
+		}
+		// The observers may narrow the documents to delete
+		whereLookups = &wst.A{{"$match": wst.M(*eventContext.Filter.Where)}}
+	}
+
+	ds, err := loadedModel.datasourceFor(targetBaseContext)
+	if err != nil {
+		return result, err
+	}
+	if loadedModel.Config.SoftDelete {
+		notDeletedLookups := loadedModel.excludeSoftDeleted(&wst.A{{"$match": wst.CopyMap((*whereLookups)[0]["$match"].(wst.M))}}, currentContext)
+		updateResult, err := ds.UpdateManyContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, notDeletedLookups, &wst.M{SoftDeleteProperty: time.Now()})
+		if err != nil {
+			return result, err
+		}
+		result = wst.DeleteResult{DeletedCount: updateResult.ModifiedCount}
+	} else {
+		result, err = ds.DeleteManyContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, whereLookups)
+		if err != nil {
+			return result, err
+		}
+	}
+	if loadedModel.DisabledHandlers["__operation__after_delete_many"] != true {
+		err = loadedModel.GetHandler("__operation__after_delete_many")(eventContext)
+	}
+	return result, err
+}
 
-	return loadedModel.Datasource.DeleteMany(loadedModel.CollectionName, whereLookups)
+// UpdateMany sets data in all the documents matching where in a single datasource operation. Like DeleteMany, it only
+// runs the "before update many" and "after update many" observers, not the ones of each document. Use the updateMany
+// remote operation to update them one by one through the observers.
+func (loadedModel *StatefulModel) UpdateMany(where *wst.Where, data wst.M, currentContext *EventContext) (result wst.UpdateManyResult, err error) {
+	if where == nil {
+		return result, errors.New("where cannot be nil")
+	}
+	if len(*where) == 0 {
+		return result, errors.New("where cannot be empty")
+	}
+	whereLookups := &wst.A{
+		{
+			"$match": wst.M(*where),
+		},
+	}
+	finalData := wst.CopyMap(data)
+	currentContext = existingOrEmpty(currentContext)
+	if !currentContext.DisableTypeConversions {
+		_, err := datasource.ReplaceObjectIds(&(*whereLookups)[0])
+		if err != nil {
+			return result, err
+		}
+		_, err = datasource.ReplaceObjectIds(finalData)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	eventContext := &EventContext{
+		BaseContext: FindBaseContext(currentContext),
+	}
+	eventContext.Data = &finalData
+	eventContext.Model = loadedModel
+	eventContext.IsNewInstance = false
+	eventContext.OperationName = wst.OperationNameUpdateMany
+	eventContext.Filter = &wst.Filter{Where: where}
+
+	if loadedModel.DisabledHandlers["__operation__before_update_many"] != true {
+		err := loadedModel.GetHandler("__operation__before_update_many")(eventContext)
+		if err != nil {
+			return result, err
+		}
+		// The observers may narrow the documents to update
+		whereLookups = &wst.A{{"$match": wst.M(*eventContext.Filter.Where)}}
+	}
+
+	ds, err := loadedModel.datasourceFor(currentContext)
+	if err != nil {
+		return result, err
+	}
+	result, err = ds.UpdateManyContext(currentContext.RequestContext(), loadedModel.CollectionName, whereLookups, &finalData)
+	if err != nil {
+		return result, err
+	}
+	if loadedModel.DisabledHandlers["__operation__after_update_many"] != true {
+		err = loadedModel.GetHandler("__operation__after_update_many")(eventContext)
+	}
+	return result, err
 }
 
 func (loadedModel *StatefulModel) UpdateById(id interface{}, data interface{}, currentContext *EventContext) (Instance, error) {
@@ -808,6 +1024,7 @@ func (loadedModel *StatefulModel) UpdateById(id interface{}, data interface{}, c
 	}
 	eventContext.Data = &finalData
 	eventContext.Model = loadedModel
+	eventContext.ModelID = finalId
 	eventContext.IsNewInstance = false
 	eventContext.OperationName = wst.OperationNameUpdateById
 
@@ -837,9 +1054,21 @@ func (loadedModel *StatefulModel) UpdateById(id interface{}, data interface{}, c
 		}
 	}
 
-	document, err := loadedModel.Datasource.UpdateById(loadedModel.CollectionName, finalId, &finalData)
+	ds, err := loadedModel.datasourceFor(targetBaseContext)
 	if err != nil {
 		return nil, err
+	}
+	var expectedVersion int64
+	if loadedModel.Config.Versioned {
+		expectedVersion, err = loadedModel.currentVersion(targetBaseContext.RequestContext(), ds, finalId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	loadedModel.setExpectedVersion(finalData, expectedVersion)
+	document, err := ds.UpdateByIdContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, finalId, &finalData)
+	if err != nil {
+		return nil, duplicateKeyError(loadedModel, versionConflictError(loadedModel, finalId, err))
 	} else {
 		result, err := loadedModel.Build(*document, eventContext)
 		if err != nil {
@@ -882,6 +1111,19 @@ type RemoteMethodOptions struct {
 	Description string
 	Accepts     RemoteMethodOptionsHttpArgs
 	Http        RemoteMethodOptionsHttp
+	// OwnerScoped lets the accounts allowed only through the $owner policies call the method over the whole collection.
+	// The handler must restrict the documents to the ReadScope of the bearer.
+	OwnerScoped bool
+}
+
+// acceptsArrayBody tells whether the method declares a body argument of type "array"
+func (options RemoteMethodOptions) acceptsArrayBody() bool {
+	for _, arg := range options.Accepts {
+		if arg.Http.Source == "body" && arg.Type == "array" {
+			return true
+		}
+	}
+	return false
 }
 
 type RemoteOperationOptions struct {
@@ -924,7 +1166,7 @@ type BearerToken struct {
 
 type EphemeralData wst.M
 
-var operationCounter int64 = 1
+var operationCounter int64
 
 func wrapEventHandler(model *StatefulModel, eventKey string, handler func(eventContext *EventContext) error) func(eventContext *EventContext) error {
 	currentHandler := model.eventHandlers[eventKey]
@@ -947,8 +1189,7 @@ func wrapEventHandler(model *StatefulModel, eventKey string, handler func(eventC
 		baseContext := FindBaseContext(eventContext)
 		if baseContext != nil {
 			if baseContext.OperationId == 0 {
-				baseContext.OperationId = operationCounter
-				operationCounter++
+				baseContext.OperationId = atomic.AddInt64(&operationCounter, 1)
 			}
 
 			// First, process new callbacks and remove them
@@ -963,28 +1204,37 @@ func wrapEventHandler(model *StatefulModel, eventKey string, handler func(eventC
 	return wrappedHandler
 }
 
+// dispatchPendingOperations runs the operations queued for the event. They are removed before running, as they may
+// queue more operations.
 func dispatchPendingOperations(eventContext *EventContext, model *StatefulModel, eventKey string, baseContext *EventContext) error {
+	model.pendingOperationsLock.Lock()
+	var entries []pendingOperationEntry
 	if v, ok := model.pendingOperations[baseContext.OperationId]; ok {
-		if v2, ok := v[eventKey]; ok {
-			for _, pendingOperation := range v2 {
-				err := pendingOperation.handler(eventContext)
-				if err != nil {
-					return err
-				}
-			}
-			delete(v, eventKey)
-		}
+		entries = v[eventKey]
+		delete(v, eventKey)
 		if len(v) == 0 {
 			delete(model.pendingOperations, baseContext.OperationId)
 		}
 	}
+	model.pendingOperationsLock.Unlock()
+	for _, pendingOperation := range entries {
+		err := pendingOperation.handler(eventContext)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (loadedModel *StatefulModel) QueueOperation(operation string, eventContext *EventContext, fn func(nextCtx *EventContext) error) {
 	eventKey := mapOperationName(operation)
+	handlerMutex.Lock()
 	loadedModel.DisabledHandlers[eventKey] = false
-	operationId := FindBaseContext(eventContext).OperationId
+	handlerMutex.Unlock()
+	baseContext := FindBaseContext(eventContext)
+	operationId := baseContext.OperationId
+	loadedModel.pendingOperationsLock.Lock()
+	defer loadedModel.pendingOperationsLock.Unlock()
 	if _, ok := loadedModel.pendingOperations[operationId]; !ok {
 		loadedModel.pendingOperations[operationId] = map[string][]pendingOperationEntry{}
 	}
@@ -992,10 +1242,41 @@ func (loadedModel *StatefulModel) QueueOperation(operation string, eventContext
 		loadedModel.pendingOperations[operationId][eventKey] = []pendingOperationEntry{}
 	}
 	loadedModel.pendingOperations[operationId][eventKey] = append(loadedModel.pendingOperations[operationId][eventKey], pendingOperationEntry{
-		handler: fn,
+		handler:  fn,
+		finished: baseContext.finished,
 	})
 }
 
+// FlushPendingOperations drops the operations queued with QueueOperation by remote methods that returned without
+// reaching the event that dispatches them, usually because they failed before. The operations of the requests still
+// running, and the ones queued outside of remote methods, are kept. It returns the number of dropped operations.
+func (loadedModel *StatefulModel) FlushPendingOperations() int {
+	loadedModel.pendingOperationsLock.Lock()
+	defer loadedModel.pendingOperationsLock.Unlock()
+	dropped := 0
+	for operationId, byEvent := range loadedModel.pendingOperations {
+		for eventKey, entries := range byEvent {
+			var kept []pendingOperationEntry
+			for _, entry := range entries {
+				if entry.finished != nil && entry.finished.Load() {
+					dropped++
+				} else {
+					kept = append(kept, entry)
+				}
+			}
+			if len(kept) == 0 {
+				delete(byEvent, eventKey)
+			} else {
+				byEvent[eventKey] = kept
+			}
+		}
+		if len(byEvent) == 0 {
+			delete(loadedModel.pendingOperations, operationId)
+		}
+	}
+	return dropped
+}
+
 func (loadedModel *StatefulModel) On(event string, handler func(eventContext *EventContext) error) {
 	loadedModel.eventHandlers[event] = wrapEventHandler(loadedModel, event, handler)
 }
@@ -1037,7 +1318,10 @@ func (loadedModel *StatefulModel) Initialize() {
 	}
 }
 
-func (loadedModel *StatefulModel) dispatchFindManyResults(cursor *ChannelCursor, dsCursor datasource.MongoCursorI, targetInclude *wst.Include, currentContext *EventContext, results chan Instance, filterMap *wst.Filter) {
+// dispatchFindManyResults sends the documents of dsCursor to results. startedAt is the time the query was sent, so the
+// slow query log includes the time spent reading the cursor and merging the included relations, but not the time
+// waiting for the consumer to take the results.
+func (loadedModel *StatefulModel) dispatchFindManyResults(cursor *ChannelCursor, dsCursor datasource.MongoCursorI, targetInclude *wst.Include, currentContext *EventContext, results chan Instance, filterMap *wst.Filter, startedAt time.Time) {
 	err := func() error {
 		defer func(cursor Cursor) {
 			//// wait 16ms for error
@@ -1067,15 +1351,19 @@ func (loadedModel *StatefulModel) dispatchFindManyResults(cursor *ChannelCursor,
 		}
 
 		documentsToCacheByKey := make(map[string]wst.A)
-		for dsCursor.Next(loadedModel.Datasource.Context) {
+		var consumerWait time.Duration
+		for dsCursor.Next(currentContext.RequestContext()) {
 			inst, err := loadedModel.dispatchFindManySingleDocument(dsCursor, targetInclude, currentContext, filterMap, disabledCache, safeCacheDs, documentsToCacheByKey)
 			if err != nil {
 				cursor.Error(err)
 				return err
 			} else if inst != nil {
+				sentAt := time.Now()
 				results <- inst
+				consumerWait += time.Since(sentAt)
 			}
 		}
+		loadedModel.logSlowQuery(currentContext.OperationName, time.Since(startedAt)-consumerWait)
 
 		for key, documents := range documentsToCacheByKey {
 			err := insertCacheEntries(safeCacheDs, loadedModel, wst.M{"_entries": documents, "_redId": key})
@@ -151,10 +151,25 @@ func (loadedModel *StatefulModel) ExtractLookupsFromFilter(filterMap *wst.Filter
 	} else {
 		targetOrder = nil
 	}
+	if filterMap.Search != "" && (targetOrder == nil || len(*targetOrder) == 0) {
+		targetOrder = &wst.Order{SearchScoreProperty + " DESC"}
+	}
 	var targetSkip = filterMap.Skip
 	var targetLimit = filterMap.Limit
 
+	targetOrder, keysetRange, restoreOrder, err := keysetPagination(filterMap, targetOrder)
+	if err != nil {
+		return nil, err
+	}
+
 	var lookups = &wst.A{}
+	if filterMap.Search != "" {
+		searchStages, err := loadedModel.searchStages(filterMap.Search)
+		if err != nil {
+			return nil, err
+		}
+		*lookups = append(*lookups, searchStages...)
+	}
 	for _, aggregationStage := range targetAggregationBeforeLookups {
 		*lookups = append(*lookups, wst.CopyMap(wst.M(aggregationStage)))
 	}
@@ -201,21 +216,16 @@ func (loadedModel *StatefulModel) ExtractLookupsFromFilter(filterMap *wst.Filter
 		})
 	}
 
+	if keysetRange != nil {
+		*lookups = append(*lookups, wst.M{
+			"$match": keysetRange,
+		})
+	}
+
 	if targetOrder != nil && len(*targetOrder) > 0 {
-		orderMap := bson.D{}
-		for _, orderPair := range *targetOrder {
-			splt := strings.Split(orderPair, " ")
-			key := splt[0]
-			directionSt := splt[1]
-			if strings.ToLower(strings.TrimSpace(directionSt)) == "asc" {
-				//orderMap[key] = 1
-				orderMap = append(orderMap, bson.E{Key: key, Value: 1})
-			} else if strings.ToLower(strings.TrimSpace(directionSt)) == "desc" {
-				//orderMap[key] = -1
-				orderMap = append(orderMap, bson.E{Key: key, Value: -1})
-			} else {
-				return nil, fmt.Errorf("invalid direction %v while trying to sort by %v", directionSt, key)
-			}
+		orderMap, err := orderToSortStage(targetOrder)
+		if err != nil {
+			return nil, err
 		}
 		*lookups = append(*lookups, wst.M{
 			"$sort": orderMap,
@@ -271,6 +281,17 @@ func (loadedModel *StatefulModel) ExtractLookupsFromFilter(filterMap *wst.Filter
 		}
 	}
 
+	if restoreOrder != nil {
+		// The page was read backwards from the Before cursor, so it is sorted again once limited
+		orderMap, err := orderToSortStage(restoreOrder)
+		if err != nil {
+			return nil, err
+		}
+		*lookups = append(*lookups, wst.M{
+			"$sort": orderMap,
+		})
+	}
+
 	if loadedModel.App.Debug {
 		marshalled, err := json.MarshalIndent(lookups, "", "  ")
 		if err != nil {
@@ -282,6 +303,25 @@ func (loadedModel *StatefulModel) ExtractLookupsFromFilter(filterMap *wst.Filter
 	return lookups, nil
 }
 
+func orderToSortStage(targetOrder *wst.Order) (bson.D, error) {
+	orderMap := bson.D{}
+	for _, orderPair := range *targetOrder {
+		splt := strings.Split(orderPair, " ")
+		key := splt[0]
+		directionSt := splt[1]
+		if strings.ToLower(strings.TrimSpace(directionSt)) == "asc" {
+			//orderMap[key] = 1
+			orderMap = append(orderMap, bson.E{Key: key, Value: 1})
+		} else if strings.ToLower(strings.TrimSpace(directionSt)) == "desc" {
+			//orderMap[key] = -1
+			orderMap = append(orderMap, bson.E{Key: key, Value: -1})
+		} else {
+			return nil, fmt.Errorf("invalid direction %v while trying to sort by %v", directionSt, key)
+		}
+	}
+	return orderMap, nil
+}
+
 func (loadedModel *StatefulModel) appendIncludeToLookups(includeItem wst.IncludeItem, disableTypeConversions bool, lookups *wst.A) (*wst.A, error) {
 	var targetScope *wst.Filter
 	if includeItem.Scope != nil {
@@ -327,15 +367,19 @@ func (loadedModel *StatefulModel) appendIncludeToLookups(includeItem wst.Include
 				}
 				break
 			}
+			pipelineMatch := wst.M{
+				"$expr": wst.M{
+					"$and": wst.A{
+						matching,
+					},
+				},
+			}
+			if relatedLoadedModel.Config.SoftDelete {
+				pipelineMatch[SoftDeleteProperty] = nil
+			}
 			pipeline := wst.A{
 				wst.M{
-					"$match": wst.M{
-						"$expr": wst.M{
-							"$and": wst.A{
-								matching,
-							},
-						},
-					},
+					"$match": pipelineMatch,
 				},
 			}
 			project := wst.M{}
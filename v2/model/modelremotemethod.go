@@ -1,6 +1,8 @@
 package model
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -10,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -114,6 +117,13 @@ func (loadedModel *StatefulModel) RemoteMethod(handler func(context *EventContex
 				assignOpenAPIRequestBody(pathDef, wst.M{
 					"$ref": fmt.Sprintf("#/components/schemas/%s", schemaName),
 				}, fiber.MIMEApplicationJSON)
+			} else if options.Name == string(wst.OperationNameCreateMany) {
+				assignOpenAPIRequestBody(pathDef, wst.M{
+					"type": "array",
+					"items": wst.M{
+						"$ref": fmt.Sprintf("#/components/schemas/%s", schemaName),
+					},
+				}, fiber.MIMEApplicationJSON)
 			} else {
 				assignOpenAPIRequestBody(pathDef, wst.M{
 					"type": "object",
@@ -147,6 +157,29 @@ func (loadedModel *StatefulModel) RemoteMethod(handler func(context *EventContex
 var activeRequestsPerModel = make(map[string]int)
 var activeRequestsMutex sync.RWMutex
 
+// ActiveRequests returns the number of remote methods being handled, across all models
+func ActiveRequests() int {
+	activeRequestsMutex.RLock()
+	defer activeRequestsMutex.RUnlock()
+	total := 0
+	for _, count := range activeRequestsPerModel {
+		total += count
+	}
+	return total
+}
+
+// WaitForActiveRequests blocks until no remote method is being handled, or until ctx is done
+func WaitForActiveRequests(ctx context.Context) error {
+	for ActiveRequests() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v requests still active: %w", ActiveRequests(), ctx.Err())
+		case <-time.After(16 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
 func createFiberHandler(options RemoteMethodOptions, loadedModel *StatefulModel, verb string, path string) func(ctx *fiber.Ctx) error {
 	return func(ctx *fiber.Ctx) error {
 		// Limit to 2 concurrent requests per model, new requests will be queued
@@ -168,10 +201,16 @@ func createFiberHandler(options RemoteMethodOptions, loadedModel *StatefulModel,
 			activeRequestsMutex.Unlock()
 		}()
 
+		requestCtx, cancelFn := loadedModel.newRequestContext(ctx)
 		eventContext := &EventContext{
-			Ctx:    ctx,
-			Remote: &options,
+			Ctx:           ctx,
+			Remote:        &options,
+			Context:       requestCtx,
+			cancelContext: cancelFn,
+			finished:      &atomic.Bool{},
 		}
+		defer eventContext.finished.Store(true)
+		defer eventContext.releaseContext()
 		eventContext.Model = loadedModel
 		err2 := loadedModel.HandleRemoteMethod(options.Name, eventContext)
 		if err2 != nil {
@@ -321,6 +360,9 @@ func (loadedModel *StatefulModel) HandleRemoteMethod(name string, eventContext *
 	}
 
 	err, allowed := loadedModel.EnforceEx(token, objId, action, eventContext)
+	if !allowed && options.OwnerScoped && objId == "*" && token != nil && token.Account != nil && loadedModel.ownerPolicyAllows(token, action) {
+		err, allowed = nil, true
+	}
 	if err != nil {
 		return err
 	}
@@ -341,12 +383,28 @@ func (loadedModel *StatefulModel) HandleRemoteMethod(name string, eventContext *
 	if shouldHaveBody {
 		// if application/json
 		if wst.CleanContentType(c.Get("Content-Type")) == "application/json" {
-			var data wst.M
-			err := eventContext.Ctx.BodyParser(&data)
-			if err != nil {
-				return wst.CreateError(fiber.ErrBadRequest, "INVALID_BODY", fiber.Map{"message": err.Error()}, "ValidationError")
+			// Only the methods declaring an array body accept one, the others reject it when parsing the object
+			if trimmedBody := bytes.TrimSpace(c.Body()); len(trimmedBody) > 0 && trimmedBody[0] == '[' && options.acceptsArrayBody() {
+				var items wst.A
+				err := eventContext.Ctx.BodyParser(&items)
+				if err != nil {
+					return wst.CreateError(fiber.ErrBadRequest, "INVALID_BODY", fiber.Map{"message": err.Error()}, "ValidationError")
+				}
+				for idx := range items {
+					_, err = datasource.ReplaceObjectIds(items[idx])
+					if err != nil {
+						return err
+					}
+				}
+				eventContext.DataItems = &items
+			} else {
+				var data wst.M
+				err := eventContext.Ctx.BodyParser(&data)
+				if err != nil {
+					return wst.CreateError(fiber.ErrBadRequest, "INVALID_BODY", fiber.Map{"message": err.Error()}, "ValidationError")
+				}
+				eventContext.Data = &data
 			}
-			eventContext.Data = &data
 		} else if /*application/x-www-form-urlencoded*/ wst.CleanContentType(c.Get("Content-Type")) == "application/x-www-form-urlencoded" {
 			rawBodyBytes := c.BodyRaw()
 			rawBody := string(rawBodyBytes)
@@ -488,7 +546,7 @@ func (loadedModel *StatefulModel) HandleRemoteMethod(name string, eventContext *
 				eventContext.Ctx.Set("Transfer-Encoding", "chunked")
 				eventContext.Ctx.Response().Header.Set("Transfer-Encoding", "chunked")
 
-				return eventContext.Ctx.SendStream(resultAsGenerator.Reader(eventContext), -1)
+				return eventContext.Ctx.SendStream(eventContext.streamContext(resultAsGenerator.Reader(eventContext)), -1)
 
 			} else {
 
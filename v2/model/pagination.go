@@ -0,0 +1,229 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// keysetCursor is the content of the opaque cursors of the keyset pagination. It keeps the order it was created for,
+// so a cursor cannot be used with a different order.
+type keysetCursor struct {
+	Order  []string      `bson:"o"`
+	Values []interface{} `bson:"v"`
+}
+
+type keysetField struct {
+	name       string
+	descending bool
+}
+
+func (field keysetField) String() string {
+	if field.descending {
+		return field.name + " DESC"
+	}
+	return field.name + " ASC"
+}
+
+// keysetOrder normalizes the order of a filter and appends _id as a tie-breaker, so every document has a unique position
+func keysetOrder(order *wst.Order) ([]keysetField, error) {
+	var fields []keysetField
+	idFound := false
+	if order != nil {
+		for _, orderPair := range *order {
+			parts := strings.Fields(orderPair)
+			if len(parts) == 0 {
+				continue
+			}
+			field := keysetField{name: parts[0]}
+			if field.name == "id" {
+				field.name = "_id"
+			}
+			if len(parts) > 1 {
+				switch strings.ToLower(parts[1]) {
+				case "asc":
+				case "desc":
+					field.descending = true
+				default:
+					return nil, fmt.Errorf("invalid direction %v while trying to sort by %v", parts[1], field.name)
+				}
+			}
+			idFound = idFound || field.name == "_id"
+			fields = append(fields, field)
+		}
+	}
+	if !idFound {
+		fields = append(fields, keysetField{name: "_id"})
+	}
+	return fields, nil
+}
+
+func keysetOrderAsFilterOrder(fields []keysetField, reversed bool) *wst.Order {
+	order := make(wst.Order, len(fields))
+	for idx, field := range fields {
+		if reversed {
+			field.descending = !field.descending
+		}
+		order[idx] = field.String()
+	}
+	return &order
+}
+
+func encodeKeysetCursor(fields []keysetField, values []interface{}) (string, error) {
+	cursor := keysetCursor{Values: values}
+	for _, field := range fields {
+		cursor.Order = append(cursor.Order, field.String())
+	}
+	asBytes, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(asBytes), nil
+}
+
+func decodeKeysetCursor(encoded string, fields []keysetField) ([]interface{}, error) {
+	asBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	var cursor keysetCursor
+	if err == nil {
+		err = bson.Unmarshal(asBytes, &cursor)
+	}
+	if err != nil {
+		return nil, invalidCursorError("the cursor is malformed")
+	}
+	if len(cursor.Order) != len(fields) || len(cursor.Values) != len(fields) {
+		return nil, invalidCursorError("the cursor was created for a different order")
+	}
+	for idx, field := range fields {
+		if cursor.Order[idx] != field.String() {
+			return nil, invalidCursorError("the cursor was created for a different order")
+		}
+	}
+	return cursor.Values, nil
+}
+
+// keysetMatch selects the documents placed after the values in the given order, or before them if backwards is true.
+// Null and missing values are sorted before any other value, as in MongoDB, but $gt and $lt never match them, so they
+// are compared explicitly.
+func keysetMatch(fields []keysetField, values []interface{}, backwards bool) wst.M {
+	conditions := make(wst.A, 0, len(fields))
+	for idx, field := range fields {
+		condition := wst.M{}
+		for previousIdx := 0; previousIdx < idx; previousIdx++ {
+			// Equal to null matches the missing values too
+			condition[fields[previousIdx].name] = values[previousIdx]
+		}
+		greater := field.descending == backwards
+		switch value := values[idx]; {
+		case greater && value == nil:
+			condition[field.name] = wst.M{"$ne": nil}
+		case greater:
+			condition[field.name] = wst.M{"$gt": value}
+		case value == nil:
+			// No value is sorted before null
+			continue
+		default:
+			condition["$or"] = wst.A{{field.name: wst.M{"$lt": value}}, {field.name: nil}}
+		}
+		conditions = append(conditions, condition)
+	}
+	return wst.M{"$or": conditions}
+}
+
+// keysetEnabled tells whether the filter uses the keyset pagination: the client opts in with Keyset for the first page,
+// and passes a cursor for the rest
+func keysetEnabled(filterMap *wst.Filter) bool {
+	return filterMap != nil && (filterMap.Keyset || filterMap.After != "" || filterMap.Before != "")
+}
+
+// keysetPagination returns the order to sort by, the range $match of the After or Before cursor, and, when paginating
+// backwards, the order that restores the direction of the page once it has been limited.
+// Filters not using the keyset pagination keep their order untouched.
+func keysetPagination(filterMap *wst.Filter, targetOrder *wst.Order) (order *wst.Order, match wst.M, restoreOrder *wst.Order, err error) {
+	if !keysetEnabled(filterMap) {
+		return targetOrder, nil, nil, nil
+	}
+	if filterMap.After != "" && filterMap.Before != "" {
+		return nil, nil, nil, invalidCursorError("after and before cannot be used together")
+	}
+	if filterMap.Limit <= 0 {
+		return nil, nil, nil, wst.CreateError(fiber.ErrBadRequest, "LIMIT_REQUIRED", fiber.Map{"message": "the keyset pagination requires a limit"}, "ValidationError")
+	}
+	fields, err := keysetOrder(targetOrder)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backwards := filterMap.Before != ""
+	order = keysetOrderAsFilterOrder(fields, backwards)
+	if backwards {
+		restoreOrder = keysetOrderAsFilterOrder(fields, false)
+	}
+	if encoded := filterMap.After + filterMap.Before; encoded != "" {
+		values, err := decodeKeysetCursor(encoded, fields)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		match = keysetMatch(fields, values, backwards)
+	}
+	return order, match, restoreOrder, nil
+}
+
+// PageCursors returns the cursors of the pages next to a page obtained with the filter, to be used as Filter.After or
+// Filter.Before. A cursor is empty when there is no page in that direction, which is known without querying again only
+// when the page is not full. Filters not using the keyset pagination, see wst.Filter.Keyset, have no cursors.
+func (loadedModel *StatefulModel) PageCursors(filterMap *wst.Filter, page InstanceA) (next string, prev string, err error) {
+	if !keysetEnabled(filterMap) || len(page) == 0 {
+		return "", "", nil
+	}
+	fields, err := keysetOrder(filterMap.Order)
+	if err != nil {
+		return "", "", err
+	}
+	full := filterMap.Limit > 0 && int64(len(page)) == filterMap.Limit
+	backwards := filterMap.Before != ""
+	if full || backwards {
+		next, err = encodeKeysetCursor(fields, keysetValues(fields, page[len(page)-1]))
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if (full && backwards) || filterMap.After != "" {
+		prev, err = encodeKeysetCursor(fields, keysetValues(fields, page[0]))
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return next, prev, nil
+}
+
+func keysetValues(fields []keysetField, instance Instance) []interface{} {
+	document := instance.ToJSON()
+	values := make([]interface{}, len(fields))
+	for idx, field := range fields {
+		if field.name == "_id" {
+			values[idx] = instance.GetID()
+			continue
+		}
+		var value interface{} = document
+		for _, part := range strings.Split(field.name, ".") {
+			switch asMap := value.(type) {
+			case wst.M:
+				value = asMap[part]
+			case map[string]interface{}:
+				value = asMap[part]
+			default:
+				value = nil
+			}
+		}
+		values[idx] = value
+	}
+	return values
+}
+
+func invalidCursorError(message string) error {
+	return wst.CreateError(fiber.ErrBadRequest, "INVALID_CURSOR", fiber.Map{"message": message}, "ValidationError")
+}
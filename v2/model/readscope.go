@@ -0,0 +1,110 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+)
+
+// ReadScope returns the condition matching the documents that the bearer of currentContext can access through action.
+// It is nil when action is allowed over the whole collection, or the documents owned by the account when it is only
+// allowed through the $owner policies. The accounts and apps own themselves, and the other documents are owned through
+// a belongsTo relation to the Account model with the "accountId" foreign key, or to the App model with "appId". It fails
+// with fiber.ErrUnauthorized otherwise.
+func (loadedModel *StatefulModel) ReadScope(action string, currentContext *EventContext) (wst.M, error) {
+	baseContext := FindBaseContext(existingOrEmpty(currentContext))
+	token := baseContext.Bearer
+	if token != nil && token.Account != nil && token.Account.System {
+		return nil, nil
+	}
+	if _, allowed := loadedModel.EnforceEx(token, "*", action, baseContext); allowed {
+		return nil, nil
+	}
+	if token == nil || token.Account == nil || token.Account.Id == nil || !loadedModel.ownerPolicyAllows(token, action) {
+		return nil, fiber.ErrUnauthorized
+	}
+	scope := loadedModel.ownerScope(token.Account.Id)
+	if scope == nil {
+		return nil, fiber.ErrUnauthorized
+	}
+	return scope, nil
+}
+
+// ownerPolicyAllows tells whether the policies of the model allow action over the whole collection to the owners of the
+// documents, taking into account the MFA variants of $owner
+func (loadedModel *StatefulModel) ownerPolicyAllows(token *BearerToken, action string) bool {
+	ownerSubjects := map[string]bool{"_OWNER_": true, "_OWNER:NOT:MFA_": true}
+	for _, role := range token.Roles {
+		if role.Name == "USER:mfa" {
+			ownerSubjects = map[string]bool{"_OWNER_": true, "_OWNER:MFA_": true}
+			break
+		}
+	}
+	actions := map[string]bool{action: true, "*": true}
+	AuthMutex.RLock()
+	defer AuthMutex.RUnlock()
+	roles, err := loadedModel.Enforcer.GetImplicitRolesForUser(action)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not obtain the roles of %v.%v: %v\n", loadedModel.Name, action, err)
+		return false
+	}
+	for _, role := range roles {
+		actions[role] = true
+	}
+	policies, err := loadedModel.Enforcer.GetPolicy()
+	if err != nil {
+		fmt.Printf("[ERROR] Could not obtain the policies of %v: %v\n", loadedModel.Name, err)
+		return false
+	}
+	allowed := false
+	for _, policy := range policies {
+		if len(policy) < 4 || !ownerSubjects[policy[0]] || policy[1] != "*" || !actions[policy[2]] {
+			continue
+		}
+		if policy[3] == "deny" {
+			return false
+		}
+		allowed = allowed || policy[3] == "allow"
+	}
+	return allowed
+}
+
+// ownerScope returns the condition matching the documents owned by accountId, or nil if the model cannot be owned
+func (loadedModel *StatefulModel) ownerScope(accountId interface{}) wst.M {
+	// The foreign keys may be stored as strings or as ObjectIDs
+	candidates := primitive.A{accountId}
+	if hex, ok := accountId.(string); ok {
+		if objectId, err := primitive.ObjectIDFromHex(hex); err == nil {
+			candidates = append(candidates, objectId)
+		}
+	}
+	var conditions primitive.A
+	if loadedModel.Config.Base == "Account" || loadedModel.Config.Base == "App" {
+		conditions = append(conditions, wst.M{"_id": wst.M{"$in": candidates}})
+	}
+	if loadedModel.Config.Relations != nil {
+		for _, relation := range *loadedModel.Config.Relations {
+			if relation.Type != "belongsTo" || relation.ForeignKey == nil {
+				continue
+			}
+			relatedModel, err := loadedModel.App.FindModel(relation.Model)
+			if err != nil || relatedModel == nil {
+				continue
+			}
+			relatedBase := relatedModel.(*StatefulModel).Config.Base
+			if relatedBase == "Account" && *relation.ForeignKey == "accountId" || relatedBase == "App" && *relation.ForeignKey == "appId" {
+				conditions = append(conditions, wst.M{*relation.ForeignKey: wst.M{"$in": candidates}})
+			}
+		}
+	}
+	switch len(conditions) {
+	case 0:
+		return nil
+	case 1:
+		return conditions[0].(wst.M)
+	}
+	return wst.M{"$or": conditions}
+}
@@ -0,0 +1,77 @@
+package model
+
+import (
+	"context"
+	"io"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+)
+
+// RequestContext returns the Context of the base context, so the operations run by hooks and nested calls are
+// cancelled together with the request. It is context.Background() for the operations run outside of a request.
+func (eventContext *EventContext) RequestContext() context.Context {
+	if eventContext == nil {
+		return context.Background()
+	}
+	for current := eventContext; current != nil; current = current.BaseContext {
+		if current.Context != nil {
+			return current.Context
+		}
+	}
+	return context.Background()
+}
+
+// newRequestContext derives the context of a request from the user context of c, which middlewares may replace with
+// c.SetUserContext() to add deadlines or tracing metadata. The "requestTimeout" setting, in seconds, bounds it.
+// fasthttp does not report when a client disconnects while its request is handled, so the context is not cancelled
+// then: only requestTimeout and the deadlines of the middlewares stop the operations of abandoned requests.
+func (loadedModel *StatefulModel) newRequestContext(c *fiber.Ctx) (context.Context, context.CancelFunc) {
+	parent := c.UserContext()
+	if timeout := loadedModel.App.Viper.GetFloat64("requestTimeout"); timeout > 0 {
+		return context.WithTimeout(parent, time.Duration(timeout*float64(time.Second)))
+	}
+	return context.WithCancel(parent)
+}
+
+// releaseContext cancels the context created for the request, unless it was handed over to a streamed response
+func (eventContext *EventContext) releaseContext() {
+	if eventContext.cancelContext != nil {
+		eventContext.cancelContext()
+		eventContext.cancelContext = nil
+	}
+}
+
+// streamContext hands the context of the request over to reader, which cancels it when it is consumed or closed,
+// because the streamed responses keep reading from the datasource after the handler returns
+func (eventContext *EventContext) streamContext(reader io.Reader) io.Reader {
+	baseContext := FindBaseContext(eventContext)
+	if baseContext.cancelContext == nil {
+		return reader
+	}
+	cancelFn := baseContext.cancelContext
+	baseContext.cancelContext = nil
+	return &contextReleasingReader{reader: reader, cancelFn: cancelFn}
+}
+
+type contextReleasingReader struct {
+	reader   io.Reader
+	cancelFn context.CancelFunc
+}
+
+func (r *contextReleasingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil {
+		r.cancelFn()
+	}
+	return n, err
+}
+
+// Close is called by fasthttp when the stream ends, including when the client goes away
+func (r *contextReleasingReader) Close() error {
+	r.cancelFn()
+	if closer, ok := r.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+// SearchScoreProperty is the virtual property holding the relevance of the documents found with the "q" filter
+// parameter. It can be used in the order of the filter, and the results are sorted by it when no order is given.
+const SearchScoreProperty = "_score"
+
+// searchIndexName is the name of the text index over the searchable fields
+const searchIndexName = "search"
+
+// SearchWeights returns the weight of every searchable field, or nil if the model is not searchable
+func (loadedModel *StatefulModel) SearchWeights() map[string]int32 {
+	search := loadedModel.Config.Search
+	if search == nil || len(search.Fields) == 0 {
+		return nil
+	}
+	weights := make(map[string]int32, len(search.Fields))
+	for _, field := range search.Fields {
+		weights[field] = 1
+		if weight, ok := search.Weights[field]; ok {
+			weights[field] = weight
+		}
+	}
+	return weights
+}
+
+// searchIndex returns the text index over the searchable fields
+func (loadedModel *StatefulModel) searchIndex() (datasource.Index, error) {
+	weights := loadedModel.SearchWeights()
+	if weights == nil {
+		return datasource.Index{}, fmt.Errorf("search of model %v has no fields", loadedModel.Name)
+	}
+	for field := range loadedModel.Config.Search.Weights {
+		if _, ok := weights[field]; !ok {
+			return datasource.Index{}, fmt.Errorf("search of model %v has a weight for %v, which is not among its fields", loadedModel.Name, field)
+		}
+	}
+	index := datasource.Index{Name: searchIndexName, Weights: weights}
+	fields := make([]string, 0, len(weights))
+	for field := range weights {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		index.Keys = append(index.Keys, bson.E{Key: field, Value: "text"})
+	}
+	return index, nil
+}
+
+// searchStages returns the stages matching the documents for the full-text query, which must be the first ones of the
+// pipeline, and setting their SearchScoreProperty
+func (loadedModel *StatefulModel) searchStages(query string) (wst.A, error) {
+	if loadedModel.SearchWeights() == nil {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "SEARCH_NOT_ENABLED", fiber.Map{"message": fmt.Sprintf("model %v has no searchable fields", loadedModel.Name)}, "ValidationError")
+	}
+	return wst.A{
+		{"$match": wst.M{"$text": wst.M{"$search": query}}},
+		{"$addFields": wst.M{SearchScoreProperty: wst.M{"$meta": "textScore"}}},
+	}, nil
+}
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+// SoftDeleteProperty holds the deletion timestamp of the models configured with "softDelete": true
+const SoftDeleteProperty = "deleted"
+
+// excludeSoftDeleted adds the condition that filters out the deleted documents, merging it into a copy of the first
+// $match stage when possible, so the lookups of the caller are not modified
+func (loadedModel *StatefulModel) excludeSoftDeleted(lookups *wst.A, currentContext *EventContext) *wst.A {
+	if !loadedModel.Config.SoftDelete || currentContext.IncludeDeleted {
+		return lookups
+	}
+	if lookups == nil {
+		return &wst.A{{"$match": wst.M{SoftDeleteProperty: nil}}}
+	}
+	if len(*lookups) > 0 {
+		if match, ok := (*lookups)[0]["$match"].(wst.M); ok {
+			if _, exists := match[SoftDeleteProperty]; !exists {
+				merged := make(wst.M, len(match)+1)
+				for key, value := range match {
+					merged[key] = value
+				}
+				merged[SoftDeleteProperty] = nil
+				result := make(wst.A, len(*lookups))
+				copy(result, *lookups)
+				result[0] = wst.M{"$match": merged}
+				return &result
+			}
+		}
+	}
+	result := append(wst.A{{"$match": wst.M{SoftDeleteProperty: nil}}}, *lookups...)
+	return &result
+}
+
+// softDeleteById sets the deletion timestamp instead of removing the document. Documents already deleted are not
+// matched, so they are not counted, like DeleteById does with missing documents.
+func (loadedModel *StatefulModel) softDeleteById(ctx context.Context, ds *datasource.Datasource, id interface{}) (wst.DeleteResult, error) {
+	result, err := ds.UpdateManyContext(ctx, loadedModel.CollectionName, &wst.A{{"$match": wst.M{"_id": id, SoftDeleteProperty: nil}}}, &wst.M{SoftDeleteProperty: time.Now()})
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	return wst.DeleteResult{DeletedCount: result.MatchedCount}, nil
+}
+
+// RestoreById clears the deletion timestamp of a soft deleted document. It returns nil if there is no deleted document
+// with that id. The operation hooks are not run.
+func (loadedModel *StatefulModel) RestoreById(id interface{}, currentContext *EventContext) (Instance, error) {
+	finalId := softDeleteObjectId(id)
+	currentContext = existingOrEmpty(currentContext)
+	targetBaseContext := FindBaseContext(currentContext)
+	ds, err := loadedModel.datasourceFor(targetBaseContext)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ds.UpdateManyContext(targetBaseContext.RequestContext(), loadedModel.CollectionName, &wst.A{{"$match": wst.M{"_id": finalId, SoftDeleteProperty: wst.M{"$ne": nil}}}}, &wst.M{SoftDeleteProperty: nil})
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, nil
+	}
+	return loadedModel.FindById(finalId, nil, &EventContext{BaseContext: targetBaseContext, OperationName: wst.OperationNameRestoreById})
+}
+
+// PurgeById physically removes a document, whether it was soft deleted or not. The operation hooks are not run.
+func (loadedModel *StatefulModel) PurgeById(id interface{}, currentContext *EventContext) (wst.DeleteResult, error) {
+	finalId := softDeleteObjectId(id)
+	ds, err := loadedModel.datasourceFor(currentContext)
+	if err != nil {
+		return wst.DeleteResult{}, err
+	}
+	return ds.DeleteByIdContext(currentContext.RequestContext(), loadedModel.CollectionName, finalId)
+}
+
+func softDeleteObjectId(id interface{}) interface{} {
+	switch v := id.(type) {
+	case string:
+		if asObjectId, err := primitive.ObjectIDFromHex(v); err == nil {
+			return asObjectId
+		}
+	case *primitive.ObjectID:
+		return *v
+	}
+	return id
+}
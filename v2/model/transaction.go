@@ -0,0 +1,134 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+// Transaction holds the datasource transactions opened by WithTransaction. The transaction of each datasource is
+// started the first time an operation targets it, so models from several datasources can be used together, although
+// each datasource is committed separately.
+type Transaction struct {
+	lock         sync.Mutex
+	transactions []*datasource.Transaction
+	afterCommit  []func()
+}
+
+// WithTransaction runs fn with a context whose Create, UpdateById, UpdateAttributes, DeleteById, DeleteMany and
+// UpdateMany operations, as well as the ones run by the hooks they trigger, are committed together when fn returns nil,
+// or rolled back when it returns an error.
+//
+// Connectors without transactions support, like memorykv or a standalone MongoDB server, fall back to running the
+// operations one by one, so the changes applied before the error are kept. See datasource.Transaction.
+//
+// Calling WithTransaction again from inside fn reuses the transaction in progress.
+func WithTransaction(currentContext *EventContext, fn func(txCtx *EventContext) error) error {
+	baseContext := FindBaseContext(existingOrEmpty(currentContext))
+	if baseContext.Transaction != nil {
+		return fn(currentContext)
+	}
+
+	// The operations link their event contexts to the base context, so the transaction must live in a base context
+	txCtx := *baseContext
+	txCtx.Transaction = &Transaction{}
+	err := fn(&txCtx)
+	if err != nil {
+		txCtx.Transaction.abort()
+		return err
+	}
+	return txCtx.Transaction.commit()
+}
+
+// WithTransaction is the same as model.WithTransaction
+func (loadedModel *StatefulModel) WithTransaction(currentContext *EventContext, fn func(txCtx *EventContext) error) error {
+	return WithTransaction(currentContext, fn)
+}
+
+func (tx *Transaction) datasourceFor(ds *datasource.Datasource) (*datasource.Datasource, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	for _, dsTransaction := range tx.transactions {
+		if dsTransaction.Source() == ds {
+			return dsTransaction.Datasource, nil
+		}
+	}
+	dsTransaction, err := ds.StartTransaction(ds.Context)
+	if err != nil {
+		return nil, err
+	}
+	if !dsTransaction.Atomic {
+		fmt.Printf("[WARNING] Datasource %v does not support transactions, operations will not be rolled back\n", ds.Name)
+	}
+	tx.transactions = append(tx.transactions, dsTransaction)
+	return dsTransaction.Datasource, nil
+}
+
+// AfterCommit runs fn once every datasource of the transaction is committed. It is dropped if the transaction is
+// rolled back or fails to commit.
+func (tx *Transaction) AfterCommit(fn func()) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.afterCommit = append(tx.afterCommit, fn)
+}
+
+func (tx *Transaction) commit() error {
+	tx.lock.Lock()
+	for idx, dsTransaction := range tx.transactions {
+		err := dsTransaction.Commit(dsTransaction.Source().Context)
+		if err != nil {
+			for _, pending := range tx.transactions[idx+1:] {
+				abortDatasourceTransaction(pending)
+			}
+			tx.afterCommit = nil
+			tx.lock.Unlock()
+			return err
+		}
+	}
+	afterCommit := tx.afterCommit
+	tx.afterCommit = nil
+	tx.lock.Unlock()
+	// The callbacks run outside of the lock, so they can start other transactions
+	for _, fn := range afterCommit {
+		fn()
+	}
+	return nil
+}
+
+func (tx *Transaction) abort() {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	for _, dsTransaction := range tx.transactions {
+		abortDatasourceTransaction(dsTransaction)
+	}
+	tx.afterCommit = nil
+}
+
+func abortDatasourceTransaction(dsTransaction *datasource.Transaction) {
+	err := dsTransaction.Abort(dsTransaction.Source().Context)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not abort transaction in %v: %v\n", dsTransaction.Source().Name, err)
+	}
+}
+
+// AfterCommit runs fn once the transaction of the context is committed, or right away when there is no transaction
+// in progress
+func (eventContext *EventContext) AfterCommit(fn func()) {
+	baseContext := FindBaseContext(existingOrEmpty(eventContext))
+	if baseContext.Transaction == nil {
+		fn()
+		return
+	}
+	baseContext.Transaction.AfterCommit(fn)
+}
+
+// datasourceFor returns the datasource bound to the transaction of the context, or the model datasource when there is
+// no transaction in progress
+func (loadedModel *StatefulModel) datasourceFor(eventContext *EventContext) (*datasource.Datasource, error) {
+	baseContext := FindBaseContext(existingOrEmpty(eventContext))
+	if baseContext.Transaction == nil {
+		return loadedModel.Datasource, nil
+	}
+	return baseContext.Transaction.datasourceFor(loadedModel.Datasource)
+}
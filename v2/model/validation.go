@@ -0,0 +1,214 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Validate evaluates the declarative validations of the model config against the given document and returns
+// the failed codes indexed by property path, e.g. {"email": ["presence"]}. An empty map means the document is valid.
+func (config *Config) Validate(data *wst.M) map[string][]string {
+	codes := map[string][]string{}
+	if data == nil {
+		return codes
+	}
+	for _, validation := range config.Validations {
+		mergeValidationCodes(codes, validation.evaluate(*data, ""))
+	}
+	return codes
+}
+
+func (validation *Validation) evaluate(data wst.M, prefix string) map[string][]string {
+	codes := map[string][]string{}
+
+	// All the conditions in "if" must hold for the rest of the validation to be applied
+	for key, condition := range validation.If {
+		if !condition.matches(data, prefix+key) {
+			return codes
+		}
+	}
+
+	for key, propertyValidation := range validation.Properties {
+		path := prefix + key
+		if propertyValidation.NotEmpty {
+			if value, _ := lookupValidationPath(data, path); isEmptyValidationValue(value) {
+				addValidationCode(codes, path, "presence")
+			}
+		}
+		mergeValidationCodes(codes, propertyValidation.evaluate(data, path+"."))
+	}
+
+	for _, subValidation := range validation.AllOf {
+		mergeValidationCodes(codes, subValidation.evaluate(data, prefix))
+	}
+
+	mergeValidationCodes(codes, evaluateAlternatives(validation.AnyOf, data, prefix))
+	mergeValidationCodes(codes, evaluateAlternatives(validation.OneOf, data, prefix))
+
+	if validation.Then != nil {
+		mergeValidationCodes(codes, validation.Then.evaluate(data, prefix))
+	}
+
+	return codes
+}
+
+// evaluateAlternatives requires at least one of the alternatives to pass. If none does, it reports the codes of all of them
+func evaluateAlternatives(alternatives []Validation, data wst.M, prefix string) map[string][]string {
+	alternativesCodes := map[string][]string{}
+	for _, subValidation := range alternatives {
+		subCodes := subValidation.evaluate(data, prefix)
+		if len(subCodes) == 0 {
+			return nil
+		}
+		mergeValidationCodes(alternativesCodes, subCodes)
+	}
+	return alternativesCodes
+}
+
+func (condition *Condition) matches(data wst.M, path string) bool {
+	value, exists := lookupValidationPath(data, path)
+	exists = exists && value != nil
+
+	if condition.Exists && !exists {
+		return false
+	}
+	if condition.NotExists && exists {
+		return false
+	}
+	if condition.Empty && !isEmptyValidationValue(value) {
+		return false
+	}
+	if condition.NotEmpty && isEmptyValidationValue(value) {
+		return false
+	}
+	if condition.Equals != nil && !validationValuesEqual(value, condition.Equals) {
+		return false
+	}
+	if condition.NotEquals != nil && validationValuesEqual(value, condition.NotEquals) {
+		return false
+	}
+	for _, expected := range condition.Contains {
+		if !validationValueContains(value, expected) {
+			return false
+		}
+	}
+	for _, unexpected := range condition.NotContains {
+		if validationValueContains(value, unexpected) {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeValidationCodes(target map[string][]string, source map[string][]string) {
+	for path, pathCodes := range source {
+		for _, code := range pathCodes {
+			addValidationCode(target, path, code)
+		}
+	}
+}
+
+// addValidationCode adds the code to the path, unless the same property was already reported with it
+func addValidationCode(codes map[string][]string, path string, code string) {
+	for _, existing := range codes[path] {
+		if existing == code {
+			return
+		}
+	}
+	codes[path] = append(codes[path], code)
+}
+
+func lookupValidationPath(data wst.M, path string) (interface{}, bool) {
+	var current interface{} = data
+	for _, segment := range strings.Split(path, ".") {
+		var asMap map[string]interface{}
+		switch v := current.(type) {
+		case wst.M:
+			asMap = v
+		case *wst.M:
+			if v == nil {
+				return nil, false
+			}
+			asMap = *v
+		case primitive.M:
+			asMap = v
+		case map[string]interface{}:
+			asMap = v
+		default:
+			return nil, false
+		}
+		value, ok := asMap[segment]
+		if !ok {
+			return nil, false
+		}
+		current = value
+	}
+	return current, true
+}
+
+func isEmptyValidationValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	if asString, ok := value.(string); ok {
+		return strings.TrimSpace(asString) == ""
+	}
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return reflected.Len() == 0
+	case reflect.Ptr:
+		return reflected.IsNil()
+	}
+	return false
+}
+
+func normalizeValidationValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case primitive.ObjectID:
+		return v.Hex()
+	case *primitive.ObjectID:
+		if v == nil {
+			return nil
+		}
+		return v.Hex()
+	}
+	return value
+}
+
+func validationValuesEqual(a interface{}, b interface{}) bool {
+	return reflect.DeepEqual(normalizeValidationValue(a), normalizeValidationValue(b))
+}
+
+func validationValueContains(value interface{}, expected interface{}) bool {
+	if value == nil {
+		return false
+	}
+	if asString, ok := value.(string); ok {
+		if expectedString, ok := expected.(string); ok {
+			return strings.Contains(asString, expectedString)
+		}
+		return false
+	}
+	reflected := reflect.ValueOf(value)
+	if reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < reflected.Len(); i++ {
+		if validationValuesEqual(reflected.Index(i).Interface(), expected) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+)
+
+// ETag returns the entity tag of an instance of a model configured with "versioned": true
+func ETag(instance Instance) string {
+	return fmt.Sprintf("\"%d\"", datasource.VersionOf(instance.ToJSON()))
+}
+
+// CheckIfMatch compares the value of an If-Match header with the current version of the instance. It returns a 412
+// error when none of the listed entity tags matches. Weak tags are compared as strong ones.
+func CheckIfMatch(instance Instance, ifMatch string) error {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return nil
+	}
+	currentVersion := datasource.VersionOf(instance.ToJSON())
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), "\"")
+		if version, err := strconv.ParseInt(tag, 10, 64); err == nil && version == currentVersion {
+			return nil
+		}
+	}
+	return wst.CreateError(fiber.ErrPreconditionFailed, "VERSION_MISMATCH", fiber.Map{"message": fmt.Sprintf("the current version %d does not match %v", currentVersion, ifMatch)}, "Error")
+}
+
+// setExpectedVersion makes the connector apply the update only if the document still has the given version. In the
+// models not versioned, the property is removed instead, so the connectors do not take a version sent by the client as
+// the expected one.
+func (loadedModel *StatefulModel) setExpectedVersion(data wst.M, expectedVersion int64) {
+	if loadedModel.Config.Versioned {
+		data[datasource.VersionProperty] = expectedVersion
+	} else {
+		delete(data, datasource.VersionProperty)
+	}
+}
+
+// currentVersion reads the stored version of a document, for updates that do not start from a loaded instance
+func (loadedModel *StatefulModel) currentVersion(ctx context.Context, ds *datasource.Datasource, id interface{}) (int64, error) {
+	cursor, err := ds.FindManyContext(ctx, loadedModel.CollectionName, &wst.A{
+		{"$match": wst.M{"_id": id}},
+		{"$project": wst.M{datasource.VersionProperty: 1}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+	var documents []wst.M
+	err = cursor.All(ctx, &documents)
+	if err != nil || len(documents) == 0 {
+		return 0, err
+	}
+	return datasource.VersionOf(documents[0]), nil
+}
+
+func versionConflictError(loadedModel *StatefulModel, id interface{}, err error) error {
+	if errors.Is(err, datasource.ErrVersionMismatch) {
+		return wst.CreateError(fiber.ErrConflict, "VERSION_CONFLICT", fiber.Map{"message": fmt.Sprintf("%v %v was modified by another operation", loadedModel.Name, id)}, "Error")
+	}
+	return err
+}
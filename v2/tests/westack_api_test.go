@@ -1,7 +1,17 @@
 package tests
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,6 +21,7 @@ import (
 
 	"github.com/fredyk/westack-go/client/v2/wstfuncs"
 	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/model"
 )
 
 func createNoteForAccount(userId string, token string, footerId string, t *testing.T) (note wst.M, err error) {
@@ -665,3 +676,620 @@ func Test_ImageWithTwoThumbnails(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 0, len(invalidThumbnails))
 }
+
+func invokeBulkApi(t *testing.T, method string, path string, body interface{}, token string) wst.M {
+	var bodyReader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		assert.NoError(t, err)
+		bodyReader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, path, bodyReader)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token))
+	resp, err := app.Server.Test(req, 45000)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	//goland:noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	var result wst.M
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	assert.NoError(t, err)
+	return result
+}
+
+func Test_BulkOperations(t *testing.T) {
+
+	t.Parallel()
+
+	user := createAccount(t, wst.M{
+		"username": fmt.Sprintf("user-%d", createRandomInt()),
+		"password": "Abcd1234.",
+	})
+	token, err := loginAccount(user.GetString("username"), "Abcd1234.")
+	assert.NoError(t, err)
+
+	// Belongs to another account, so it cannot be modified in bulk by the user
+	foreignNote, err := invokeApiAsRandomAccount("POST", "/notes", wst.M{"title": fmt.Sprintf("Foreign %v", createRandomInt())}, wst.M{"Content-Type": "application/json"})
+	assert.NoError(t, err)
+	assert.Contains(t, foreignNote, "id")
+
+	tag := fmt.Sprintf("bulk-%v", createRandomInt())
+	created := invokeBulkApi(t, "POST", "/api/v1/notes/batch", []wst.M{
+		{"title": "Bulk 1", "content": tag},
+		{"title": "Bulk 2", "content": tag},
+	}, token.GetString("id"))
+	assert.EqualValues(t, 2, created.GetInt("successCount"))
+	assert.EqualValues(t, 0, created.GetInt("errorCount"))
+	items, ok := created["items"].([]interface{})
+	assert.True(t, ok)
+	assert.Len(t, items, 2)
+
+	// Both notes must be returned with their ids, in the same order
+	var ids []interface{}
+	for idx, item := range items {
+		itemMap := item.(map[string]interface{})
+		assert.EqualValues(t, idx, itemMap["index"])
+		assert.Equal(t, true, itemMap["success"])
+		ids = append(ids, itemMap["id"])
+	}
+	ids = append(ids, foreignNote.GetString("id"))
+
+	where, err := json.Marshal(wst.M{"_id": wst.M{"$in": ids}})
+	assert.NoError(t, err)
+	updated := invokeBulkApi(t, "POST", fmt.Sprintf("/api/v1/notes/update?where=%v", url.QueryEscape(string(where))), wst.M{"title": "Bulk updated"}, token.GetString("id"))
+	assert.EqualValues(t, 2, updated.GetInt("successCount"))
+	assert.EqualValues(t, 1, updated.GetInt("errorCount"))
+
+	deleted := invokeBulkApi(t, "DELETE", fmt.Sprintf("/api/v1/notes?where=%v", url.QueryEscape(string(where))), nil, token.GetString("id"))
+	assert.EqualValues(t, 2, deleted.GetInt("successCount"))
+	assert.EqualValues(t, 1, deleted.GetInt("errorCount"))
+
+	// The foreign note is still there
+	count, err := noteModel.Count(&wst.Filter{Where: &wst.Where{"_id": wst.M{"$in": ids}}}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, count.Count)
+
+	// Arrays are only accepted by the batch route, which limits their size
+	postArray := func(path string, items []wst.M) int {
+		encoded, err := json.Marshal(items)
+		assert.NoError(t, err)
+		req, err := http.NewRequest("POST", path, bytes.NewReader(encoded))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token.GetString("id")))
+		resp, err := app.Server.Test(req, 45000)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+	assert.Equal(t, fiber.StatusBadRequest, postArray("/api/v1/notes", []wst.M{{"title": "Not a batch", "content": tag}}))
+	tooMany := make([]wst.M, 1001)
+	for idx := range tooMany {
+		tooMany[idx] = wst.M{"title": "Too many", "content": tag}
+	}
+	assert.Equal(t, fiber.StatusBadRequest, postArray("/api/v1/notes/batch", tooMany))
+	count, err = noteModel.Count(&wst.Filter{Where: &wst.Where{"content": tag}}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, count.Count)
+
+}
+
+func Test_SoftDeleteRestoreAndPurge(t *testing.T) {
+
+	t.Parallel()
+
+	image, err := invokeApiAsRandomAccount("POST", "/images", wst.M{"title": fmt.Sprintf("Soft deleted %v", createRandomInt()), "accountId": randomAccount.GetString("id")}, wst.M{"Content-Type": "application/json"})
+	assert.NoError(t, err)
+	imageId := image.GetString("id")
+	assert.NotEmpty(t, imageId)
+
+	deleteResult, err := invokeApiAsRandomAccount("DELETE", "/images/"+imageId, nil, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, deleteResult.GetInt("deletedCount"))
+	deleteResult, err = invokeApiAsRandomAccount("DELETE", "/images/"+imageId, nil, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, deleteResult.GetInt("deletedCount"))
+
+	// Concurrent deletes of the same document count it only once
+	concurrentImage, err := invokeApiAsRandomAccount("POST", "/images", wst.M{"title": fmt.Sprintf("Concurrently deleted %v", createRandomInt()), "accountId": randomAccount.GetString("id")}, wst.M{"Content-Type": "application/json"})
+	assert.NoError(t, err)
+	var deletedCount atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := imageModel.DeleteById(concurrentImage.GetString("id"), systemContext)
+			assert.NoError(t, err)
+			deletedCount.Add(result.DeletedCount)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, deletedCount.Load())
+
+	// Hidden from regular queries, but still stored
+	found, err := imageModel.FindById(imageId, nil, systemContext)
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+	count, err := imageModel.Count(&wst.Filter{Where: &wst.Where{"_id": imageId}}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, count.Count)
+	found, err = imageModel.FindById(imageId, nil, &model.EventContext{Bearer: systemContext.Bearer, IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.NotNil(t, found)
+
+	restored, err := invokeApiAsRandomAccount("POST", "/images/"+imageId+"/restore", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, imageId, restored.GetString("id"))
+	found, err = imageModel.FindById(imageId, nil, systemContext)
+	assert.NoError(t, err)
+	assert.NotNil(t, found)
+
+	// Only admins can purge
+	purgeResult, err := invokeApiAsRandomAccount("DELETE", "/images/"+imageId+"/purge", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusUnauthorized, purgeResult.GetInt("error.statusCode"))
+	purgeResult, err = wstfuncs.InvokeApiJsonM("DELETE", "/images/"+imageId+"/purge", nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %s", adminAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, purgeResult.GetInt("deletedCount"))
+	found, err = imageModel.FindById(imageId, nil, &model.EventContext{Bearer: systemContext.Bearer, IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+
+}
+
+func Test_ExplainFindMany(t *testing.T) {
+
+	t.Parallel()
+
+	filter := url.QueryEscape(`{"where":{"title":"Explained"},"limit":5}`)
+
+	// Only admins can explain
+	result, err := invokeApiAsRandomAccount("GET", "/images/explain?filter="+filter, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusUnauthorized, result.GetInt("error.statusCode"))
+
+	result, err = wstfuncs.InvokeApiJsonM("GET", "/images/explain?filter="+filter, nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %s", adminAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	// The pipeline is the one run by findMany, including the soft delete condition
+	pipeline, ok := result["pipeline"].([]interface{})
+	assert.True(t, ok)
+	if assert.NotEmpty(t, pipeline) {
+		match := pipeline[0].(map[string]interface{})["$match"].(map[string]interface{})
+		assert.Equal(t, "Explained", match["title"])
+		assert.Contains(t, match, "deleted")
+	}
+	assert.NotNil(t, result["explain"])
+
+	result, err = wstfuncs.InvokeApiJsonM("GET", "/images/explain?verbosity=everything", nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %s", adminAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, result.GetInt("error.statusCode"))
+
+}
+
+func Test_AggregateEndpoint(t *testing.T) {
+
+	t.Parallel()
+
+	// Apps are only readable by their owners, so the pipeline is scoped to the apps of the random account
+	name := fmt.Sprintf("Aggregated %v", time.Now().UnixNano())
+	for _, accountId := range []string{randomAccount.GetString("id"), primitive.NewObjectID().Hex()} {
+		_, err := appModel.Create(wst.M{"name": name, "accountId": accountId}, systemContext)
+		assert.NoError(t, err)
+	}
+	pipeline := url.QueryEscape(fmt.Sprintf(`[{"$match":{"name":%q}},{"$count":"total"}]`, name))
+	results, err := wstfuncs.InvokeApiJsonA("GET", "/apps/aggregate?pipeline="+pipeline, nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %s", randomAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.EqualValues(t, 1, results[0].GetInt("total"))
+	}
+
+	// The system context is not scoped
+	stages, err := model.ParseAggregatePipeline(fmt.Sprintf(`[{"$match":{"name":%q}},{"$count":"total"}]`, name))
+	assert.NoError(t, err)
+	results, err = appModel.Aggregate(stages, systemContext)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.EqualValues(t, 2, results[0]["total"])
+	}
+
+	for _, rawPipeline := range []string{
+		`[{"$lookup":{"from":"Account","localField":"accountId","foreignField":"_id","as":"account"}}]`,
+		`[{"$facet":{"leaked":[{"$match":{"$where":"true"}}]}}]`,
+		`[{"$out":"Stolen"}]`,
+		`{"$count":"total"}`,
+	} {
+		result, err := invokeApiAsRandomAccount("GET", "/apps/aggregate?pipeline="+url.QueryEscape(rawPipeline), nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, result.GetInt("error.statusCode"), rawPipeline)
+	}
+
+	result, err := invokeApiAsRandomAccount("GET", "/apps/aggregate", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, result.GetInt("error.statusCode"))
+
+}
+
+func Test_AggregateHiddenProperties(t *testing.T) {
+
+	t.Parallel()
+
+	marker := fmt.Sprintf("hidden-%v", time.Now().UnixNano())
+	_, err := orderModel.Create(wst.M{"marker": marker, "someProperty": "secret"}, systemContext)
+	assert.NoError(t, err)
+
+	// The hidden properties cannot be referenced
+	for _, rawPipeline := range []string{
+		`[{"$group":{"_id":"$someProperty"}}]`,
+		`[{"$project":{"leaked":{"$concat":["$someProperty","!"]}}}]`,
+		`[{"$match":{"someProperty":"secret"}}]`,
+		`[{"$addFields":{"document":"$$ROOT"}}]`,
+		`[{"$project":{"leaked":{"$getField":"someProperty"}}}]`,
+		`[{"$project":{"leaked":{"$getField":{"$literal":"someProperty"}}}}]`,
+		`[{"$project":{"leaked":{"$getField":{"field":{"$concat":["some","Property"]},"input":"$$CURRENT"}}}}]`,
+	} {
+		stages, err := model.ParseAggregatePipeline(rawPipeline)
+		assert.NoError(t, err)
+		_, err = orderModel.Aggregate(stages, systemContext)
+		assert.Error(t, err, rawPipeline)
+		assert.Equal(t, "BAD_AGGREGATION_STAGE", err.(*wst.WeStackError).Code, rawPipeline)
+	}
+
+	// The documents passed through do not carry them
+	stages, err := model.ParseAggregatePipeline(fmt.Sprintf(`[{"$match":{"marker":%q}}]`, marker))
+	assert.NoError(t, err)
+	results, err := orderModel.Aggregate(stages, systemContext)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, marker, results[0]["marker"])
+		assert.NotContains(t, results[0], "someProperty")
+	}
+
+}
+
+func Test_ParseAggregatePipelineKeepsKeyOrder(t *testing.T) {
+
+	t.Parallel()
+
+	stages, err := model.ParseAggregatePipeline(`[{"$sort":{"b":1,"a":-1,"c":1}}]`)
+	assert.NoError(t, err)
+	if assert.Len(t, stages, 1) {
+		assert.Equal(t, primitive.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}, {Key: "c", Value: int32(1)}}, stages[0]["$sort"])
+	}
+
+}
+
+func patchImageWithIfMatch(t *testing.T, imageId string, ifMatch string, body wst.M) *http.Response {
+	encoded, err := json.Marshal(body)
+	assert.NoError(t, err)
+	req, err := http.NewRequest("PATCH", "/api/v1/images/"+imageId, bytes.NewReader(encoded))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", randomAccountToken.GetString("id")))
+	req.Header.Set("If-Match", ifMatch)
+	resp, err := app.Server.Test(req, 45000)
+	assert.NoError(t, err)
+	return resp
+}
+
+func Test_OptimisticConcurrency(t *testing.T) {
+
+	t.Parallel()
+
+	image, err := invokeApiAsRandomAccount("POST", "/images", wst.M{"title": "Versioned", "accountId": randomAccount.GetString("id")}, wst.M{"Content-Type": "application/json"})
+	assert.NoError(t, err)
+	imageId := image.GetString("id")
+	assert.EqualValues(t, 1, image.GetInt("_version"))
+
+	req, err := http.NewRequest("GET", "/api/v1/images/"+imageId, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", randomAccountToken.GetString("id")))
+	resp, err := app.Server.Test(req, 45000)
+	assert.NoError(t, err)
+	assert.Equal(t, "\"1\"", resp.Header.Get("ETag"))
+
+	resp = patchImageWithIfMatch(t, imageId, "\"1\"", wst.M{"title": "Versioned 2"})
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, "\"2\"", resp.Header.Get("ETag"))
+
+	// The client still holds the first version
+	resp = patchImageWithIfMatch(t, imageId, "\"1\"", wst.M{"title": "Versioned 3"})
+	assert.Equal(t, fiber.StatusPreconditionFailed, resp.StatusCode)
+
+	// An instance loaded before a concurrent update cannot overwrite it
+	first, err := imageModel.FindById(imageId, nil, systemContext)
+	assert.NoError(t, err)
+	second, err := imageModel.FindById(imageId, nil, systemContext)
+	assert.NoError(t, err)
+	_, err = first.UpdateAttributes(wst.M{"title": "From first"}, systemContext)
+	assert.NoError(t, err)
+	_, err = second.UpdateAttributes(wst.M{"title": "From second"}, systemContext)
+	assert.Error(t, err)
+	assert.Equal(t, fiber.StatusConflict, err.(*wst.WeStackError).FiberError.Code)
+
+	current, err := imageModel.FindById(imageId, nil, systemContext)
+	assert.NoError(t, err)
+	assert.Equal(t, "From first", current.GetString("title"))
+	assert.EqualValues(t, 3, current.GetInt("_version"))
+
+}
+
+func Test_AuditHistory(t *testing.T) {
+
+	t.Parallel()
+
+	image, err := invokeApiAsRandomAccount("POST", "/images", wst.M{"title": "Audited", "accountId": randomAccount.GetString("id")}, wst.M{"Content-Type": "application/json"})
+	assert.NoError(t, err)
+	imageId := image.GetString("id")
+
+	_, err = invokeApiAsRandomAccount("PATCH", "/images/"+imageId, wst.M{"title": "Audited 2"}, wst.M{"Content-Type": "application/json"})
+	assert.NoError(t, err)
+
+	_, err = invokeApiAsRandomAccount("DELETE", "/images/"+imageId, nil, nil)
+	assert.NoError(t, err)
+
+	history, err := wstfuncs.InvokeApiJsonA("GET", "/images/"+imageId+"/history", nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %v", randomAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	if len(history) == 3 {
+		assert.Equal(t, string(wst.OperationNameDeleteById), history[0].GetString("operation"))
+		assert.Equal(t, string(wst.OperationNameUpdateAttributes), history[1].GetString("operation"))
+		assert.Equal(t, "Audited", history[1].GetString("changes.title.before"))
+		assert.Equal(t, "Audited 2", history[1].GetString("changes.title.after"))
+		assert.Equal(t, string(wst.OperationNameCreate), history[2].GetString("operation"))
+		assert.Equal(t, randomAccount.GetString("id"), history[2].GetString("actorId"))
+	}
+
+	// The history is guarded like any other read operation
+	unauthorized, err := wstfuncs.InvokeApiJsonM("GET", "/images/"+imageId+"/history", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusUnauthorized, unauthorized.GetInt("error.statusCode"))
+
+}
+
+func Test_AuditHistorySkipsFailedOperations(t *testing.T) {
+
+	t.Parallel()
+
+	image, err := invokeApiAsRandomAccount("POST", "/images", wst.M{"title": "Audited", "accountId": randomAccount.GetString("id")}, wst.M{"Content-Type": "application/json"})
+	assert.NoError(t, err)
+	imageId := image.GetString("id")
+
+	// The operations share a base context, like the ones run by a request
+	operationContext := &model.EventContext{Bearer: systemContext.Bearer}
+	first, err := imageModel.FindById(imageId, nil, operationContext)
+	assert.NoError(t, err)
+	second, err := imageModel.FindById(imageId, nil, operationContext)
+	assert.NoError(t, err)
+	_, err = first.UpdateAttributes(wst.M{"title": "From first"}, operationContext)
+	assert.NoError(t, err)
+	// The version conflict happens after the "before save" observers ran
+	_, err = second.UpdateAttributes(wst.M{"title": "From second"}, operationContext)
+	assert.Error(t, err)
+	_, err = first.UpdateAttributes(wst.M{"title": "From first again"}, operationContext)
+	assert.NoError(t, err)
+
+	history, err := wstfuncs.InvokeApiJsonA("GET", "/images/"+imageId+"/history", nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %v", randomAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	if len(history) == 3 {
+		assert.Equal(t, "From first", history[0].GetString("changes.title.before"))
+		assert.Equal(t, "From first again", history[0].GetString("changes.title.after"))
+		assert.Equal(t, "Audited", history[1].GetString("changes.title.before"))
+		assert.Equal(t, "From first", history[1].GetString("changes.title.after"))
+	}
+
+}
+
+func Test_AuditHistoryOfModelOperations(t *testing.T) {
+
+	t.Parallel()
+
+	var imageIds []string
+	for i := 0; i < 2; i++ {
+		image, err := invokeApiAsRandomAccount("POST", "/images", wst.M{"title": "Bulk audited", "accountId": randomAccount.GetString("id")}, wst.M{"Content-Type": "application/json"})
+		assert.NoError(t, err)
+		imageIds = append(imageIds, image.GetString("id"))
+	}
+
+	_, err := imageModel.UpdateById(imageIds[0], wst.M{"title": "Updated by id"}, systemContext)
+	assert.NoError(t, err)
+	updateResult, err := imageModel.UpdateMany(&wst.Where{"_id": wst.M{"$in": imageIds}}, wst.M{"title": "Updated many"}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, updateResult.ModifiedCount)
+	deleteResult, err := imageModel.DeleteMany(&wst.Where{"_id": wst.M{"$in": imageIds}}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, deleteResult.DeletedCount)
+
+	history, err := wstfuncs.InvokeApiJsonA("GET", "/images/"+imageIds[0]+"/history", nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %v", randomAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history, 4)
+	if len(history) == 4 {
+		assert.Equal(t, string(wst.OperationNameDeleteMany), history[0].GetString("operation"))
+		assert.Equal(t, "Updated many", history[0].GetString("changes.title.before"))
+		assert.Equal(t, string(wst.OperationNameUpdateMany), history[1].GetString("operation"))
+		assert.Equal(t, "Updated by id", history[1].GetString("changes.title.before"))
+		assert.Equal(t, "Updated many", history[1].GetString("changes.title.after"))
+		assert.Equal(t, string(wst.OperationNameUpdateById), history[2].GetString("operation"))
+		assert.Equal(t, "Bulk audited", history[2].GetString("changes.title.before"))
+		assert.Equal(t, "Updated by id", history[2].GetString("changes.title.after"))
+	}
+
+	history, err = wstfuncs.InvokeApiJsonA("GET", "/images/"+imageIds[1]+"/history", nil, wst.M{
+		"Authorization": fmt.Sprintf("Bearer %v", randomAccountToken.GetString("id")),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+
+}
+
+func Test_FindManyEnvelope(t *testing.T) {
+
+	t.Parallel()
+
+	title := fmt.Sprintf("Enveloped note %v", time.Now().UnixNano())
+	for i := 0; i < 3; i++ {
+		_, err := noteModel.Create(wst.M{"title": title}, systemContext)
+		assert.NoError(t, err)
+	}
+
+	filterSt := url.QueryEscape(fmt.Sprintf(`{"where":{"title":%q},"limit":2}`, title))
+	unpaginated, err := invokeApiAsRandomAccount("GET", "/notes?envelope=true&filter="+filterSt, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, unpaginated["data"], 2)
+	assert.Empty(t, unpaginated.GetString("next"))
+
+	firstPage, err := invokeApiAsRandomAccount("GET", "/notes?envelope=true&keyset=true&filter="+filterSt, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, firstPage.GetInt("total"))
+	assert.Equal(t, 2, firstPage.GetInt("limit"))
+	assert.Equal(t, 0, firstPage.GetInt("skip"))
+	assert.Len(t, firstPage["data"], 2)
+	next := firstPage.GetString("next")
+	assert.NotEmpty(t, next)
+
+	lastPage, err := invokeApiAsRandomAccount("GET", "/notes?envelope=true&filter="+filterSt+"&after="+url.QueryEscape(next), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, lastPage.GetInt("total"))
+	assert.Len(t, lastPage["data"], 1)
+	assert.Empty(t, lastPage.GetString("next"))
+	assert.NotEmpty(t, lastPage.GetString("prev"))
+}
+
+func Test_ModelOperationsWithExpiredContext(t *testing.T) {
+
+	t.Parallel()
+
+	// A deadline set by a middleware, or by the "requestTimeout" setting, stops the operations run on MongoDB
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelFn()
+	<-ctx.Done()
+	expiredContext := &model.EventContext{Bearer: systemContext.Bearer, Context: ctx}
+
+	_, err := noteModel.Count(nil, expiredContext)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = noteModel.Create(wst.M{"title": "Expired"}, expiredContext)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+}
+
+func Test_HealthEndpoints(t *testing.T) {
+
+	t.Parallel()
+
+	req, err := http.NewRequest("GET", "/system/health/live", nil)
+	assert.NoError(t, err)
+	resp, err := app.Server.Test(req, 45000)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"status":"ok"}`, string(body))
+
+	req, err = http.NewRequest("GET", "/system/health/ready", nil)
+	assert.NoError(t, err)
+	resp, err = app.Server.Test(req, 45000)
+	assert.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	var report wst.M
+	err = json.Unmarshal(body, &report)
+	assert.NoError(t, err)
+
+	assert.Equal(t, true, report["completedSetup"])
+	db0 := report["datasources"].(map[string]interface{})["db0"].(map[string]interface{})
+	assert.Equal(t, true, db0["healthy"])
+	assert.Equal(t, "mongodb", db0["connector"])
+	assert.NotEmpty(t, db0["lastPing"])
+	// The errors are not reported, as they may reveal the addresses of the datasources
+	assert.NotContains(t, db0, "error")
+	assert.Contains(t, report["memorykv"].(map[string]interface{})["datasources"], "memorykv")
+	// The status code follows the health of every datasource
+	if report["status"] == "ok" {
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	} else {
+		assert.Equal(t, fiber.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func Test_ChangeStreamHttp(t *testing.T) {
+
+	t.Parallel()
+
+	subjId, err := primitive.ObjectIDFromHex(randomAccountToken.GetString("accountId"))
+	assert.NoError(t, err)
+	title := fmt.Sprintf("Http streamed note %v", time.Now().UnixNano())
+	filter, err := json.Marshal(wst.M{"where": wst.M{"title": title}})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost:8019/api/v1/notes/stream?filter="+url.QueryEscape(string(filter)), nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", randomAccountToken.GetString("id")))
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (string, wst.M) {
+		eventType := ""
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("could not read the change stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				var data wst.M
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data))
+				return eventType, data
+			}
+		}
+	}
+
+	// The changes rolled back are not published
+	err = app.WithTransaction(systemContext, func(txCtx *model.EventContext) error {
+		_, err := noteModel.Create(wst.M{"title": title, "accountId": subjId}, txCtx)
+		assert.NoError(t, err)
+		return fmt.Errorf("rollback")
+	})
+	assert.Error(t, err)
+
+	var created model.Instance
+	err = app.WithTransaction(systemContext, func(txCtx *model.EventContext) error {
+		created, err = noteModel.Create(wst.M{"title": title, "accountId": subjId}, txCtx)
+		return err
+	})
+	assert.NoError(t, err)
+	_, err = noteModel.DeleteById(created.GetID(), systemContext)
+	assert.NoError(t, err)
+
+	for _, expectedType := range []model.ChangeEventType{model.ChangeEventCreated, model.ChangeEventDeleted} {
+		eventType, data := readEvent()
+		assert.Equal(t, string(expectedType), eventType)
+		assert.Equal(t, model.GetIDAsString(created.GetID()), data.GetString("id"))
+		assert.Equal(t, title, data.GetString("data.title"))
+	}
+}
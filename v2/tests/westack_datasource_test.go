@@ -3,14 +3,19 @@ package tests
 import (
 	"context"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
 	wst "github.com/fredyk/westack-go/v2/common"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/fredyk/westack-go/v2/datasource"
+	"github.com/fredyk/westack-go/v2/memorykv"
 )
 
 func Test_Datasource_Initialize_InvalidDatasource(t *testing.T) {
@@ -286,3 +291,541 @@ func Test_ReplaceObjectMList(t *testing.T) {
 	assert.NoError(t, err)
 	assert.EqualValues(t, data, result)
 }
+
+func Test_MemoryKvDatasourceCRUD(t *testing.T) {
+
+	t.Parallel()
+
+	ds := datasource.New(&wst.IApp{}, "memorykv", app.DsViper, context.Background())
+	err := ds.Initialize()
+	assert.NoError(t, err)
+
+	collectionName := "MemoryKvNote"
+	for i := 1; i <= 5; i++ {
+		created, err := ds.Create(collectionName, &wst.M{
+			"title":    fmt.Sprintf("Note %v", i),
+			"priority": i,
+			"group":    i % 2,
+			"tags":     []string{"memorykv", fmt.Sprintf("tag%v", i%2)},
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, created)
+		assert.NotNil(t, (*created)["_id"])
+	}
+
+	// where + sort + skip + limit
+	cursor, err := ds.FindMany(collectionName, &wst.A{
+		{"$match": wst.M{"priority": wst.M{"$gte": 2}, "tags": "tag1"}},
+		{"$sort": wst.M{"priority": -1}},
+		{"$skip": 0},
+		{"$limit": 1},
+	})
+	assert.NoError(t, err)
+	var found []wst.M
+	err = cursor.All(context.Background(), &found)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, "Note 5", found[0].GetString("title"))
+
+	// Several sort keys are applied in the order of a bson.D, and rejected in a map
+	cursor, err = ds.FindMany(collectionName, &wst.A{
+		{"$match": wst.M{"tags": "memorykv"}},
+		{"$sort": bson.D{{Key: "group", Value: 1}, {Key: "priority", Value: -1}}},
+	})
+	assert.NoError(t, err)
+	var sorted []wst.M
+	err = cursor.All(context.Background(), &sorted)
+	assert.NoError(t, err)
+	var sortedTitles []string
+	for _, document := range sorted {
+		sortedTitles = append(sortedTitles, document.GetString("title"))
+	}
+	assert.Equal(t, []string{"Note 4", "Note 2", "Note 5", "Note 3", "Note 1"}, sortedTitles)
+	_, err = ds.FindMany(collectionName, &wst.A{
+		{"$match": wst.M{"tags": "memorykv"}},
+		{"$sort": wst.M{"group": 1, "priority": -1}},
+	})
+	assert.Error(t, err)
+
+	// A projection of the id alone keeps only the id
+	cursor, err = ds.FindMany(collectionName, &wst.A{
+		{"$match": wst.M{"tags": "memorykv"}},
+		{"$project": wst.M{"_id": 1}},
+	})
+	assert.NoError(t, err)
+	var projected []wst.M
+	err = cursor.All(context.Background(), &projected)
+	assert.NoError(t, err)
+	if assert.Len(t, projected, 5) {
+		assert.Len(t, projected[0], 1)
+		assert.NotNil(t, projected[0]["_id"])
+	}
+
+	count, err := ds.Count(collectionName, &wst.A{{"$match": wst.M{"$or": wst.A{{"priority": 1}, {"priority": 2}}}}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, count.Count)
+
+	count, err = ds.Count(collectionName, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, count.Count)
+
+	// update by id
+	id := found[0]["_id"]
+	updated, err := ds.UpdateById(collectionName, id, &wst.M{"title": "Note 5 updated"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Note 5 updated", updated.GetString("title"))
+	assert.EqualValues(t, 5, (*updated)["priority"])
+
+	// delete by id
+	deleteResult, err := ds.DeleteById(collectionName, id)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, deleteResult.DeletedCount)
+
+	deleteResult, err = ds.DeleteById(collectionName, id)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, deleteResult.DeletedCount)
+
+	// delete many
+	deleteResult, err = ds.DeleteMany(collectionName, &wst.A{{"$match": wst.M{"priority": wst.M{"$in": []interface{}{1, 2}}}}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, deleteResult.DeletedCount)
+
+	count, err = ds.Count(collectionName, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, count.Count)
+
+	// unsupported stages are reported
+	_, err = ds.FindMany(collectionName, &wst.A{{"$lookup": wst.M{"from": "Other"}}})
+	assert.Error(t, err)
+
+}
+
+func Test_SQLiteDatasourceCRUD(t *testing.T) {
+
+	t.Parallel()
+
+	ds, err := app.FindDatasource("sqlite")
+	assert.NoError(t, err)
+	assert.NotNil(t, ds)
+
+	var noteIds []interface{}
+	for i := 1; i <= 5; i++ {
+		created, err := ds.Create("SQLiteNote", &wst.M{
+			"title":    fmt.Sprintf("Note %v", i),
+			"priority": i,
+			"tags":     []string{"sqlite", fmt.Sprintf("tag%v", i%2)},
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, created)
+		assert.IsType(t, primitive.ObjectID{}, (*created)["_id"])
+		// The created documents hold the same types as the ones read through FindMany
+		assert.IsType(t, int32(0), (*created)["priority"])
+		assert.IsType(t, primitive.A{}, (*created)["tags"])
+		noteIds = append(noteIds, (*created)["_id"])
+	}
+	for i := 1; i <= 3; i++ {
+		_, err := ds.Create("SQLiteComment", &wst.M{"body": fmt.Sprintf("Comment %v", i), "noteId": noteIds[0]})
+		assert.NoError(t, err)
+	}
+
+	// where + sort + skip + limit + fields
+	cursor, err := ds.FindMany("SQLiteNote", &wst.A{
+		{"$match": wst.M{"priority": wst.M{"$gte": 2}, "tags": "tag1", "title": primitive.Regex{Pattern: "^note", Options: "i"}}},
+		{"$sort": bson.D{{Key: "priority", Value: -1}}},
+		{"$skip": 1},
+		{"$limit": 1},
+		{"$project": wst.M{"title": true}},
+	})
+	assert.NoError(t, err)
+	var found []wst.M
+	err = cursor.All(context.Background(), &found)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, "Note 3", found[0].GetString("title"))
+	assert.Nil(t, found[0]["priority"])
+
+	// A projection of the id alone keeps only the id
+	cursor, err = ds.FindMany("SQLiteNote", &wst.A{
+		{"$match": wst.M{"_id": noteIds[0]}},
+		{"$project": wst.M{"_id": 1}},
+	})
+	assert.NoError(t, err)
+	var projected []wst.M
+	err = cursor.All(context.Background(), &projected)
+	assert.NoError(t, err)
+	if assert.Len(t, projected, 1) {
+		assert.Equal(t, wst.M{"_id": noteIds[0]}, projected[0])
+	}
+
+	count, err := ds.Count("SQLiteNote", &wst.A{{"$match": wst.M{"$or": wst.A{{"priority": 1}, {"priority": 2}}}}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, count.Count)
+
+	// hasMany and belongsTo lookups
+	cursor, err = ds.FindMany("SQLiteNote", &wst.A{
+		{"$match": wst.M{"_id": noteIds[0]}},
+		{"$lookup": wst.M{
+			"from":     "SQLiteComment",
+			"let":      wst.M{"noteId": "$_id"},
+			"pipeline": wst.A{{"$match": wst.M{"$expr": wst.M{"$and": wst.A{{"$eq": []string{"$noteId", "$$noteId"}}}}}}},
+			"as":       "comments",
+		}},
+	})
+	assert.NoError(t, err)
+	found = nil
+	err = cursor.All(context.Background(), &found)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, 3, len(found[0]["comments"].(primitive.A)))
+
+	cursor, err = ds.FindMany("SQLiteComment", &wst.A{
+		{"$lookup": wst.M{
+			"from":     "SQLiteNote",
+			"let":      wst.M{"noteId": "$noteId"},
+			"pipeline": wst.A{{"$match": wst.M{"$expr": wst.M{"$and": wst.A{{"$eq": []string{"$_id", "$$noteId"}}}}}}, {"$limit": 2}},
+			"as":       "note",
+		}},
+		{"$unwind": wst.M{"path": "$note", "preserveNullAndEmptyArrays": true}},
+		{"$match": wst.M{"note.priority": 1}},
+	})
+	assert.NoError(t, err)
+	found = nil
+	err = cursor.All(context.Background(), &found)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(found))
+	assert.Equal(t, "Note 1", found[0]["note"].(wst.M)["title"])
+
+	// update by id with the version check
+	updated, err := ds.UpdateById("SQLiteNote", noteIds[1], &wst.M{"title": "Note 2 updated", datasource.VersionProperty: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, "Note 2 updated", updated.GetString("title"))
+	assert.EqualValues(t, 2, (*updated)["priority"])
+	assert.EqualValues(t, 1, datasource.VersionOf(*updated))
+	_, err = ds.UpdateById("SQLiteNote", noteIds[1], &wst.M{"title": "Note 2 stale", datasource.VersionProperty: 0})
+	assert.ErrorIs(t, err, datasource.ErrVersionMismatch)
+
+	// duplicated ids are rejected
+	_, err = ds.Create("SQLiteNote", &wst.M{"_id": noteIds[4]})
+	assert.Error(t, err)
+
+	// delete by id and delete many
+	deleteResult, err := ds.DeleteById("SQLiteNote", noteIds[3])
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, deleteResult.DeletedCount)
+
+	deleteResult, err = ds.DeleteMany("SQLiteNote", &wst.A{{"$match": wst.M{"priority": wst.M{"$in": []interface{}{1, 2}}}}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, deleteResult.DeletedCount)
+
+	count, err = ds.Count("SQLiteNote", nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, count.Count)
+
+}
+
+// countingConnector is a connector defined outside the datasource package, which delegates to memorykv
+type countingConnector struct {
+	datasource.PersistedConnector
+	created int
+}
+
+func (connector *countingConnector) GetName() string {
+	return "counting"
+}
+
+func (connector *countingConnector) Create(collectionName string, data *wst.M) (*wst.M, error) {
+	connector.created++
+	return connector.PersistedConnector.Create(collectionName, data)
+}
+
+func Test_RegisterConnector(t *testing.T) {
+
+	t.Parallel()
+
+	var receivedViper *viper.Viper
+	var receivedOptions *datasource.Options
+	connector := &countingConnector{}
+	datasource.RegisterConnector("counting", func(dsKey string, dsViper *viper.Viper, options *datasource.Options) (datasource.PersistedConnector, error) {
+		receivedViper = dsViper
+		receivedOptions = options
+		connector.PersistedConnector = datasource.NewMemoryKVConnector(wst.CreateDefaultMongoRegistry(), dsKey)
+		return connector, nil
+	})
+	assert.True(t, datasource.IsConnectorRegistered("counting"))
+	assert.False(t, datasource.IsConnectorRegistered("unknown"))
+
+	dsViper := viper.New()
+	dsViper.Set("countingDs.connector", "counting")
+	dsViper.Set("countingDs.engine", "in-house")
+	ds := datasource.New(&wst.IApp{}, "countingDs", dsViper, context.Background())
+	ds.Options = &datasource.Options{RetryOnError: true}
+	err := ds.Initialize()
+	assert.NoError(t, err)
+	assert.Equal(t, "in-house", receivedViper.GetString("engine"))
+	assert.Equal(t, ds.Options, receivedOptions)
+
+	created, err := ds.Create("CountingNote", &wst.M{"title": "Note"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Note", created.GetString("title"))
+	assert.Equal(t, 1, connector.created)
+
+	err = ds.Close()
+	assert.NoError(t, err)
+
+}
+
+func Test_RedisCacheConnector(t *testing.T) {
+
+	t.Parallel()
+
+	// A memorykv server stands in for Redis
+	serverDb := memorykv.NewMemoryKvDb(memorykv.Options{Name: "redisStandIn"})
+	server := memorykv.NewServer(serverDb, memorykv.ServerOptions{Password: "redisPassword"})
+	err := server.Start("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+
+	dsViper := viper.New()
+	dsViper.Set("redisCache.connector", "redis")
+	dsViper.Set("redisCache.host", "127.0.0.1")
+	dsViper.Set("redisCache.port", server.Addr().(*net.TCPAddr).Port)
+	dsViper.Set("redisCache.password", "redisPassword")
+	ds := datasource.New(&wst.IApp{}, "redisCache", dsViper, context.Background())
+	err = ds.Initialize()
+	assert.NoError(t, err)
+	assert.True(t, ds.Health().Healthy)
+
+	_, err = ds.Create("CachedNote", &wst.M{
+		"_redId":   "accountId:abc",
+		"_entries": wst.A{{"title": "First"}, {"title": "Second"}},
+	})
+	assert.NoError(t, err)
+	err = ds.Db.(memorykv.MemoryKvDb).GetBucket("CachedNote").Expire("accountId:abc", 30*time.Second)
+	assert.NoError(t, err)
+
+	cursor, err := ds.FindMany("CachedNote", &wst.A{{"$match": wst.M{"accountId": "accountId:abc"}}})
+	assert.NoError(t, err)
+	var cached []wst.M
+	err = cursor.All(context.Background(), &cached)
+	assert.NoError(t, err)
+	assert.Len(t, cached, 2)
+	assert.Equal(t, "Second", cached[1].GetString("title"))
+
+	// The entries are stored in the server, shared by every replica
+	ttl, found := serverDb.GetBucket("CachedNote").TTL("accountId:abc")
+	assert.True(t, found)
+	assert.InDelta(t, 30, ttl.Seconds(), 2)
+
+	err = ds.Close()
+	assert.NoError(t, err)
+	entries, err := serverDb.GetBucket("CachedNote").Get("accountId:abc")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+}
+
+func Test_DatasourceDegradedBoot(t *testing.T) {
+
+	t.Parallel()
+
+	// Reserve a port with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	dsViper := viper.New()
+	dsViper.Set("degradedCache.connector", "memorykv")
+	dsViper.Set("degradedCache.url", "redis://"+address)
+	ds := datasource.New(&wst.IApp{}, "degradedCache", dsViper, context.Background())
+	err = ds.Initialize()
+	assert.Error(t, err)
+
+	// In degraded mode the boot goes on, and the datasource is connected once it is reachable
+	ds = datasource.New(&wst.IApp{}, "degradedCache", dsViper, context.Background())
+	ds.Options = &datasource.Options{Degraded: true}
+	err = ds.Initialize()
+	assert.NoError(t, err)
+	health := ds.Health()
+	assert.False(t, health.Healthy)
+	assert.NotEmpty(t, health.Error)
+
+	server := memorykv.NewServer(memorykv.NewMemoryKvDb(memorykv.Options{Name: "degradedStandIn"}), memorykv.ServerOptions{})
+	err = server.Start(address)
+	assert.NoError(t, err)
+	defer server.Close()
+	assert.Eventually(t, func() bool {
+		return ds.Health().Healthy
+	}, 15*time.Second, 100*time.Millisecond)
+	_, err = ds.Create("DegradedNote", &wst.M{"_id": "note1"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, ds.Close())
+
+}
+
+func Test_MemoryKvDocumentCollections(t *testing.T) {
+
+	t.Parallel()
+
+	dsViper := viper.New()
+	dsViper.Set("memorykvDocuments.connector", "memorykv")
+	dsViper.Set("memorykvDocuments.persistence.directory", t.TempDir())
+	ds := datasource.New(&wst.IApp{}, "memorykvDocuments", dsViper, context.Background())
+	err := ds.Initialize()
+	assert.NoError(t, err)
+
+	for _, id := range []string{"note1", "note2"} {
+		_, err = ds.Create("DocumentNote", &wst.M{"_id": id, "title": "Note"})
+		assert.NoError(t, err)
+	}
+	_, err = ds.Create("DocumentNote", &wst.M{"_id": "note1", "title": "Duplicated"})
+	var duplicateKeyError *datasource.DuplicateKeyError
+	assert.ErrorAs(t, err, &duplicateKeyError)
+
+	// The documents never expire
+	ttl, found := ds.Db.(memorykv.MemoryKvDb).GetBucket("DocumentNote").TTL("note1")
+	assert.True(t, found)
+	assert.Equal(t, time.Duration(-1), ttl)
+	updated, err := ds.UpdateById("DocumentNote", "note1", &wst.M{"title": "Updated"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Updated", updated.GetString("title"))
+	ttl, _ = ds.Db.(memorykv.MemoryKvDb).GetBucket("DocumentNote").TTL("note1")
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	err = ds.Close()
+	assert.NoError(t, err)
+
+	// After a restart the collection is only read as documents once it is declared, as the models do at boot
+	replayed := datasource.New(&wst.IApp{}, "memorykvDocuments", dsViper, context.Background())
+	err = replayed.Initialize()
+	assert.NoError(t, err)
+	count, err := replayed.Count("DocumentNote", nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, count.Count)
+	replayed.SetDocumentCollection("DocumentNote")
+	count, err = replayed.Count("DocumentNote", nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, count.Count)
+
+	err = replayed.Close()
+	assert.NoError(t, err)
+
+}
+
+func Test_DatasourceContextOperations(t *testing.T) {
+
+	t.Parallel()
+
+	for _, connectorName := range []string{"sqlite", "memorykv"} {
+		dsKey := connectorName + "Ctx"
+		dsViper := viper.New()
+		dsViper.Set(dsKey+".connector", connectorName)
+		ds := datasource.New(&wst.IApp{}, dsKey, dsViper, context.Background())
+		err := ds.Initialize()
+		assert.NoError(t, err)
+
+		created, err := ds.CreateContext(context.Background(), "ContextNote", &wst.M{"_id": "note1", "title": "Note"})
+		assert.NoError(t, err)
+		assert.Equal(t, "Note", created.GetString("title"))
+
+		// The operations of a request already cancelled are not run
+		cancelledCtx, cancelFn := context.WithCancel(context.Background())
+		cancelFn()
+		_, err = ds.FindManyContext(cancelledCtx, "ContextNote", nil)
+		assert.ErrorIs(t, err, context.Canceled, connectorName)
+		_, err = ds.CountContext(cancelledCtx, "ContextNote", nil)
+		assert.ErrorIs(t, err, context.Canceled, connectorName)
+		_, err = ds.CreateContext(cancelledCtx, "ContextNote", &wst.M{"_id": "note2"})
+		assert.ErrorIs(t, err, context.Canceled, connectorName)
+		_, _, err = ds.FindManyWithCountContext(cancelledCtx, "ContextNote", nil, nil)
+		assert.ErrorIs(t, err, context.Canceled, connectorName)
+
+		// The operations without context are not cancelled
+		count, err := ds.Count("ContextNote", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), count.Count, connectorName)
+
+		deleted, err := ds.DeleteByIdContext(context.Background(), "ContextNote", "note1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), deleted.DeletedCount, connectorName)
+
+		err = ds.Close()
+		assert.NoError(t, err)
+	}
+
+}
+
+func Test_MemoryKvTextSearch(t *testing.T) {
+
+	t.Parallel()
+
+	dsViper := viper.New()
+	dsViper.Set("memorykvSearch.connector", "memorykv")
+	ds := datasource.New(&wst.IApp{}, "memorykvSearch", dsViper, context.Background())
+	err := ds.Initialize()
+	assert.NoError(t, err)
+	assert.True(t, ds.SupportsSearch())
+
+	searchLookups := func(q string) *wst.A {
+		return &wst.A{
+			{"$match": wst.M{"$text": wst.M{"$search": q}}},
+			{"$addFields": wst.M{"_score": wst.M{"$meta": "textScore"}}},
+			{"$sort": wst.M{"_score": -1}},
+		}
+	}
+
+	// Without a text index the $text queries fail, as in MongoDB
+	_, err = ds.Create("SearchNote", &wst.M{"_id": "note1", "title": "Golang tips", "body": "Concurrency with channels"})
+	assert.NoError(t, err)
+	_, err = ds.FindMany("SearchNote", searchLookups("golang"))
+	assert.Error(t, err)
+
+	err = ds.SetTextIndex("SearchNote", map[string]int32{"title": 10, "body": 1})
+	assert.NoError(t, err)
+	_, err = ds.Create("SearchNote", &wst.M{"_id": "note2", "title": "Channels", "body": "Golang channels are typed conduits"})
+	assert.NoError(t, err)
+	_, err = ds.Create("SearchNote", &wst.M{"_id": "note3", "title": "Gardening", "body": "Tomatoes need sun"})
+	assert.NoError(t, err)
+
+	cursor, err := ds.FindMany("SearchNote", searchLookups("GOLANG channels"))
+	assert.NoError(t, err)
+	var found []wst.M
+	err = cursor.All(context.Background(), &found)
+	assert.NoError(t, err)
+	if assert.Len(t, found, 2) {
+		// The matches in the title weigh more
+		assert.Equal(t, "note2", found[0]["_id"])
+		assert.Equal(t, "note1", found[1]["_id"])
+		assert.Greater(t, found[0]["_score"], found[1]["_score"])
+		assert.NotContains(t, found[0], "$textScore")
+	}
+
+	// The excluded words discard the documents containing them
+	count, err := ds.Count("SearchNote", &wst.A{{"$match": wst.M{"$text": wst.M{"$search": "golang -concurrency"}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count.Count)
+
+	// The updated documents are indexed again
+	_, err = ds.UpdateById("SearchNote", "note3", &wst.M{"body": "Tomatoes and golang"})
+	assert.NoError(t, err)
+	count, err = ds.Count("SearchNote", &wst.A{{"$match": wst.M{"$text": wst.M{"$search": "golang"}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count.Count)
+
+	// The words removed by an update and the deleted documents are dropped from the index
+	_, err = ds.UpdateMany("SearchNote", &wst.A{{"$match": wst.M{"_id": "note2"}}}, &wst.M{"body": "Buffered or not"})
+	assert.NoError(t, err)
+	_, err = ds.DeleteById("SearchNote", "note1")
+	assert.NoError(t, err)
+	count, err = ds.Count("SearchNote", &wst.A{{"$match": wst.M{"$text": wst.M{"$search": "golang"}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count.Count)
+	count, err = ds.Count("SearchNote", &wst.A{{"$match": wst.M{"$text": wst.M{"$search": "buffered"}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count.Count)
+
+	err = ds.Close()
+	assert.NoError(t, err)
+
+}
@@ -1,8 +1,16 @@
 package tests
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"github.com/fredyk/westack-go/v2/memorykv"
 	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -122,3 +130,640 @@ func Test_MemoryKvReuseBucket(t *testing.T) {
 	assert.Equal(t, [][]byte{[]byte("bar")}, val)
 
 }
+
+func Test_MemoryKvPersistence(t *testing.T) {
+
+	t.Parallel()
+
+	options := memorykv.Options{
+		Name:        "persistedMemoryKv",
+		Persistence: &memorykv.PersistenceOptions{Directory: t.TempDir(), SnapshotInterval: time.Hour},
+	}
+	db := memorykv.NewMemoryKvDb(options)
+	bucket := db.GetBucket("testBucket")
+	err := bucket.SetEx("snapshotted", [][]byte{[]byte("a"), []byte("b")}, time.Hour)
+	assert.NoError(t, err)
+	err = bucket.SetEx("removed", [][]byte{[]byte("c")}, time.Hour)
+	assert.NoError(t, err)
+	err = db.Snapshot()
+	assert.NoError(t, err)
+
+	// These writes are only in the append-only log
+	err = bucket.SetEx("logged", [][]byte{[]byte("d")}, time.Hour)
+	assert.NoError(t, err)
+	err = bucket.SetEx("expiring", [][]byte{[]byte("e")}, time.Second)
+	assert.NoError(t, err)
+	err = bucket.Delete("removed")
+	assert.NoError(t, err)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	// Replayed without closing the first database, like after a crash
+	replayed := memorykv.NewMemoryKvDb(options)
+	replayedBucket := replayed.GetBucket("testBucket")
+	val, err := replayedBucket.Get("snapshotted")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, val)
+	val, err = replayedBucket.Get("logged")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("d")}, val)
+	val, err = replayedBucket.Get("removed")
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	val, err = replayedBucket.Get("expiring")
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+
+	// The TTLs are kept
+	stats := replayed.Stats()["testBucket"]
+	assert.Equal(t, 2, stats.Entries)
+	earliest, err := time.Parse(time.RFC3339, stats.EarliestExpirationTime)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), earliest, 10*time.Second)
+
+	assert.NoError(t, replayed.Close())
+	assert.NoError(t, db.Close())
+}
+
+func Test_MemoryKvPersistenceOrderAndFailedSnapshots(t *testing.T) {
+
+	t.Parallel()
+
+	directory := t.TempDir()
+	options := memorykv.Options{
+		Name:        "orderedMemoryKv",
+		Persistence: &memorykv.PersistenceOptions{Directory: directory, SnapshotInterval: time.Hour},
+	}
+	db, err := memorykv.OpenMemoryKvDb(options)
+	assert.NoError(t, err)
+	bucket := db.GetBucket("testBucket")
+
+	// The log follows the order of the concurrent writes, so the replayed value is the one in memory
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bucket.Set("contended", [][]byte{[]byte(fmt.Sprintf("%v", i))})
+		}(i)
+	}
+	wg.Wait()
+	expected, err := bucket.Get("contended")
+	assert.NoError(t, err)
+
+	// A snapshot that cannot be written keeps the moved log, which is replayed together with the new one
+	tmpPath := directory + "/orderedMemoryKv.snapshot.tmp"
+	assert.NoError(t, os.Mkdir(tmpPath, 0755))
+	assert.Error(t, db.Snapshot())
+	bucket.Set("afterFailedSnapshot", [][]byte{[]byte("a")})
+	assert.Error(t, db.Snapshot())
+	bucket.Set("afterSecondFailedSnapshot", [][]byte{[]byte("b")})
+	assert.Error(t, db.Close())
+
+	replayed, err := memorykv.OpenMemoryKvDb(options)
+	assert.NoError(t, err)
+	replayedBucket := replayed.GetBucket("testBucket")
+	for key, value := range map[string][][]byte{
+		"contended":                 expected,
+		"afterFailedSnapshot":       {[]byte("a")},
+		"afterSecondFailedSnapshot": {[]byte("b")},
+	} {
+		val, err := replayedBucket.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, value, val, key)
+	}
+
+	assert.NoError(t, os.Remove(tmpPath))
+	assert.NoError(t, replayed.Snapshot())
+	_, err = os.Stat(directory + "/orderedMemoryKv.aof.previous")
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, replayed.Close())
+
+	// The errors reading the persisted files are returned
+	assert.NoError(t, os.WriteFile(directory+"/orderedMemoryKv.snapshot", []byte("corrupted"), 0644))
+	_, err = memorykv.OpenMemoryKvDb(options)
+	assert.Error(t, err)
+}
+
+func Test_MemoryKvPersistenceCorruptedLength(t *testing.T) {
+
+	t.Parallel()
+
+	directory := t.TempDir()
+	options := memorykv.Options{
+		Name:        "corruptedMemoryKv",
+		Persistence: &memorykv.PersistenceOptions{Directory: directory, SnapshotInterval: time.Hour},
+	}
+	db, err := memorykv.OpenMemoryKvDb(options)
+	assert.NoError(t, err)
+	db.GetBucket("testBucket").Set("kept", [][]byte{[]byte("a")})
+	assert.NoError(t, db.Close())
+
+	// A length above the limit, or past the end of the log, is discarded without allocating it
+	logPath := directory + "/corruptedMemoryKv.aof"
+	for _, length := range []uint64{1 << 62, 100} {
+		info, err := os.Stat(logPath)
+		assert.NoError(t, err)
+		logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		_, err = logFile.Write(append(binary.AppendUvarint(nil, length), "corrupted"...))
+		assert.NoError(t, err)
+		assert.NoError(t, logFile.Close())
+
+		replayed, err := memorykv.OpenMemoryKvDb(options)
+		assert.NoError(t, err)
+		val, err := replayed.GetBucket("testBucket").Get("kept")
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("a")}, val)
+		truncated, err := os.Stat(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, info.Size(), truncated.Size())
+		assert.NoError(t, replayed.Close())
+	}
+}
+
+func Test_MemoryKvEviction(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{
+		Name:   "evictingMemoryKv",
+		Limits: memorykv.Limits{MaxBytes: 40},
+		BucketLimits: map[string]memorykv.Limits{
+			"lruBucket": {MaxEntries: 3},
+			"lfuBucket": {MaxEntries: 2, Policy: memorykv.EvictionLFU},
+		},
+	})
+
+	lruBucket := db.GetBucket("lruBucket")
+	assert.NoError(t, lruBucket.SetEx("k1", [][]byte{[]byte("1")}, time.Hour))
+	assert.NoError(t, lruBucket.SetEx("k2", [][]byte{[]byte("2")}, time.Hour))
+	assert.NoError(t, lruBucket.SetEx("k3", [][]byte{[]byte("3")}, time.Hour))
+	val, err := lruBucket.Get("k1")
+	assert.NoError(t, err)
+	assert.NotNil(t, val)
+	assert.NoError(t, lruBucket.SetEx("k4", [][]byte{[]byte("4")}, time.Hour))
+	val, err = lruBucket.Get("k2")
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	assert.ElementsMatch(t, []string{"k1", "k3", "k4"}, lruBucket.Keys())
+
+	lfuBucket := db.GetBucket("lfuBucket")
+	assert.NoError(t, lfuBucket.SetEx("k1", [][]byte{[]byte("1")}, time.Hour))
+	assert.NoError(t, lfuBucket.SetEx("k2", [][]byte{[]byte("2")}, time.Hour))
+	for i := 0; i < 3; i++ {
+		_, err = lfuBucket.Get("k2")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, lfuBucket.SetEx("k3", [][]byte{[]byte("3")}, time.Hour))
+	assert.ElementsMatch(t, []string{"k2", "k3"}, lfuBucket.Keys())
+
+	stats := db.Stats()
+	assert.Equal(t, int64(1), stats["lruBucket"].Evictions)
+	assert.Equal(t, int64(3), stats["lruBucket"].EvictedBytes)
+	assert.Equal(t, int64(1), stats["lfuBucket"].Evictions)
+
+	// The large entry takes 39 of the 40 bytes of the database, so the entries of the other buckets are evicted
+	otherBucket := db.GetBucket("otherBucket")
+	assert.NoError(t, otherBucket.SetEx("large", [][]byte{[]byte("0123456789012345678901234567890123")}, time.Hour))
+	stats = db.Stats()
+	var entries int
+	var evictions int64
+	for _, bucketStats := range stats {
+		entries += bucketStats.Entries
+		evictions += bucketStats.Evictions
+	}
+	assert.Equal(t, 1, entries)
+	assert.Equal(t, int64(7), evictions)
+	assert.ElementsMatch(t, []string{"large"}, otherBucket.Keys())
+}
+
+func Test_MemoryKvEvictionExcludedBuckets(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{
+		Name:         "excludingMemoryKv",
+		Limits:       memorykv.Limits{MaxEntries: 3},
+		BucketLimits: map[string]memorykv.Limits{"documents": {MaxEntries: 1}},
+	})
+	db.(*memorykv.MemoryKvDbImpl).ExcludeFromEviction("documents")
+
+	documents := db.GetBucket("documents")
+	for i := 0; i < 5; i++ {
+		documents.Set(fmt.Sprintf("doc%v", i), [][]byte{[]byte("document")})
+	}
+	cache := db.GetBucket("cache")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, cache.SetEx(fmt.Sprintf("k%v", i), [][]byte{[]byte("entry")}, time.Hour))
+	}
+
+	// The documents are kept, and only the cache entries count for the limits of the database
+	assert.Len(t, documents.Keys(), 5)
+	assert.Len(t, cache.Keys(), 3)
+	stats := db.Stats()
+	assert.Equal(t, int64(0), stats["documents"].Evictions)
+	assert.Equal(t, int64(2), stats["cache"].Evictions)
+	// The evicted entries leave the expiration queue
+	assert.Equal(t, int64(3), stats["cache"].ExpirationQueueSize)
+}
+
+func Test_MemoryKvServer(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "servedMemoryKv"})
+	server := memorykv.NewServer(db, memorykv.ServerOptions{Password: "secret"})
+	err := server.Start("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+	address := server.Addr().String()
+
+	_, err = memorykv.NewRemoteMemoryKvDb(memorykv.RemoteOptions{Address: address, Password: "wrong"})
+	assert.Error(t, err)
+
+	remote, err := memorykv.NewRemoteMemoryKvDb(memorykv.RemoteOptions{Address: address, Password: "secret"})
+	assert.NoError(t, err)
+	defer remote.Close()
+	assert.NoError(t, remote.Ping(context.Background()))
+
+	// Values with several entries, like the cache envelopes, keep their entries
+	remoteBucket := remote.GetBucket("Order")
+	err = remoteBucket.SetEx("cached", [][]byte{[]byte("first"), []byte("second")}, time.Hour)
+	assert.NoError(t, err)
+	val, err := db.GetBucket("Order").Get("cached")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("first"), []byte("second")}, val)
+
+	db.GetBucket("Order").Set("local", [][]byte{[]byte("plain")})
+	val, err = remoteBucket.Get("local")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("plain")}, val)
+	val, err = remoteBucket.Get("missing")
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	assert.ElementsMatch(t, []string{"cached", "local"}, remoteBucket.Keys())
+	assert.Contains(t, remote.Buckets(), "Order")
+
+	ttl, found := remoteBucket.TTL("cached")
+	assert.True(t, found)
+	assert.InDelta(t, time.Hour.Seconds(), ttl.Seconds(), 2)
+	assert.NoError(t, remoteBucket.Expire("local", time.Minute))
+	ttl, found = remoteBucket.TTL("local")
+	assert.True(t, found)
+	assert.InDelta(t, time.Minute.Seconds(), ttl.Seconds(), 2)
+	assert.Error(t, remoteBucket.Expire("missing", time.Minute))
+
+	assert.NoError(t, remoteBucket.Delete("local"))
+	_, found = remoteBucket.TTL("local")
+	assert.False(t, found)
+	assert.Equal(t, int64(1), remote.Stats()["Order"].Hits)
+	assert.Equal(t, int64(1), remote.Stats()["Order"].Misses)
+
+	// Raw RESP commands, as sent by redis-cli
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send := func(command string) string {
+		_, err := conn.Write([]byte(command))
+		assert.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+	assert.Equal(t, "-NOAUTH Authentication required.\r\n", send("GET counter\r\n"))
+	assert.Equal(t, "+OK\r\n", send("*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n"))
+	assert.Equal(t, ":1\r\n", send("*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n"))
+	assert.Equal(t, ":2\r\n", send("INCR counter\r\n"))
+	assert.Equal(t, "$1\r\n", send("GET counter\r\n"))
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "2\r\n", line)
+	assert.Equal(t, "+OK\r\n", send("SETEX Order:raw 100 value\r\n"))
+	// The TTL is rounded to seconds
+	assert.Regexp(t, `^:(99|100)\r\n$`, send("TTL Order:raw\r\n"))
+	assert.Equal(t, ":-2\r\n", send("TTL Order:missing\r\n"))
+	assert.Equal(t, "*1\r\n", send("KEYS Order:r*\r\n"))
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "$9\r\n", line)
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "Order:raw\r\n", line)
+	assert.Equal(t, "*2\r\n", send("SCAN 0 MATCH Order:r* COUNT 10\r\n"))
+	for _, expected := range []string{"$1\r\n", "0\r\n", "*1\r\n", "$9\r\n", "Order:raw\r\n"} {
+		line, _ = reader.ReadString('\n')
+		assert.Equal(t, expected, line)
+	}
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", send("INCR Order:raw\r\n"))
+	// Transactions
+	assert.Equal(t, "+OK\r\n", send("MULTI\r\n"))
+	assert.Equal(t, "+QUEUED\r\n", send("INCR tx\r\n"))
+	assert.Equal(t, "+QUEUED\r\n", send("INCRBY tx 2\r\n"))
+	assert.Equal(t, "*2\r\n", send("EXEC\r\n"))
+	for _, expected := range []string{":1\r\n", ":3\r\n"} {
+		line, _ = reader.ReadString('\n')
+		assert.Equal(t, expected, line)
+	}
+	assert.Equal(t, "+OK\r\n", send("MULTI\r\n"))
+	assert.Equal(t, "-ERR unknown command 'HSET'\r\n", send("HSET a b c\r\n"))
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", send("EXEC\r\n"))
+	assert.Equal(t, "-ERR EXEC without MULTI\r\n", send("EXEC\r\n"))
+	assert.Equal(t, "+OK\r\n", send("MULTI\r\n"))
+	assert.Equal(t, "+QUEUED\r\n", send("DEL tx\r\n"))
+	assert.Equal(t, "+OK\r\n", send("DISCARD\r\n"))
+	assert.Equal(t, ":1\r\n", send("DEL tx\r\n"))
+	assert.Equal(t, ":2\r\n", send("DEL Order:raw counter Order:missing\r\n"))
+	// SET with GET and EX replaces the value and its expiration in one operation
+	assert.Equal(t, "+OK\r\n", send("SET Order:swap old\r\n"))
+	assert.Equal(t, "$3\r\n", send("SET Order:swap new GET EX 50\r\n"))
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "old\r\n", line)
+	assert.Regexp(t, `^:(49|50)\r\n$`, send("TTL Order:swap\r\n"))
+	// EXEC fails when the value of a watched key changed
+	assert.Equal(t, "+OK\r\n", send("WATCH Order:swap\r\n"))
+	db.GetBucket("Order").Set("swap", [][]byte{[]byte("changed")})
+	assert.Equal(t, "+OK\r\n", send("MULTI\r\n"))
+	assert.Equal(t, "+QUEUED\r\n", send("SET Order:swap mine\r\n"))
+	assert.Equal(t, "*-1\r\n", send("EXEC\r\n"))
+	assert.Equal(t, "+OK\r\n", send("WATCH Order:swap\r\n"))
+	assert.Equal(t, "+OK\r\n", send("MULTI\r\n"))
+	assert.Equal(t, "+QUEUED\r\n", send("SET Order:swap mine\r\n"))
+	assert.Equal(t, "*1\r\n", send("EXEC\r\n"))
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "+OK\r\n", line)
+	// Patterns with many * do not backtrack exponentially
+	db.GetBucket("Order").Set(strings.Repeat("a", 40), [][]byte{[]byte("value")})
+	startedAt := time.Now()
+	assert.Equal(t, "*0\r\n", send("KEYS "+strings.Repeat("*a", 12)+"b\r\n"))
+	assert.Less(t, time.Since(startedAt), time.Second)
+	assert.Equal(t, "*1\r\n", send("KEYS Order:"+strings.Repeat("*a", 12)+"\r\n"))
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "$46\r\n", line)
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "Order:"+strings.Repeat("a", 40)+"\r\n", line)
+	assert.Equal(t, "+OK\r\n", send("FLUSHDB\r\n"))
+	assert.Empty(t, remoteBucket.Keys())
+	assert.Equal(t, "-ERR unknown command 'HSET'\r\n", send("HSET a b c\r\n"))
+}
+
+func Test_MemoryKvServerRequestLimits(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "limitedMemoryKv"})
+	server := memorykv.NewServer(db, memorykv.ServerOptions{Password: "secret"})
+	err := server.Start("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+	address := server.Addr().String()
+
+	request := func(commands ...string) string {
+		conn, err := net.Dial("tcp", address)
+		assert.NoError(t, err)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var line string
+		for _, command := range commands {
+			_, err = conn.Write([]byte(command))
+			assert.NoError(t, err)
+			line, err = reader.ReadString('\n')
+			assert.NoError(t, err)
+		}
+		return line
+	}
+
+	// Before AUTH, neither large arrays nor large bulk strings are accepted
+	assert.Equal(t, "-ERR Protocol error\r\n", request("*536870912\r\n"))
+	assert.Equal(t, "-ERR Protocol error\r\n", request("*11\r\n"))
+	assert.Equal(t, "-ERR Protocol error\r\n", request("*2\r\n$4\r\nAUTH\r\n$536870912\r\n"))
+	// Requests are flat arrays
+	assert.Equal(t, "-ERR Protocol error\r\n", request("*1\r\n*1\r\n$4\r\nPING\r\n"))
+
+	auth := "*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n"
+	assert.Equal(t, "-ERR Protocol error\r\n", request(auth, "*1048577\r\n"))
+	// Once authenticated, larger values are accepted
+	value := strings.Repeat("x", 20000)
+	assert.Equal(t, "+OK\r\n", request(auth, fmt.Sprintf("*3\r\n$3\r\nSET\r\n$5\r\nlarge\r\n$%d\r\n%v\r\n", len(value), value)))
+}
+
+func Test_MemoryKvAtomicOps(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "atomicMemoryKv"})
+	server := memorykv.NewServer(db, memorykv.ServerOptions{})
+	err := server.Start("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+	remote, err := memorykv.NewRemoteMemoryKvDb(memorykv.RemoteOptions{Address: server.Addr().String()})
+	assert.NoError(t, err)
+	defer remote.Close()
+
+	for name, bucket := range map[string]memorykv.MemoryKvBucket{
+		"local":  db.GetBucket("localBucket"),
+		"remote": remote.GetBucket("remoteBucket"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						_, err := bucket.Incr("counter", time.Minute)
+						assert.NoError(t, err)
+					}
+				}()
+			}
+			wg.Wait()
+			count, err := bucket.IncrBy("counter", -50, time.Hour)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(150), count)
+			// The TTL is only set when the counter is created
+			ttl, found := bucket.TTL("counter")
+			assert.True(t, found)
+			assert.InDelta(t, time.Minute.Seconds(), ttl.Seconds(), 2)
+			// Even when the result equals the increment
+			_, err = bucket.IncrBy("counter", -150, time.Hour)
+			assert.NoError(t, err)
+			count, err = bucket.IncrBy("counter", 1, time.Hour)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), count)
+			ttl, _ = bucket.TTL("counter")
+			assert.InDelta(t, time.Minute.Seconds(), ttl.Seconds(), 2)
+
+			bucket.Set("text", [][]byte{[]byte("abc")})
+			_, err = bucket.Incr("text", 0)
+			assert.ErrorIs(t, err, memorykv.ErrNotInteger)
+
+			stored, err := bucket.SetNX("lock", [][]byte{[]byte("owner1")}, time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, stored)
+			stored, err = bucket.SetNX("lock", [][]byte{[]byte("owner2")}, time.Minute)
+			assert.NoError(t, err)
+			assert.False(t, stored)
+
+			swapped, err := bucket.CompareAndSwap("lock", [][]byte{[]byte("owner2")}, [][]byte{[]byte("owner3")}, 0)
+			assert.NoError(t, err)
+			assert.False(t, swapped)
+			swapped, err = bucket.CompareAndSwap("lock", [][]byte{[]byte("owner1")}, [][]byte{[]byte("owner3")}, 0)
+			assert.NoError(t, err)
+			assert.True(t, swapped)
+			swapped, err = bucket.CompareAndSwap("idempotencyKey", nil, [][]byte{[]byte("a"), []byte("b")}, time.Hour)
+			assert.NoError(t, err)
+			assert.True(t, swapped)
+			swapped, err = bucket.CompareAndSwap("idempotencyKey", nil, [][]byte{[]byte("c")}, time.Hour)
+			assert.NoError(t, err)
+			assert.False(t, swapped)
+
+			previous, err := bucket.GetSet("lock", [][]byte{[]byte("owner4")})
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("owner3")}, previous)
+			val, err := bucket.Get("lock")
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("owner4")}, val)
+			ttl, found = bucket.TTL("lock")
+			assert.True(t, found)
+			assert.InDelta(t, time.Minute.Seconds(), ttl.Seconds(), 2)
+			previous, err = bucket.GetSet("fresh", [][]byte{[]byte("value")})
+			assert.NoError(t, err)
+			assert.Nil(t, previous)
+		})
+	}
+}
+
+func Test_MemoryKvLocks(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "lockingMemoryKv"})
+	server := memorykv.NewServer(db, memorykv.ServerOptions{})
+	err := server.Start("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+	remote, err := memorykv.NewRemoteMemoryKvDb(memorykv.RemoteOptions{Address: server.Addr().String()})
+	assert.NoError(t, err)
+	defer remote.Close()
+
+	for name, bucket := range map[string]memorykv.MemoryKvBucket{
+		"local":  db.GetBucket("localLocks"),
+		"remote": remote.GetBucket("remoteLocks"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			owner1 := [][]byte{[]byte("owner1")}
+			owner2 := [][]byte{[]byte("owner2")}
+			acquired, err := bucket.SetNX("renewed", owner1, time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, acquired)
+
+			// The owner renews the lock by swapping its own value with a new TTL
+			renewed, err := bucket.CompareAndSwap("renewed", owner1, owner1, time.Hour)
+			assert.NoError(t, err)
+			assert.True(t, renewed)
+			ttl, found := bucket.TTL("renewed")
+			assert.True(t, found)
+			assert.InDelta(t, time.Hour.Seconds(), ttl.Seconds(), 2)
+			renewed, err = bucket.CompareAndSwap("renewed", owner2, owner2, time.Hour)
+			assert.NoError(t, err)
+			assert.False(t, renewed)
+
+			// Once released, the lock is acquired again
+			assert.NoError(t, bucket.Delete("renewed"))
+			acquired, err = bucket.SetNX("renewed", owner2, time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, acquired)
+
+			// Expired locks cannot be renewed, and are acquired again even before they are removed
+			acquired, err = bucket.SetNX("expiring", owner1, time.Second)
+			assert.NoError(t, err)
+			assert.True(t, acquired)
+			count, err := bucket.IncrBy("counter", 5, time.Second)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(5), count)
+			time.Sleep(2100 * time.Millisecond)
+			renewed, err = bucket.CompareAndSwap("expiring", owner1, owner1, time.Minute)
+			assert.NoError(t, err)
+			assert.False(t, renewed)
+			acquired, err = bucket.SetNX("expiring", owner2, time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, acquired)
+			val, err := bucket.Get("expiring")
+			assert.NoError(t, err)
+			assert.Equal(t, owner2, val)
+			ttl, _ = bucket.TTL("expiring")
+			assert.InDelta(t, time.Minute.Seconds(), ttl.Seconds(), 2)
+			count, err = bucket.IncrBy("counter", 1, time.Minute)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), count)
+
+			// Expirations keep the milliseconds of the TTL
+			acquired, err = bucket.SetNX("short", owner1, 300*time.Millisecond)
+			assert.NoError(t, err)
+			assert.True(t, acquired)
+			time.Sleep(500 * time.Millisecond)
+			acquired, err = bucket.SetNX("short", owner2, time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, acquired)
+
+			// Only one of the concurrent swaps of the same value succeeds
+			bucket.Set("contended", owner1)
+			var wg sync.WaitGroup
+			var swaps sync.Map
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					swapped, err := bucket.CompareAndSwap("contended", owner1, [][]byte{[]byte(fmt.Sprintf("owner%v", i))}, 0)
+					assert.NoError(t, err)
+					if swapped {
+						swaps.Store(i, true)
+					}
+				}(i)
+			}
+			wg.Wait()
+			swapCount := 0
+			swaps.Range(func(key, value any) bool {
+				swapCount++
+				return true
+			})
+			assert.Equal(t, 1, swapCount)
+		})
+	}
+}
+
+func Test_MemoryKvExpirationQueue(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "queuedMemoryKv"})
+	bucket := db.GetBucket("queued")
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, bucket.SetEx("expiring", [][]byte{[]byte("value")}, time.Hour))
+		bucket.Set("persistent", [][]byte{[]byte("value")})
+	}
+	// Each key with TTL is queued once, and the keys without TTL are not queued
+	assert.Equal(t, int64(1), db.Stats()["queued"].ExpirationQueueSize)
+
+	assert.NoError(t, bucket.Delete("expiring"))
+	assert.Equal(t, int64(0), db.Stats()["queued"].ExpirationQueueSize)
+
+	// The keys written by SetEx are never seen without their TTL
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			assert.NoError(t, bucket.SetEx(fmt.Sprintf("atomic%v", i%10), [][]byte{[]byte("value")}, time.Hour))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for i := 0; i < 10; i++ {
+			if ttl, found := bucket.TTL(fmt.Sprintf("atomic%v", i)); found {
+				assert.Greater(t, ttl, time.Duration(0))
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/model"
+	"github.com/fredyk/westack-go/v2/westack"
+)
+
+func Test_Migrations(t *testing.T) {
+
+	t.Parallel()
+
+	title := fmt.Sprintf("Migrated note %v", createRandomInt())
+	firstVersion := fmt.Sprintf("%d", time.Now().UnixNano())
+	secondVersion := fmt.Sprintf("%d", time.Now().UnixNano()+1)
+	westack.RegisterMigration(westack.Migration{
+		Version: firstVersion,
+		Name:    "create_note",
+		Up: func(app *westack.WeStack, ctx *model.EventContext) error {
+			// The lock is held while the migrations run
+			lock, err := findMigrationLock()
+			if err != nil {
+				return err
+			}
+			if lock == nil || lock.GetString("owner") == "" {
+				return fmt.Errorf("migrations are not locked")
+			}
+			_, err = noteModel.Create(wst.M{"title": title}, ctx)
+			return err
+		},
+		Down: func(app *westack.WeStack, ctx *model.EventContext) error {
+			_, err := noteModel.DeleteMany(&wst.Where{"title": title}, ctx)
+			return err
+		},
+	})
+	westack.RegisterMigration(westack.Migration{
+		Version: secondVersion,
+		Name:    "backfill_note",
+		Up: func(app *westack.WeStack, ctx *model.EventContext) error {
+			_, err := noteModel.UpdateMany(&wst.Where{"title": title}, wst.M{"migrated": true}, ctx)
+			return err
+		},
+		Down: func(app *westack.WeStack, ctx *model.EventContext) error {
+			_, err := noteModel.UpdateMany(&wst.Where{"title": title}, wst.M{"migrated": false}, ctx)
+			return err
+		},
+	})
+
+	applied, err := app.MigrateUp(0)
+	assert.NoError(t, err)
+	assert.Contains(t, applied, firstVersion)
+	assert.Contains(t, applied, secondVersion)
+
+	note, err := noteModel.FindOne(&wst.Filter{Where: &wst.Where{"title": title}}, systemContext)
+	assert.NoError(t, err)
+	assert.NotNil(t, note)
+	assert.Equal(t, true, note.ToJSON()["migrated"])
+
+	statuses, err := app.MigrationsStatus()
+	assert.NoError(t, err)
+	for _, status := range statuses {
+		if status.Version == firstVersion || status.Version == secondVersion {
+			assert.True(t, status.Applied)
+		}
+	}
+
+	// Applied migrations are not applied again
+	applied, err = app.MigrateUp(0)
+	assert.NoError(t, err)
+	assert.NotContains(t, applied, firstVersion)
+
+	// Migrations are reverted from the last one
+	reverted, err := app.MigrateDown(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{secondVersion, firstVersion}, reverted)
+
+	note, err = noteModel.FindOne(&wst.Filter{Where: &wst.Where{"title": title}}, systemContext)
+	assert.NoError(t, err)
+	assert.Nil(t, note)
+
+	lock, err := findMigrationLock()
+	assert.NoError(t, err)
+	assert.Nil(t, lock)
+
+	// A lock held by another instance is neither taken over nor released
+	ds, err := app.FindDatasource("db0")
+	assert.NoError(t, err)
+	_, err = ds.Create("MigrationLock", &wst.M{"_id": "migrations", "owner": "other", "expiresAt": time.Now().Add(time.Minute).UnixMilli()})
+	assert.NoError(t, err)
+	_, err = app.MigrateUp(0)
+	assert.ErrorContains(t, err, "locked by other")
+	lock, err = findMigrationLock()
+	assert.NoError(t, err)
+	if assert.NotNil(t, lock) {
+		assert.Equal(t, "other", lock.GetString("owner"))
+	}
+	_, err = ds.DeleteById("MigrationLock", "migrations")
+	assert.NoError(t, err)
+
+	// Once another instance takes the lock over, the next migrations are not run
+	takeoverVersion := fmt.Sprintf("%d", time.Now().UnixNano())
+	nextVersion := fmt.Sprintf("%d", time.Now().UnixNano()+1)
+	nextRan := false
+	westack.RegisterMigration(westack.Migration{
+		Version: takeoverVersion,
+		Name:    "lose_lock",
+		Up: func(app *westack.WeStack, ctx *model.EventContext) error {
+			_, err := ds.UpdateMany("MigrationLock", &wst.A{{"$match": wst.M{"_id": "migrations"}}}, &wst.M{"owner": "other"})
+			return err
+		},
+	})
+	westack.RegisterMigration(westack.Migration{
+		Version: nextVersion,
+		Name:    "after_lock_lost",
+		Up: func(app *westack.WeStack, ctx *model.EventContext) error {
+			nextRan = true
+			return nil
+		},
+	})
+	applied, err = app.MigrateUp(0)
+	assert.ErrorIs(t, err, westack.ErrMigrationLockLost)
+	assert.Equal(t, []string{takeoverVersion}, applied)
+	assert.False(t, nextRan)
+	lock, err = findMigrationLock()
+	assert.NoError(t, err)
+	if assert.NotNil(t, lock) {
+		assert.Equal(t, "other", lock.GetString("owner"))
+	}
+	_, err = ds.DeleteById("MigrationLock", "migrations")
+	assert.NoError(t, err)
+}
+
+func findMigrationLock() (*wst.M, error) {
+	ds, err := app.FindDatasource("db0")
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := ds.FindMany("MigrationLock", &wst.A{{"$match": wst.M{"_id": "migrations"}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	var documents []wst.M
+	err = cursor.All(context.Background(), &documents)
+	if err != nil || len(documents) == 0 {
+		return nil, err
+	}
+	return &documents[0], nil
+}
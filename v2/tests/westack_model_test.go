@@ -1,8 +1,10 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sort"
 	"testing"
 	"time"
 
@@ -522,3 +524,458 @@ func Test_ProtectedFields(t *testing.T) {
 	assert.Equalf(t, user1.GetString("phone"), user1RetrievedWithUserWithPrivileges.GetString("phone"), "Phone should be the same")
 
 }
+
+func Test_DeclarativeValidations(t *testing.T) {
+
+	t.Parallel()
+
+	// Missing name and empty nested city
+	_, err := storeModel.Create(wst.M{
+		"address": wst.M{
+			"street": "Main",
+		},
+	}, systemContext)
+	assert.Error(t, err)
+	assert.Equal(t, "*wst.WeStackError", fmt.Sprintf("%T", err))
+	assert.Equal(t, 400, err.(*wst.WeStackError).FiberError.Code)
+	assert.Equal(t, "ERR_VALIDATION", err.(*wst.WeStackError).Code)
+	assert.Equal(t, "Required fields are missing", err.(*wst.WeStackError).Details["message"])
+	codes := err.(*wst.WeStackError).Details["codes"].(wst.M)
+	assert.Equal(t, []string{"presence"}, codes["name"])
+	assert.Equal(t, []string{"presence"}, codes["address.city"])
+
+	// None of the alternatives is present for an online store
+	_, err = storeModel.Create(wst.M{
+		"name": "Online store",
+		"type": "online",
+	}, systemContext)
+	assert.Error(t, err)
+	codes = err.(*wst.WeStackError).Details["codes"].(wst.M)
+	assert.Equal(t, []string{"presence"}, codes["url"])
+	assert.Equal(t, []string{"presence"}, codes["email"])
+
+	// Any of the alternatives is enough, and both are allowed
+	bothStore, err := storeModel.Create(wst.M{
+		"name":  "Online store",
+		"type":  "online",
+		"url":   "https://example.com",
+		"email": "store@example.com",
+	}, systemContext)
+	assert.NoError(t, err)
+	assert.NotNil(t, bothStore)
+	created, err := storeModel.Create(wst.M{
+		"name":  "Online store",
+		"type":  "online",
+		"email": "store@example.com",
+	}, systemContext)
+	assert.NoError(t, err)
+	assert.NotNil(t, created)
+
+	// Validations are evaluated on the merged document when updating
+	_, err = created.UpdateAttributes(wst.M{
+		"email": "",
+	}, systemContext)
+	assert.Error(t, err)
+	codes = err.(*wst.WeStackError).Details["codes"].(wst.M)
+	assert.Equal(t, []string{"presence"}, codes["email"])
+
+	_, err = created.UpdateAttributes(wst.M{
+		"url": "https://example.com",
+	}, systemContext)
+	assert.NoError(t, err)
+
+}
+
+func Test_DeclarativeValidationCodesAreUnique(t *testing.T) {
+
+	t.Parallel()
+
+	// The same property is declared by its path, nested, and in another validation
+	config := &model.Config{Validations: []model.Validation{
+		{Properties: map[string]model.Validation{
+			"address.city": {NotEmpty: true},
+			"address":      {Properties: map[string]model.Validation{"city": {NotEmpty: true}}},
+		}},
+		{Properties: map[string]model.Validation{"address.city": {NotEmpty: true}}},
+	}}
+	for i := 0; i < 10; i++ {
+		codes := config.Validate(&wst.M{"address": wst.M{}})
+		assert.Equal(t, map[string][]string{"address.city": {"presence"}}, codes)
+	}
+
+}
+
+func Test_DeclarativeValidationAlternativesKeys(t *testing.T) {
+
+	t.Parallel()
+
+	// "oneOf" is still accepted next to "anyOf"
+	for _, key := range []string{"anyOf", "oneOf"} {
+		var config model.Config
+		err := json.Unmarshal([]byte(`{"validations": [{"`+key+`": [
+			{"properties": {"url": {"notEmpty": true}}},
+			{"properties": {"email": {"notEmpty": true}}}
+		]}]}`), &config)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"url": {"presence"}, "email": {"presence"}}, config.Validate(&wst.M{}))
+		assert.Empty(t, config.Validate(&wst.M{"email": "store@example.com"}))
+	}
+
+}
+
+func Test_WithTransaction(t *testing.T) {
+
+	t.Parallel()
+
+	title := fmt.Sprintf("Transaction note %v", createRandomInt())
+	err := app.WithTransaction(systemContext, func(txCtx *model.EventContext) error {
+		_, err := noteModel.Create(wst.M{"title": title}, txCtx)
+		return err
+	})
+	assert.NoError(t, err)
+	count, err := noteModel.Count(&wst.Filter{Where: &wst.Where{"title": title}}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, count.Count)
+
+	probe, err := noteModel.Datasource.StartTransaction(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, probe.Abort(context.Background()))
+
+	abortedTitle := fmt.Sprintf("Aborted note %v", createRandomInt())
+	err = app.WithTransaction(systemContext, func(txCtx *model.EventContext) error {
+		_, err := noteModel.Create(wst.M{"title": abortedTitle}, txCtx)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("forced rollback")
+	})
+	assert.EqualError(t, err, "forced rollback")
+	count, err = noteModel.Count(&wst.Filter{Where: &wst.Where{"title": abortedTitle}}, systemContext)
+	assert.NoError(t, err)
+	if probe.Atomic {
+		assert.EqualValues(t, 0, count.Count)
+	} else {
+		// Without transactions support the note is kept
+		assert.EqualValues(t, 1, count.Count)
+	}
+
+}
+
+func Test_AccountCreationRollsBackCredentials(t *testing.T) {
+
+	t.Parallel()
+
+	existing := createAccount(t, wst.M{
+		"email":    fmt.Sprintf("existing%v@example.com", createRandomInt()),
+		"password": "Abcd1234.",
+	})
+
+	// The id is taken, so the account insert fails after its credentials were created in the "before save" hook
+	email := fmt.Sprintf("rolledback%v@example.com", createRandomInt())
+	result, err := wstfuncs.InvokeApiJsonM("POST", "/accounts", wst.M{
+		"id":       existing.GetString("id"),
+		"email":    email,
+		"password": "Abcd1234.",
+	}, wst.M{
+		"Content-Type": "application/json",
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, result["error"])
+
+	probe, err := accountModel.Datasource.StartTransaction(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, probe.Abort(context.Background()))
+
+	credentialsModel, err := app.FindModel("AccountCredentials")
+	assert.NoError(t, err)
+	count, err := credentialsModel.Count(&wst.Filter{Where: &wst.Where{"email": email}}, systemContext)
+	assert.NoError(t, err)
+	if probe.Atomic {
+		assert.EqualValues(t, 0, count.Count)
+	} else {
+		// Without transactions support the credentials are kept
+		assert.EqualValues(t, 1, count.Count)
+	}
+
+}
+
+func Test_ChangeStream(t *testing.T) {
+
+	t.Parallel()
+
+	subjId, err := primitive.ObjectIDFromHex(randomAccountToken.GetString("accountId"))
+	assert.NoError(t, err)
+	userBearer := model.CreateBearer(subjId, float64(time.Now().Unix()), float64(60), []string{"USER"})
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, userBearer.Claims)
+	tokenString, err := token.SignedString(appInstance.Model.App.JwtSecretKey)
+	assert.NoError(t, err)
+	userBearer.Raw = tokenString
+
+	title := fmt.Sprintf("Streamed note %v", time.Now().UnixNano())
+	filtered, err := noteModel.SubscribeChanges(&wst.Where{"title": title}, &model.EventContext{Bearer: userBearer})
+	assert.NoError(t, err)
+	defer filtered.Close()
+	// Notes cannot be read without a token, so this subscription must not receive anything
+	anonymous, err := noteModel.SubscribeChanges(nil, &model.EventContext{})
+	assert.NoError(t, err)
+	defer anonymous.Close()
+
+	_, err = noteModel.Create(wst.M{"title": "Other " + title, "accountId": subjId}, systemContext)
+	assert.NoError(t, err)
+	created, err := noteModel.Create(wst.M{"title": title, "accountId": subjId}, systemContext)
+	assert.NoError(t, err)
+	_, err = created.UpdateAttributes(wst.M{"body": "updated"}, systemContext)
+	assert.NoError(t, err)
+	_, err = noteModel.DeleteById(created.GetID(), systemContext)
+	assert.NoError(t, err)
+
+	for _, expectedType := range []model.ChangeEventType{model.ChangeEventCreated, model.ChangeEventUpdated, model.ChangeEventDeleted} {
+		select {
+		case event := <-filtered.Events():
+			assert.Equal(t, expectedType, event.Type)
+			assert.Equal(t, model.GetIDAsString(created.GetID()), model.GetIDAsString(event.Id))
+			assert.Equal(t, title, event.Data["title"])
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a %v event", expectedType)
+		}
+	}
+
+	select {
+	case event, ok := <-anonymous.Events():
+		if ok {
+			t.Errorf("unexpected %v event for an anonymous subscription", event.Type)
+		}
+	default:
+	}
+}
+
+func Test_KeysetPagination(t *testing.T) {
+
+	t.Parallel()
+
+	title := fmt.Sprintf("Paginated note %v", time.Now().UnixNano())
+	var expectedIds []string
+	for _, position := range []int{0, 1, 0, 1, 0} {
+		created, err := noteModel.Create(wst.M{"title": title, "position": position}, systemContext)
+		assert.NoError(t, err)
+		if position == 1 {
+			expectedIds = append(expectedIds, model.GetIDAsString(created.GetID()))
+		}
+	}
+	// Notes with position 1 go first, and ties are sorted by id
+	remaining, err := noteModel.FindMany(&wst.Filter{Where: &wst.Where{"title": title, "position": 0}, Order: &wst.Order{"_id ASC"}}, systemContext).All()
+	assert.NoError(t, err)
+	for _, instance := range remaining {
+		expectedIds = append(expectedIds, model.GetIDAsString(instance.GetID()))
+	}
+
+	filter := &wst.Filter{Where: &wst.Where{"title": title}, Order: &wst.Order{"position DESC"}, Limit: 2, Keyset: true}
+	var pages []model.InstanceA
+	var pageFilters []*wst.Filter
+	var seenIds []string
+	for {
+		page, err := noteModel.FindMany(filter, systemContext).All()
+		assert.NoError(t, err)
+		pages = append(pages, page)
+		pageFilters = append(pageFilters, filter)
+		for _, instance := range page {
+			seenIds = append(seenIds, model.GetIDAsString(instance.GetID()))
+		}
+		next, _, err := noteModel.PageCursors(filter, page)
+		assert.NoError(t, err)
+		if next == "" {
+			break
+		}
+		filter = &wst.Filter{Where: filter.Where, Order: filter.Order, Limit: 2, After: next}
+	}
+	assert.Equal(t, expectedIds, seenIds)
+	assert.Len(t, pages, 3)
+
+	// Going back from the second page returns the first one in the same order
+	_, prev, err := noteModel.PageCursors(pageFilters[1], pages[1])
+	assert.NoError(t, err)
+	assert.NotEmpty(t, prev)
+	previousPage, err := noteModel.FindMany(&wst.Filter{Where: filter.Where, Order: filter.Order, Limit: 2, Before: prev}, systemContext).All()
+	assert.NoError(t, err)
+	if assert.Len(t, previousPage, 2) {
+		assert.Equal(t, expectedIds[0], model.GetIDAsString(previousPage[0].GetID()))
+		assert.Equal(t, expectedIds[1], model.GetIDAsString(previousPage[1].GetID()))
+	}
+
+	// A cursor cannot be used with another order
+	_, err = noteModel.FindMany(&wst.Filter{Where: filter.Where, Order: &wst.Order{"position ASC"}, Limit: 2, After: prev}, systemContext).All()
+	assert.Error(t, err)
+
+	// The keyset pagination requires a limit, and limited filters not opting in have no cursors
+	_, err = noteModel.FindMany(&wst.Filter{Where: filter.Where, Keyset: true}, systemContext).All()
+	assert.Error(t, err)
+	limitedFilter := &wst.Filter{Where: filter.Where, Limit: 2}
+	limitedPage, err := noteModel.FindMany(limitedFilter, systemContext).All()
+	assert.NoError(t, err)
+	next, prev, err := noteModel.PageCursors(limitedFilter, limitedPage)
+	assert.NoError(t, err)
+	assert.Empty(t, next)
+	assert.Empty(t, prev)
+}
+
+func Test_KeysetPaginationNullValues(t *testing.T) {
+
+	t.Parallel()
+
+	title := fmt.Sprintf("Ranked note %v", time.Now().UnixNano())
+	var unranked []string
+	ranked := map[int]string{}
+	for _, rank := range []int{2, 0, 1, 0} {
+		data := wst.M{"title": title}
+		if rank > 0 {
+			data["rank"] = rank
+		}
+		created, err := noteModel.Create(data, systemContext)
+		assert.NoError(t, err)
+		if rank > 0 {
+			ranked[rank] = model.GetIDAsString(created.GetID())
+		} else {
+			unranked = append(unranked, model.GetIDAsString(created.GetID()))
+		}
+	}
+	sort.Strings(unranked)
+
+	paginate := func(order string) []string {
+		var seenIds []string
+		filter := &wst.Filter{Where: &wst.Where{"title": title}, Order: &wst.Order{order}, Limit: 1, Keyset: true}
+		for i := 0; i < 10; i++ {
+			page, err := noteModel.FindMany(filter, systemContext).All()
+			assert.NoError(t, err)
+			for _, instance := range page {
+				seenIds = append(seenIds, model.GetIDAsString(instance.GetID()))
+			}
+			next, _, err := noteModel.PageCursors(filter, page)
+			assert.NoError(t, err)
+			if next == "" {
+				break
+			}
+			filter = &wst.Filter{Where: filter.Where, Order: filter.Order, Limit: 1, After: next}
+		}
+		return seenIds
+	}
+	// Missing values are sorted first, as null
+	assert.Equal(t, append(append([]string{}, unranked...), ranked[1], ranked[2]), paginate("rank ASC"))
+	assert.Equal(t, []string{ranked[2], ranked[1], unranked[0], unranked[1]}, paginate("rank DESC"))
+}
+
+func Test_DeclaredIndexes(t *testing.T) {
+
+	t.Parallel()
+
+	// The indexes declared in Store.json are created at boot
+	diff, err := storeModel.IndexDiff(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, diff.InSync())
+
+	code := fmt.Sprintf("code-%v", createRandomInt())
+	_, err = storeModel.Create(wst.M{"name": "Indexed store", "code": code}, systemContext)
+	assert.NoError(t, err)
+
+	// The unique index rejects a second store with the same code
+	_, err = storeModel.Create(wst.M{"name": "Another indexed store", "code": code}, systemContext)
+	assert.Error(t, err)
+	assert.Equal(t, "*wst.WeStackError", fmt.Sprintf("%T", err))
+	assert.Equal(t, 409, err.(*wst.WeStackError).FiberError.Code)
+	assert.Equal(t, "UNIQUENESS", err.(*wst.WeStackError).Code)
+	assert.Equal(t, []string{"uniqueness"}, err.(*wst.WeStackError).Details["codes"].(wst.M)["code"])
+
+	// Stores without code are not indexed, as the index is sparse
+	_, err = storeModel.Create(wst.M{"name": "Store without code"}, systemContext)
+	assert.NoError(t, err)
+	_, err = storeModel.Create(wst.M{"name": "Store without code"}, systemContext)
+	assert.NoError(t, err)
+}
+
+func Test_DeclaredIndexesSingleTextIndex(t *testing.T) {
+
+	t.Parallel()
+
+	config := &model.Config{
+		Name:    "TextIndexed",
+		Indexes: []model.IndexConfig{{Keys: []string{"title TEXT"}}},
+		Search:  &model.SearchConfig{Fields: []string{"body"}},
+	}
+	loadedModel := model.New(config, &map[string]*model.StatefulModel{}).(*model.StatefulModel)
+	_, err := loadedModel.DeclaredIndexes()
+	assert.ErrorContains(t, err, "can only have one text index")
+
+	config.Search = nil
+	config.Indexes = append(config.Indexes, model.IndexConfig{Keys: []string{"body TEXT"}})
+	_, err = loadedModel.DeclaredIndexes()
+	assert.ErrorContains(t, err, "can only have one")
+
+	config.Indexes = config.Indexes[:1]
+	indexes, err := loadedModel.DeclaredIndexes()
+	assert.NoError(t, err)
+	assert.Len(t, indexes, 1)
+}
+
+func Test_SearchStores(t *testing.T) {
+
+	t.Parallel()
+
+	word := fmt.Sprintf("searchable%v", createRandomInt())
+	_, err := storeModel.Create(wst.M{"name": "Bakery", "description": fmt.Sprintf("Next to the %v kiosk", word)}, systemContext)
+	assert.NoError(t, err)
+	_, err = storeModel.Create(wst.M{"name": fmt.Sprintf("Kiosk %v", word)}, systemContext)
+	assert.NoError(t, err)
+	_, err = storeModel.Create(wst.M{"name": "Unrelated store"}, systemContext)
+	assert.NoError(t, err)
+
+	// The matches in the name weigh more, and the results are sorted by relevance
+	found, err := storeModel.FindMany(&wst.Filter{Search: word}, systemContext).All()
+	assert.NoError(t, err)
+	if assert.Len(t, found, 2) {
+		assert.Equal(t, fmt.Sprintf("Kiosk %v", word), found[0].GetString("name"))
+		assert.Equal(t, "Bakery", found[1].GetString("name"))
+		assert.Greater(t, found[0].GetFloat64(model.SearchScoreProperty), found[1].GetFloat64(model.SearchScoreProperty))
+	}
+
+	// The score can be sorted like any other property
+	found, err = storeModel.FindMany(&wst.Filter{Search: word, Order: &wst.Order{model.SearchScoreProperty + " ASC"}}, systemContext).All()
+	assert.NoError(t, err)
+	if assert.Len(t, found, 2) {
+		assert.Equal(t, "Bakery", found[0].GetString("name"))
+	}
+
+	count, err := storeModel.Count(&wst.Filter{Search: word}, systemContext)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count.Count)
+
+	// The total of a paginated search counts only the matches
+	cursor, total, err := storeModel.FindManyWithTotal(&wst.Filter{Search: word, Limit: 1}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, total)
+	found, err = cursor.All()
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+
+	// The models without searchable fields reject the search
+	_, err = noteModel.Count(&wst.Filter{Search: word}, systemContext)
+	assert.Error(t, err)
+	assert.Equal(t, "SEARCH_NOT_ENABLED", err.(*wst.WeStackError).Code)
+}
+
+func Test_VersionIgnoredInModelsNotVersioned(t *testing.T) {
+
+	t.Parallel()
+
+	note, err := noteModel.Create(wst.M{"title": "Not versioned"}, systemContext)
+	assert.NoError(t, err)
+
+	// A _version sent by the client is not taken as the expected version of the document
+	updated, err := noteModel.UpdateById(note.GetID(), wst.M{"title": "Still not versioned", "_version": 3}, systemContext)
+	assert.NoError(t, err)
+	assert.Equal(t, "Still not versioned", updated.GetString("title"))
+	assert.EqualValues(t, 0, updated.GetInt("_version"))
+
+	updated, err = note.UpdateAttributes(wst.M{"title": "Never versioned", "_version": 7}, systemContext)
+	assert.NoError(t, err)
+	assert.Equal(t, "Never versioned", updated.GetString("title"))
+	assert.EqualValues(t, 0, updated.GetInt("_version"))
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"github.com/fredyk/westack-go/v2/westack"
 
 	"github.com/fredyk/westack-go/v2/datasource"
+	_ "github.com/fredyk/westack-go/v2/datasource/sqlite"
 	"github.com/fredyk/westack-go/v2/model"
 	"github.com/gofiber/fiber/v2"
 	"github.com/mailru/easyjson"
@@ -631,11 +633,16 @@ func Test_WeStackStop(t *testing.T) {
 	app.Boot(westack.BootOptions{
 		RegisterControllers: func(r model.ControllerRegistry) {},
 	})
+	hookCalled := make(chan bool, 1)
+	app.OnShutdown(func(ctx context.Context) error {
+		hookCalled <- true
+		return nil
+	})
 
+	stopped := make(chan error, 1)
 	go func() {
 		time.Sleep(3 * time.Second)
-		err := app.Stop()
-		assert.NoError(t, err)
+		stopped <- app.Stop()
 	}()
 
 	err := app.Start()
@@ -643,6 +650,15 @@ func Test_WeStackStop(t *testing.T) {
 	//err = app.Stop()
 	//assert.NoError(t, err)
 
+	assert.NoError(t, <-stopped)
+	assert.True(t, <-hookCalled)
+
+	// The datasources are closed once the app is stopped
+	ds, err := app.FindDatasource("sqlite")
+	assert.NoError(t, err)
+	_, err = ds.FindMany("unknownCollection", nil)
+	assert.Error(t, err)
+
 }
 
 func Test_GetWeStackLoggerPrefix(t *testing.T) {
@@ -10,7 +10,6 @@ import (
 	"runtime/debug"
 
 	wst "github.com/fredyk/westack-go/v2/common"
-	"github.com/fredyk/westack-go/v2/memorykv"
 	"github.com/fredyk/westack-go/v2/model"
 	"github.com/fredyk/westack-go/v2/utils"
 	"github.com/gofiber/fiber/v2"
@@ -35,6 +34,9 @@ func appBoot(customRoutesCallbacks []func(app *WeStack), app *WeStack) {
 		app.logger.Fatalf("Error while loading models: %v", err)
 	}
 
+	app.syncIndexes()
+	app.setupSearch()
+
 	app.Middleware(func(c *fiber.Ctx) error {
 		err := c.Next()
 		if err != nil {
@@ -95,23 +97,11 @@ func appBoot(customRoutesCallbacks []func(app *WeStack), app *WeStack) {
 	app.loadNotFoundRoutes()
 
 	app.Server.Get("/system/memorykv/stats", func(c *fiber.Ctx) error {
-		allStats := make(map[string]map[string]memorykv.MemoryKvStats)
-		var totalSizeKiB float64
-		for _, ds := range *app.datasources {
-			if ds.SubViper.GetString("connector") == "memorykv" {
-				kvDbStats := ds.Db.(memorykv.MemoryKvDb).Stats()
-				allStats[ds.Name] = kvDbStats
-				for _, kvStats := range kvDbStats {
-					totalSizeKiB += float64(kvStats.TotalSize) / 1024.0
-				}
-			}
-		}
-		return c.JSON(fiber.Map{"stats": wst.M{
-			"totalSizeKiB": totalSizeKiB,
-			"datasources":  allStats,
-		}})
+		return c.JSON(fiber.Map{"stats": app.memoryKvStats()})
 	})
 
+	app.registerHealthRoutes()
+
 	app.Server.Get("/swagger/doc.json", swaggerDocsHandler(app))
 
 	var swaggerUIStatic []byte
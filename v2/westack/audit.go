@@ -0,0 +1,247 @@
+package westack
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+// auditIgnoredProperties change on every save, so they are left out of the audit diff
+var auditIgnoredProperties = map[string]bool{"id": true, "_id": true, "modified": true}
+
+func newAuditLogModelConfig() *model.Config {
+	return &model.Config{
+		Name:   "AuditLog",
+		Plural: "audit-logs",
+		Base:   "PersistedModel",
+		Public: false,
+		Properties: map[string]model.Property{
+			"modelName": {
+				Type: "string",
+			},
+			"operation": {
+				Type: "string",
+			},
+			"changes": {
+				Type: "object",
+			},
+		},
+		Relations: &map[string]*model.Relation{},
+	}
+}
+
+// registerAuditHooks writes an AuditLog entry after every create, update and delete of a model configured with
+// "audit": true. The state before an update or delete is captured in the "before" observers and kept in the event
+// context, so the entry is only written by the "after" observers once the operation succeeds.
+// Model.UpdateMany and Model.DeleteMany write one entry for each document they modify.
+func registerAuditHooks(app *WeStack, loadedModel *model.StatefulModel) {
+
+	loadedModel.Observe("before save", func(ctx *model.EventContext) error {
+		if ctx.IsNewInstance || ctx.Before != nil {
+			return nil
+		}
+		before, err := auditSnapshot(loadedModel, ctx.Instance, ctx.ModelID)
+		if err != nil {
+			return err
+		}
+		ctx.Before = before
+		return nil
+	})
+
+	loadedModel.Observe("after save", func(ctx *model.EventContext) error {
+		after := ctx.Instance.ToJSON()
+		changes := wst.M{}
+		if ctx.IsNewInstance {
+			for key, value := range after {
+				addAuditChange(loadedModel, changes, key, nil, value)
+			}
+		} else if ctx.Data != nil {
+			for key := range *ctx.Data {
+				addAuditChange(loadedModel, changes, key, ctx.Before[key], after[key])
+			}
+		}
+		return writeAuditLog(app, loadedModel, ctx, ctx.Instance.GetID(), changes)
+	})
+
+	loadedModel.Observe("before delete", func(ctx *model.EventContext) error {
+		if ctx.Before != nil {
+			return nil
+		}
+		before, err := auditSnapshot(loadedModel, nil, ctx.ModelID)
+		if err != nil {
+			return err
+		}
+		ctx.Before = before
+		return nil
+	})
+
+	loadedModel.Observe("after delete", func(ctx *model.EventContext) error {
+		if ctx.Before == nil {
+			// The document did not exist
+			return nil
+		}
+		changes := wst.M{}
+		for key, value := range ctx.Before {
+			addAuditChange(loadedModel, changes, key, value, nil)
+		}
+		return writeAuditLog(app, loadedModel, ctx, ctx.ModelID, changes)
+	})
+
+	loadedModel.Observe("before update many", func(ctx *model.EventContext) error {
+		// Model.UpdateMany modifies the soft deleted documents too
+		return auditBulkSnapshot(loadedModel, ctx, true)
+	})
+
+	loadedModel.Observe("after update many", func(ctx *model.EventContext) error {
+		ids := make([]interface{}, 0, len(ctx.Before))
+		for _, before := range ctx.Before {
+			ids = append(ids, before.(wst.M)["id"])
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		findContext := auditSystemContext()
+		findContext.IncludeDeleted = true
+		updated, err := loadedModel.FindMany(&wst.Filter{Where: &wst.Where{"_id": wst.M{"$in": ids}}}, findContext).All()
+		if err != nil {
+			return err
+		}
+		for _, instance := range updated {
+			before, _ := ctx.Before[model.GetIDAsString(instance.GetID())].(wst.M)
+			after := instance.ToJSON()
+			changes := wst.M{}
+			for key := range *ctx.Data {
+				addAuditChange(loadedModel, changes, key, before[key], after[key])
+			}
+			err := writeAuditLog(app, loadedModel, ctx, instance.GetID(), changes)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	loadedModel.Observe("before delete many", func(ctx *model.EventContext) error {
+		return auditBulkSnapshot(loadedModel, ctx, false)
+	})
+
+	loadedModel.Observe("after delete many", func(ctx *model.EventContext) error {
+		for _, before := range ctx.Before {
+			changes := wst.M{}
+			for key, value := range before.(wst.M) {
+				addAuditChange(loadedModel, changes, key, value, nil)
+			}
+			err := writeAuditLog(app, loadedModel, ctx, before.(wst.M)["id"], changes)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+}
+
+// auditBulkSnapshot copies the current state of every document matched by Model.UpdateMany or Model.DeleteMany, and
+// narrows the operation to them, so that a document inserted in the meantime is not modified without an entry
+func auditBulkSnapshot(loadedModel *model.StatefulModel, ctx *model.EventContext, includeDeleted bool) error {
+	where := wst.CopyMap(wst.M(*ctx.Filter.Where))
+	findContext := auditSystemContext()
+	findContext.IncludeDeleted = includeDeleted
+	found, err := loadedModel.FindMany(&wst.Filter{Where: (*wst.Where)(&where)}, findContext).All()
+	if err != nil {
+		return err
+	}
+	ctx.Before = wst.M{}
+	ids := make([]interface{}, 0, len(found))
+	for _, instance := range found {
+		ctx.Before[model.GetIDAsString(instance.GetID())] = wst.CopyMap(instance.ToJSON())
+		ids = append(ids, instance.GetID())
+	}
+	ctx.Filter.Where = &wst.Where{"$and": wst.A{wst.M(*ctx.Filter.Where), {"_id": wst.M{"$in": ids}}}}
+	return nil
+}
+
+func auditSystemContext() *model.EventContext {
+	return &model.EventContext{Bearer: &model.BearerToken{Account: &model.BearerAccount{System: true}}}
+}
+
+// auditSnapshot copies the current state of the document, loading it when the operation does not provide the instance
+func auditSnapshot(loadedModel *model.StatefulModel, instance *model.StatefulInstance, id interface{}) (wst.M, error) {
+	if instance == nil {
+		findContext := auditSystemContext()
+		findContext.IncludeDeleted = true
+		found, err := loadedModel.FindById(id, nil, findContext)
+		if err != nil || found == nil {
+			return nil, err
+		}
+		return wst.CopyMap(found.ToJSON()), nil
+	}
+	return wst.CopyMap(instance.ToJSON()), nil
+}
+
+func addAuditChange(loadedModel *model.StatefulModel, changes wst.M, key string, before interface{}, after interface{}) {
+	if auditIgnoredProperties[key] || reflect.DeepEqual(before, after) {
+		return
+	}
+	for _, hiddenProperty := range loadedModel.Config.Hidden {
+		if key == hiddenProperty {
+			return
+		}
+	}
+	if _, isRelation := (*loadedModel.Config.Relations)[key]; isRelation {
+		return
+	}
+	changes[key] = wst.M{"before": before, "after": after}
+}
+
+func writeAuditLog(app *WeStack, loadedModel *model.StatefulModel, ctx *model.EventContext, modelId interface{}, changes wst.M) error {
+	if app.auditLogModel == nil {
+		return fmt.Errorf("could not audit %v: the AuditLog model is not available", loadedModel.Name)
+	}
+	entry := wst.M{
+		"modelName": loadedModel.Name,
+		"modelId":   modelId,
+		"operation": string(ctx.OperationName),
+		"changes":   changes,
+		"created":   time.Now(),
+	}
+	baseContext := model.FindBaseContext(ctx)
+	if baseContext.Bearer != nil && baseContext.Bearer.Account != nil {
+		entry["actorId"] = baseContext.Bearer.Account.Id
+		entry["actorSystem"] = baseContext.Bearer.Account.System
+		roleNames := make([]string, 0, len(baseContext.Bearer.Roles))
+		for _, role := range baseContext.Bearer.Roles {
+			roleNames = append(roleNames, role.Name)
+		}
+		entry["actorRoles"] = roleNames
+	}
+	_, err := app.auditLogModel.Create(entry, ctx)
+	return err
+}
+
+func registerAuditHistoryHook(app *WeStack, loadedModel *model.StatefulModel) {
+	loadedModel.On(string(wst.OperationNameFindHistory), func(ctx *model.EventContext) error {
+		if app.auditLogModel == nil {
+			return wst.CreateError(fiber.ErrNotImplemented, "AUDIT_UNAVAILABLE", fiber.Map{"message": "The AuditLog model is not available"}, "Error")
+		}
+		entries, err := app.auditLogModel.FindMany(&wst.Filter{
+			Where: &wst.Where{"modelName": loadedModel.Name, "modelId": model.GetIDAsString(ctx.ModelID)},
+			Order: &wst.Order{"created DESC"},
+		}, ctx).All()
+		if err != nil {
+			return err
+		}
+		result := make(wst.A, 0, len(entries))
+		for _, entry := range entries {
+			result = append(result, entry.ToJSON())
+		}
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = result
+		return nil
+	})
+}
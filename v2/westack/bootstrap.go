@@ -260,7 +260,7 @@ func (app *WeStack) loadDataSources() error {
 			dsName = key
 		}
 		connector := dsViper.GetString(key + ".connector")
-		if connector == "mongodb" || connector == "memorykv" {
+		if datasource.IsConnectorRegistered(connector) {
 			ds := datasource.New(app.asInterface(), key, dsViper, ctx)
 
 			if app.dataSourceOptions != nil {
@@ -270,6 +270,12 @@ func (app *WeStack) loadDataSources() error {
 				}
 				ds.Options.RetryOnError = dsViper.GetBool(key + ".retryOnError")
 			}
+			if app.Viper.GetBool("health.degradedMode") {
+				if ds.Options == nil {
+					ds.Options = &datasource.Options{}
+				}
+				ds.Options.Degraded = true
+			}
 
 			err := ds.Initialize()
 			if err != nil {
@@ -320,15 +326,33 @@ func (app *WeStack) setupModel(loadedModel *model.StatefulModel, dataSource *dat
 
 	loadedModel.App = app.asInterface()
 	loadedModel.Datasource = dataSource
+	if dataSource != nil {
+		dataSource.SetDocumentCollection(loadedModel.CollectionName)
+	}
 
 	config := loadedModel.Config
 
 	loadedModel.Initialize()
 
+	// The indexes are validated at load, as they are not synced until the app starts
+	_, err := loadedModel.DeclaredIndexes()
+	if err != nil {
+		return err
+	}
+
 	if config.Base == "Role" {
 		setupInternalModels(config, app, dataSource)
 	}
 
+	if config.Audit && app.auditLogModel == nil {
+		// The AuditLog model is stored with the first audited model, whether or not the app has a Role model
+		app.auditLogModel = model.New(newAuditLogModelConfig(), app.modelRegistry).(*model.StatefulModel)
+		err := app.setupModel(app.auditLogModel, dataSource)
+		if err != nil {
+			return err
+		}
+	}
+
 	if config.Base == "Account" {
 
 		setupAccountModel(loadedModel, app)
@@ -343,7 +367,7 @@ func (app *WeStack) setupModel(loadedModel *model.StatefulModel, dataSource *dat
 	}
 	config.Plural = plural
 
-	err := createCasbinModel(loadedModel, app, config)
+	err = createCasbinModel(loadedModel, app, config)
 	if err != nil {
 		return err
 	}
@@ -371,6 +395,7 @@ func registerPersistedModelFixedHooks(loadedModel *model.StatefulModel, app *WeS
 		return handleFindMany(app, loadedModel, ctx)
 	})
 	loadedModel.On(string(wst.OperationNameCount), func(ctx *model.EventContext) error {
+		applySearchQueryParam(ctx)
 		result, err := loadedModel.Count(ctx.Filter, ctx)
 		if err != nil {
 			return err
@@ -379,6 +404,29 @@ func registerPersistedModelFixedHooks(loadedModel *model.StatefulModel, app *WeS
 		ctx.Result = result
 		return nil
 	})
+	loadedModel.On(string(wst.OperationNameExplain), func(ctx *model.EventContext) error {
+		return handleExplain(loadedModel, ctx)
+	})
+	loadedModel.On(string(wst.OperationNameAggregate), func(ctx *model.EventContext) error {
+		var rawPipeline string
+		if ctx.Query != nil {
+			rawPipeline = ctx.Query.GetString("pipeline")
+		}
+		if rawPipeline == "" {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_PIPELINE", fiber.Map{"message": "the pipeline parameter is required"}, "ValidationError")
+		}
+		stages, err := model.ParseAggregatePipeline(rawPipeline)
+		if err != nil {
+			return err
+		}
+		result, err := loadedModel.Aggregate(stages, ctx)
+		if err != nil {
+			return err
+		}
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = result
+		return nil
+	})
 	loadedModel.On(string(wst.OperationNameFindById), func(ctx *model.EventContext) error {
 		result, err := loadedModel.FindById(ctx.ModelID, ctx.Filter, ctx)
 		if err != nil {
@@ -388,6 +436,9 @@ func registerPersistedModelFixedHooks(loadedModel *model.StatefulModel, app *WeS
 		if result != nil {
 			result.(*model.StatefulInstance).HideProperties()
 			ctx.Result = result.ToJSON()
+			if config.Versioned && ctx.Ctx != nil {
+				ctx.Ctx.Set(fiber.HeaderETag, model.ETag(result))
+			}
 		}
 		return nil
 	})
@@ -425,14 +476,23 @@ func registerPersistedModelFixedHooks(loadedModel *model.StatefulModel, app *WeS
 				}
 
 				if isMissing {
-					if allErrorsCodes[propertyName] == nil {
-						allErrorsCodes[propertyName] = []string{}
-					}
-					allErrorsCodes[propertyName] = append(allErrorsCodes[propertyName].([]string), "presence")
+					addValidationErrorCode(allErrorsCodes, propertyName, "presence")
 				}
 			}
 		}
 
+		// Perform declarative validations
+		for propertyPath, codes := range config.Validate(mergedData) {
+			if !ctx.IsNewInstance && isHiddenAndNotUpdated(config, propertyPath, data) {
+				// Hidden properties are not present in the instance, so they can only be checked when they are updated
+				continue
+			}
+			for _, code := range codes {
+				// A required property may also be declared as notEmpty
+				addValidationErrorCode(allErrorsCodes, propertyPath, code)
+			}
+		}
+
 		if len(allErrorsCodes) > 0 {
 			return wst.CreateError(fiber.ErrBadRequest, "ERR_VALIDATION", fiber.Map{"message": "Required fields are missing", "codes": allErrorsCodes}, "ValidationError")
 		}
@@ -635,7 +695,17 @@ func registerPersistedModelFixedHooks(loadedModel *model.StatefulModel, app *WeS
 	})
 
 	loadedModel.On(string(wst.OperationNameCreate), func(ctx *model.EventContext) error {
-		created, err := loadedModel.Create(*ctx.Data, ctx)
+		var created model.Instance
+		var err error
+		if config.Base == "Account" {
+			// The credentials are created in the "before save" hook, so they must be rolled back if the account insert fails
+			err = loadedModel.WithTransaction(ctx, func(txCtx *model.EventContext) error {
+				created, err = loadedModel.Create(*ctx.Data, txCtx)
+				return err
+			})
+		} else {
+			created, err = loadedModel.Create(*ctx.Data, ctx)
+		}
 		if err != nil {
 			return err
 		}
@@ -650,12 +720,22 @@ func registerPersistedModelFixedHooks(loadedModel *model.StatefulModel, app *WeS
 			return err
 		}
 
+		if config.Versioned && inst != nil && ctx.Ctx != nil {
+			err = model.CheckIfMatch(inst, ctx.Ctx.Get(fiber.HeaderIfMatch))
+			if err != nil {
+				return err
+			}
+		}
+
 		updated, err := inst.UpdateAttributes(ctx.Data, ctx)
 		if err != nil {
 			return err
 		}
 		ctx.StatusCode = fiber.StatusOK
 		ctx.Result = updated.ToJSON()
+		if config.Versioned && ctx.Ctx != nil {
+			ctx.Ctx.Set(fiber.HeaderETag, model.ETag(updated))
+		}
 		return nil
 	})
 
@@ -695,6 +775,44 @@ func registerPersistedModelFixedHooks(loadedModel *model.StatefulModel, app *WeS
 	}
 	loadedModel.On(string(wst.OperationNameDeleteById), deleteByIdHandler)
 
+	registerPersistedModelBulkHooks(loadedModel)
+
+	if config.Audit {
+		registerAuditHooks(app, loadedModel)
+		registerAuditHistoryHook(app, loadedModel)
+	}
+
+	if config.ChangeStream.Enabled {
+		registerChangeStreamHooks(app, loadedModel)
+	}
+
+	if config.SoftDelete {
+		loadedModel.On(string(wst.OperationNameRestoreById), func(ctx *model.EventContext) error {
+			restored, err := loadedModel.RestoreById(ctx.ModelID, ctx)
+			if err != nil {
+				return err
+			}
+			if restored == nil {
+				return wst.CreateError(fiber.ErrNotFound, "NOT_FOUND", fiber.Map{"message": fmt.Sprintf("deleted document %v not found", ctx.ModelID)}, "Error")
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = restored.ToJSON()
+			return nil
+		})
+		loadedModel.On(string(wst.OperationNamePurgeById), func(ctx *model.EventContext) error {
+			deleteResult, err := loadedModel.PurgeById(ctx.ModelID, ctx)
+			if err != nil {
+				return err
+			}
+			if deleteResult.DeletedCount != 1 {
+				return wst.CreateError(fiber.ErrNotFound, "NOT_FOUND", fiber.Map{"message": fmt.Sprintf("document %v not found", ctx.ModelID)}, "Error")
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = deleteResult
+			return nil
+		})
+	}
+
 	if config.Base == "Account" {
 		upsertAccountRolesHandler := func(ctx *model.EventContext) error {
 			var body UpserRequestBody
@@ -717,6 +835,12 @@ func handleFindMany(app *WeStack, loadedModel *model.StatefulModel, ctx *model.E
 		fmt.Println("[DEBUG] handleFindMany")
 	}
 
+	applyCursorQueryParams(ctx)
+	applySearchQueryParam(ctx)
+	envelope := ctx.Query != nil && ctx.Query.GetString("envelope") == "true"
+	if envelope || (ctx.Ctx != nil && ctx.Ctx.Get("X-Total-Count") != "") {
+		return handleFindManyWithTotal(loadedModel, ctx, envelope)
+	}
 	cursor := loadedModel.FindMany(ctx.Filter, ctx)
 	if v, ok := cursor.(*model.ErrorCursor); ok {
 		defer func(v *model.ErrorCursor) {
@@ -729,6 +853,24 @@ func handleFindMany(app *WeStack, loadedModel *model.StatefulModel, ctx *model.E
 		ctx.Result, err = v.Next()
 		return err
 	}
+	if isKeysetPage(ctx.Filter) {
+		// The page is bounded by the limit, so it is loaded to obtain the cursors of its first and last documents
+		page, err := cursor.All()
+		if err != nil {
+			return err
+		}
+		next, prev, err := loadedModel.PageCursors(ctx.Filter, page)
+		if err != nil {
+			return err
+		}
+		err = setPaginationLinks(ctx, next, prev)
+		if err != nil {
+			return err
+		}
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = model.NewInstanceAChunkGenerator(loadedModel, page, "application/json")
+		return nil
+	}
 	chunkGenerator, err := traceChunkGenerator(app, loadedModel, ctx, cursor)
 	if err != nil {
 		return err
@@ -749,6 +891,61 @@ func handleFindMany(app *WeStack, loadedModel *model.StatefulModel, ctx *model.E
 	return nil
 }
 
+// handleFindManyWithTotal responds with the total number of documents matching the filter in the X-Total-Count header.
+// With envelope, the body is {"data": [...], "total": n, "skip": n, "limit": n} instead of the bare array, with the
+// "next" and "prev" cursors of keyset pages too.
+func handleFindManyWithTotal(loadedModel *model.StatefulModel, ctx *model.EventContext, envelope bool) error {
+	cursor, total, err := loadedModel.FindManyWithTotal(ctx.Filter, ctx)
+	if err != nil {
+		return err
+	}
+	page, err := cursor.All()
+	if err != nil {
+		return err
+	}
+	ctx.Ctx.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	var next, prev string
+	if isKeysetPage(ctx.Filter) {
+		next, prev, err = loadedModel.PageCursors(ctx.Filter, page)
+		if err != nil {
+			return err
+		}
+		err = setPaginationLinks(ctx, next, prev)
+		if err != nil {
+			return err
+		}
+	}
+	ctx.StatusCode = fiber.StatusOK
+	if !envelope {
+		ctx.Result = model.NewInstanceAChunkGenerator(loadedModel, page, "application/json")
+		return nil
+	}
+
+	data := make(wst.A, 0, len(page))
+	for _, instance := range page {
+		instance.(*model.StatefulInstance).HideProperties()
+		data = append(data, instance.ToJSON())
+	}
+	result := wst.M{
+		"data":  data,
+		"total": total,
+		"skip":  int64(0),
+		"limit": int64(0),
+	}
+	if ctx.Filter != nil {
+		result["skip"] = ctx.Filter.Skip
+		result["limit"] = ctx.Filter.Limit
+	}
+	if next != "" {
+		result["next"] = next
+	}
+	if prev != "" {
+		result["prev"] = prev
+	}
+	ctx.Result = result
+	return nil
+}
+
 // traceChunkGenerator is a helper function to trace the cursorChunkGenerator. For a given
 // ctx.Filter:
 // This is the flow:
@@ -913,3 +1110,27 @@ func fixModelRelations(loadedModel *model.StatefulModel) error {
 func skipOperationForBeforeBuild(operationName wst.OperationName) bool {
 	return operationName == wst.OperationNameCreate || operationName == wst.OperationNameCount /* || operationName == wst.OperationNameFindMany*/
 }
+
+func isHiddenAndNotUpdated(config *model.Config, propertyPath string, data *wst.M) bool {
+	rootProperty := strings.Split(propertyPath, ".")[0]
+	if _, updated := (*data)[rootProperty]; updated {
+		return false
+	}
+	for _, hiddenProperty := range config.Hidden {
+		if hiddenProperty == rootProperty {
+			return true
+		}
+	}
+	return false
+}
+
+// addValidationErrorCode adds the code to the failed codes of the property, unless it was already reported
+func addValidationErrorCode(allErrorsCodes wst.M, propertyPath string, code string) {
+	codes, _ := allErrorsCodes[propertyPath].([]string)
+	for _, existing := range codes {
+		if existing == code {
+			return
+		}
+	}
+	allErrorsCodes[propertyPath] = append(codes, code)
+}
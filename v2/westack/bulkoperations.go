@@ -0,0 +1,184 @@
+package westack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+// maxBulkCreateItems is the maximum number of documents created by a single batch request
+const maxBulkCreateItems = 1000
+
+// registerPersistedModelBulkHooks registers the handlers for the bulk remote operations. Each item is processed through
+// the regular Create, UpdateAttributes and DeleteById methods, so the before/after save and delete observers still run
+// per item, and a failing item does not prevent the others from being processed. Matched instances are also authorized
+// one by one against instance_updateAttributes and instance_delete.
+func registerPersistedModelBulkHooks(loadedModel *model.StatefulModel) {
+
+	loadedModel.On(string(wst.OperationNameCreateMany), func(ctx *model.EventContext) error {
+		if ctx.DataItems == nil {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_BODY", fiber.Map{"message": "Body must be an array"}, "ValidationError")
+		}
+		if len(*ctx.DataItems) > maxBulkCreateItems {
+			return wst.CreateError(fiber.ErrBadRequest, "BATCH_TOO_LARGE", fiber.Map{"message": fmt.Sprintf("a batch cannot have more than %v items", maxBulkCreateItems)}, "ValidationError")
+		}
+		result := wst.BulkResult{Items: make([]wst.BulkItemResult, 0, len(*ctx.DataItems))}
+		for idx, item := range *ctx.DataItems {
+			created, err := loadedModel.Create(item, ctx)
+			var id interface{}
+			var itemResult interface{}
+			if err == nil {
+				id = created.GetID()
+				itemResult = created.ToJSON()
+			}
+			appendBulkItemResult(&result, idx, id, itemResult, err)
+		}
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = result
+		return nil
+	})
+
+	loadedModel.On(string(wst.OperationNameUpdateMany), func(ctx *model.EventContext) error {
+		where, err := parseBulkWhere(ctx)
+		if err != nil {
+			return err
+		}
+		if ctx.Data == nil || len(*ctx.Data) == 0 {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_BODY", fiber.Map{"message": "Body cannot be empty"}, "ValidationError")
+		}
+		instances, err := loadedModel.FindMany(&wst.Filter{Where: where}, ctx).All()
+		if err != nil {
+			return err
+		}
+		result := wst.BulkResult{Items: make([]wst.BulkItemResult, 0, len(instances))}
+		for idx, instance := range instances {
+			var itemResult interface{}
+			err := enforceBulkItem(loadedModel, ctx, instance, wst.OperationNameUpdateAttributes)
+			if err == nil {
+				// Each item gets its own copy, because the observers may alter the data
+				data := wst.CopyMap(*ctx.Data)
+				var updated model.Instance
+				updated, err = instance.UpdateAttributes(data, ctx)
+				if err == nil {
+					itemResult = updated.ToJSON()
+				}
+			}
+			appendBulkItemResult(&result, idx, instance.GetID(), itemResult, err)
+		}
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = result
+		return nil
+	})
+
+	loadedModel.On(string(wst.OperationNameDeleteMany), func(ctx *model.EventContext) error {
+		where, err := parseBulkWhere(ctx)
+		if err != nil {
+			return err
+		}
+		instances, err := loadedModel.FindMany(&wst.Filter{Where: where}, ctx).All()
+		if err != nil {
+			return err
+		}
+		result := wst.BulkResult{Items: make([]wst.BulkItemResult, 0, len(instances))}
+		for idx, instance := range instances {
+			var itemResult interface{}
+			err := enforceBulkItem(loadedModel, ctx, instance, wst.OperationNameDeleteById)
+			if err == nil {
+				var deleteResult wst.DeleteResult
+				deleteResult, err = loadedModel.DeleteById(instance.GetID(), ctx)
+				if err == nil && deleteResult.DeletedCount != 1 {
+					err = wst.CreateError(fiber.ErrBadRequest, "BAD_REQUEST", fiber.Map{"message": fmt.Sprintf("Deleted %v instances for %v", deleteResult.DeletedCount, instance.GetID())}, "Error")
+				}
+				if err == nil {
+					itemResult = deleteResult
+				}
+			}
+			appendBulkItemResult(&result, idx, instance.GetID(), itemResult, err)
+		}
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = result
+		return nil
+	})
+}
+
+// enforceBulkItem checks the single-item action for every matched instance, so that policies like `$owner,*,write,allow`
+// still restrict which of the matched documents can be modified
+func enforceBulkItem(loadedModel *model.StatefulModel, ctx *model.EventContext, instance model.Instance, action wst.OperationName) error {
+	err, allowed := loadedModel.EnforceEx(ctx.Bearer, model.GetIDAsString(instance.GetID()), string(action), ctx)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fiber.ErrUnauthorized
+	}
+	return nil
+}
+
+// parseBulkWhere reads the mandatory `where` query parameter. An empty where is rejected to avoid touching the whole collection by mistake.
+func parseBulkWhere(ctx *model.EventContext) (*wst.Where, error) {
+	whereSt := ""
+	if ctx.Query != nil {
+		whereSt = ctx.Query.GetString("where")
+	}
+	if whereSt == "" {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": "The where query parameter is required"}, "ValidationError")
+	}
+	var where wst.Where
+	err := json.Unmarshal([]byte(whereSt), &where)
+	if err != nil {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": fmt.Sprintf("Invalid where: %v", err)}, "ValidationError")
+	}
+	if len(where) == 0 {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": "The where query parameter cannot be empty"}, "ValidationError")
+	}
+	return &where, nil
+}
+
+func appendBulkItemResult(result *wst.BulkResult, index int, id interface{}, itemResult interface{}, err error) {
+	item := wst.BulkItemResult{
+		Index:   index,
+		Id:      id,
+		Success: err == nil,
+		Result:  itemResult,
+	}
+	if err != nil {
+		item.Error = bulkItemError(err)
+		result.ErrorCount++
+	} else {
+		result.SuccessCount++
+	}
+	result.Items = append(result.Items, item)
+}
+
+// bulkItemError mirrors the error body sent by the error handler, so clients can parse both the same way
+func bulkItemError(err error) fiber.Map {
+	var westackError *wst.WeStackError
+	var fiberError *fiber.Error
+	if errors.As(err, &westackError) {
+		errorName := westackError.Name
+		if errorName == "" {
+			errorName = "Error"
+		}
+		return fiber.Map{
+			"statusCode": westackError.FiberError.Code,
+			"name":       errorName,
+			"code":       westackError.Code,
+			"error":      westackError.FiberError.Error(),
+			"message":    westackError.Details["message"],
+			"details":    westackError.Details,
+		}
+	} else if errors.As(err, &fiberError) {
+		return fiber.Map{"status": fiberError.Code, "message": fiberError.Message}
+	}
+	return fiber.Map{
+		"statusCode": fiber.StatusInternalServerError,
+		"name":       "Error",
+		"code":       "ERR_INTERNAL",
+		"message":    err.Error(),
+	}
+}
@@ -0,0 +1,131 @@
+package westack
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+// changeStreamRetryInterval is the delay before watching again a MongoDB change stream that stopped
+const changeStreamRetryInterval = 5 * time.Second
+
+// registerChangeStreamHooks publishes the changes of a model configured with "changeStream": {"enabled": true}.
+// With the default source the events come from the observers, so Model.UpdateMany and Model.DeleteMany are not
+// published, and the changes applied inside WithTransaction are only published once it is committed. With the "mongodb" source they are read from a MongoDB change stream instead.
+func registerChangeStreamHooks(app *WeStack, loadedModel *model.StatefulModel) {
+
+	loadedModel.On(string(wst.OperationNameStream), func(ctx *model.EventContext) error {
+		var where *wst.Where
+		if ctx.Filter != nil {
+			where = ctx.Filter.Where
+		}
+		subscription, err := loadedModel.SubscribeChanges(where, ctx)
+		if err != nil {
+			return err
+		}
+		ctx.Ctx.Set("Cache-Control", "no-cache")
+		ctx.Ctx.Set("X-Accel-Buffering", "no")
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = model.NewChangeStreamChunkGenerator(loadedModel, subscription)
+		return nil
+	})
+
+	if loadedModel.Config.ChangeStream.Source == "mongodb" {
+		go watchMongoChangeStream(app, loadedModel)
+		return
+	}
+
+	loadedModel.Observe("after save", func(ctx *model.EventContext) error {
+		if !loadedModel.HasChangeSubscriptions() {
+			return nil
+		}
+		eventType := model.ChangeEventUpdated
+		if ctx.IsNewInstance {
+			eventType = model.ChangeEventCreated
+		}
+		event := loadedModel.NewChangeEvent(eventType, ctx.Instance.GetID(), ctx.Instance.ToJSON())
+		ctx.AfterCommit(func() {
+			loadedModel.PublishChange(event)
+		})
+		return nil
+	})
+
+	loadedModel.Observe("before delete", func(ctx *model.EventContext) error {
+		if !loadedModel.HasChangeSubscriptions() {
+			return nil
+		}
+		before, err := auditSnapshot(loadedModel, nil, ctx.ModelID)
+		if err != nil || before == nil {
+			return err
+		}
+		// The recipients are resolved while the document still exists, so that "$owner" can be checked
+		event := loadedModel.NewChangeEvent(model.ChangeEventDeleted, ctx.ModelID, before)
+		recipients := loadedModel.ChangeRecipients(event)
+		ctx.QueueOperation("after delete", func(nextCtx *model.EventContext) error {
+			nextCtx.AfterCommit(func() {
+				loadedModel.PublishChangeTo(recipients, event)
+			})
+			return nil
+		})
+		return nil
+	})
+
+}
+
+// watchMongoChangeStream publishes the changes read from the MongoDB change stream of the model collection until the
+// datasource is closed. Deleted documents cannot be loaded anymore, so their events carry only the id and reach the
+// subscriptions without a where filter whose bearer is still known to be allowed to read the document.
+func watchMongoChangeStream(app *WeStack, loadedModel *model.StatefulModel) {
+	ds := loadedModel.Datasource
+	for ds.Context.Err() == nil {
+		changes, err := ds.WatchCollection(ds.Context, loadedModel.CollectionName)
+		if err != nil {
+			app.logger.Printf("[ERROR] Could not watch the changes of %v: %v\n", loadedModel.Name, err)
+		} else {
+			for change := range changes {
+				publishCollectionChange(app, loadedModel, change)
+			}
+		}
+		select {
+		case <-ds.Context.Done():
+		case <-time.After(changeStreamRetryInterval):
+		}
+	}
+}
+
+func publishCollectionChange(app *WeStack, loadedModel *model.StatefulModel, change datasource.CollectionChange) {
+	if !loadedModel.HasChangeSubscriptions() {
+		return
+	}
+	var eventType model.ChangeEventType
+	switch change.OperationType {
+	case "insert":
+		eventType = model.ChangeEventCreated
+	case "update", "replace":
+		eventType = model.ChangeEventUpdated
+		if loadedModel.Config.SoftDelete && change.FullDocument[model.SoftDeleteProperty] != nil {
+			eventType = model.ChangeEventDeleted
+		}
+	case "delete":
+		loadedModel.PublishChange(loadedModel.NewChangeEvent(model.ChangeEventDeleted, change.DocumentId, nil))
+		return
+	default:
+		return
+	}
+	if change.FullDocument == nil {
+		// The document was removed before the update could be looked up
+		return
+	}
+	instance, err := loadedModel.Build(change.FullDocument, &model.EventContext{
+		Bearer: &model.BearerToken{Account: &model.BearerAccount{System: true}},
+	})
+	if err != nil {
+		app.logger.Printf("[ERROR] Could not build the changed %v %v: %v\n", loadedModel.Name, change.DocumentId, err)
+		return
+	}
+	loadedModel.PublishChange(loadedModel.NewChangeEvent(eventType, change.DocumentId, instance.ToJSON()))
+}
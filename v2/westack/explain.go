@@ -0,0 +1,45 @@
+package westack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+var explainVerbosities = map[string]bool{
+	"queryPlanner":      true,
+	"executionStats":    true,
+	"allPlansExecution": true,
+}
+
+// handleExplain responds with the pipeline that findMany runs for the same filter, and its plan. With the
+// "executionStats" and "allPlansExecution" verbosities, the pipeline is run to obtain the statistics.
+func handleExplain(loadedModel *model.StatefulModel, ctx *model.EventContext) error {
+	var verbosity string
+	if ctx.Query != nil {
+		verbosity = ctx.Query.GetString("verbosity")
+	}
+	if verbosity != "" && !explainVerbosities[verbosity] {
+		return wst.CreateError(fiber.ErrBadRequest, "INVALID_VERBOSITY", fiber.Map{"message": fmt.Sprintf("invalid verbosity %q, expected queryPlanner, executionStats or allPlansExecution", verbosity)}, "ValidationError")
+	}
+	applyCursorQueryParams(ctx)
+	applySearchQueryParam(ctx)
+	pipeline, plan, err := loadedModel.Explain(ctx.Filter, verbosity, ctx)
+	if errors.Is(err, datasource.ErrExplainNotSupported) {
+		return wst.CreateError(fiber.ErrNotImplemented, "EXPLAIN_NOT_SUPPORTED", fiber.Map{"message": fmt.Sprintf("the datasource of %v does not support explain", loadedModel.Name)}, "Error")
+	}
+	if err != nil {
+		return err
+	}
+	ctx.StatusCode = fiber.StatusOK
+	ctx.Result = wst.M{
+		"pipeline": pipeline,
+		"explain":  plan,
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package westack
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+	"github.com/fredyk/westack-go/v2/memorykv"
+)
+
+// registerHealthRoutes adds the liveness and readiness endpoints. The liveness endpoint always answers 200, as it only
+// tells the process is serving requests. The readiness one answers 503 until the app is booted, once it starts stopping,
+// and while any datasource fails its pings, which only happens without stopping the process when "health.degradedMode"
+// is enabled in config.json. The errors of the datasources are logged, but not reported, as they may reveal their
+// addresses.
+func (app *WeStack) registerHealthRoutes() {
+	app.Server.Get("/system/health/live", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+
+	app.Server.Get("/system/health/ready", func(c *fiber.Ctx) error {
+		report, ready := app.healthReport()
+		if !ready {
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+		return c.JSON(report)
+	})
+}
+
+// healthReport returns the health of the app and whether it is ready to serve requests
+func (app *WeStack) healthReport() (fiber.Map, bool) {
+	ready := app.completedSetup && !app.stopping.Load()
+	datasources := make(map[string]datasource.HealthStatus, len(*app.datasources))
+	for name, ds := range *app.datasources {
+		health := ds.Health()
+		health.Error = ""
+		datasources[name] = health
+		if !health.Healthy {
+			ready = false
+		}
+	}
+	status := "ok"
+	if !app.completedSetup {
+		status = "starting"
+	} else if app.stopping.Load() {
+		status = "stopping"
+	} else if !ready {
+		status = "degraded"
+	}
+	return fiber.Map{
+		"status":         status,
+		"completedSetup": app.completedSetup,
+		"datasources":    datasources,
+		"memorykv":       app.memoryKvStats(),
+	}, ready
+}
+
+func (app *WeStack) memoryKvStats() wst.M {
+	allStats := make(map[string]map[string]memorykv.MemoryKvStats)
+	var totalSizeKiB float64
+	var evictions int64
+	for _, ds := range *app.datasources {
+		if kvDb, ok := ds.Db.(memorykv.MemoryKvDb); ok {
+			kvDbStats := kvDb.Stats()
+			allStats[ds.Name] = kvDbStats
+			for _, kvStats := range kvDbStats {
+				totalSizeKiB += float64(kvStats.TotalSize) / 1024.0
+				evictions += kvStats.Evictions
+			}
+		}
+	}
+	return wst.M{
+		"totalSizeKiB": totalSizeKiB,
+		"evictions":    evictions,
+		"datasources":  allStats,
+	}
+}
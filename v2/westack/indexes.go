@@ -0,0 +1,122 @@
+package westack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/fredyk/westack-go/v2/datasource"
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+// ModelIndexDiff is the index drift of a model collection
+type ModelIndexDiff struct {
+	Model      string               `json:"model"`
+	Collection string               `json:"collection"`
+	Diff       datasource.IndexDiff `json:"diff"`
+}
+
+// LoadIndexDiffs loads the datasources and models if the app was not booted, and returns the index drift of every model
+// declaring indexes. It is used by the `indexes` CLI command.
+func (app *WeStack) LoadIndexDiffs(ctx context.Context) ([]ModelIndexDiff, error) {
+	err := app.loadWithoutBoot()
+	if err != nil {
+		return nil, err
+	}
+	var result []ModelIndexDiff
+	for _, loadedModel := range app.modelsWithIndexes() {
+		diff, err := loadedModel.IndexDiff(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not diff the indexes of %v: %w", loadedModel.Name, err)
+		}
+		result = append(result, ModelIndexDiff{Model: loadedModel.Name, Collection: loadedModel.CollectionName, Diff: diff})
+	}
+	return result, nil
+}
+
+// ApplyIndexDiffs applies the drift returned by LoadIndexDiffs. Undeclared indexes are dropped only if prune is true.
+func (app *WeStack) ApplyIndexDiffs(ctx context.Context, diffs []ModelIndexDiff, prune bool) error {
+	for _, modelDiff := range diffs {
+		loadedModel, err := app.FindModel(modelDiff.Model)
+		if err != nil {
+			return err
+		}
+		err = loadedModel.Datasource.ApplyIndexDiff(ctx, modelDiff.Collection, modelDiff.Diff, prune)
+		if err != nil {
+			return fmt.Errorf("could not apply the indexes of %v: %w", modelDiff.Model, err)
+		}
+	}
+	return nil
+}
+
+// loadWithoutBoot loads the datasources and models for the CLI commands, unless the app was booted already
+func (app *WeStack) loadWithoutBoot() error {
+	if app.modelRegistry != nil && len(*app.modelRegistry) > 0 {
+		return nil
+	}
+	err := createDataDirectory()
+	if err != nil {
+		return err
+	}
+	err = app.loadDataSources()
+	if err != nil {
+		return fmt.Errorf("error while loading datasources: %w", err)
+	}
+	err = app.loadModels()
+	if err != nil {
+		return fmt.Errorf("error while loading models: %w", err)
+	}
+	return nil
+}
+
+// syncIndexes creates the missing indexes at boot. Replacing a changed index drops it first, which may be slow or
+// leave the collection unprotected in production, so the changed and undeclared indexes are only reported and left
+// to `westack-go indexes apply`. Failures are logged instead of stopping the app, as an index may not be buildable
+// until the existing data is fixed.
+func (app *WeStack) syncIndexes() {
+	for _, loadedModel := range app.modelsWithIndexes() {
+		// In degraded mode the datasources may not be connected yet
+		if !loadedModel.Datasource.Health().Healthy {
+			app.logger.Printf("[WARNING] Could not sync the indexes of %v: datasource %v is unavailable\n", loadedModel.Name, loadedModel.Datasource.Name)
+			continue
+		}
+		diff, err := loadedModel.IndexDiff(context.Background())
+		if err != nil {
+			app.logger.Printf("[ERROR] Could not sync the indexes of %v: %v\n", loadedModel.Name, err)
+			continue
+		}
+		err = loadedModel.Datasource.ApplyIndexDiff(context.Background(), loadedModel.CollectionName, datasource.IndexDiff{Missing: diff.Missing}, false)
+		if err != nil {
+			app.logger.Printf("[ERROR] Could not sync the indexes of %v: %v\n", loadedModel.Name, err)
+		}
+		for _, change := range diff.Changed {
+			app.logger.Printf("[WARNING] Index %v of %v differs from the model config, run `indexes apply` to replace it\n", change.Declared.IndexName(), loadedModel.Name)
+		}
+		for _, index := range diff.Extra {
+			app.logger.Printf("[WARNING] Index %v of %v is not declared in the model config\n", index.IndexName(), loadedModel.Name)
+		}
+	}
+}
+
+// modelsWithIndexes returns the models declaring indexes in a datasource able to manage them, sorted by name
+func (app *WeStack) modelsWithIndexes() []*model.StatefulModel {
+	var result []*model.StatefulModel
+	for _, loadedModel := range *app.modelRegistry {
+		if loadedModel.Datasource == nil {
+			continue
+		}
+		// The datasources without indexes evaluate the search by themselves, so its text index is not synced there
+		searchIndexed := loadedModel.Config.Search != nil && loadedModel.Datasource.SupportsIndexes()
+		if len(loadedModel.Config.Indexes) > 0 || searchIndexed {
+			if !loadedModel.Datasource.SupportsIndexes() {
+				app.logger.Printf("[WARNING] Datasource %v of %v does not support indexes\n", loadedModel.Datasource.Name, loadedModel.Name)
+				continue
+			}
+			result = append(result, loadedModel)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
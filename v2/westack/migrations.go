@@ -0,0 +1,414 @@
+package westack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/datasource"
+	"github.com/fredyk/westack-go/v2/model"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	migrationsCollection    = "Migration"
+	migrationLockCollection = "MigrationLock"
+	migrationLockId         = "migrations"
+	// migrationLockTtl is how long a lock is honored, so the lock of a crashed instance does not block the migrations
+	// forever. The owner renews it every migrationLockRenewal while the migrations run.
+	migrationLockTtl     = 10 * time.Minute
+	migrationLockRenewal = migrationLockTtl / 3
+)
+
+// ErrMigrationLockLost is returned by MigrateUp and MigrateDown when another instance took over the migrations lock
+// while they ran. The migrations that follow are not run.
+var ErrMigrationLockLost = errors.New("the migrations lock was taken over by another instance")
+
+// Migration is a versioned change of the data. Migrations are applied in ascending order of Version, which is usually
+// the creation timestamp, like "20240131120000".
+type Migration struct {
+	Version string
+	Name    string
+	Up      func(app *WeStack, ctx *model.EventContext) error
+	// Down reverts Up. Migrations without Down cannot be reverted.
+	Down func(app *WeStack, ctx *model.EventContext) error
+}
+
+// MigrationStatus tells whether a migration is applied. Missing migrations are applied but not registered anymore.
+type MigrationStatus struct {
+	Version   string    `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"appliedAt,omitempty"`
+	Missing   bool      `json:"missing,omitempty"`
+}
+
+var (
+	registeredMigrations     = make(map[string]Migration)
+	registeredMigrationsLock sync.RWMutex
+)
+
+// RegisterMigration makes a migration available to MigrateUp and MigrateDown. It must be called before running the
+// migrations, usually from the init function of the migration file created by `westack-go migrate create`.
+func RegisterMigration(migration Migration) {
+	if migration.Version == "" || migration.Up == nil {
+		panic("westack: RegisterMigration requires a Version and an Up function")
+	}
+	registeredMigrationsLock.Lock()
+	defer registeredMigrationsLock.Unlock()
+	if _, exists := registeredMigrations[migration.Version]; exists {
+		panic("westack: migration " + migration.Version + " is already registered")
+	}
+	registeredMigrations[migration.Version] = migration
+}
+
+// sortedMigrations returns the registered migrations in ascending order of version
+func sortedMigrations() []Migration {
+	registeredMigrationsLock.RLock()
+	defer registeredMigrationsLock.RUnlock()
+	migrations := make([]Migration, 0, len(registeredMigrations))
+	for _, migration := range registeredMigrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations
+}
+
+// MigrationsStatus lists the registered migrations and the applied ones, in ascending order of version
+func (app *WeStack) MigrationsStatus() ([]MigrationStatus, error) {
+	ds, err := app.migrationsDatasource()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := loadAppliedMigrations(ds)
+	if err != nil {
+		return nil, err
+	}
+	var result []MigrationStatus
+	for _, migration := range sortedMigrations() {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if appliedStatus, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = appliedStatus.AppliedAt
+			delete(applied, migration.Version)
+		}
+		result = append(result, status)
+	}
+	for _, appliedStatus := range applied {
+		appliedStatus.Missing = true
+		result = append(result, appliedStatus)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+	return result, nil
+}
+
+// MigrateUp applies the pending migrations in ascending order of version, or the first steps of them if steps is
+// greater than 0. It returns the applied versions. Only one instance can run the migrations at a time.
+func (app *WeStack) MigrateUp(steps int) ([]string, error) {
+	var done []string
+	err := app.withMigrationLock(func(lock *migrationLock) error {
+		ds := lock.ds
+		applied, err := loadAppliedMigrations(ds)
+		if err != nil {
+			return err
+		}
+		for _, migration := range sortedMigrations() {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if steps > 0 && len(done) >= steps {
+				break
+			}
+			err = lock.check()
+			if err != nil {
+				return err
+			}
+			err = migration.Up(app, migrationContext(lock.ctx))
+			if err != nil {
+				return fmt.Errorf("migration %v %v failed: %w", migration.Version, migration.Name, err)
+			}
+			_, err = ds.Create(migrationsCollection, &wst.M{"_id": migration.Version, "name": migration.Name, "appliedAt": time.Now()})
+			if err != nil {
+				return fmt.Errorf("could not record migration %v: %w", migration.Version, err)
+			}
+			done = append(done, migration.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown reverts the last applied migrations, one if steps is not greater than 0. It returns the reverted
+// versions.
+func (app *WeStack) MigrateDown(steps int) ([]string, error) {
+	if steps <= 0 {
+		steps = 1
+	}
+	var done []string
+	err := app.withMigrationLock(func(lock *migrationLock) error {
+		ds := lock.ds
+		applied, err := loadAppliedMigrations(ds)
+		if err != nil {
+			return err
+		}
+		versions := make([]string, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+		registeredMigrationsLock.RLock()
+		defer registeredMigrationsLock.RUnlock()
+		for _, version := range versions {
+			if len(done) >= steps {
+				break
+			}
+			migration, registered := registeredMigrations[version]
+			if !registered {
+				return fmt.Errorf("migration %v is not registered", version)
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("migration %v %v cannot be reverted", migration.Version, migration.Name)
+			}
+			err = lock.check()
+			if err != nil {
+				return err
+			}
+			err = migration.Down(app, migrationContext(lock.ctx))
+			if err != nil {
+				return fmt.Errorf("migration %v %v failed: %w", migration.Version, migration.Name, err)
+			}
+			_, err = ds.DeleteById(migrationsCollection, version)
+			if err != nil {
+				return fmt.Errorf("could not record migration %v: %w", migration.Version, err)
+			}
+			done = append(done, version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// RunMigrateCommand runs the `migrate up|down|status` commands with the migrations registered in the app binary. It
+// loads the datasources and models if the app was not booted.
+func (app *WeStack) RunMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate [up|down|status] [steps]")
+	}
+	steps := 0
+	if len(args) > 1 {
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid steps %v", args[1])
+		}
+	}
+	err := app.loadWithoutBoot()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "up":
+		versions, err := app.MigrateUp(steps)
+		for _, version := range versions {
+			fmt.Printf("Applied %v\n", version)
+		}
+		if err == nil && len(versions) == 0 {
+			fmt.Println("No pending migrations")
+		}
+		return err
+	case "down":
+		versions, err := app.MigrateDown(steps)
+		for _, version := range versions {
+			fmt.Printf("Reverted %v\n", version)
+		}
+		return err
+	case "status":
+		statuses, err := app.MigrationsStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			switch {
+			case status.Missing:
+				fmt.Printf("%v %v\tapplied at %v, missing\n", status.Version, status.Name, status.AppliedAt.Format(time.RFC3339))
+			case status.Applied:
+				fmt.Printf("%v %v\tapplied at %v\n", status.Version, status.Name, status.AppliedAt.Format(time.RFC3339))
+			default:
+				fmt.Printf("%v %v\tpending\n", status.Version, status.Name)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %v", args[0])
+}
+
+// migrationsDatasource returns the datasource set in the "migrations.datasource" setting of config.json, or the one of
+// the account models
+func (app *WeStack) migrationsDatasource() (*datasource.Datasource, error) {
+	if dsName := app.Viper.GetString("migrations.datasource"); dsName != "" {
+		return app.FindDatasource(dsName)
+	}
+	if app.accountCredentialsModel == nil || app.accountCredentialsModel.Datasource == nil {
+		return nil, errors.New("missing migrations datasource. Set migrations.datasource in config.json")
+	}
+	return app.accountCredentialsModel.Datasource, nil
+}
+
+// migrationLock is the migrations lock held by this instance. Its ctx is cancelled with ErrMigrationLockLost when
+// another instance takes the lock over.
+type migrationLock struct {
+	ds     *datasource.Datasource
+	owner  string
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// renew extends the expiration of the lock, and cancels its ctx if it is not owned anymore
+func (lock *migrationLock) renew() error {
+	ownLock := &wst.A{{"$match": wst.M{"_id": migrationLockId, "owner": lock.owner}}}
+	result, err := lock.ds.UpdateMany(migrationLockCollection, ownLock, &wst.M{"expiresAt": time.Now().Add(migrationLockTtl).UnixMilli()})
+	if err != nil {
+		return fmt.Errorf("could not renew the migrations lock: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		lock.cancel(ErrMigrationLockLost)
+		return ErrMigrationLockLost
+	}
+	return nil
+}
+
+// check is called before each migration, so that none starts once the lock is lost
+func (lock *migrationLock) check() error {
+	if err := context.Cause(lock.ctx); err != nil {
+		return err
+	}
+	return lock.renew()
+}
+
+// withMigrationLock runs fn while holding the migrations lock. The lock is a document with a fixed id, so a second
+// instance fails to create it until it is released or expires. It is renewed while fn runs, and only released by its
+// owner. If another instance takes it over, the context of the lock is cancelled.
+func (app *WeStack) withMigrationLock(fn func(lock *migrationLock) error) error {
+	ds, err := app.migrationsDatasource()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%v:%v:%v", hostname, os.Getpid(), uuid.NewString())
+	lock := wst.M{"_id": migrationLockId, "owner": owner, "expiresAt": time.Now().Add(migrationLockTtl).UnixMilli()}
+	_, err = ds.Create(migrationLockCollection, &lock)
+	var duplicateKeyErr *datasource.DuplicateKeyError
+	if errors.As(err, &duplicateKeyErr) {
+		current, findErr := findMigrationLock(ds)
+		if findErr != nil {
+			return findErr
+		}
+		if current != nil && int64(current.GetInt("expiresAt")) > time.Now().UnixMilli() {
+			return fmt.Errorf("migrations are locked by %v", current.GetString("owner"))
+		}
+		// The lock expired. It is taken over only if no other instance took it over in the meantime.
+		if current != nil {
+			_, err = ds.DeleteMany(migrationLockCollection, &wst.A{{"$match": wst.M{"_id": migrationLockId, "expiresAt": (*current)["expiresAt"]}}})
+			if err != nil {
+				return err
+			}
+		}
+		lock = wst.M{"_id": migrationLockId, "owner": owner, "expiresAt": time.Now().Add(migrationLockTtl).UnixMilli()}
+		_, err = ds.Create(migrationLockCollection, &lock)
+	}
+	if err != nil {
+		return fmt.Errorf("could not lock the migrations: %w", err)
+	}
+	held := &migrationLock{ds: ds, owner: owner}
+	held.ctx, held.cancel = context.WithCancelCause(context.Background())
+	defer held.cancel(nil)
+	done := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(migrationLockRenewal)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := held.renew()
+				if errors.Is(err, ErrMigrationLockLost) {
+					app.logger.Printf("[ERROR] The migrations lock was taken over by another instance\n")
+					return
+				} else if err != nil {
+					app.logger.Printf("[ERROR] %v\n", err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-renewed
+		_, releaseErr := ds.DeleteMany(migrationLockCollection, &wst.A{{"$match": wst.M{"_id": migrationLockId, "owner": owner}}})
+		if releaseErr != nil {
+			app.logger.Printf("[ERROR] Could not release the migrations lock: %v\n", releaseErr)
+		}
+	}()
+	return fn(held)
+}
+
+func findMigrationLock(ds *datasource.Datasource) (*wst.M, error) {
+	cursor, err := ds.FindMany(migrationLockCollection, &wst.A{{"$match": wst.M{"_id": migrationLockId}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	var documents []wst.M
+	err = cursor.All(context.Background(), &documents)
+	if err != nil || len(documents) == 0 {
+		return nil, err
+	}
+	return &documents[0], nil
+}
+
+func loadAppliedMigrations(ds *datasource.Datasource) (map[string]MigrationStatus, error) {
+	cursor, err := ds.FindMany(migrationsCollection, &wst.A{{"$match": wst.M{}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	var documents []wst.M
+	err = cursor.All(context.Background(), &documents)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]MigrationStatus, len(documents))
+	for _, document := range documents {
+		version := fmt.Sprintf("%v", document["_id"])
+		status := MigrationStatus{Version: version, Name: document.GetString("name"), Applied: true}
+		switch appliedAt := document["appliedAt"].(type) {
+		case time.Time:
+			status.AppliedAt = appliedAt
+		case primitive.DateTime:
+			status.AppliedAt = appliedAt.Time()
+		}
+		applied[version] = status
+	}
+	return applied, nil
+}
+
+// migrationContext runs the operations of a migration under ctx, which is cancelled if the migrations lock is lost
+func migrationContext(ctx context.Context) *model.EventContext {
+	return &model.EventContext{
+		Bearer:  &model.BearerToken{Account: &model.BearerAccount{System: true}},
+		Context: ctx,
+	}
+}
@@ -0,0 +1,62 @@
+package westack
+
+import (
+	"net/url"
+	"strings"
+
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+// applyCursorQueryParams copies the "keyset", "after" and "before" query parameters into the filter, so the keyset
+// pagination can be used without rewriting the filter parameter
+func applyCursorQueryParams(ctx *model.EventContext) {
+	if ctx.Query == nil {
+		return
+	}
+	keyset := ctx.Query.GetString("keyset") == "true"
+	after := ctx.Query.GetString("after")
+	before := ctx.Query.GetString("before")
+	if !keyset && after == "" && before == "" {
+		return
+	}
+	if ctx.Filter == nil {
+		ctx.Filter = &wst.Filter{}
+	}
+	if keyset {
+		ctx.Filter.Keyset = true
+	}
+	if after != "" {
+		ctx.Filter.After = after
+	}
+	if before != "" {
+		ctx.Filter.Before = before
+	}
+}
+
+// isKeysetPage tells whether the response of findMany carries the links to the next and previous pages
+func isKeysetPage(filter *wst.Filter) bool {
+	return filter != nil && filter.Skip == 0 && filter.Limit > 0 && (filter.Keyset || filter.After != "" || filter.Before != "")
+}
+
+// setPaginationLinks sets the Link header with the URLs of the next and previous pages, as described in RFC 8288
+func setPaginationLinks(ctx *model.EventContext, next string, prev string) error {
+	var links []string
+	for _, link := range []struct{ rel, param, cursor string }{{"next", "after", next}, {"prev", "before", prev}} {
+		if link.cursor == "" {
+			continue
+		}
+		query, err := url.ParseQuery(string(ctx.Ctx.Request().URI().QueryString()))
+		if err != nil {
+			return err
+		}
+		query.Del("after")
+		query.Del("before")
+		query.Set(link.param, link.cursor)
+		links = append(links, "<"+ctx.Ctx.BaseURL()+ctx.Ctx.Path()+"?"+query.Encode()+">; rel=\""+link.rel+"\"")
+	}
+	if len(links) > 0 {
+		ctx.Ctx.Set("Link", strings.Join(links, ", "))
+	}
+	return nil
+}
@@ -350,6 +350,15 @@ func mountBaseModelFixedRoutes(app *WeStack, loadedModel *model.StatefulModel) {
 				},
 				Required: false,
 			},
+			{
+				Arg:         "q",
+				Type:        "string",
+				Description: "Full-text search over the searchable fields of the model",
+				Http: model.ArgHttp{
+					Source: "query",
+				},
+				Required: false,
+			},
 		},
 		Http: model.RemoteMethodOptionsHttp{
 			Path: "/",
@@ -374,6 +383,15 @@ func mountBaseModelFixedRoutes(app *WeStack, loadedModel *model.StatefulModel) {
 				},
 				Required: false,
 			},
+			{
+				Arg:         "q",
+				Type:        "string",
+				Description: "Full-text search over the searchable fields of the model",
+				Http: model.ArgHttp{
+					Source: "query",
+				},
+				Required: false,
+			},
 		},
 		Http: model.RemoteMethodOptionsHttp{
 			Path: "/count",
@@ -381,6 +399,93 @@ func mountBaseModelFixedRoutes(app *WeStack, loadedModel *model.StatefulModel) {
 		},
 	})
 
+	if app.debug {
+		log.Println("Mount GET " + loadedModel.BaseUrl + "/aggregate")
+	}
+	loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+		return handleEvent(eventContext, loadedModel, string(wst.OperationNameAggregate))
+	}, model.RemoteMethodOptions{
+		Name:        string(wst.OperationNameAggregate),
+		Description: fmt.Sprintf("Runs an aggregation pipeline over the %v readable by the caller.", loadedModel.Config.Plural),
+		Accepts: model.RemoteMethodOptionsHttpArgs{
+			{
+				Arg:         "pipeline",
+				Type:        "string",
+				Description: "JSON array of $match, $group, $bucket, $bucketAuto, $facet, $count, $sortByCount, $sort, $skip, $limit, $project, $addFields, $set, $unset and $unwind stages",
+				Http: model.ArgHttp{
+					Source: "query",
+				},
+				Required: true,
+			},
+		},
+		Http: model.RemoteMethodOptionsHttp{
+			Path: "/aggregate",
+			Verb: "get",
+		},
+		OwnerScoped: true,
+	})
+
+	if app.debug {
+		log.Println("Mount GET " + loadedModel.BaseUrl + "/explain")
+	}
+	loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+		return handleEvent(eventContext, loadedModel, string(wst.OperationNameExplain))
+	}, model.RemoteMethodOptions{
+		Name:        string(wst.OperationNameExplain),
+		Description: "Returns the pipeline run for the filter, and its plan as explained by the datasource.",
+		Accepts: model.RemoteMethodOptionsHttpArgs{
+			{
+				Arg:         "filter",
+				Type:        "string",
+				Description: "",
+				Http: model.ArgHttp{
+					Source: "query",
+				},
+				Required: false,
+			},
+			{
+				Arg:         "verbosity",
+				Type:        "string",
+				Description: "queryPlanner (default), executionStats or allPlansExecution",
+				Http: model.ArgHttp{
+					Source: "query",
+				},
+				Required: false,
+			},
+		},
+		Http: model.RemoteMethodOptionsHttp{
+			Path: "/explain",
+			Verb: "get",
+		},
+	})
+
+	if loadedModel.Config.ChangeStream.Enabled {
+		if app.debug {
+			log.Println("Mount GET " + loadedModel.BaseUrl + "/stream")
+		}
+		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+			return handleEvent(eventContext, loadedModel, string(wst.OperationNameStream))
+		}, model.RemoteMethodOptions{
+			Name:        string(wst.OperationNameStream),
+			Description: fmt.Sprintf("Streams the changes of %v as Server-Sent Events.", loadedModel.Config.Plural),
+			Accepts: model.RemoteMethodOptionsHttpArgs{
+				{
+					Arg:         "filter",
+					Type:        "string",
+					Description: "",
+					Http: model.ArgHttp{
+						Source: "query",
+					},
+					Required: false,
+				},
+			},
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/stream",
+				Verb: "get",
+			},
+		})
+	}
+
 	if app.debug {
 		log.Println("Mount POST " + loadedModel.BaseUrl)
 	}
@@ -402,6 +507,79 @@ func mountBaseModelFixedRoutes(app *WeStack, loadedModel *model.StatefulModel) {
 			Verb: "post",
 		},
 	})
+
+	if app.debug {
+		log.Println("Mount POST " + loadedModel.BaseUrl + "/batch")
+	}
+	loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+		return handleEvent(eventContext, loadedModel, string(wst.OperationNameCreateMany))
+	}, model.RemoteMethodOptions{
+		Name: string(wst.OperationNameCreateMany),
+		Accepts: model.RemoteMethodOptionsHttpArgs{
+			{
+				Arg:         "body",
+				Type:        "array",
+				Description: "",
+				Http:        model.ArgHttp{Source: "body"},
+				Required:    true,
+			},
+		},
+		Http: model.RemoteMethodOptionsHttp{
+			Path: "/batch",
+			Verb: "post",
+		},
+	})
+
+	if app.debug {
+		log.Println("Mount POST " + loadedModel.BaseUrl + "/update")
+	}
+	loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+		return handleEvent(eventContext, loadedModel, string(wst.OperationNameUpdateMany))
+	}, model.RemoteMethodOptions{
+		Name: string(wst.OperationNameUpdateMany),
+		Accepts: model.RemoteMethodOptionsHttpArgs{
+			{
+				Arg:         "where",
+				Type:        "string",
+				Description: "",
+				Http:        model.ArgHttp{Source: "query"},
+				Required:    true,
+			},
+			{
+				Arg:         "data",
+				Type:        "object",
+				Description: "",
+				Http:        model.ArgHttp{Source: "body"},
+				Required:    true,
+			},
+		},
+		Http: model.RemoteMethodOptionsHttp{
+			Path: "/update",
+			Verb: "post",
+		},
+	})
+
+	if app.debug {
+		log.Println("Mount DELETE " + loadedModel.BaseUrl)
+	}
+	loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+		return handleEvent(eventContext, loadedModel, string(wst.OperationNameDeleteMany))
+	}, model.RemoteMethodOptions{
+		Name: string(wst.OperationNameDeleteMany),
+		Accepts: model.RemoteMethodOptionsHttpArgs{
+			{
+				Arg:         "where",
+				Type:        "string",
+				Description: "",
+				Http:        model.ArgHttp{Source: "query"},
+				Required:    true,
+			},
+		},
+		Http: model.RemoteMethodOptionsHttp{
+			Path: "/",
+			Verb: "delete",
+		},
+	})
 }
 
 func mountAppDynamicRoutes(loadedModel *model.StatefulModel, app *WeStack) {
@@ -488,6 +666,34 @@ func addDefaultCasbinRoles(app *WeStack, e *casbin.Enforcer) (err error) {
 	if app.debug {
 		app.logger.Printf("[DEBUG] Added role instance_delete for user %v, err: %v\n", replaceVarNames("write"), err)
 	}
+	_, err = e.AddRoleForUser("createMany", replaceVarNames("write"))
+	if app.debug {
+		app.logger.Printf("[DEBUG] Added role createMany for user %v, err: %v\n", replaceVarNames("write"), err)
+	}
+	_, err = e.AddRoleForUser("updateMany", replaceVarNames("write"))
+	if app.debug {
+		app.logger.Printf("[DEBUG] Added role updateMany for user %v, err: %v\n", replaceVarNames("write"), err)
+	}
+	_, err = e.AddRoleForUser("deleteMany", replaceVarNames("write"))
+	if app.debug {
+		app.logger.Printf("[DEBUG] Added role deleteMany for user %v, err: %v\n", replaceVarNames("write"), err)
+	}
+	_, err = e.AddRoleForUser("instance_history", replaceVarNames("read"))
+	if app.debug {
+		app.logger.Printf("[DEBUG] Added role instance_history for user %v, err: %v\n", replaceVarNames("read"), err)
+	}
+	_, err = e.AddRoleForUser("stream", replaceVarNames("read"))
+	if app.debug {
+		app.logger.Printf("[DEBUG] Added role stream for user %v, err: %v\n", replaceVarNames("read"), err)
+	}
+	_, err = e.AddRoleForUser("aggregate", replaceVarNames("read"))
+	if app.debug {
+		app.logger.Printf("[DEBUG] Added role aggregate for user %v, err: %v\n", replaceVarNames("read"), err)
+	}
+	_, err = e.AddRoleForUser("instance_restore", replaceVarNames("write"))
+	if app.debug {
+		app.logger.Printf("[DEBUG] Added role instance_restore for user %v, err: %v\n", replaceVarNames("write"), err)
+	}
 	_, err = e.AddRoleForUser("read", replaceVarNames("read_write"))
 	if app.debug {
 		app.logger.Printf("[DEBUG] Added role read for user %v, err: %v\n", replaceVarNames("read_write"), err)
@@ -599,6 +805,64 @@ func registerPersistedModelDynamicHooks(app *WeStack, loadedModel *model.Statefu
 		},
 	})
 
+	if loadedModel.Config.SoftDelete {
+		if app.debug {
+			log.Println("Mount POST " + loadedModel.BaseUrl + "/:id/restore")
+		}
+		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+			id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+			if err != nil {
+				return err
+			}
+			eventContext.ModelID = &id
+			return handleEvent(eventContext, loadedModel, string(wst.OperationNameRestoreById))
+		}, model.RemoteMethodOptions{
+			Name: string(wst.OperationNameRestoreById),
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/:id/restore",
+				Verb: "post",
+			},
+		})
+
+		if app.debug {
+			log.Println("Mount DELETE " + loadedModel.BaseUrl + "/:id/purge")
+		}
+		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+			id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+			if err != nil {
+				return err
+			}
+			eventContext.ModelID = &id
+			return handleEvent(eventContext, loadedModel, string(wst.OperationNamePurgeById))
+		}, model.RemoteMethodOptions{
+			Name: string(wst.OperationNamePurgeById),
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/:id/purge",
+				Verb: "delete",
+			},
+		})
+	}
+
+	if loadedModel.Config.Audit {
+		if app.debug {
+			log.Println("Mount GET " + loadedModel.BaseUrl + "/:id/history")
+		}
+		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+			id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+			if err != nil {
+				return err
+			}
+			eventContext.ModelID = &id
+			return handleEvent(eventContext, loadedModel, string(wst.OperationNameFindHistory))
+		}, model.RemoteMethodOptions{
+			Name: string(wst.OperationNameFindHistory),
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/:id/history",
+				Verb: "get",
+			},
+		})
+	}
+
 	if loadedModel.Config.Base == "Account" {
 		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 			id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
@@ -806,6 +1070,8 @@ func findOwnerRecursiveInRelation(loadedModel *model.StatefulModel, modelConfigs
 			Bearer: &model.BearerToken{
 				Account: &model.BearerAccount{System: true},
 			},
+			// Soft deleted documents keep their owner, so they can be restored
+			IncludeDeleted: true,
 		})
 		if err != nil {
 			return err
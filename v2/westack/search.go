@@ -0,0 +1,37 @@
+package westack
+
+import (
+	wst "github.com/fredyk/westack-go/v2/common"
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+// applySearchQueryParam copies the "q" query parameter into the filter, so the full-text search can be combined with
+// any filter
+func applySearchQueryParam(ctx *model.EventContext) {
+	if ctx.Query == nil {
+		return
+	}
+	q := ctx.Query.GetString("q")
+	if q == "" {
+		return
+	}
+	if ctx.Filter == nil {
+		ctx.Filter = &wst.Filter{}
+	}
+	ctx.Filter.Search = q
+}
+
+// setupSearch declares the searchable fields of the models in the datasources evaluating the full-text queries by
+// themselves. The other datasources rely on the text index synced with the declared indexes.
+func (app *WeStack) setupSearch() {
+	for _, loadedModel := range *app.modelRegistry {
+		weights := loadedModel.SearchWeights()
+		if weights == nil || loadedModel.Datasource == nil {
+			continue
+		}
+		err := loadedModel.Datasource.SetTextIndex(loadedModel.CollectionName, weights)
+		if err != nil {
+			app.logger.Printf("[WARNING] Model %v cannot be searched: %v\n", loadedModel.Name, err)
+		}
+	}
+}
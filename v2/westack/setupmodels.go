@@ -83,6 +83,19 @@ func createCasbinModel(loadedModel *model.StatefulModel, app *WeStack, config *m
 		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$owner,*,read_write,allow")})
 	}
 
+	if config.SoftDelete {
+		// Purging cannot be undone, so it is not part of the write role
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("admin,*,instance_purge,allow")})
+	}
+
+	// The plans expose the indexes and the relations of the model, so they are only available to the admins
+	casbModel.AddPolicy("p", "p", []string{replaceVarNames("admin,*,explain,allow")})
+
+	if config.ChangeStream.Enabled {
+		// Every event is checked against the read permission of the subscriber, so "$owner" can subscribe too
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,stream,allow")})
+	}
+
 	if config.Base == "Account" {
 		addOAuthLoginPolicies(casbModel)
 		// TODO: any other oauth login providers
@@ -390,7 +403,7 @@ func setupInternalModels(config *model.Config, app *WeStack, dataSource *datasou
 							NotEmpty: true,
 						},
 					},
-					OneOf: []model.Validation{
+					AnyOf: []model.Validation{
 						{
 							Properties: map[string]model.Validation{
 								"email": {
@@ -434,6 +447,19 @@ func setupInternalModels(config *model.Config, app *WeStack, dataSource *datasou
 			},
 		},
 		Hidden: []string{"password"},
+		// The uniqueness checks of the before save hook are racy, so the indexes enforce them too
+		Indexes: []model.IndexConfig{
+			{
+				Keys:          []string{"username"},
+				Unique:        true,
+				PartialFilter: wst.M{"username": wst.M{"$gt": ""}},
+			},
+			{
+				Keys:          []string{"email"},
+				Unique:        true,
+				PartialFilter: wst.M{"email": wst.M{"$gt": ""}, "password": wst.M{"$exists": true}},
+			},
+		},
 		Casbin: model.CasbinConfig{
 			Policies: []string{
 				"$owner,*,__get__account,allow",
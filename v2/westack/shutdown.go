@@ -0,0 +1,74 @@
+package westack
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/fredyk/westack-go/v2/model"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// OnShutdown registers a hook run by Stop once the in-flight requests finished, before closing the datasources. Hooks
+// run in registration order and receive a context that is done when the shutdown timeout expires.
+func (app *WeStack) OnShutdown(hook func(ctx context.Context) error) {
+	app.shutdownHooks = append(app.shutdownHooks, hook)
+}
+
+// Stop shuts the app down gracefully. It stops accepting connections, closes the change streams and waits for the
+// in-flight requests up to Options.ShutdownTimeout. Then it drops the operations queued by finished requests that were
+// never dispatched, runs the OnShutdown hooks and closes every datasource. The readiness endpoint answers 503 from the
+// beginning.
+func (app *WeStack) Stop() (err error) {
+	defer app.stopOnce.Do(func() {
+		app.stopErr = err
+		close(app.stopped)
+	})
+	log.Println("Stopping server")
+	app.stopping.Store(true)
+
+	timeout := app.Options.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	// The change streams never end by themselves, so they would hold the shutdown until the timeout
+	for _, loadedModel := range *app.modelRegistry {
+		loadedModel.CloseChangeSubscriptions()
+	}
+	err = app.Server.ShutdownWithContext(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	err = model.WaitForActiveRequests(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// The operations of the requests still running when the timeout expired are kept
+	for _, loadedModel := range *app.modelRegistry {
+		if dropped := loadedModel.FlushPendingOperations(); dropped > 0 {
+			app.logger.Printf("[WARNING] Dropped %v queued operations of %v\n", dropped, loadedModel.Name)
+		}
+	}
+
+	for _, hook := range app.shutdownHooks {
+		err = hook(ctx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, ds := range *app.datasources {
+		err = ds.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -9,6 +9,9 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -47,6 +50,7 @@ type WeStack struct {
 	roleMappingModel               *model.StatefulModel
 	accountCredentialsModel        *model.StatefulModel
 	mfaModel                       *model.StatefulModel
+	auditLogModel                  *model.StatefulModel
 	dataSourceOptions              *map[string]*datasource.Options
 	init                           time.Time
 	jwtSecretKey                   []byte
@@ -54,6 +58,12 @@ type WeStack struct {
 	logger                         wst.ILogger
 	completedSetup                 bool
 	registerControllers            func(r model.ControllerRegistry)
+	stopping                       atomic.Bool
+	shutdownHooks                  []func(ctx context.Context) error
+	// stopped is closed once Stop finished, with its error in stopErr
+	stopped  chan struct{}
+	stopOnce sync.Once
+	stopErr  error
 }
 
 type BootOptions struct {
@@ -78,6 +88,12 @@ func (app *WeStack) FindDatasource(dsName string) (*datasource.Datasource, error
 	return result, nil
 }
 
+// WithTransaction runs fn with a context whose model operations are committed together when fn returns nil, and rolled
+// back otherwise. See model.WithTransaction for the behavior with connectors that cannot run transactions.
+func (app *WeStack) WithTransaction(ctx *model.EventContext, fn func(txCtx *model.EventContext) error) error {
+	return model.WithTransaction(ctx, fn)
+}
+
 func (app *WeStack) FindModelsWithClass(modelClass string) (foundModels []*model.StatefulModel) {
 	for _, foundModel := range *app.modelRegistry {
 		if foundModel.Config.Base == modelClass {
@@ -109,17 +125,6 @@ func (app *WeStack) Middleware(handler fiber.Handler) {
 	app.Server.Use(handler)
 }
 
-func (app *WeStack) Stop() error {
-	log.Println("Stopping server")
-	for _, ds := range *app.datasources {
-		err := ds.Close()
-		if err != nil {
-			return err
-		}
-	}
-	return app.Server.Shutdown()
-}
-
 func (app *WeStack) Logger() wst.ILogger {
 	return app.logger
 }
@@ -146,6 +151,8 @@ type Options struct {
 	adminPwd          string
 	Logger            wst.ILogger
 	DisablePortEnvVar bool
+	// ShutdownTimeout is how long Stop waits for the in-flight requests. Defaults to 30 seconds.
+	ShutdownTimeout time.Duration
 }
 
 func New(options ...Options) *WeStack {
@@ -289,6 +296,7 @@ func New(options ...Options) *WeStack {
 		dataSourceOptions:              finalOptions.DatasourceOptions,
 		init:                           time.Now(),
 		logger:                         logger,
+		stopped:                        make(chan struct{}),
 	}
 
 	return &app
@@ -297,21 +305,35 @@ func New(options ...Options) *WeStack {
 func InitAndServe(options Options, onBoot ...func(app *WeStack)) {
 	app := New(options)
 
+	// `westack-go migrate up|down|status` runs the app binary with these arguments, as the migrations are compiled in it
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := app.RunMigrateCommand(os.Args[2:])
+		if err != nil {
+			app.logger.Fatal(err)
+		}
+		return
+	}
+
 	app.Boot(BootOptions{RegisterControllers: func(r model.ControllerRegistry) {
 
 	}}, onBoot...)
 
-	// Catch SIGINT signal and Stop()
+	// Catch SIGINT and SIGTERM signals and Stop()
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
-		err := app.Stop()
-		if err != nil {
-			app.logger.Fatal(err)
-		}
-		os.Exit(0)
+		// The error is reported once Stop finished
+		_ = app.Stop()
 	}()
 
-	app.logger.Fatal(app.Start())
+	err := app.Start()
+	if err != nil {
+		app.logger.Fatal(err)
+	}
+	// Start returns as soon as Stop closes the listener, so the process waits for Stop to finish draining
+	<-app.stopped
+	if app.stopErr != nil {
+		app.logger.Fatal(app.stopErr)
+	}
 }